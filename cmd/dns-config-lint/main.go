@@ -0,0 +1,154 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+// dns-config-lint checks a k8s-nameserver config without running the
+// nameserver, for example in CI before the config is deployed:
+//
+//	dns-config-lint --file=dns.json --output=json
+//
+// The config is checked with the same code as when the nameserver loads it,
+// so a config that lints without errors loads with the same flags. All
+// invalid values in the config are reported.
+//
+// It exits with 0 if the config has no problems, 1 if it has errors and
+// would not load, and 2 if it loads but has warnings.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+// Exit codes of run.
+const (
+	exitOK       = 0 // no errors or warnings
+	exitErrors   = 1 // the config doesn't load, or run was misused
+	exitWarnings = 2 // the config loads, but has warnings
+)
+
+// report is the result of linting a config, as printed by run.
+type report struct {
+	File     string             `json:"file"`
+	Errors   []*nsconfig.Error  `json:"errors"`
+	Warnings []nsconfig.Warning `json:"warnings"`
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the linter with the command line arguments in args, writes its
+// report to stdout and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("dns-config-lint", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		file               = fs.String("file", "", "path of the nameserver config to check (required)")
+		output             = fs.String("output", "text", "format of the report: \"text\" or \"json\"")
+		format             = fs.String("config-format", nsconfig.FormatAuto, "format of the config, as for the nameserver's --config-format; \"auto\" picks it based on the file extension of --file")
+		strict             = fs.Bool("strict-config", false, "report unknown fields in JSON configs as errors, as for the nameserver's --strict-config")
+		localDomainsFlag   = fs.String("local-domains", "", "comma-separated list of additional domains that the nameserver is authoritative for, as for the nameserver's --local-domains")
+		disableRootDomains = fs.Bool("disable-ts-net-root-domains", false, "as for the nameserver's --disable-ts-net-root-domains")
+		allowExternal      = fs.Bool("allow-external-records", false, "as for the nameserver's --allow-external-records")
+		allowLongLabels    = fs.Bool("allow-long-labels", false, "as for the nameserver's --allow-long-labels")
+		enableIDN          = fs.Bool("enable-idn", false, "as for the nameserver's --enable-idn")
+	)
+	if err := fs.Parse(args); err != nil {
+		return exitErrors
+	}
+	if *file == "" || fs.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: dns-config-lint --file=<config> [flags]")
+		fs.PrintDefaults()
+		return exitErrors
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(stderr, "invalid --output %q, must be \"text\" or \"json\"\n", *output)
+		return exitErrors
+	}
+	switch *format {
+	case nsconfig.FormatJSON, nsconfig.FormatYAML, nsconfig.FormatCBOR, nsconfig.FormatHosts, nsconfig.FormatCorefile:
+	case nsconfig.FormatAuto:
+		*format = nsconfig.FormatForKey(*file)
+	default:
+		fmt.Fprintf(stderr, "invalid --config-format %q\n", *format)
+		return exitErrors
+	}
+	localDomains, err := nsconfig.ParseLocalDomains(*localDomainsFlag, *disableRootDomains)
+	if err != nil {
+		fmt.Fprintf(stderr, "error parsing --local-domains: %v\n", err)
+		return exitErrors
+	}
+
+	configDir := filepath.Dir(*file)
+	opts := nsconfig.Options{
+		Format: *format,
+		Strict: *strict,
+		// Files referenced by the config, such as the hosts files of a
+		// Corefile, are read from its directory, as by the nameserver.
+		ReadFile: func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(configDir, name))
+		},
+		LocalDomains:         localDomains,
+		AllowExternalRecords: *allowExternal,
+		AllowLongLabels:      *allowLongLabels,
+		EnableIDN:            *enableIDN,
+	}
+	rep := lint(*file, opts)
+	if *output == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			fmt.Fprintf(stderr, "error writing report: %v\n", err)
+			return exitErrors
+		}
+	} else {
+		for _, e := range rep.Errors {
+			fmt.Fprintf(stdout, "%s: error: %v\n", rep.File, e)
+		}
+		for _, w := range rep.Warnings {
+			if w.Field != "" {
+				fmt.Fprintf(stdout, "%s: warning: %s: %s\n", rep.File, w.Field, w.Message)
+			} else {
+				fmt.Fprintf(stdout, "%s: warning: %s\n", rep.File, w.Message)
+			}
+		}
+	}
+	switch {
+	case len(rep.Errors) > 0:
+		return exitErrors
+	case len(rep.Warnings) > 0:
+		return exitWarnings
+	}
+	return exitOK
+}
+
+// lint checks the config in path as the nameserver would load it with opts
+// and returns the report. Warnings are only reported for configs that load.
+func lint(path string, opts nsconfig.Options) *report {
+	rep := &report{File: path, Errors: []*nsconfig.Error{}, Warnings: []nsconfig.Warning{}}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		rep.Errors = nsconfig.Errors(fmt.Errorf("error reading nameserver config: %w", err))
+		return rep
+	}
+	dnsCfg, err := nsconfig.Decode(b, opts)
+	if err != nil {
+		rep.Errors = nsconfig.Errors(err)
+		return rep
+	}
+	cfg, err := nsconfig.Parse(dnsCfg, opts)
+	if err != nil {
+		rep.Errors = nsconfig.Errors(err)
+		return rep
+	}
+	rep.Warnings = append(rep.Warnings, cfg.Warnings...)
+	return rep
+}
@@ -0,0 +1,223 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+// testReport is a report as decoded from the JSON output of run.
+type testReport struct {
+	Errors []struct {
+		Field string `json:"field"`
+		Value string `json:"value"`
+		Error string `json:"error"`
+	} `json:"errors"`
+	Warnings []nsconfig.Warning `json:"warnings"`
+}
+
+// runLint writes config to a file named name in a temporary directory and
+// returns the exit code and JSON report of linting it with args.
+func runLint(t *testing.T, name, config string, args ...string) (int, testReport) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"--file=" + path, "--output=json"}, args...), &stdout, &stderr)
+	var report testReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("error decoding report %q (stderr %q): %v", stdout.String(), stderr.String(), err)
+	}
+	return code, report
+}
+
+func TestLintErrors(t *testing.T) {
+	longLabel := strings.Repeat("t", 64)
+	longName := strings.Repeat(strings.Repeat("a", 49)+".", 5) + "ts.net."
+	tests := []struct {
+		name   string
+		file   string // defaults to dns.json
+		config string
+		args   []string
+		// wantField is the prefix of the field of the reported error.
+		wantField string
+	}{
+		{name: "syntax", config: `{"hosts":{"foo.ts.net.":["10.0.0.1"]`},
+		{name: "type", config: `{"hosts":{"foo.ts.net.":"10.0.0.1"}}`, wantField: "hosts"},
+		{name: "unknown_field", config: `{"hosts":{},"hostz":{}}`, args: []string{"--strict-config"}},
+		{name: "empty_label", config: `{"hosts":{"foo..ts.net.":["10.0.0.1"]}}`, wantField: `hosts["foo..ts.net."]`},
+		{name: "long_label", config: `{"hosts":{"` + longLabel + `.ts.net.":["10.0.0.1"]}}`, wantField: `hosts["` + longLabel},
+		{name: "long_name", config: `{"hosts":{"` + longName + `":["10.0.0.1"]}}`, wantField: `hosts["aaa`},
+		{name: "ip", config: `{"hosts":{"foo.ts.net.":["10.0.0.256"]}}`, wantField: `hosts["foo.ts.net."][0]`},
+		{name: "second_ip", config: `{"hosts":{"foo.ts.net.":["10.0.0.1","fd7a::1::2"]}}`, wantField: `hosts["foo.ts.net."][1]`},
+		{name: "external_ip", config: `{"externalRecords":{"foo.example.com.":["nope"]}}`, args: []string{"--allow-external-records"}, wantField: `externalRecords["foo.example.com."][0]`},
+		{name: "external_local", config: `{"externalRecords":{"foo.ts.net.":["10.0.0.1"]}}`, args: []string{"--allow-external-records"}, wantField: `externalRecords["foo.ts.net."]`},
+		{name: "external_local_domain_flag", config: `{"externalRecords":{"foo.corp.example.":["10.0.0.1"]}}`, args: []string{"--allow-external-records", "--local-domains=corp.example"}, wantField: `externalRecords["foo.corp.example."]`},
+		{name: "health_check_port_name", config: `{"healthCheckPorts":{"foo..ts.net.":80}}`, wantField: `healthCheckPorts["foo..ts.net."]`},
+		{name: "health_check_port_range", config: `{"healthCheckPorts":{"foo.ts.net.":65536}}`, wantField: "healthCheckPorts"},
+		{name: "expires_at_name", config: `{"expiresAt":{"foo..ts.net.":"2030-01-01T00:00:00Z"}}`, wantField: `expiresAt["foo..ts.net."]`},
+		{name: "rpz_name", config: `{"rpz":[{"name":"ads..example.com.","action":"NXDOMAIN"}]}`, wantField: "rpz[0].name"},
+		{name: "rpz_action", config: `{"rpz":[{"name":"ads.example.com.","action":"BLOCK"}]}`, wantField: "rpz[0].action"},
+		{name: "rewrite_cidr", config: `{"rewriteRules":[{"sourceCIDR":"10.0.0.0/33","originalIP":"10.0.0.1","replacementIP":"10.0.0.2"}]}`, wantField: "rewriteRules[0].sourceCIDR"},
+		{name: "rewrite_family", config: `{"rewriteRules":[{"sourceCIDR":"10.0.0.0/8","originalIP":"10.0.0.1","replacementIP":"fd7a::1"}]}`, wantField: "rewriteRules[0].replacementIP"},
+		{name: "view_cidr", config: `{"views":[{"sourceCIDR":"10.0.0.1","hosts":{}}]}`, wantField: "views[0].sourceCIDR"},
+		{name: "view_ip", config: `{"views":[{"sourceCIDR":"10.0.0.0/8","hosts":{"foo.ts.net.":["nope"]}}]}`, wantField: `views[0].hosts["foo.ts.net."][0]`},
+		{name: "search_domain", config: `{"searchDomains":["."]}`, wantField: "searchDomains[0]"},
+		{name: "ndots", config: `{"searchDomains":["svc.cluster.local."],"ndots":-1}`, wantField: "ndots"},
+		{name: "cluster_domain", config: `{"clusterDomain":"."}`, wantField: "clusterDomain"},
+		{name: "yaml", file: "dns.yaml", config: "hosts: [foo"},
+		{name: "yaml_ip", file: "dns.yaml", config: "hosts:\n  foo.ts.net.:\n  - nope\n", wantField: `hosts["foo.ts.net."][0]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tt.file
+			if file == "" {
+				file = "dns.json"
+			}
+			code, report := runLint(t, file, tt.config, tt.args...)
+			if code != exitErrors {
+				t.Errorf("got exit code %d, want %d", code, exitErrors)
+			}
+			if len(report.Errors) != 1 {
+				t.Fatalf("got errors %+v, want 1", report.Errors)
+			}
+			if got := report.Errors[0]; !strings.HasPrefix(got.Field, tt.wantField) || got.Error == "" {
+				t.Errorf("got error %+v, want one for field %q", got, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestLintMultipleErrors(t *testing.T) {
+	config := `{
+		"hosts": {"b.ts.net.": ["nope"], "a.ts.net.": ["10.0.0.1", "10.0.0.256"], "c.ts.net.": ["127.0.0.1"]},
+		"rpz": [{"name": "ads.example.com.", "action": "BLOCK"}],
+		"searchDomains": ["svc.cluster.local.", "."]
+	}`
+	code, report := runLint(t, "dns.json", config)
+	if code != exitErrors {
+		t.Errorf("got exit code %d, want %d", code, exitErrors)
+	}
+	var fields []string
+	for _, e := range report.Errors {
+		fields = append(fields, e.Field)
+	}
+	want := []string{`hosts["a.ts.net."][1]`, `hosts["b.ts.net."][0]`, "rpz[0].action", "searchDomains[1]"}
+	if !slices.Equal(fields, want) {
+		t.Errorf("got errors for fields %q, want %q", fields, want)
+	}
+	if len(report.Warnings) != 0 {
+		t.Errorf("got warnings %+v for a config that doesn't load, want none", report.Warnings)
+	}
+}
+
+func TestLintWarnings(t *testing.T) {
+	// longChain redirects through one rule more than is followed.
+	var longChain []string
+	for i := range nsconfig.MaxRPZRedirects + 1 {
+		longChain = append(longChain, fmt.Sprintf(`{"name":"r%d.example.com.","action":"REDIRECT r%d.example.com."}`, i, i+1))
+	}
+	longChain = append(longChain, fmt.Sprintf(`{"name":"r%d.example.com.","action":"NXDOMAIN"}`, nsconfig.MaxRPZRedirects+1))
+	tests := []struct {
+		name     string
+		config   string
+		wantType string
+	}{
+		{"duplicate_ip", `{"hosts":{"a.ts.net.":["10.0.0.1"],"b.ts.net.":["10.0.0.1"]}}`, nsconfig.WarningDuplicateIP},
+		{"loopback", `{"hosts":{"a.ts.net.":["127.0.0.1"]}}`, nsconfig.WarningUnreachableIP},
+		{"link_local", `{"hosts":{"a.ts.net.":["fe80::1"]}}`, nsconfig.WarningUnreachableIP},
+		{"dangling_redirect", `{"rpz":[{"name":"ads.example.com.","action":"REDIRECT nope.ts.net."}]}`, nsconfig.WarningDanglingRedirect},
+		{"not_fqdn", `{"hosts":{"a.ts.net":["10.0.0.1"]}}`, nsconfig.WarningNotFQDN},
+		{"external_records_ignored", `{"externalRecords":{"foo.example.com.":["10.0.0.1"]}}`, nsconfig.WarningExternalRecordsIgnored},
+		{"redirect_loop", `{"rpz":[{"name":"a.example.com.","action":"REDIRECT b.example.com."},{"name":"b.example.com.","action":"REDIRECT a.example.com."}]}`, nsconfig.WarningRedirectLoop},
+		{"redirect_chain", `{"rpz":[` + strings.Join(longChain, ",") + `]}`, nsconfig.WarningRedirectLoop},
+		{"schema_version", `{"schemaVersion":1000,"hosts":{}}`, nsconfig.WarningSchemaVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, report := runLint(t, "dns.json", tt.config)
+			if code != exitWarnings {
+				t.Errorf("got exit code %d, want %d", code, exitWarnings)
+			}
+			if len(report.Errors) != 0 {
+				t.Errorf("got errors %+v, want none", report.Errors)
+			}
+			found := false
+			for _, w := range report.Warnings {
+				found = found || w.Type == tt.wantType
+			}
+			if !found {
+				t.Errorf("got warnings %+v, want one of type %q", report.Warnings, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestLintValid(t *testing.T) {
+	config := `{
+		"hosts": {"foo.bar.ts.net.": ["10.20.30.40"], "baz.bar.ts.net.": ["10.20.30.41", "fd7a:115c:a1e0::1"]},
+		"rpz": [
+			{"name": "ads.example.com.", "action": "REDIRECT sink.example.com."},
+			{"name": "sink.example.com.", "action": "REDIRECT foo.bar.ts.net."}
+		]
+	}`
+	code, report := runLint(t, "dns.json", config)
+	if code != exitOK || len(report.Errors) != 0 || len(report.Warnings) != 0 {
+		t.Errorf("got exit code %d and report %+v, want no problems", code, report)
+	}
+
+	// A config that loads is not an error, even if it would be served
+	// differently with other flags.
+	code, report = runLint(t, "dns.json", `{"externalRecords":{"foo.example.com.":["10.0.0.1"]}}`, "--allow-external-records")
+	if code != exitOK {
+		t.Errorf("got exit code %d and report %+v, want %d", code, report, exitOK)
+	}
+}
+
+func TestLintTextOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.json")
+	if err := os.WriteFile(path, []byte(`{"hosts":{"a.ts.net.":["127.0.0.1"],"b.ts.net.":["nope"]}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"--file", path}, &stdout, &stderr); code != exitErrors {
+		t.Errorf("got exit code %d, want %d", code, exitErrors)
+	}
+	want := fmt.Sprintf("%s: error: invalid value \"nope\" for hosts[\"b.ts.net.\"][0]: ", path)
+	if got := stdout.String(); !strings.HasPrefix(got, want) || strings.Count(got, "\n") != 1 {
+		t.Errorf("got output %q, want one line starting with %q", got, want)
+	}
+}
+
+func TestLintUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"--file=dns.json", "--output=xml"},
+		{"--file=dns.json", "--config-format=toml"},
+		{"--file=dns.json", "--nope"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(args, &stdout, &stderr); code != exitErrors || stderr.Len() == 0 {
+			t.Errorf("run(%q) = %d with stderr %q, want %d and usage", args, code, stderr.String(), exitErrors)
+		}
+	}
+	// A missing file is a config error.
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"--file", filepath.Join(t.TempDir(), "nope.json")}, &stdout, &stderr); code != exitErrors || !strings.Contains(stdout.String(), "error reading nameserver config") {
+		t.Errorf("got exit code %d and output %q for a missing file, want %d and a read error", code, stdout.String(), exitErrors)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdListenFDsStart is the first file descriptor that systemd passes to
+// socket activated services.
+const sdListenFDsStart = 3
+
+// systemdListenFDs returns the file descriptors of the sockets passed to the
+// nameserver by systemd-style socket activation, if any, and unsets the
+// environment variables of the protocol so that they aren't inherited by
+// child processes.
+// https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html
+func systemdListenFDs() ([]int, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// The sockets were passed to another process.
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	var ret []int
+	for fd := sdListenFDsStart; fd < sdListenFDsStart+n; fd++ {
+		ret = append(ret, fd)
+	}
+	return ret, nil
+}
+
+// socketsFromFDs returns the UDP socket and, if there is one, the TCP
+// listener among the pre-bound sockets with the file descriptors fds. It is
+// an error if there is no UDP socket among them.
+func socketsFromFDs(fds []int) (conn *net.UDPConn, ln net.Listener, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if ln != nil {
+			ln.Close()
+		}
+	}()
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "dns-listener-"+strconv.Itoa(fd))
+		if f == nil {
+			return conn, ln, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		// The net package dups the file descriptor, so f is not needed
+		// afterwards either way.
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			l, lnErr := net.FileListener(f)
+			f.Close()
+			if lnErr != nil {
+				return conn, ln, fmt.Errorf("file descriptor %d is not a UDP or TCP socket: %w", fd, errors.Join(err, lnErr))
+			}
+			ln = l
+			continue
+		}
+		f.Close()
+		udp, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return conn, ln, fmt.Errorf("file descriptor %d is a %T, not a UDP socket", fd, pc)
+		}
+		conn = udp
+	}
+	if conn == nil {
+		return conn, ln, errors.New("no UDP socket among the passed file descriptors")
+	}
+	return conn, ln, nil
+}
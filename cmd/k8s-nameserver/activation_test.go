@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// socketFD returns a duplicate of the file descriptor of c, which becomes
+// owned by the caller.
+func socketFD(t *testing.T, c interface{ File() (*os.File, error) }) int {
+	t.Helper()
+	f, err := c.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestSocketsFromFDs(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	conn, ln, err := socketsFromFDs([]int{socketFD(t, udp), socketFD(t, tcp)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer ln.Close()
+	if got, want := conn.LocalAddr().String(), udp.LocalAddr().String(); got != want {
+		t.Errorf("got UDP socket bound to %s, want %s", got, want)
+	}
+	if got, want := ln.Addr().String(), tcp.Addr().String(); got != want {
+		t.Errorf("got TCP listener bound to %s, want %s", got, want)
+	}
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	go ns.serve(ctx, conn)
+	go ns.serveTCP(ctx, ln, time.Second)
+	for network, addr := range map[string]net.Addr{"udp": udp.LocalAddr(), "tcp": tcp.Addr()} {
+		c := &dns.Client{Net: network, Timeout: 5 * time.Second}
+		m := new(dns.Msg)
+		m.SetQuestion("foo.bar.ts.net.", dns.TypeA)
+		r, _, err := c.Exchange(m, addr.String())
+		if err != nil {
+			t.Fatalf("%s query: %v", network, err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.20.30.40" {
+			t.Errorf("%s query: got answers %v, want 10.20.30.40", network, r.Answer)
+		}
+	}
+
+	if _, _, err := socketsFromFDs([]int{socketFD(t, tcp)}); err == nil {
+		t.Error("socketsFromFDs without a UDP socket succeeded, want error")
+	}
+}
+
+func TestSystemdListenFDs(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name    string
+		fds     string
+		pid     string
+		want    []int
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "two_sockets", fds: "2", pid: pid, want: []int{3, 4}},
+		{name: "no_pid", fds: "1", want: []int{3}},
+		{name: "other_process", fds: "1", pid: "1"},
+		{name: "invalid", fds: "two", pid: pid, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_FDS", tt.fds)
+			t.Setenv("LISTEN_PID", tt.pid)
+			got, err := systemdListenFDs()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got file descriptors %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got file descriptors %v, want %v", got, tt.want)
+			}
+			if tt.want != nil && os.Getenv("LISTEN_FDS") != "" {
+				t.Error("LISTEN_FDS is still set")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// anyTypes are the record types whose records are combined into the
+// response to a query for QTYPE ANY, in the order in which they are included
+// in the response.
+var anyTypes = []dnsmessage.Type{
+	dnsmessage.TypeA,
+	dnsmessage.TypeAAAA,
+	dnsmessage.TypeCNAME,
+	dnsmessage.TypeTXT,
+	dnsmessage.TypeMX,
+	dnsmessage.TypeSRV,
+}
+
+// anyTypesFor returns anyTypes in the order in which their records are
+// included in the response to a query from addr. With preferSameFamily,
+// addresses of the family of addr come first, so that clients that only try
+// the first address of a name connect over a family that they have, as with
+// the address selection of RFC 6724.
+// https://datatracker.ietf.org/doc/html/rfc6724
+func anyTypesFor(addr netip.AddrPort, preferSameFamily bool) []dnsmessage.Type {
+	if !preferSameFamily || !addr.Addr().Unmap().Is6() {
+		return anyTypes
+	}
+	types := slices.Clone(anyTypes)
+	types[0], types[1] = dnsmessage.TypeAAAA, dnsmessage.TypeA
+	return types
+}
+
+// answerANY returns the response to the DNS query in payload and true if it
+// is for QTYPE ANY and n.anyMaxTypes is set. The resolver only answers such
+// queries with a single address, so instead, the queried name is looked up
+// for each of anyTypes in parallel and the records of the first
+// n.anyMaxTypes types that have any are combined into one response, in the
+// order of anyTypesFor.
+func (n *nameserver) answerANY(ctx context.Context, payload []byte, family string, addr netip.AddrPort) ([]byte, bool, error) {
+	if n.anyMaxTypes <= 0 {
+		return nil, false, nil
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(payload); err != nil || len(msg.Questions) != 1 || msg.Questions[0].Type != dnsmessage.TypeALL {
+		return nil, false, nil
+	}
+	q := msg.Questions[0]
+	types := anyTypesFor(addr, n.preferSameFamily)
+	queries := make([][]byte, len(types))
+	for i, typ := range types {
+		msg.Questions[0].Type = typ
+		b, err := msg.Pack()
+		if err != nil {
+			return nil, true, err
+		}
+		queries[i] = b
+	}
+
+	resps := make([][]byte, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i], errs[i] = n.lookup(ctx, queries[i], family, addr)
+		}()
+	}
+	wg.Wait()
+
+	// The response is based on the first one, so that it has its header
+	// and EDNS0 options.
+	var merged dnsmessage.Message
+	included := 0
+	for i, resp := range resps {
+		if errs[i] != nil {
+			return nil, true, errs[i]
+		}
+		var rm dnsmessage.Message
+		if err := rm.Unpack(resp); err != nil {
+			return nil, true, err
+		}
+		if i == 0 {
+			merged = rm
+			merged.Questions = []dnsmessage.Question{q}
+			merged.Answers = nil
+		}
+		if rm.Header.RCode == dnsmessage.RCodeSuccess {
+			merged.Header.RCode = dnsmessage.RCodeSuccess
+		}
+		if len(rm.Answers) > 0 && included < n.anyMaxTypes {
+			merged.Answers = append(merged.Answers, rm.Answers...)
+			included++
+		}
+	}
+	if len(merged.Answers) > 0 {
+		// Drop the SOA record of the negative response that the
+		// response is based on, if any.
+		merged.Authorities = nil
+	}
+	resp, err := merged.Pack()
+	return resp, true, err
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// extraRecordsResolver is a dnsResolver that answers queries for the names
+// and types in records with their records, and passes all other queries to
+// the wrapped resolver.
+type extraRecordsResolver struct {
+	dnsResolver
+	records map[string]map[dnsmessage.Type]dnsmessage.ResourceBody
+}
+
+func (r *extraRecordsResolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(bs); err != nil {
+		return nil, err
+	}
+	q := msg.Questions[0]
+	body, ok := r.records[q.Name.String()][q.Type]
+	if !ok {
+		return r.dnsResolver.Query(ctx, bs, family, from)
+	}
+	msg.Header.Response = true
+	msg.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 600},
+		Body:   body,
+	}}
+	return msg.Pack()
+}
+
+func TestNameserverANY(t *testing.T) {
+	records := map[string]map[dnsmessage.Type]dnsmessage.ResourceBody{
+		"baz.bar.ts.net.": {
+			dnsmessage.TypeTXT: &dnsmessage.TXTResource{TXT: []string{"baz"}},
+		},
+		"mail.bar.ts.net.": {
+			dnsmessage.TypeTXT: &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}},
+			dnsmessage.TypeMX:  &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("baz.bar.ts.net.")},
+		},
+	}
+	tests := []struct {
+		name      string
+		query     string
+		maxTypes  int
+		wantTypes []dnsmessage.Type
+		wantRCode dnsmessage.RCode
+	}{
+		{"all_types", "baz.bar.ts.net.", 3, []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeTXT}, dnsmessage.RCodeSuccess},
+		{"limited", "baz.bar.ts.net.", 2, []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}, dnsmessage.RCodeSuccess},
+		{"no_addresses", "mail.bar.ts.net.", 3, []dnsmessage.Type{dnsmessage.TypeTXT, dnsmessage.TypeMX}, dnsmessage.RCodeSuccess},
+		{"not_found", "nope.bar.ts.net.", 3, nil, dnsmessage.RCodeNameError},
+		// Without --any-max-types, the resolver answers with one address.
+		{"disabled", "baz.bar.ts.net.", 0, []dnsmessage.Type{dnsmessage.TypeA}, dnsmessage.RCodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.res = &extraRecordsResolver{dnsResolver: ns.res, records: records}
+			ns.anyMaxTypes = tt.maxTypes
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, tt.query, dnsmessage.TypeALL), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != tt.wantRCode {
+				t.Errorf("got rcode %v, want %v", msg.Header.RCode, tt.wantRCode)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Type != dnsmessage.TypeALL {
+				t.Errorf("got questions %v, want the ANY query", msg.Questions)
+			}
+			var types []dnsmessage.Type
+			for _, rr := range msg.Answers {
+				if rr.Header.Name.String() != tt.query {
+					t.Errorf("got answer for %s, want %s", rr.Header.Name, tt.query)
+				}
+				types = append(types, rr.Header.Type)
+			}
+			if !slices.Equal(types, tt.wantTypes) {
+				t.Errorf("got answers of types %v, want %v", types, tt.wantTypes)
+			}
+		})
+	}
+}
+
+func TestNameserverANYResolverError(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.res = &failingResolver{dnsResolver: ns.res, typ: dnsmessage.TypeTXT}
+	ns.anyMaxTypes = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.query(ctx, testQuery(t, "baz.bar.ts.net.", dnsmessage.TypeALL), testSrc); err == nil {
+		t.Error("query succeeded, want the error of the TXT lookup")
+	}
+}
+
+// failingResolver is a dnsResolver that fails queries for records of type
+// typ.
+type failingResolver struct {
+	dnsResolver
+	typ dnsmessage.Type
+}
+
+func (r *failingResolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+	if _, q, err := parseQuestion(bs); err == nil && q.Type == r.typ {
+		return nil, fmt.Errorf("no %v records today", r.typ)
+	}
+	return r.dnsResolver.Query(ctx, bs, family, from)
+}
+
+func TestNameserverANYPreferSameFamily(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		prefer    bool
+		wantTypes []dnsmessage.Type
+	}{
+		{"ipv4_source", "10.0.0.1:12345", true, []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}},
+		{"ipv6_source", "[fd7a:115c:a1e0::2]:12345", true, []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}},
+		{"ipv4_mapped_source", "[::ffff:10.0.0.1]:12345", true, []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}},
+		{"ipv6_source_disabled", "[fd7a:115c:a1e0::2]:12345", false, []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.anyMaxTypes = 3
+			ns.preferSameFamily = tt.prefer
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, "baz.bar.ts.net.", dnsmessage.TypeALL), netip.MustParseAddrPort(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			var types []dnsmessage.Type
+			for _, rr := range msg.Answers {
+				types = append(types, rr.Header.Type)
+			}
+			if !slices.Equal(types, tt.wantTypes) {
+				t.Errorf("got answers of types %v, want %v", types, tt.wantTypes)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"tailscale.com/util/dnsname"
+)
+
+// autodiscoverDNSNameAnnotation is the Pod annotation with the DNS name to
+// serve the IP addresses of autodiscovered Pods under. Single label names,
+// i.e. "web", are served within the Pod's namespace in the cluster domain,
+// as "web.<namespace>.svc.<cluster domain>".
+const autodiscoverDNSNameAnnotation = "tailscale.com/dns-name"
+
+// runPodAutodiscovery watches the Pods in namespace, or in all namespaces if
+// it is empty, that match selector, and serves the IP addresses of each one
+// that has an autodiscoverDNSNameAnnotation under the annotated name, in
+// addition to the records from the config. Records are removed when their
+// Pods are deleted or finish. It returns once the existing Pods have been
+// listed and keeps watching them in the background until ctx is done. While
+// it runs, the nameserver is also authoritative for the cluster domain.
+//
+// The nameserver's service account must be allowed to list and watch Pods,
+// for example with this ClusterRole and a ClusterRoleBinding to it, or a
+// Role and RoleBinding in namespace if it is set:
+//
+//	apiVersion: rbac.authorization.k8s.io/v1
+//	kind: ClusterRole
+//	metadata:
+//	  name: k8s-nameserver-autodiscovery
+//	rules:
+//	- apiGroups: [""]
+//	  resources: ["pods"]
+//	  verbs: ["list", "watch"]
+func (n *nameserver) runPodAutodiscovery(ctx context.Context, client kubernetes.Interface, namespace string, selector labels.Selector) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = selector.String()
+		}))
+	informer := factory.Core().V1().Pods().Informer()
+	d := &podDiscovery{n: n, selector: selector}
+	n.mu.Lock()
+	n.podAutodiscovery = true
+	err := n.setResolverConfigLocked()
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    d.update,
+		UpdateFunc: func(_, obj any) { d.update(obj) },
+		DeleteFunc: d.delete,
+	}); err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return errors.New("Pod autodiscovery stopped before listing the existing Pods")
+	}
+	n.logger.Infof("autodiscovering Pods matching %q", selector)
+	return nil
+}
+
+// podRecord is the host record of an autodiscovered Pod.
+type podRecord struct {
+	// name is the annotated DNS name, which is either an FQDN or, if it
+	// has a single label, relative to namespace.
+	name      string
+	namespace string
+	ips       []netip.Addr
+}
+
+// fqdn returns the name that r is served under, with single label names in
+// r.namespace in clusterDomain, and whether it is a valid DNS name.
+func (r podRecord) fqdn(clusterDomain dnsname.FQDN) (dnsname.FQDN, bool) {
+	name := r.name
+	if !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		name = strings.TrimSuffix(name, ".") + "." + r.namespace + ".svc." + clusterDomain.WithTrailingDot()
+	}
+	fqdn, err := dnsname.ToFQDN(name)
+	return fqdn, err == nil
+}
+
+// podDiscovery keeps the nameserver's discoveredHosts up to date with the
+// Pods reported by an informer.
+type podDiscovery struct {
+	n        *nameserver
+	selector labels.Selector
+
+	mu sync.Mutex
+	// pods are the records of the Pods that are served, by Pod key. It is
+	// protected by mu.
+	pods map[string]podRecord
+}
+
+// update updates the record of the Pod in obj.
+func (d *podDiscovery) update(obj any) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		return
+	}
+	rec, ok := d.podRecord(key, pod)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old, had := d.pods[key]
+	if !ok {
+		if had {
+			delete(d.pods, key)
+			d.syncLocked()
+		}
+		return
+	}
+	if had && old.name == rec.name && old.namespace == rec.namespace && slices.Equal(old.ips, rec.ips) {
+		return
+	}
+	if d.pods == nil {
+		d.pods = make(map[string]podRecord)
+	}
+	d.pods[key] = rec
+	d.syncLocked()
+}
+
+// delete removes the record of the deleted Pod in obj, which may be a
+// cache.DeletedFinalStateUnknown.
+func (d *podDiscovery) delete(obj any) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pods[key]; ok {
+		delete(d.pods, key)
+		d.syncLocked()
+	}
+}
+
+// podRecord returns the record to serve for pod, with key key, and whether
+// it should be served at all.
+func (d *podDiscovery) podRecord(key string, pod *corev1.Pod) (podRecord, bool) {
+	annotation, ok := pod.Annotations[autodiscoverDNSNameAnnotation]
+	if !ok || !d.selector.Matches(labels.Set(pod.Labels)) {
+		return podRecord{}, false
+	}
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return podRecord{}, false
+	}
+	var err error
+	if label := strings.TrimSuffix(annotation, "."); !strings.Contains(label, ".") {
+		err = dnsname.ValidLabel(label)
+	} else {
+		_, err = dnsname.ToFQDN(annotation)
+	}
+	if err != nil {
+		d.n.logger.Warnf("ignoring Pod %s with invalid %s annotation %q: %v", key, autodiscoverDNSNameAnnotation, annotation, err)
+		return podRecord{}, false
+	}
+	var ips []netip.Addr
+	for _, pip := range pod.Status.PodIPs {
+		if ip, err := netip.ParseAddr(pip.IP); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		if ip, err := netip.ParseAddr(pod.Status.PodIP); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		// Not scheduled yet.
+		return podRecord{}, false
+	}
+	slices.SortFunc(ips, netip.Addr.Compare)
+	return podRecord{name: annotation, namespace: pod.Namespace, ips: ips}, true
+}
+
+// syncLocked updates the nameserver's discoveredPods to the records of
+// d.pods. d.mu must be held.
+func (d *podDiscovery) syncLocked() {
+	pods := make([]podRecord, 0, len(d.pods))
+	for _, rec := range d.pods {
+		pods = append(pods, rec)
+	}
+
+	n := d.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.discoveredPods = pods
+	if err := n.setResolverConfigLocked(); err != nil {
+		n.logger.Errorf("error updating resolver config after Pod change: %v", err)
+		return
+	}
+	n.logger.Infof("serving %d autodiscovered Pod records", len(n.discoveredHostsLocked()))
+}
+
+// discoveredHostsLocked returns the host records of n.discoveredPods, with
+// the IP addresses of all Pods with the same name combined. n.mu must be
+// held.
+func (n *nameserver) discoveredHostsLocked() map[dnsname.FQDN][]netip.Addr {
+	if len(n.discoveredPods) == 0 {
+		return nil
+	}
+	clusterDomain := n.clusterDomainLocked()
+	hosts := make(map[dnsname.FQDN][]netip.Addr)
+	for _, rec := range n.discoveredPods {
+		name, ok := rec.fqdn(clusterDomain)
+		if !ok {
+			// Too long within the cluster domain.
+			continue
+		}
+		for _, ip := range rec.ips {
+			if !slices.Contains(hosts[name], ip) {
+				hosts[name] = append(hosts[name], ip)
+			}
+		}
+	}
+	for _, ips := range hosts {
+		slices.SortFunc(ips, netip.Addr.Compare)
+	}
+	return hosts
+}
+
+// clusterDomainLocked returns the cluster domain from the last config that
+// was successfully loaded, or n.clusterDomain if it has none. n.mu must be
+// held.
+func (n *nameserver) clusterDomainLocked() dnsname.FQDN {
+	if n.configClusterDomain != "" {
+		return n.configClusterDomain
+	}
+	return n.clusterDomain
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	"tailscale.com/tstest"
+)
+
+func testPod(name, dnsName string, podLabels map[string]string, ips ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      podLabels,
+			Annotations: map[string]string{autodiscoverDNSNameAnnotation: dnsName},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+	}
+	if len(ips) > 0 {
+		pod.Status.PodIP = ips[0]
+	}
+	return pod
+}
+
+func TestNameserverPodAutodiscovery(t *testing.T) {
+	matching := map[string]string{"tailscale.com/dns": "true"}
+	client := fake.NewSimpleClientset(
+		testPod("web", "web.bar.ts.net", matching, "10.1.0.1", "fd7a:115c:a1e0::1"),
+		testPod("other", "other.bar.ts.net", map[string]string{"app": "other"}, "10.1.0.2"),
+		testPod("pending", "pending.bar.ts.net", matching),
+	)
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	selector, err := labels.Parse("tailscale.com/dns=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.runPodAutodiscovery(ctx, client, "", selector); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForIPs := func(name string, want ...string) {
+		t.Helper()
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			got := fmt.Sprint(ns.Dump().Hosts[name])
+			if want := fmt.Sprint(want); got != want {
+				return fmt.Errorf("%s: got IPs %s, want %s", name, got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForIPs("web.bar.ts.net.", "10.1.0.1", "fd7a:115c:a1e0::1")
+	waitForIPs("other.bar.ts.net.")
+	waitForIPs("pending.bar.ts.net.")
+	// Config records are still served.
+	waitForIPs("foo.bar.ts.net.", "10.20.30.40")
+	resp, err := ns.query(ctx, testQuery(t, "web.bar.ts.net.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0].String() != "10.1.0.1" {
+		t.Errorf("got IPs %v, want [10.1.0.1]", ips)
+	}
+
+	pods := client.CoreV1().Pods("default")
+	// Pods get their records once they have an IP address.
+	if _, err := pods.UpdateStatus(ctx, testPod("pending", "pending.bar.ts.net", matching, "10.1.0.3"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForIPs("pending.bar.ts.net.", "10.1.0.3")
+	// Pods with the same name share a record.
+	if _, err := pods.Create(ctx, testPod("web-2", "web.bar.ts.net.", matching, "10.1.0.4"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForIPs("web.bar.ts.net.", "10.1.0.1", "10.1.0.4", "fd7a:115c:a1e0::1")
+	if err := pods.Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForIPs("web.bar.ts.net.", "10.1.0.4")
+	// Pods whose labels no longer match lose their records.
+	if _, err := pods.Update(ctx, testPod("web-2", "web.bar.ts.net.", nil, "10.1.0.4"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForIPs("web.bar.ts.net.")
+}
+
+func TestNameserverPodAutodiscoveryClusterDomain(t *testing.T) {
+	matching := map[string]string{"tailscale.com/dns": "true"}
+	web := testPod("web", "web", matching, "10.1.0.1")
+	web.Namespace = "prod"
+	client := fake.NewSimpleClientset(web, testPod("db", "db.bar.ts.net", matching, "10.1.0.2"))
+	cfg := testHosts
+	ns := newTestNameserver(t, func() ([]byte, error) { return cfg, nil })
+	ns.clusterDomain = "k8s.local."
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	selector, err := labels.Parse("tailscale.com/dns=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.runPodAutodiscovery(ctx, client, "", selector); err != nil {
+		t.Fatal(err)
+	}
+	waitForRecord := func(name, want string) {
+		t.Helper()
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			if got := fmt.Sprint(ns.Dump().Hosts[name]); got != want {
+				return fmt.Errorf("%s: got IPs %s, want %s", name, got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Single label names are served in the Pod's namespace in the
+	// cluster domain, FQDNs as they are.
+	waitForRecord("web.prod.svc.k8s.local.", "[10.1.0.1]")
+	waitForRecord("db.bar.ts.net.", "[10.1.0.2]")
+	waitForRecord("web.prod.svc.cluster.local.", "[]")
+	resp, err := ns.query(ctx, testQuery(t, "web.prod.svc.k8s.local.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, resp); fmt.Sprint(ips) != "[10.1.0.1]" {
+		t.Errorf("got IPs %v, want [10.1.0.1]", ips)
+	}
+	// The nameserver is authoritative for the cluster domain.
+	resp, err = ns.query(ctx, testQuery(t, "missing.prod.svc.k8s.local.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := answerIPs(t, resp); h.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("got rcode %v for a missing name in the cluster domain, want NXDOMAIN", h.RCode)
+	}
+
+	// The cluster domain in the config takes precedence.
+	cfg = []byte(`{"hosts": {"foo.bar.ts.net.": ["10.20.30.40"]}, "clusterDomain": "cluster.example.com"}`)
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	waitForRecord("web.prod.svc.cluster.example.com.", "[10.1.0.1]")
+	waitForRecord("web.prod.svc.k8s.local.", "[]")
+
+	cfg = []byte(`{"hosts": {}, "clusterDomain": "."}`)
+	if err := ns.updateResolverConfig(); err == nil {
+		t.Error("loading a config with the root domain as cluster domain succeeded")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// axfrTTL is the TTL of the records in zone transfers, the same as the
+	// TTL of the resolver's responses.
+	axfrTTL = 600
+	// axfrMessageSize is the size above which a zone transfer is split
+	// into another message. It leaves room below the 64KiB limit of DNS
+	// over TCP for the last record that is added.
+	axfrMessageSize = 60 << 10
+)
+
+// isZoneTransfer reports whether payload is an AXFR query.
+func isZoneTransfer(payload []byte) bool {
+	_, q, err := parseQuestion(payload)
+	return err == nil && q.Type == dnsmessage.TypeAXFR
+}
+
+// refuseZoneTransfer returns a REFUSED response and true if the DNS query in
+// payload is an AXFR query. Zone transfers that are allowed are answered by
+// handleTCPConn before they reach the query path, so this refuses AXFR over
+// UDP and from clients that are not in n.axfrAllowFrom.
+func refuseZoneTransfer(payload []byte) ([]byte, bool) {
+	h, q, err := parseQuestion(payload)
+	if err != nil || q.Type != dnsmessage.TypeAXFR {
+		return nil, false
+	}
+	resp, err := errorResponse(h, q, dnsmessage.RCodeRefused)
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// zoneTransferAllowed reports whether addr may request zone transfers.
+func (n *nameserver) zoneTransferAllowed(addr netip.Addr) bool {
+	return slices.ContainsFunc(n.axfrAllowFrom, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// zoneTransfer returns the messages of the response to the AXFR query in
+// payload: the SOA record of the zone, followed by the A and AAAA records of
+// all served host records within it and the SOA record again. Queries for
+// names other than one of the local domains are refused.
+// https://datatracker.ietf.org/doc/html/rfc5936#section-2.2
+func (n *nameserver) zoneTransfer(payload []byte) ([][]byte, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(payload); err != nil {
+		return nil, err
+	}
+	zone, err := dnsname.ToFQDN(strings.ToLower(req.Question[0].Name))
+	if err != nil || !slices.Contains(n.domains(), zone) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+		b, err := resp.Pack()
+		return [][]byte{b}, err
+	}
+
+	n.mu.Lock()
+	hosts := n.servedHostsLocked()
+	serial := uint32(n.lastReloadTime.Unix())
+	n.mu.Unlock()
+	names := make([]dnsname.FQDN, 0, len(hosts))
+	for name := range hosts {
+		if zone.Contains(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone.WithTrailingDot(), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: axfrTTL},
+		Ns:      zone.WithTrailingDot(),
+		Mbox:    "hostmaster." + zone.WithTrailingDot(),
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  axfrTTL,
+	}
+	var msgs [][]byte
+	resp := newZoneTransferMessage(req, true)
+	add := func(rr dns.RR) error {
+		resp.Answer = append(resp.Answer, rr)
+		if resp.Len() < axfrMessageSize {
+			return nil
+		}
+		b, err := resp.Pack()
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, b)
+		resp = newZoneTransferMessage(req, false)
+		return nil
+	}
+	if err := add(soa); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		for _, ip := range hosts[name] {
+			hdr := dns.RR_Header{Name: name.WithTrailingDot(), Class: dns.ClassINET, Ttl: axfrTTL}
+			var rr dns.RR
+			if ip.Is4() {
+				hdr.Rrtype = dns.TypeA
+				rr = &dns.A{Hdr: hdr, A: ip.AsSlice()}
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rr = &dns.AAAA{Hdr: hdr, AAAA: ip.AsSlice()}
+			}
+			if err := add(rr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	resp.Answer = append(resp.Answer, soa)
+	b, err := resp.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return append(msgs, b), nil
+}
+
+// newZoneTransferMessage returns an empty message of the response to the
+// AXFR query req. Only the first message of a zone transfer needs to repeat
+// the question.
+func newZoneTransferMessage(req *dns.Msg, first bool) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	if !first {
+		m.Question = nil
+	}
+	return m
+}
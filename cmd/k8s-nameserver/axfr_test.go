@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/dns/dnsmessage"
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestZoneTransfer(t *testing.T) {
+	// Enough records that the transfer is split into multiple messages.
+	cfg := &operatorutils.TSHosts{Hosts: map[string][]string{
+		"baz.bar.ts.net.": {"10.20.30.41", "fd7a:115c:a1e0::1"},
+	}}
+	for i := range 3000 {
+		cfg.Hosts[fmt.Sprintf("host-%04d.bar.ts.net.", i)] = []string{netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)}).String()}
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newTestNameserver(t, staticConfig(b))
+	ns.axfrAllowFrom, err = parseCIDRs("127.0.0.0/8, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	// AXFR over UDP is refused, even from an allowed client.
+	resp, err := ns.query(ctx, testQuery(t, "ts.net.", dnsmessage.TypeAXFR), testSrc)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if h, _ := answerIPs(t, resp); h.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("AXFR over UDP: got rcode %v, want REFUSED", h.RCode)
+	}
+
+	ln, err := listenTCP("127.0.0.1:0", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ns.serveTCP(ctx, ln, 5*time.Second)
+
+	tr := &dns.Transfer{DialTimeout: 5 * time.Second, ReadTimeout: 5 * time.Second}
+	m := new(dns.Msg)
+	m.SetAxfr("ts.net.")
+	envs, err := tr.In(m, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rrs []dns.RR
+	var messages int
+	for env := range envs {
+		if env.Error != nil {
+			t.Fatal(env.Error)
+		}
+		messages++
+		rrs = append(rrs, env.RR...)
+	}
+	if messages < 2 {
+		t.Errorf("got zone transfer in %d messages, want several", messages)
+	}
+	if len(rrs) != 3002+2 {
+		t.Fatalf("got %d records, want %d", len(rrs), 3002+2)
+	}
+	first, ok := rrs[0].(*dns.SOA)
+	if !ok || first.Hdr.Name != "ts.net." {
+		t.Errorf("first record is %v, want ts.net. SOA", rrs[0])
+	}
+	if last, ok := rrs[len(rrs)-1].(*dns.SOA); !ok || first == nil || last.Serial != first.Serial {
+		t.Errorf("last record is %v, want the same SOA as the first", rrs[len(rrs)-1])
+	}
+	var baz []string
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if rr.Header().Name != "baz.bar.ts.net." {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			baz = append(baz, rr.A.String())
+		case *dns.AAAA:
+			baz = append(baz, rr.AAAA.String())
+		}
+	}
+	if want := []string{"10.20.30.41", "fd7a:115c:a1e0::1"}; !slices.Equal(baz, want) {
+		t.Errorf("got records %q for baz.bar.ts.net., want %q", baz, want)
+	}
+
+	// AXFR for names other than the zone apex is refused.
+	c := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	m = new(dns.Msg)
+	m.SetAxfr("bar.ts.net.")
+	r, _, err := c.Exchange(m, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeRefused {
+		t.Errorf("AXFR for bar.ts.net.: got rcode %s, want REFUSED", dns.RcodeToString[r.Rcode])
+	}
+
+	// Clients outside of --axfr-allow-from are refused over TCP as well.
+	ns2 := newTestNameserver(t, staticConfig(testHosts))
+	ns2.axfrAllowFrom = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	if err := ns2.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	ln2, err := listenTCP("127.0.0.1:0", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	go ns2.serveTCP(ctx, ln2, 5*time.Second)
+	m = new(dns.Msg)
+	m.SetAxfr("ts.net.")
+	r, _, err = c.Exchange(m, ln2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeRefused || len(r.Answer) != 0 {
+		t.Errorf("AXFR from disallowed client: got %v, want REFUSED", r)
+	}
+}
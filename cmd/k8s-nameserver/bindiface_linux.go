@@ -0,0 +1,39 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenConfig returns the net.ListenConfig and address to listen on
+// network at addr with. If iface is non-empty, the sockets are bound to
+// the network interface with that name using SO_BINDTODEVICE, so that they
+// only receive traffic that arrives on it.
+func listenConfig(network, addr, iface string) (*net.ListenConfig, string, error) {
+	if iface == "" {
+		return &net.ListenConfig{}, addr, nil
+	}
+	if _, err := net.InterfaceByName(iface); err != nil {
+		return nil, "", fmt.Errorf("error looking up interface %q: %w", iface, err)
+	}
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+			}); err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("error binding to interface %q: %w", iface, sockErr)
+			}
+			return nil
+		},
+	}, addr, nil
+}
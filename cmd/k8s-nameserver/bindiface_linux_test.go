@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListenBindInterface(t *testing.T) {
+	conn, err := listenUDP("127.0.0.1:0", false, "lo", false)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("binding to an interface needs CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ln, err := listenTCP("127.0.0.1:0", false, "lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, c := range []syscall.Conn{conn, ln.(*net.TCPListener)} {
+		rc, err := c.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dev string
+		var sockErr error
+		if err := rc.Control(func(fd uintptr) {
+			dev, sockErr = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if sockErr != nil {
+			t.Fatal(sockErr)
+		}
+		if dev != "lo" {
+			t.Errorf("%T bound to interface %q, want \"lo\"", c, dev)
+		}
+	}
+
+	if _, err := listenUDP("127.0.0.1:0", false, "does-not-exist0", false); err == nil {
+		t.Error("listening on a nonexistent interface succeeded, want error")
+	}
+}
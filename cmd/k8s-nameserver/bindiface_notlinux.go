@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !plan9
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// listenConfig returns the net.ListenConfig and address to listen on
+// network at addr with. If iface is non-empty, the host part of addr is
+// replaced with the first IP address of the network interface with that
+// name that matches network, as binding sockets to an interface is only
+// supported on Linux.
+func listenConfig(network, addr, iface string) (*net.ListenConfig, string, error) {
+	if iface == "" {
+		return &net.ListenConfig{}, addr, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, "", fmt.Errorf("error looking up interface %q: %w", iface, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting addresses of interface %q: %w", iface, err)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if strings.HasSuffix(network, "6") && !ip.Is6() || strings.HasSuffix(network, "4") && !ip.Is4() {
+			continue
+		}
+		return &net.ListenConfig{}, net.JoinHostPort(ip.String(), port), nil
+	}
+	return nil, "", fmt.Errorf("interface %q has no IP address to listen on for %s", iface, network)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/version"
+)
+
+// buildTime is the time at which the nameserver was built, in RFC 3339
+// format. It is set at build time with
+// -ldflags "-X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)", alongside the
+// tailscale.com/version stamps (see build_docker.sh).
+var buildTime string
+
+const (
+	// versionRecordName is the name of the TXT record that the nameserver
+	// serves its version and build info in.
+	versionRecordName dnsname.FQDN = "_tailscale.ts.net."
+	// versionRecordTTL is the TTL of the version record, kept short so
+	// that resolvers don't keep serving the version of a replaced
+	// nameserver after an upgrade.
+	versionRecordTTL = 10
+	// chaosVersionName is the name of the CHAOS class TXT record that DNS
+	// servers conventionally serve their version in, as queried with
+	// "dig CH TXT version.bind".
+	chaosVersionName dnsname.FQDN = "version.bind."
+)
+
+// versionRecord returns the contents of the version record, of the form
+// "v=ts-nameserver version=<VERSION> commit=<GIT_SHA> built=<BUILD_TIME>".
+// Values that are not known for this build are "unknown".
+func versionRecord() string {
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	return fmt.Sprintf("v=ts-nameserver version=%s commit=%s built=%s", version.Long(), orUnknown(version.GetMeta().GitCommit), orUnknown(buildTime))
+}
+
+// versionResponse returns a response and true if the DNS query in payload is
+// for the version record name. TXT queries are answered with the version
+// record, and queries for other types with an empty answer.
+func versionResponse(payload []byte) ([]byte, bool, error) {
+	h, q, err := parseQuestion(payload)
+	if err != nil {
+		return nil, false, nil
+	}
+	if name, err := dnsname.ToFQDN(strings.ToLower(q.Name.String())); err != nil || name != versionRecordName {
+		return nil, false, nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: h.RecursionDesired,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, true, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, true, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, true, err
+	}
+	if q.Type == dnsmessage.TypeTXT {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: versionRecordTTL}
+		if err := b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{versionRecord()}}); err != nil {
+			return nil, true, err
+		}
+	}
+	resp, err := b.Finish()
+	return resp, true, err
+}
+
+// chaosResponse returns a response and true if the DNS query in payload is
+// of class CHAOS. TXT queries for version.bind. are answered with version,
+// queries for other types of version.bind. with an empty answer, and all
+// other CHAOS queries with REFUSED, as the nameserver serves no other CHAOS
+// records.
+func chaosResponse(payload []byte, version string) ([]byte, bool, error) {
+	h, q, err := parseQuestion(payload)
+	if err != nil || q.Class != dnsmessage.ClassCHAOS {
+		return nil, false, nil
+	}
+	if name, err := dnsname.ToFQDN(strings.ToLower(q.Name.String())); err != nil || name != chaosVersionName {
+		resp, err := errorResponse(h, q, dnsmessage.RCodeRefused)
+		return resp, true, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: h.RecursionDesired,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, true, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, true, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, true, err
+	}
+	if q.Type == dnsmessage.TypeTXT {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassCHAOS}
+		if err := b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{version}}); err != nil {
+			return nil, true, err
+		}
+	}
+	resp, err := b.Finish()
+	return resp, true, err
+}
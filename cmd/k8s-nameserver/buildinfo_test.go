@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/version"
+)
+
+func TestNameserverVersionRecord(t *testing.T) {
+	// Test binaries are built without the build time stamp unless run with
+	// -ldflags "-X main.buildTime=...", in which case the stamped value is
+	// checked instead.
+	if buildTime == "" {
+		buildTime = "2024-05-01T12:00:00Z"
+		t.Cleanup(func() { buildTime = "" })
+	}
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ns.query(ctx, testQuery(t, "_TailScale.ts.net.", dnsmessage.TypeTXT), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("got rcode %v and answers %v, want one answer", msg.Header.RCode, msg.Answers)
+	}
+	if ttl := msg.Answers[0].Header.TTL; ttl != versionRecordTTL {
+		t.Errorf("got TTL %d, want %d", ttl, versionRecordTTL)
+	}
+	txt, ok := msg.Answers[0].Body.(*dnsmessage.TXTResource)
+	if !ok || len(txt.TXT) != 1 {
+		t.Fatalf("got answer %v, want a single TXT string", msg.Answers[0].Body)
+	}
+	got := txt.TXT[0]
+	fields := map[string]string{}
+	for _, f := range strings.Fields(got) {
+		k, v, _ := strings.Cut(f, "=")
+		fields[k] = v
+	}
+	if fields["v"] != "ts-nameserver" {
+		t.Errorf("got record %q, want v=ts-nameserver", got)
+	}
+	if fields["version"] == "" || fields["version"] != version.Long() {
+		t.Errorf("got record %q, want version=%s", got, version.Long())
+	}
+	if fields["built"] != buildTime {
+		t.Errorf("got record %q, want built=%s", got, buildTime)
+	}
+	if _, ok := fields["commit"]; !ok {
+		t.Errorf("got record %q, want a commit", got)
+	}
+
+	// Other types get an empty answer rather than being forwarded.
+	resp, err = ns.query(ctx, testQuery(t, "_tailscale.ts.net.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("got rcode %v and answers %v for A query, want no answers", msg.Header.RCode, msg.Answers)
+	}
+}
+
+// chaosQuery returns a packed CHAOS class DNS query for name and typ.
+func chaosQuery(t testing.TB, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1234},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassCHAOS,
+		}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNameserverChaosVersion(t *testing.T) {
+	tests := []struct {
+		name         string
+		chaosVersion string
+		query        string
+		typ          dnsmessage.Type
+		wantRCode    dnsmessage.RCode
+		wantTXT      []string
+	}{
+		{"version", "ts-nameserver test", "version.bind.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, []string{"ts-nameserver test"}},
+		{"case_insensitive", "ts-nameserver test", "VERSION.bind.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, []string{"ts-nameserver test"}},
+		{"real_version", versionRecord(), "version.bind.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, []string{versionRecord()}},
+		{"other_type", "ts-nameserver test", "version.bind.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil},
+		{"other_name", "ts-nameserver test", "hostname.bind.", dnsmessage.TypeTXT, dnsmessage.RCodeRefused, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.chaosVersion = tt.chaosVersion
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, chaosQuery(t, tt.query, tt.typ), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != tt.wantRCode {
+				t.Errorf("got rcode %v, want %v", msg.Header.RCode, tt.wantRCode)
+			}
+			var got []string
+			for _, rr := range msg.Answers {
+				if rr.Header.Class != dnsmessage.ClassCHAOS {
+					t.Errorf("got answer of class %v, want CHAOS", rr.Header.Class)
+				}
+				if txt, ok := rr.Body.(*dnsmessage.TXTResource); ok {
+					got = append(got, txt.TXT...)
+				}
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.wantTXT) {
+				t.Errorf("got TXT %q, want %q", got, tt.wantTXT)
+			}
+		})
+	}
+}
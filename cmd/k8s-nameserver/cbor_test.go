@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestNameserverCBORConfig(t *testing.T) {
+	cfg := &operatorutils.TSHosts{Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.50"}}}
+	b, err := cbor.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CBOR configs are detected with the default JSON format, as well as
+	// used with the CBOR format.
+	for _, format := range []string{"", nsconfig.FormatJSON, nsconfig.FormatCBOR} {
+		t.Run(fmt.Sprintf("format=%q", format), func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(b))
+			ns.configFormat = format
+			ns.strictConfig = true
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.50") {
+				t.Errorf("got IPs %v, want [10.20.30.50]", ips)
+			}
+		})
+	}
+}
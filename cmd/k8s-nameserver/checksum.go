@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// configChecksumSuffix is appended to the config key to get the name of the
+// file next to it with its SHA-256 checksum, i.e. dns.json.sha256, see
+// --config-checksum-validation.
+const configChecksumSuffix = ".sha256"
+
+// newChecksumConfigReader returns a configReaderFunc that returns the config
+// read by r, the key named key of the ConfigMap mounted at dir, once it has
+// verified that it matches the SHA-256 checksum in the key named key +
+// configChecksumSuffix. The checksum file holds the hex encoded checksum,
+// optionally followed by the file name, as written by sha256sum. Configs
+// that don't match their checksum, or that have none, are refused, so that
+// the last good config stays in place.
+func newChecksumConfigReader(r configReaderFunc, dir, key string, logger *zap.SugaredLogger) configReaderFunc {
+	checksumFile := filepath.Join(dir, key+configChecksumSuffix)
+	return func() ([]byte, error) {
+		b, err := r()
+		if err != nil || b == nil {
+			return b, err
+		}
+		want, err := readConfigChecksum(checksumFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading nameserver config checksum: %w", err)
+		}
+		if got := sha256.Sum256(b); !bytes.Equal(got[:], want) {
+			logger.Errorf("CRITICAL: security alert: the SHA-256 checksum %x of nameserver config %s does not match %x in %s, refusing to load it", got, key, want, checksumFile)
+			return nil, fmt.Errorf("nameserver config %s does not match its checksum in %s", key, checksumFile)
+		}
+		return b, nil
+	}
+}
+
+// readConfigChecksum returns the SHA-256 checksum in the file at path.
+func readConfigChecksum(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err == nil && len(sum) != sha256.Size {
+		err = errors.New("not a SHA-256 checksum")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum %q in %s: %w", fields[0], path, err)
+	}
+	return sum, nil
+}
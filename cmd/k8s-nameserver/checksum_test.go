@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstest"
+)
+
+func TestConfigChecksumValidation(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, defaultDNSFile)
+	checksumFile := configFile + configChecksumSuffix
+	writeFile := func(path string, b []byte) {
+		t.Helper()
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksum := func(b []byte) []byte {
+		return []byte(fmt.Sprintf("%x  %s\n", sha256.Sum256(b), defaultDNSFile))
+	}
+	writeFile(configFile, testHosts)
+	writeFile(checksumFile, checksum(testHosts))
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ns := newTestNameserver(t, nil)
+	ns.logger = zap.New(core).Sugar()
+	ns.configReader = newChecksumConfigReader(newConfigMapConfigReader(dir, defaultDNSFile), dir, defaultDNSFile, ns.logger)
+	ns.maxReloadErrors = 100
+	watcher, err := ensureWatcherForKubeConfigMap(ctx, dir, defaultDNSFile, ns.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.configWatcher = watcher
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	waitForIP := func(name, want string) {
+		t.Helper()
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			resp, err := ns.query(ctx, testQuery(t, name, dnsmessage.TypeA), testSrc)
+			if err != nil {
+				return err
+			}
+			if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr(want) {
+				return fmt.Errorf("%s: got IPs %v, want [%s]", name, ips, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForIP("foo.bar.ts.net.", "10.20.30.40")
+
+	// A new config with a corrupted checksum is refused.
+	newHosts := []byte(`{"hosts":{"new.bar.ts.net.":["10.20.30.70"]}}`)
+	bad := checksum(newHosts)
+	bad[0] ^= 1
+	writeFile(configFile, newHosts)
+	writeFile(checksumFile, bad)
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if logs.FilterMessageSnippet("CRITICAL").Len() == 0 {
+			return errors.New("no CRITICAL log for the checksum mismatch")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ns.reloadErrors() == 0 {
+		t.Error("config with a corrupted checksum was loaded")
+	}
+	waitForIP("foo.bar.ts.net.", "10.20.30.40")
+
+	// Fixing the checksum loads the new config.
+	writeFile(checksumFile, checksum(newHosts))
+	waitForIP("new.bar.ts.net.", "10.20.30.70")
+}
+
+func TestReadConfigChecksumError(t *testing.T) {
+	dir := t.TempDir()
+	for _, contents := range []string{"", "not-hex", strings.Repeat("ab", 16)} {
+		path := filepath.Join(dir, "dns.json.sha256")
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfigChecksum(path); err == nil {
+			t.Errorf("readConfigChecksum(%q) succeeded, want error", contents)
+		}
+	}
+	if _, err := readConfigChecksum(filepath.Join(dir, "missing.sha256")); err == nil {
+		t.Error("reading a missing checksum file succeeded, want error")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxCoalescedResponses is the maximum number of responses that a
+// udpResponseBatcher sends at once. At that many, they are sent right away
+// rather than at the end of the coalescing window.
+const maxCoalescedResponses = 64
+
+// batchWriter is implemented by *ipv4.PacketConn and *ipv6.PacketConn.
+type batchWriter interface {
+	WriteBatch(ms []ipv6.Message, flags int) (int, error)
+}
+
+// udpResponseBatcher sends the DNS responses written to a UDP socket within
+// a coalescing window in a single batch, with one sendmmsg system call on
+// Linux, which is cheaper than one write per response during bursts of
+// queries such as when many pods start at once. Each response is still a
+// datagram of its own to its client. On other platforms the responses are
+// written one at a time when the window ends.
+type udpResponseBatcher struct {
+	logger *zap.SugaredLogger
+	pc     batchWriter
+	window time.Duration
+
+	mu sync.Mutex
+	// pending are the responses to send at the end of the current window,
+	// if any. It is protected by mu.
+	pending []ipv6.Message
+	timer   *time.Timer
+}
+
+// newUDPResponseBatcher returns a udpResponseBatcher for the responses sent
+// on conn that coalesces them for window.
+func newUDPResponseBatcher(logger *zap.SugaredLogger, conn *net.UDPConn, window time.Duration) *udpResponseBatcher {
+	b := &udpResponseBatcher{logger: logger, window: window}
+	if la, ok := conn.LocalAddr().(*net.UDPAddr); ok && la.IP.To4() != nil {
+		b.pc = ipv4.NewPacketConn(conn)
+	} else {
+		b.pc = ipv6.NewPacketConn(conn)
+	}
+	return b
+}
+
+// write queues resp to be sent to addr. resp must not be modified
+// afterwards.
+func (b *udpResponseBatcher) write(resp []byte, addr *net.UDPAddr) {
+	b.mu.Lock()
+	b.pending = append(b.pending, ipv6.Message{Buffers: [][]byte{resp}, Addr: addr})
+	var batch []ipv6.Message
+	switch {
+	case len(b.pending) >= maxCoalescedResponses:
+		batch = b.takeLocked()
+	case len(b.pending) == 1:
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+	b.send(batch)
+}
+
+// flush sends the pending responses.
+func (b *udpResponseBatcher) flush() {
+	b.mu.Lock()
+	batch := b.takeLocked()
+	b.mu.Unlock()
+	b.send(batch)
+}
+
+// takeLocked returns the pending responses and stops the timer for sending
+// them. b.mu must be held.
+func (b *udpResponseBatcher) takeLocked() []ipv6.Message {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+// send writes the responses in batch, which WriteBatch might only partially
+// do in one call.
+func (b *udpResponseBatcher) send(batch []ipv6.Message) {
+	for len(batch) > 0 {
+		n, err := b.pc.WriteBatch(batch, 0)
+		if err != nil {
+			// The failed response is lost; continue with the rest of
+			// the batch.
+			b.logger.Errorf("error writing DNS response to %v: %v", batch[n].Addr, err)
+			n++
+		}
+		batch = batch[n:]
+	}
+}
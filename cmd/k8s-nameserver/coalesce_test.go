@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/syncs"
+)
+
+func TestNameserverCoalescingWindow(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", ":0"} {
+		t.Run(addr, func(t *testing.T) {
+			conn, err := listenUDP(addr, false, "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.coalescingWindow = 10 * time.Millisecond
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			go ns.serve(ctx, conn)
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+
+			// Enough concurrent clients for both full batches and
+			// ones sent when the window ends.
+			const clients = maxCoalescedResponses + 10
+			var wg syncs.WaitGroup
+			for range clients {
+				wg.Go(func() {
+					c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer c.Close()
+					c.SetDeadline(time.Now().Add(5 * time.Second))
+					if _, err := c.Write(testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)); err != nil {
+						t.Error(err)
+						return
+					}
+					buf := make([]byte, 512)
+					n, err := c.Read(buf)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if _, ips := answerIPs(t, buf[:n]); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+						t.Errorf("got IPs %v, want [10.20.30.40]", ips)
+					}
+				})
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkUDPResponses compares writing bursts of 1000 DNS responses to a
+// UDP socket one at a time and in coalesced batches.
+func BenchmarkUDPResponses(b *testing.B) {
+	const burst = 1000
+	resp := make([]byte, 100)
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadBuffer(8 << 20)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	dst := client.LocalAddr().(*net.UDPAddr)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.Run("single", func(b *testing.B) {
+		for range b.N {
+			for range burst {
+				if _, err := conn.WriteToUDP(resp, dst); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		// The window is long enough that only full batches are sent.
+		batcher := newUDPResponseBatcher(zap.NewNop().Sugar(), conn, time.Hour)
+		for range b.N {
+			for range burst {
+				batcher.write(resp, dst)
+			}
+		}
+		batcher.flush()
+	})
+}
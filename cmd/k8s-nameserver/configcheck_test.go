@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+func TestNameserverConfigWarnings(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig([]byte(`{"hosts":{"foo.bar.ts.net.":["10.20.30.40"],"baz.bar.ts.net.":["10.20.30.40","127.0.0.1"]}}`)))
+	ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+	core, logs := observer.New(zap.WarnLevel)
+	ns.logger = zap.New(core).Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Warnings don't prevent the config from loading.
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.Stats().RecordCount; got != 2 {
+		t.Errorf("got %d records, want 2", got)
+	}
+	if got := logs.FilterMessageSnippet("nameserver config: ").Len(); got != 2 {
+		t.Errorf("got %d config warnings logged, want 2: %v", got, logs.All())
+	}
+	for typ, want := range map[string]float64{nsconfig.WarningDuplicateIP: 1, nsconfig.WarningUnreachableIP: 1, nsconfig.WarningDanglingRedirect: 0} {
+		if got := testutil.ToFloat64(ns.metrics.configWarnings.WithLabelValues(typ)); got != want {
+			t.Errorf("got config_warnings_total{type=%q} %v, want %v", typ, got, want)
+		}
+	}
+}
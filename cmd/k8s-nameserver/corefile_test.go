@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+func TestNameserverCorefile(t *testing.T) {
+	corefile := `.:53 {
+    hosts {
+        fd7a:115c:a1e0::1 foo.bar.ts.net baz.bar.ts.net
+        fallthrough
+    }
+    forward . /etc/resolv.conf
+}
+`
+	ns := newTestNameserver(t, staticConfig([]byte(corefile)))
+	ns.configFormat = nsconfig.FormatCorefile
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ns.query(ctx, testQuery(t, "baz.bar.ts.net.", dnsmessage.TypeAAAA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("fd7a:115c:a1e0::1") {
+		t.Errorf("got IPs %v, want [fd7a:115c:a1e0::1]", ips)
+	}
+}
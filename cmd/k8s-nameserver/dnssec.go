@@ -0,0 +1,218 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnssecSignatureValidity is how long RRSIGs created by the nameserver
+	// are valid for. Responses are signed when they are served, so this
+	// only needs to cover the time that they may be cached for.
+	dnssecSignatureValidity = 24 * time.Hour
+	// dnssecInceptionOffset backdates the RRSIG inception time to allow
+	// for clock skew between the nameserver and validators.
+	dnssecInceptionOffset = time.Hour
+	// dnskeyTTL is the TTL of the DNSKEY records served at the zone apex.
+	dnskeyTTL = 3600
+)
+
+// dnssecSigner signs DNS responses for a single zone with a single key,
+// which acts as both the key signing key and the zone signing key.
+type dnssecSigner struct {
+	zone   string // zone apex, with trailing dot
+	signer crypto.Signer
+	dnskey *dns.DNSKEY
+	now    func() time.Time
+}
+
+// loadDNSSECSigner reads a PKCS#8 PEM encoded RSA or ECDSA private key from
+// path and returns a signer for zone that uses it.
+func loadDNSSECSigner(path, zone string) (*dnssecSigner, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading DNSSEC key: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("DNSSEC key is not PEM encoded")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DNSSEC key: %w", err)
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported DNSSEC key type %T", k)
+	}
+	return newDNSSECSigner(zone, signer)
+}
+
+// newDNSSECSigner returns a signer for zone that signs with k, which must be
+// an RSA key or an ECDSA key on the P-256 or P-384 curve.
+func newDNSSECSigner(zone string, k crypto.Signer) (*dnssecSigner, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    dnskeyTTL,
+		},
+		// Zone key with the secure entry point bit set.
+		// https://datatracker.ietf.org/doc/html/rfc4034#section-2.1.1
+		Flags:    dns.ZONE | dns.SEP,
+		Protocol: 3,
+	}
+	var pub []byte
+	switch pk := k.Public().(type) {
+	case *rsa.PublicKey:
+		dnskey.Algorithm = dns.RSASHA256
+		pub = rsaPublicKeyBytes(pk)
+	case *ecdsa.PublicKey:
+		var size int
+		switch pk.Curve {
+		case elliptic.P256():
+			dnskey.Algorithm, size = dns.ECDSAP256SHA256, 32
+		case elliptic.P384():
+			dnskey.Algorithm, size = dns.ECDSAP384SHA384, 48
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", pk.Curve.Params().Name)
+		}
+		pub = append(pub, pk.X.FillBytes(make([]byte, size))...)
+		pub = append(pub, pk.Y.FillBytes(make([]byte, size))...)
+	default:
+		return nil, fmt.Errorf("unsupported DNSSEC public key type %T", pk)
+	}
+	dnskey.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	return &dnssecSigner{
+		zone:   dnskey.Hdr.Name,
+		signer: k,
+		dnskey: dnskey,
+		now:    time.Now,
+	}, nil
+}
+
+// rsaPublicKeyBytes returns the DNSKEY wire format of k.
+// https://datatracker.ietf.org/doc/html/rfc3110#section-2
+func rsaPublicKeyBytes(k *rsa.PublicKey) []byte {
+	e := big.NewInt(int64(k.E)).Bytes()
+	var b []byte
+	if len(e) < 256 {
+		b = append(b, byte(len(e)))
+	} else {
+		b = append(b, 0, byte(len(e)>>8), byte(len(e)))
+	}
+	b = append(b, e...)
+	return append(b, k.N.Bytes()...)
+}
+
+// DS returns the DS record that needs to be published in the parent zone to
+// establish a chain of trust to the signer's key.
+func (s *dnssecSigner) DS() *dns.DS {
+	return s.dnskey.ToDS(dns.SHA256)
+}
+
+// wantsDNSSEC reports whether the DNS query in b has the EDNS0 DO bit set.
+func wantsDNSSEC(b []byte) bool {
+	var m dns.Msg
+	if err := m.Unpack(b); err != nil {
+		return false
+	}
+	opt := m.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// dnskeyResponse returns a response with the signer's DNSKEY RRset and true
+// if the query in b is for the zone apex DNSKEY records.
+func (s *dnssecSigner) dnskeyResponse(b []byte) ([]byte, bool, error) {
+	var req dns.Msg
+	if err := req.Unpack(b); err != nil || len(req.Question) == 0 {
+		return nil, false, nil
+	}
+	q := req.Question[0]
+	if q.Qtype != dns.TypeDNSKEY || !dns.IsSubDomain(s.zone, q.Name) || !dns.IsSubDomain(q.Name, s.zone) {
+		return nil, false, nil
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(&req)
+	resp.Authoritative = true
+	resp.Answer = []dns.RR{dns.Copy(s.dnskey)}
+	out, err := resp.Pack()
+	return out, true, err
+}
+
+// sign adds RRSIGs for all A, AAAA and DNSKEY RRsets in the answer section of
+// the DNS response in b that are within the signer's zone and sets the AD
+// bit if any were signed. It must only be called for responses to queries
+// that have the EDNS0 DO bit set.
+func (s *dnssecSigner) sign(b []byte) ([]byte, error) {
+	var m dns.Msg
+	if err := m.Unpack(b); err != nil {
+		return nil, fmt.Errorf("error unpacking response: %w", err)
+	}
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range m.Answer {
+		h := rr.Header()
+		switch h.Rrtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeDNSKEY:
+		default:
+			continue
+		}
+		if !dns.IsSubDomain(s.zone, h.Name) {
+			continue
+		}
+		k := rrsetKey{dns.CanonicalName(h.Name), h.Rrtype}
+		if _, ok := rrsets[k]; !ok {
+			keys = append(keys, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+	if len(keys) == 0 {
+		return b, nil
+	}
+	now := s.now()
+	for _, k := range keys {
+		rrset := rrsets[k]
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  s.dnskey.Algorithm,
+			KeyTag:     s.dnskey.KeyTag(),
+			SignerName: s.zone,
+			Inception:  uint32(now.Add(-dnssecInceptionOffset).Unix()),
+			Expiration: uint32(now.Add(dnssecSignatureValidity).Unix()),
+		}
+		if err := sig.Sign(s.signer, rrset); err != nil {
+			return nil, fmt.Errorf("error signing %s %s: %w", k.name, dns.TypeToString[k.rtype], err)
+		}
+		m.Answer = append(m.Answer, sig)
+	}
+	m.AuthenticatedData = true
+	if m.IsEdns0() == nil {
+		// The DO bit must be copied into the response.
+		// https://datatracker.ietf.org/doc/html/rfc3225#section-3
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return m.Pack()
+}
@@ -0,0 +1,167 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func writeTestKey(t *testing.T, k crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dnssec.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func dnssecQuery(t *testing.T, name string, qtype uint16, do bool) []byte {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	if do {
+		m.SetEdns0(1232, true)
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDNSSECSigning(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, k := range map[string]crypto.Signer{"ecdsa": ecKey, "rsa": rsaKey} {
+		t.Run(name, func(t *testing.T) {
+			signer, err := loadDNSSECSigner(writeTestKey(t, k), "ts.net")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.dnssec = signer
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+
+			query := func(name string, qtype uint16, do bool) *dns.Msg {
+				t.Helper()
+				b, err := ns.query(ctx, dnssecQuery(t, name, qtype, do), testSrc)
+				if err != nil {
+					t.Fatalf("query: %v", err)
+				}
+				m := new(dns.Msg)
+				if err := m.Unpack(b); err != nil {
+					t.Fatalf("unpacking response: %v", err)
+				}
+				return m
+			}
+			// splitAnswer returns the records and the RRSIG in
+			// the answer section of m.
+			splitAnswer := func(m *dns.Msg) (rrs []dns.RR, sig *dns.RRSIG) {
+				for _, rr := range m.Answer {
+					if s, ok := rr.(*dns.RRSIG); ok {
+						sig = s
+						continue
+					}
+					rrs = append(rrs, rr)
+				}
+				return rrs, sig
+			}
+
+			// The DNSKEY at the zone apex is self-signed.
+			m := query("ts.net.", dns.TypeDNSKEY, true)
+			rrs, sig := splitAnswer(m)
+			if len(rrs) != 1 || sig == nil {
+				t.Fatalf("DNSKEY response: got %v, want DNSKEY and RRSIG", m.Answer)
+			}
+			dnskey, ok := rrs[0].(*dns.DNSKEY)
+			if !ok {
+				t.Fatalf("DNSKEY response: got %T, want *dns.DNSKEY", rrs[0])
+			}
+			if err := sig.Verify(dnskey, rrs); err != nil {
+				t.Errorf("verifying DNSKEY RRSIG: %v", err)
+			}
+			if ds := dnskey.ToDS(dns.SHA256); ds.Digest != signer.DS().Digest {
+				t.Errorf("got DS %v, want %v", ds, signer.DS())
+			}
+
+			m = query("foo.bar.ts.net.", dns.TypeA, true)
+			rrs, sig = splitAnswer(m)
+			if len(rrs) != 1 || sig == nil {
+				t.Fatalf("A response: got %v, want A and RRSIG", m.Answer)
+			}
+			if !m.AuthenticatedData {
+				t.Error("A response: AD bit not set")
+			}
+			if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+				t.Error("A response: DO bit not set")
+			}
+			if sig.TypeCovered != dns.TypeA || sig.SignerName != "ts.net." || sig.KeyTag != dnskey.KeyTag() {
+				t.Errorf("A response: unexpected RRSIG %v", sig)
+			}
+			if !sig.ValidityPeriod(signer.now()) {
+				t.Errorf("A response: RRSIG %v not currently valid", sig)
+			}
+			if err := sig.Verify(dnskey, rrs); err != nil {
+				t.Errorf("verifying A RRSIG: %v", err)
+			}
+
+			// Clients that don't set the DO bit get unsigned
+			// responses.
+			m = query("foo.bar.ts.net.", dns.TypeA, false)
+			rrs, sig = splitAnswer(m)
+			if len(rrs) != 1 || sig != nil || m.AuthenticatedData {
+				t.Errorf("A response without DO: got %v (AD=%v), want unsigned A record", m.Answer, m.AuthenticatedData)
+			}
+		})
+	}
+}
+
+func TestLoadDNSSECSignerErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "notpem")
+	if err := os.WriteFile(notPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDNSSECSigner(notPEM, "ts.net."); err == nil {
+		t.Error("loading non-PEM key: got nil error")
+	}
+	if _, err := loadDNSSECSigner(filepath.Join(dir, "missing"), "ts.net."); err == nil {
+		t.Error("loading missing key: got nil error")
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDNSSECSigner(writeTestKey(t, p224), "ts.net."); err == nil {
+		t.Error("loading P-224 key: got nil error")
+	}
+}
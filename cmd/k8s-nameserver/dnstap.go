@@ -0,0 +1,256 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// dnstapContentType is the Frame Streams content type of dnstap.
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+
+	// dnstapRedialInterval is how long the dnstap logger waits before
+	// connecting again after the connection to the dnstap socket failed.
+	// Messages logged in the meantime are dropped.
+	dnstapRedialInterval = 5 * time.Second
+)
+
+// Field numbers and enum values of the dnstap protobuf schema.
+// https://github.com/dnstap/dnstap.pb/blob/master/dnstap.proto
+const (
+	dnstapFieldIdentity = 1
+	dnstapFieldVersion  = 2
+	dnstapFieldMessage  = 14
+	dnstapFieldType     = 15
+	dnstapTypeMessage   = 1
+
+	dnstapMessageFieldType             = 1
+	dnstapMessageFieldSocketFamily     = 2
+	dnstapMessageFieldSocketProtocol   = 3
+	dnstapMessageFieldQueryAddress     = 4
+	dnstapMessageFieldQueryPort        = 6
+	dnstapMessageFieldQueryTimeSec     = 8
+	dnstapMessageFieldQueryTimeNsec    = 9
+	dnstapMessageFieldQueryMessage     = 10
+	dnstapMessageFieldResponseTimeSec  = 12
+	dnstapMessageFieldResponseTimeNsec = 13
+	dnstapMessageFieldResponseMessage  = 14
+
+	dnstapMessageAuthQuery    = 1
+	dnstapMessageAuthResponse = 2
+
+	dnstapSocketFamilyINET  = 1
+	dnstapSocketFamilyINET6 = 2
+
+	dnstapSocketProtocolUDP = 1
+	dnstapSocketProtocolTCP = 2
+)
+
+// dnstapLogger streams the DNS queries that the nameserver answers and its
+// responses to a dnstap socket, as AUTH_QUERY and AUTH_RESPONSE messages.
+// Like queryLogger, messages are written by a background goroutine, so that
+// a slow or unavailable receiver doesn't add latency to queries.
+type dnstapLogger struct {
+	dial     func() (net.Conn, error)
+	identity string
+	version  string
+	frames   chan []byte
+	stop     chan struct{}
+	done     chan struct{}
+	// errorf logs errors connecting and writing to the socket.
+	errorf func(format string, args ...any)
+	// closeErr is the error closing the stream, set before done is
+	// closed.
+	closeErr error
+}
+
+// newDnstapLogger returns a dnstapLogger that writes to the connections
+// returned by dial, with up to bufSize messages waiting to be written. The
+// messages are tagged with identity and version, which may be empty.
+func newDnstapLogger(dial func() (net.Conn, error), identity, version string, bufSize int, errorf func(string, ...any)) *dnstapLogger {
+	l := &dnstapLogger{
+		dial:     dial,
+		identity: identity,
+		version:  version,
+		frames:   make(chan []byte, bufSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		errorf:   errorf,
+	}
+	go l.run()
+	return l
+}
+
+// parseDnstapSocket returns the network and address of s, the value of
+// --dnstap-socket, which is either "tcp://host:port" or a Unix socket path,
+// optionally prefixed by "unix://".
+func parseDnstapSocket(s string) (network, address string) {
+	if addr, ok := strings.CutPrefix(s, "tcp://"); ok {
+		return "tcp", addr
+	}
+	return "unix", strings.TrimPrefix(s, "unix://")
+}
+
+// log adds the query in payload, received from addr over family at start,
+// and resp, the response to it after latency, if any, to the dnstap stream.
+// It never blocks, and reports false if messages were dropped because too
+// many messages are waiting to be written.
+func (l *dnstapLogger) log(payload, resp []byte, family string, addr netip.AddrPort, start time.Time, latency time.Duration) bool {
+	ok := l.enqueue(l.frame(dnstapMessage(dnstapMessageAuthQuery, payload, family, addr, start, time.Time{})))
+	if len(resp) > 0 {
+		ok = l.enqueue(l.frame(dnstapMessage(dnstapMessageAuthResponse, resp, family, addr, start, start.Add(latency)))) && ok
+	}
+	return ok
+}
+
+func (l *dnstapLogger) enqueue(frame []byte) bool {
+	select {
+	case l.frames <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close writes the messages that are waiting to be written and closes the
+// connection to the socket. Messages logged after Close are dropped.
+func (l *dnstapLogger) Close() error {
+	close(l.stop)
+	<-l.done
+	return l.closeErr
+}
+
+func (l *dnstapLogger) run() {
+	defer close(l.done)
+	var (
+		w        *frameStreamWriter
+		lastDial time.Time
+	)
+	write := func(frame []byte) {
+		if w == nil {
+			if time.Since(lastDial) < dnstapRedialInterval {
+				return
+			}
+			lastDial = time.Now()
+			conn, err := l.dial()
+			if err == nil {
+				w, err = newFrameStreamWriter(conn, dnstapContentType)
+			}
+			if err != nil {
+				l.errorf("error connecting to dnstap socket: %v", err)
+				return
+			}
+		}
+		err := w.WriteFrame(frame)
+		if err == nil && len(l.frames) == 0 {
+			// Flush once the messages that were waiting are written,
+			// rather than after every message.
+			err = w.Flush()
+		}
+		if err != nil {
+			l.errorf("error writing to dnstap socket: %v", err)
+			w.conn.Close()
+			w = nil
+		}
+	}
+	for {
+		select {
+		case frame := <-l.frames:
+			write(frame)
+		case <-l.stop:
+			for {
+				select {
+				case frame := <-l.frames:
+					write(frame)
+				default:
+					if w != nil {
+						if l.closeErr = w.Flush(); l.closeErr != nil {
+							w.conn.Close()
+						} else {
+							l.closeErr = w.Close()
+						}
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// frame returns the dnstap.Dnstap protobuf message for msg, an encoded
+// dnstap.Message.
+func (l *dnstapLogger) frame(msg []byte) []byte {
+	var b []byte
+	if l.identity != "" {
+		b = appendProtoBytes(b, dnstapFieldIdentity, []byte(l.identity))
+	}
+	if l.version != "" {
+		b = appendProtoBytes(b, dnstapFieldVersion, []byte(l.version))
+	}
+	b = appendProtoBytes(b, dnstapFieldMessage, msg)
+	b = appendProtoVarint(b, dnstapFieldType, dnstapTypeMessage)
+	return b
+}
+
+// dnstapMessage returns the dnstap.Message protobuf message of type typ for
+// the DNS message dns, of a query received from addr over family at
+// queryTime. For responses, respTime is when the response was sent.
+func dnstapMessage(typ uint64, dns []byte, family string, addr netip.AddrPort, queryTime, respTime time.Time) []byte {
+	var b []byte
+	b = appendProtoVarint(b, dnstapMessageFieldType, typ)
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		b = appendProtoVarint(b, dnstapMessageFieldSocketFamily, dnstapSocketFamilyINET)
+	} else {
+		b = appendProtoVarint(b, dnstapMessageFieldSocketFamily, dnstapSocketFamilyINET6)
+	}
+	if family == "tcp" {
+		b = appendProtoVarint(b, dnstapMessageFieldSocketProtocol, dnstapSocketProtocolTCP)
+	} else {
+		b = appendProtoVarint(b, dnstapMessageFieldSocketProtocol, dnstapSocketProtocolUDP)
+	}
+	if ip.IsValid() {
+		b = appendProtoBytes(b, dnstapMessageFieldQueryAddress, ip.AsSlice())
+		b = appendProtoVarint(b, dnstapMessageFieldQueryPort, uint64(addr.Port()))
+	}
+	b = appendProtoVarint(b, dnstapMessageFieldQueryTimeSec, uint64(queryTime.Unix()))
+	b = appendProtoFixed32(b, dnstapMessageFieldQueryTimeNsec, uint32(queryTime.Nanosecond()))
+	if typ == dnstapMessageAuthQuery {
+		return appendProtoBytes(b, dnstapMessageFieldQueryMessage, dns)
+	}
+	b = appendProtoVarint(b, dnstapMessageFieldResponseTimeSec, uint64(respTime.Unix()))
+	b = appendProtoFixed32(b, dnstapMessageFieldResponseTimeNsec, uint32(respTime.Nanosecond()))
+	return appendProtoBytes(b, dnstapMessageFieldResponseMessage, dns)
+}
+
+// Protobuf wire types.
+// https://protobuf.dev/programming-guides/encoding/
+const (
+	protoWireVarint  = 0
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoWireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoWireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoWireFixed32)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
@@ -0,0 +1,214 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnstapReceiver accepts a single Frame Streams connection on ln, like the
+// dnstap command, and sends the data frames it receives to frames until
+// the writer stops the stream.
+func dnstapReceiver(t *testing.T, ln net.Listener, frames chan<- []byte) {
+	defer close(frames)
+	c, err := ln.Accept()
+	if err != nil {
+		t.Errorf("accept: %v", err)
+		return
+	}
+	defer c.Close()
+	w := &frameStreamWriter{conn: c, bw: bufio.NewWriter(c), contentType: dnstapContentType}
+	if typ, contentTypes, err := readControlFrame(c); err != nil || typ != fstrmControlReady || len(contentTypes) != 1 || contentTypes[0] != dnstapContentType {
+		t.Errorf("got control frame %d with content types %q and error %v, want READY for %q", typ, contentTypes, err, dnstapContentType)
+		return
+	}
+	if err := w.writeControl(fstrmControlAccept); err != nil {
+		t.Errorf("writing ACCEPT: %v", err)
+		return
+	}
+	if typ, _, err := readControlFrame(c); err != nil || typ != fstrmControlStart {
+		t.Errorf("got control frame %d and error %v, want START", typ, err)
+		return
+	}
+	for {
+		var n [4]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			t.Errorf("reading frame: %v", err)
+			return
+		}
+		if binary.BigEndian.Uint32(n[:]) == 0 {
+			// The escape sequence of a control frame, which must be
+			// STOP, read back in with the escape sequence.
+			typ, _, err := readControlFrame(io.MultiReader(bytes.NewReader(n[:]), c))
+			if err != nil || typ != fstrmControlStop {
+				t.Errorf("got control frame %d and error %v, want STOP", typ, err)
+				return
+			}
+			if err := w.writeControl(fstrmControlFinish); err != nil {
+				t.Errorf("writing FINISH: %v", err)
+			}
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(n[:]))
+		if _, err := io.ReadFull(c, frame); err != nil {
+			t.Errorf("reading frame: %v", err)
+			return
+		}
+		frames <- frame
+	}
+}
+
+// protoFields returns the fields of the protobuf message in b by field
+// number, with varint and fixed32 fields in ints and others in fields.
+func protoFields(t *testing.T, b []byte) (ints map[int]uint64, fields map[int][]byte) {
+	t.Helper()
+	ints, fields = make(map[int]uint64), make(map[int][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag in %x", b)
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case protoWireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid varint in %x", b)
+			}
+			ints[field], b = v, b[n:]
+		case protoWireFixed32:
+			ints[field], b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoWireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("invalid length in %x", b)
+			}
+			fields[field], b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return ints, fields
+}
+
+func TestNameserverDnstap(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	frames := make(chan []byte, 10)
+	go dnstapReceiver(t, ln, frames)
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.dnstap = newDnstapLogger(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, "test-ns", "1.2.3", 10, t.Errorf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	query := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	start := time.Now()
+	resp, err := ns.query(ctx, query, testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.dnstap.Close(); err != nil {
+		t.Fatalf("closing dnstap logger: %v", err)
+	}
+
+	var got [][]byte
+	for f := range frames {
+		got = append(got, f)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d frames, want a query and a response", len(got))
+	}
+	for i, want := range []struct {
+		typ     uint64
+		field   int
+		message []byte
+	}{
+		{dnstapMessageAuthQuery, dnstapMessageFieldQueryMessage, query},
+		{dnstapMessageAuthResponse, dnstapMessageFieldResponseMessage, resp},
+	} {
+		ints, fields := protoFields(t, got[i])
+		if ints[dnstapFieldType] != dnstapTypeMessage || string(fields[dnstapFieldIdentity]) != "test-ns" || string(fields[dnstapFieldVersion]) != "1.2.3" {
+			t.Errorf("frame %d: got type %d, identity %q and version %q", i, ints[dnstapFieldType], fields[dnstapFieldIdentity], fields[dnstapFieldVersion])
+		}
+		ints, fields = protoFields(t, fields[dnstapFieldMessage])
+		if ints[dnstapMessageFieldType] != want.typ {
+			t.Errorf("frame %d: got message type %d, want %d", i, ints[dnstapMessageFieldType], want.typ)
+		}
+		if ints[dnstapMessageFieldSocketFamily] != dnstapSocketFamilyINET || ints[dnstapMessageFieldSocketProtocol] != dnstapSocketProtocolUDP {
+			t.Errorf("frame %d: got socket family %d and protocol %d, want INET and UDP", i, ints[dnstapMessageFieldSocketFamily], ints[dnstapMessageFieldSocketProtocol])
+		}
+		ip, _ := netip.AddrFromSlice(fields[dnstapMessageFieldQueryAddress])
+		if ip != testSrc.Addr() || ints[dnstapMessageFieldQueryPort] != uint64(testSrc.Port()) {
+			t.Errorf("frame %d: got query address %v port %d, want %v", i, ip, ints[dnstapMessageFieldQueryPort], testSrc)
+		}
+		if sec := int64(ints[dnstapMessageFieldQueryTimeSec]); sec < start.Unix() || sec > time.Now().Unix() {
+			t.Errorf("frame %d: got query time %d, want around %d", i, sec, start.Unix())
+		}
+		if !bytes.Equal(fields[want.field], want.message) {
+			t.Errorf("frame %d: got DNS message %x, want %x", i, fields[want.field], want.message)
+		}
+	}
+}
+
+func TestDnstapLoggerUnavailable(t *testing.T) {
+	var dials, errs atomic.Int32
+	l := newDnstapLogger(func() (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New("connection refused")
+	}, "", "", 2, func(string, ...any) { errs.Add(1) })
+	query := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	for range 100 {
+		l.log(query, nil, "udp", testSrc, time.Now(), 0)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Messages are dropped while the receiver is unavailable, rather than
+	// each retrying the connection.
+	if got := dials.Load(); got != 1 {
+		t.Errorf("got %d dials, want 1", got)
+	}
+	if errs.Load() != 1 {
+		t.Errorf("got %d errors logged, want 1", errs.Load())
+	}
+}
+
+func TestParseDnstapSocket(t *testing.T) {
+	tests := []struct {
+		in, network, address string
+	}{
+		{"/var/run/dnstap.sock", "unix", "/var/run/dnstap.sock"},
+		{"unix:///var/run/dnstap.sock", "unix", "/var/run/dnstap.sock"},
+		{"tcp://10.0.0.1:6000", "tcp", "10.0.0.1:6000"},
+	}
+	for _, tt := range tests {
+		network, address := parseDnstapSocket(tt.in)
+		if network != tt.network || address != tt.address {
+			t.Errorf("parseDnstapSocket(%q) = %q, %q, want %q, %q", tt.in, network, address, tt.network, tt.address)
+		}
+	}
+}
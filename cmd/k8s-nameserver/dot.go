@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// parseTLSMinVersion parses the --tls-min-version flag, which is "1.2" or
+// "1.3". TLS 1.2 is the lowest version that RFC 8310 allows for DNS over TLS.
+// https://datatracker.ietf.org/doc/html/rfc8310#section-8.1
+func parseTLSMinVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, must be \"1.2\" or \"1.3\"", s)
+}
+
+// parseTLSCipherSuites parses the --tls-cipher-suites flag, a comma-separated
+// list of the names of cipher suites as returned by tls.CipherSuites, for
+// TLS connections with a minimum version of minVersion. It returns nil if s
+// is empty, for the crypto/tls defaults. Cipher suites that crypto/tls
+// considers insecure are rejected, and so are cipher suites with a minimum
+// version of TLS 1.3, as the TLS 1.3 cipher suites are not configurable.
+func parseTLSCipherSuites(s string, minVersion uint16) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if minVersion >= tls.VersionTLS13 {
+		return nil, errors.New("cipher suites can't be configured for TLS 1.3, which is the minimum TLS version")
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool { return cs.Name == name })
+		if i < 0 {
+			if slices.ContainsFunc(tls.InsecureCipherSuites(), func(cs *tls.CipherSuite) bool { return cs.Name == name }) {
+				return nil, fmt.Errorf("cipher suite %q is insecure", name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		cs := tls.CipherSuites()[i]
+		if !slices.Contains(cs.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("cipher suite %q is only used with TLS 1.3, and can't be configured", name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+// loadDoTConfig returns the TLS config to serve DNS over TLS with, using the
+// PEM encoded certificate chain and private key in the given files. If
+// requireSNI is non-empty, the handshake fails with an unrecognized_name
+// alert for clients that don't send it as their SNI, i.e. because they are
+// meant for another nameserver behind the same load balancer. minVersion and
+// cipherSuites are as returned by parseTLSMinVersion and
+// parseTLSCipherSuites.
+func loadDoTConfig(certFile, keyFile, requireSNI string, minVersion uint16, cipherSuites []uint16) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml#alpn-protocol-ids
+		NextProtos: []string{"dot"},
+	}
+	if requireSNI != "" {
+		// With no Certificates, crypto/tls sends unrecognized_name
+		// when GetCertificate returns no certificate and no error.
+		cfg.Certificates = nil
+		cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if !strings.EqualFold(hello.ServerName, requireSNI) {
+				return nil, nil
+			}
+			return &cert, nil
+		}
+	}
+	return cfg, nil
+}
+
+// serveDoT accepts DNS over TLS connections from ln until ctx is done and
+// answers the DNS queries on each one in its own goroutine, the same way as
+// over TCP. Clients may have at most maxPerIP connections open at a time,
+// or any number if maxPerIP is 0; further connections are closed right
+// away.
+// https://datatracker.ietf.org/doc/html/rfc7858
+func (n *nameserver) serveDoT(ctx context.Context, ln net.Listener, cfg *tls.Config, idleTimeout time.Duration, maxPerIP int) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			n.logger.Errorf("error accepting DNS over TLS connection: %v", err)
+			continue
+		}
+		src, err := netip.ParseAddrPort(c.RemoteAddr().String())
+		if err != nil {
+			n.logger.Errorf("invalid DNS over TLS client address %v: %v", c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+		ip := src.Addr().Unmap()
+		if !n.acquireDoTConn(ip, maxPerIP) {
+			n.logger.Debugf("closing DNS over TLS connection from %v, which already has %d open", src, maxPerIP)
+			c.Close()
+			continue
+		}
+		go func() {
+			defer n.releaseDoTConn(ip)
+			// The TLS handshake happens on the first read, within the
+			// idle timeout of the connection.
+			n.handleTCPConn(ctx, tls.Server(c, cfg), idleTimeout, &n.dotConns)
+		}()
+	}
+}
+
+// acquireDoTConn reports whether ip may open another DNS over TLS
+// connection, and if so counts it towards the maxPerIP limit until
+// releaseDoTConn is called.
+func (n *nameserver) acquireDoTConn(ip netip.Addr, maxPerIP int) bool {
+	n.dotMu.Lock()
+	defer n.dotMu.Unlock()
+	if maxPerIP > 0 && n.dotConnsPerIP[ip] >= maxPerIP {
+		return false
+	}
+	if n.dotConnsPerIP == nil {
+		n.dotConnsPerIP = make(map[netip.Addr]int)
+	}
+	n.dotConnsPerIP[ip]++
+	return true
+}
+
+// releaseDoTConn releases a connection acquired by acquireDoTConn.
+func (n *nameserver) releaseDoTConn(ip netip.Addr) {
+	n.dotMu.Lock()
+	defer n.dotMu.Unlock()
+	if n.dotConnsPerIP[ip]--; n.dotConnsPerIP[ip] <= 0 {
+		delete(n.dotConnsPerIP, ip)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tstest"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and
+// dns.bar.ts.net and its key to PEM files and returns their paths, along with
+// a pool containing the certificate for clients to trust.
+func writeTestCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"dns.bar.ts.net"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, pool
+}
+
+func TestDoT(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	cfg, err := loadDoTConfig(certFile, keyFile, "", tls.VersionTLS12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDoTConfig(certFile, certFile, "", tls.VersionTLS12, nil); err == nil {
+		t.Error("loading a TLS config without a private key succeeded")
+	}
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listenTCP("127.0.0.1:0", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	const maxPerIP = 2
+	go ns.serveDoT(ctx, ln, cfg, 5*time.Second, maxPerIP)
+
+	client := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{RootCAs: pool, NextProtos: []string{"dot"}},
+		Timeout:   5 * time.Second,
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("foo.bar.ts.net.", dns.TypeA)
+	var conns []*dns.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := range maxPerIP {
+		c, err := client.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+		// Several queries can be sent on the same connection.
+		for range 2 {
+			resp, _, err := client.ExchangeWithConn(m, c)
+			if err != nil {
+				t.Fatalf("conn %d: %v", i, err)
+			}
+			if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.20.30.40" {
+				t.Fatalf("conn %d: got answers %v, want 10.20.30.40", i, resp.Answer)
+			}
+		}
+		if proto := c.Conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; proto != "dot" {
+			t.Errorf("conn %d: negotiated protocol %q, want dot", i, proto)
+		}
+	}
+	if n := ns.dotConns.Load(); n != maxPerIP {
+		t.Errorf("got %d DoT connections, want %d", n, maxPerIP)
+	}
+	if n := ns.tcpConns.Load(); n != 0 {
+		t.Errorf("got %d TCP connections, want 0", n)
+	}
+
+	// Connections over the per-client limit are closed before the TLS
+	// handshake, until one of the open connections is closed.
+	if c, err := client.Dial(ln.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("connection over the per-client limit succeeded")
+	}
+	conns[0].Close()
+	conns = conns[1:]
+	if err := tstest.WaitFor(2*time.Second, func() error {
+		c, err := client.Dial(ln.Addr().String())
+		if err != nil {
+			return err
+		}
+		conns = append(conns, c)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range conns {
+		c.Close()
+	}
+	conns = nil
+	if err := tstest.WaitFor(2*time.Second, func() error {
+		if n := ns.dotConns.Load(); n != 0 {
+			return fmt.Errorf("%d DoT connections open, want 0", n)
+		}
+		ns.dotMu.Lock()
+		defer ns.dotMu.Unlock()
+		if len(ns.dotConnsPerIP) != 0 {
+			return fmt.Errorf("got per-client connection counts %v, want none", ns.dotConnsPerIP)
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	// Clients that don't speak TLS don't get answers.
+	plain := &dns.Client{Net: "tcp", Timeout: time.Second}
+	if _, _, err := plain.Exchange(m, ln.Addr().String()); err == nil {
+		t.Error("DNS over TCP query to the DoT listener succeeded")
+	}
+}
+
+func TestDoTRequireSNI(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	cfg, err := loadDoTConfig(certFile, keyFile, "dns.bar.ts.net", tls.VersionTLS12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listenTCP("127.0.0.1:0", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ns.serveDoT(ctx, ln, cfg, 5*time.Second, 0)
+
+	for _, tc := range []struct {
+		serverName string
+		wantErr    bool
+	}{
+		{"dns.bar.ts.net", false},
+		{"DNS.bar.ts.net", false},
+		{"other.bar.ts.net", true},
+		// No SNI is sent for IP addresses.
+		{"127.0.0.1", true},
+	} {
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			RootCAs:    pool,
+			ServerName: tc.serverName,
+			// The server rejects the connection before sending a
+			// certificate that could be verified for the name.
+			InsecureSkipVerify: tc.wantErr,
+		})
+		if tc.wantErr {
+			if err == nil {
+				c.Close()
+				t.Errorf("SNI %q: handshake succeeded, want it rejected", tc.serverName)
+			} else if !strings.Contains(err.Error(), "unrecognized name") {
+				t.Errorf("SNI %q: got error %v, want an unrecognized_name alert", tc.serverName, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SNI %q: %v", tc.serverName, err)
+			continue
+		}
+		dc := &dns.Conn{Conn: c}
+		m := new(dns.Msg)
+		m.SetQuestion("foo.bar.ts.net.", dns.TypeA)
+		resp, _, err := (&dns.Client{Timeout: 5 * time.Second}).ExchangeWithConn(m, dc)
+		if err != nil || len(resp.Answer) != 1 {
+			t.Errorf("SNI %q: got response %v and error %v, want one answer", tc.serverName, resp, err)
+		}
+		c.Close()
+	}
+}
+
+func TestDoTMinVersionAndCipherSuites(t *testing.T) {
+	certFile, keyFile, _ := writeTestCert(t)
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	// serve serves DNS over TLS with the given settings and returns the
+	// address of the listener.
+	serve := func(minVersion uint16, cipherSuites []uint16) string {
+		cfg, err := loadDoTConfig(certFile, keyFile, "", minVersion, cipherSuites)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := listenTCP("127.0.0.1:0", false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go ns.serveDoT(ctx, ln, cfg, 5*time.Second, 0)
+		return ln.Addr().String()
+	}
+	// handshake returns the connection state of a TLS connection to addr
+	// with a client that allows at most maxVersion.
+	handshake := func(addr string, maxVersion uint16) (tls.ConnectionState, error) {
+		c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: maxVersion})
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer c.Close()
+		return c.ConnectionState(), nil
+	}
+
+	tls13 := serve(tls.VersionTLS13, nil)
+	if _, err := handshake(tls13, tls.VersionTLS12); err == nil {
+		t.Error("TLS 1.2 handshake with a TLS 1.3 minimum succeeded")
+	}
+	if cs, err := handshake(tls13, 0); err != nil || cs.Version != tls.VersionTLS13 {
+		t.Errorf("got version %x, %v, want TLS 1.3", cs.Version, err)
+	}
+
+	suite := tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	tls12 := serve(tls.VersionTLS12, []uint16{suite})
+	cs, err := handshake(tls12, tls.VersionTLS12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != tls.VersionTLS12 || cs.CipherSuite != suite {
+		t.Errorf("got version %x and cipher suite %s, want TLS 1.2 and %s", cs.Version, tls.CipherSuiteName(cs.CipherSuite), tls.CipherSuiteName(suite))
+	}
+	// Clients that support none of the allowed cipher suites can't
+	// connect.
+	c, err := tls.Dial("tcp", tls12, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err == nil {
+		c.Close()
+		t.Error("handshake with a cipher suite that is not allowed succeeded")
+	}
+}
+
+func TestParseTLSFlags(t *testing.T) {
+	for _, tc := range []struct {
+		minVersion   string
+		cipherSuites string
+		wantVersion  uint16
+		wantSuites   []uint16
+		wantErr      bool
+	}{
+		{minVersion: "1.2", wantVersion: tls.VersionTLS12},
+		{minVersion: "1.3", wantVersion: tls.VersionTLS13},
+		{minVersion: "1.2", cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", wantVersion: tls.VersionTLS12,
+			wantSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}},
+		{minVersion: "1.1", wantErr: true},
+		{minVersion: "1.0", wantErr: true},
+		{minVersion: "tls1.3", wantErr: true},
+		{minVersion: "1.2", cipherSuites: "TLS_NOPE", wantErr: true},
+		// Insecure cipher suites are rejected.
+		{minVersion: "1.2", cipherSuites: "TLS_RSA_WITH_RC4_128_SHA", wantErr: true},
+		// TLS 1.3 cipher suites are not configurable.
+		{minVersion: "1.2", cipherSuites: "TLS_AES_128_GCM_SHA256", wantErr: true},
+		{minVersion: "1.3", cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", wantErr: true},
+	} {
+		version, err := parseTLSMinVersion(tc.minVersion)
+		var suites []uint16
+		if err == nil {
+			suites, err = parseTLSCipherSuites(tc.cipherSuites, version)
+		}
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("--tls-min-version=%s --tls-cipher-suites=%q: got no error", tc.minVersion, tc.cipherSuites)
+			}
+			continue
+		}
+		if err != nil || version != tc.wantVersion || !slices.Equal(suites, tc.wantSuites) {
+			t.Errorf("--tls-min-version=%s --tls-cipher-suites=%q: got %x, %x, %v, want %x, %x", tc.minVersion, tc.cipherSuites, version, suites, err, tc.wantVersion, tc.wantSuites)
+		}
+	}
+}
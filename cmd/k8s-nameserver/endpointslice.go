@@ -0,0 +1,203 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"tailscale.com/util/dnsname"
+)
+
+// runEndpointSliceSync watches the EndpointSlices in all namespaces and
+// serves the IP addresses of the ready endpoints of each Service as
+// "<service>.<namespace>.<zone>", where the zone is the first of the local
+// domains, in addition to the records from the config. It returns once the
+// existing EndpointSlices have been listed and keeps watching them in the
+// background until ctx is done.
+//
+// The nameserver's service account must be allowed to list and watch
+// EndpointSlices, for example with this ClusterRole and a
+// ClusterRoleBinding to it:
+//
+//	apiVersion: rbac.authorization.k8s.io/v1
+//	kind: ClusterRole
+//	metadata:
+//	  name: k8s-nameserver-endpointslices
+//	rules:
+//	- apiGroups: ["discovery.k8s.io"]
+//	  resources: ["endpointslices"]
+//	  verbs: ["list", "watch"]
+func (n *nameserver) runEndpointSliceSync(ctx context.Context, client kubernetes.Interface) error {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	informer := factory.Discovery().V1().EndpointSlices().Informer()
+	s := &endpointSliceSync{n: n}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.update,
+		UpdateFunc: func(_, obj any) { s.update(obj) },
+		DeleteFunc: s.delete,
+	}); err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return errors.New("EndpointSlice sync stopped before listing the existing EndpointSlices")
+	}
+	n.logger.Info("serving the ready endpoints of EndpointSlices")
+	return nil
+}
+
+// endpointRecord is the host record of the ready endpoints in an
+// EndpointSlice of a Service.
+type endpointRecord struct {
+	service   string
+	namespace string
+	ips       []netip.Addr
+}
+
+// fqdn returns the name that r is served under in zone, and whether it is a
+// valid DNS name.
+func (r endpointRecord) fqdn(zone dnsname.FQDN) (dnsname.FQDN, bool) {
+	fqdn, err := dnsname.ToFQDN(r.service + "." + r.namespace + "." + zone.WithTrailingDot())
+	return fqdn, err == nil
+}
+
+// endpointSliceSync keeps the nameserver's syncedEndpoints up to date with
+// the EndpointSlices reported by an informer.
+type endpointSliceSync struct {
+	n *nameserver
+
+	mu sync.Mutex
+	// slices are the records of the EndpointSlices that are served, by
+	// EndpointSlice key. It is protected by mu.
+	slices map[string]endpointRecord
+}
+
+// update updates the record of the EndpointSlice in obj.
+func (s *endpointSliceSync) update(obj any) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(slice)
+	if err != nil {
+		return
+	}
+	rec, ok := endpointSliceRecord(slice)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.slices[key]
+	if !ok {
+		if had {
+			delete(s.slices, key)
+			s.syncLocked()
+		}
+		return
+	}
+	if had && old.service == rec.service && old.namespace == rec.namespace && slices.Equal(old.ips, rec.ips) {
+		return
+	}
+	if s.slices == nil {
+		s.slices = make(map[string]endpointRecord)
+	}
+	s.slices[key] = rec
+	s.syncLocked()
+}
+
+// delete removes the record of the deleted EndpointSlice in obj, which may
+// be a cache.DeletedFinalStateUnknown.
+func (s *endpointSliceSync) delete(obj any) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.slices[key]; ok {
+		delete(s.slices, key)
+		s.syncLocked()
+	}
+}
+
+// endpointSliceRecord returns the record to serve for the ready endpoints of
+// slice and whether it has any. Endpoints whose ready condition is unknown
+// are considered ready, as by kube-proxy.
+func endpointSliceRecord(slice *discoveryv1.EndpointSlice) (endpointRecord, bool) {
+	service := slice.Labels[discoveryv1.LabelServiceName]
+	if service == "" || slice.AddressType == discoveryv1.AddressTypeFQDN {
+		return endpointRecord{}, false
+	}
+	var ips []netip.Addr
+	for _, ep := range slice.Endpoints {
+		if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+			continue
+		}
+		for _, addr := range ep.Addresses {
+			if ip, err := netip.ParseAddr(addr); err == nil && !slices.Contains(ips, ip) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return endpointRecord{}, false
+	}
+	slices.SortFunc(ips, netip.Addr.Compare)
+	return endpointRecord{service: service, namespace: slice.Namespace, ips: ips}, true
+}
+
+// syncLocked updates the nameserver's syncedEndpoints to the records of
+// s.slices. s.mu must be held.
+func (s *endpointSliceSync) syncLocked() {
+	recs := make([]endpointRecord, 0, len(s.slices))
+	for _, rec := range s.slices {
+		recs = append(recs, rec)
+	}
+
+	n := s.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.syncedEndpoints = recs
+	if err := n.setResolverConfigLocked(); err != nil {
+		n.logger.Errorf("error updating resolver config after EndpointSlice change: %v", err)
+		return
+	}
+	n.logger.Infof("serving %d EndpointSlice Service records", len(n.endpointHostsLocked()))
+}
+
+// endpointHostsLocked returns the host records of n.syncedEndpoints, with
+// the IP addresses of all EndpointSlices of the same Service combined. n.mu
+// must be held.
+func (n *nameserver) endpointHostsLocked() map[dnsname.FQDN][]netip.Addr {
+	if len(n.syncedEndpoints) == 0 {
+		return nil
+	}
+	zone := n.domains()[0]
+	hosts := make(map[dnsname.FQDN][]netip.Addr)
+	for _, rec := range n.syncedEndpoints {
+		name, ok := rec.fqdn(zone)
+		if !ok {
+			// Too long within the zone.
+			continue
+		}
+		for _, ip := range rec.ips {
+			if !slices.Contains(hosts[name], ip) {
+				hosts[name] = append(hosts[name], ip)
+			}
+		}
+	}
+	for _, ips := range hosts {
+		slices.SortFunc(ips, netip.Addr.Compare)
+	}
+	return hosts
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"tailscale.com/tstest"
+	"tailscale.com/types/ptr"
+)
+
+// testEndpoint is an endpoint of a testEndpointSlice.
+type testEndpoint struct {
+	ip    string
+	ready *bool
+}
+
+func testEndpointSlice(name, namespace, service string, addrType discoveryv1.AddressType, eps ...testEndpoint) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: addrType,
+	}
+	for _, ep := range eps {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{ep.ip},
+			Conditions: discoveryv1.EndpointConditions{Ready: ep.ready},
+		})
+	}
+	return slice
+}
+
+func TestNameserverEndpointSliceSync(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testEndpointSlice("web-abc", "default", "web", discoveryv1.AddressTypeIPv4,
+			testEndpoint{"10.1.0.1", ptr.To(true)},
+			testEndpoint{"10.1.0.2", ptr.To(false)},
+			testEndpoint{"10.1.0.3", nil}),
+		testEndpointSlice("web-def", "default", "web", discoveryv1.AddressTypeIPv6,
+			testEndpoint{"fd7a:115c:a1e0::1", ptr.To(true)}),
+		testEndpointSlice("db-abc", "prod", "db", discoveryv1.AddressTypeIPv4,
+			testEndpoint{"10.2.0.1", ptr.To(false)}),
+	)
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.runEndpointSliceSync(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForIPs := func(name string, want ...string) {
+		t.Helper()
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			got := fmt.Sprint(ns.Dump().Hosts[name])
+			if want := fmt.Sprint(want); got != want {
+				return fmt.Errorf("%s: got IPs %s, want %s", name, got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unready endpoints are left out, and the endpoints of all slices of
+	// a Service are combined.
+	waitForIPs("web.default.ts.net.", "10.1.0.1", "10.1.0.3", "fd7a:115c:a1e0::1")
+	waitForIPs("db.prod.ts.net.")
+	// Config records are still served.
+	waitForIPs("foo.bar.ts.net.", "10.20.30.40")
+	resp, err := ns.query(ctx, testQuery(t, "web.default.ts.net.", dnsmessage.TypeAAAA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0].String() != "fd7a:115c:a1e0::1" {
+		t.Errorf("got IPs %v, want [fd7a:115c:a1e0::1]", ips)
+	}
+
+	prodSlices := client.DiscoveryV1().EndpointSlices("prod")
+	if _, err := prodSlices.Update(ctx, testEndpointSlice("db-abc", "prod", "db", discoveryv1.AddressTypeIPv4,
+		testEndpoint{"10.2.0.1", ptr.To(true)}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForIPs("db.prod.ts.net.", "10.2.0.1")
+	if err := client.DiscoveryV1().EndpointSlices("default").Delete(ctx, "web-def", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForIPs("web.default.ts.net.", "10.1.0.1", "10.1.0.3")
+	// Slices whose endpoints all become unready lose their records.
+	if _, err := prodSlices.Update(ctx, testEndpointSlice("db-abc", "prod", "db", discoveryv1.AddressTypeIPv4,
+		testEndpoint{"10.2.0.1", ptr.To(false)}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForIPs("db.prod.ts.net.")
+}
+
+func TestEndpointSliceRecord(t *testing.T) {
+	unlabelled := testEndpointSlice("web-abc", "default", "web", discoveryv1.AddressTypeIPv4, testEndpoint{"10.1.0.1", nil})
+	unlabelled.Labels = nil
+	if _, ok := endpointSliceRecord(unlabelled); ok {
+		t.Error("got a record for an EndpointSlice without a Service")
+	}
+	fqdnSlice := testEndpointSlice("web-abc", "default", "web", discoveryv1.AddressTypeFQDN, testEndpoint{"web.example.com", nil})
+	if _, ok := endpointSliceRecord(fqdnSlice); ok {
+		t.Error("got a record for an EndpointSlice of FQDN addresses")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"net/netip"
+	"time"
+
+	"tailscale.com/util/dnsname"
+)
+
+// expiryHeap is a min-heap of the times at which records of the current
+// config expire, so that runRecordExpiry knows how long to sleep for.
+type expiryHeap []time.Time
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].Before(h[j]) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(time.Time)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// removeExpired deletes the records in hosts that expire at or before now
+// according to expiresAt and returns their names.
+func removeExpired(hosts map[dnsname.FQDN][]netip.Addr, expiresAt map[dnsname.FQDN]time.Time, now time.Time) []dnsname.FQDN {
+	var expired []dnsname.FQDN
+	for name, t := range expiresAt {
+		if _, ok := hosts[name]; ok && !t.After(now) {
+			delete(hosts, name)
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+// setExpiriesLocked makes the records in expiresAt that haven't expired by
+// now the ones that runRecordExpiry waits for. n.mu must be held.
+func (n *nameserver) setExpiriesLocked(expiresAt map[dnsname.FQDN]time.Time, now time.Time) {
+	n.expiresAt = make(map[dnsname.FQDN]time.Time, len(expiresAt))
+	n.expiries = n.expiries[:0]
+	for name, t := range expiresAt {
+		if t.After(now) {
+			n.expiresAt[name] = t
+			n.expiries = append(n.expiries, t)
+		}
+	}
+	heap.Init(&n.expiries)
+	select {
+	case n.expiriesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// runRecordExpiry updates the resolver config every time that a record of
+// the current config expires, so that it is no longer served, until ctx is
+// done. It is woken up by expiriesChanged whenever a new config is loaded.
+func (n *nameserver) runRecordExpiry(ctx context.Context, expiriesChanged <-chan struct{}) {
+	for {
+		var timer *time.Timer
+		var expired <-chan time.Time
+		n.mu.Lock()
+		if len(n.expiries) > 0 {
+			timer = time.NewTimer(time.Until(n.expiries[0]))
+			expired = timer.C
+		}
+		n.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-expiriesChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-expired:
+			// Drop the times that have passed even if the update
+			// fails, so that it isn't retried in a busy loop. The
+			// records are removed with the next config update.
+			n.mu.Lock()
+			now := time.Now()
+			for len(n.expiries) > 0 && !n.expiries[0].After(now) {
+				heap.Pop(&n.expiries)
+			}
+			n.mu.Unlock()
+			if err := n.updateResolverConfig(); err != nil {
+				n.logger.Errorf("error updating resolver config to remove expired records: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/tstest"
+)
+
+func TestNameserverRecordExpiry(t *testing.T) {
+	now := time.Now()
+	cfg, err := json.Marshal(&operatorutils.TSHosts{
+		Hosts: map[string][]string{
+			"expired.bar.ts.net.":  {"10.20.30.40"},
+			"expiring.bar.ts.net.": {"10.20.30.41"},
+			"later.bar.ts.net.":    {"10.20.30.42"},
+			"never.bar.ts.net.":    {"10.20.30.43"},
+		},
+		ExpiresAt: map[string]time.Time{
+			"expired.bar.ts.net.":  now.Add(-time.Minute),
+			"expiring.bar.ts.net.": now.Add(200 * time.Millisecond),
+			"later.bar.ts.net.":    now.Add(time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newTestNameserver(t, staticConfig(cfg))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := ns.Dump()
+	if _, ok := dump.Hosts["expired.bar.ts.net."]; ok {
+		t.Error("expired record is served")
+	}
+	if _, ok := dump.ExpiresAt["expired.bar.ts.net."]; ok {
+		t.Error("expired record is in the dumped expiresAt")
+	}
+	for _, name := range []string{"expiring.bar.ts.net.", "later.bar.ts.net.", "never.bar.ts.net."} {
+		if _, ok := dump.Hosts[name]; !ok {
+			t.Errorf("%s is not served before it expires", name)
+		}
+	}
+
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if _, ok := ns.Dump().Hosts["expiring.bar.ts.net."]; ok {
+			return fmt.Errorf("expiring.bar.ts.net. is still served")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	dump = ns.Dump()
+	for _, name := range []string{"later.bar.ts.net.", "never.bar.ts.net."} {
+		if _, ok := dump.Hosts[name]; !ok {
+			t.Errorf("%s is no longer served after another record expired", name)
+		}
+	}
+	if got, want := dump.ExpiresAt["later.bar.ts.net."], now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("got expiresAt %v for later.bar.ts.net., want %v", got, want)
+	}
+}
+
+func TestNameserverRecordExpiryMigrationCheck(t *testing.T) {
+	// A config whose only record expires doesn't trip the check for
+	// reloads that remove too many records.
+	cfg, err := json.Marshal(&operatorutils.TSHosts{
+		Hosts:     map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+		ExpiresAt: map[string]time.Time{"foo.bar.ts.net.": time.Now().Add(200 * time.Millisecond)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newTestNameserver(t, staticConfig(cfg))
+	ns.migrationChecker = MigrationChecker{Threshold: 0.5}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if _, ok := ns.Dump().Hosts["foo.bar.ts.net."]; ok {
+			return fmt.Errorf("foo.bar.ts.net. is still served")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := ns.reloadErrors(); errs != 0 {
+		t.Errorf("got %d reload errors, want 0", errs)
+	}
+}
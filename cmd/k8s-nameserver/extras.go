@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// responseExtras are the EDNS0 options and records that are added to every
+// response, for --response-extra-options and
+// --response-extra-additional-records-file.
+type responseExtras struct {
+	// options are added to the OPT record of responses to queries that
+	// have one.
+	options []dns.EDNS0
+	// records are appended to the additional section of all responses.
+	records []dns.RR
+}
+
+// parseResponseExtraOptions parses s, the hex encoding of EDNS0 options in
+// their wire format: a 2 byte option code, a 2 byte length and the option
+// data, repeated.
+// https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.2
+func parseResponseExtraOptions(s string) ([]dns.EDNS0, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EDNS0 options %q: %w", s, err)
+	}
+	var opts []dns.EDNS0
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("invalid EDNS0 options %q: truncated option header", s)
+		}
+		code, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < n {
+			return nil, fmt.Errorf("invalid EDNS0 options %q: option %d is %d bytes, but only %d are left", s, code, n, len(b))
+		}
+		opts = append(opts, &dns.EDNS0_LOCAL{Code: code, Data: b[:n:n]})
+		b = b[n:]
+	}
+	return opts, nil
+}
+
+// loadResponseExtraRecords returns the records in the zone file at path.
+// Names that aren't fully qualified are relative to the root, unless the
+// file sets $ORIGIN.
+func loadResponseExtraRecords(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zp := dns.NewZoneParser(f, ".", path)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// addResponseExtras returns resp with the options and records of extras
+// added. As with NSID, the options are only added if the query in payload
+// has an OPT record. The records are left out of UDP responses that they
+// would make larger than the payload size that the client supports, rather
+// than making the client retry over TCP.
+func addResponseExtras(payload, resp []byte, family string, extras *responseExtras) ([]byte, error) {
+	var req dns.Msg
+	if err := req.Unpack(payload); err != nil {
+		return resp, nil
+	}
+	var m dns.Msg
+	if err := m.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("error parsing response to add extra records to: %w", err)
+	}
+	reqOpt := req.IsEdns0()
+	if reqOpt != nil && len(extras.options) > 0 {
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt = m.IsEdns0()
+		}
+		opt.Option = append(opt.Option, extras.options...)
+	}
+	if len(extras.records) == 0 {
+		return m.Pack()
+	}
+	extra := m.Extra
+	m.Extra = append(slices.Clip(extra), extras.records...)
+	if family == "udp" {
+		maxSize := dns.MinMsgSize
+		if reqOpt != nil {
+			maxSize = int(max(reqOpt.UDPSize(), dns.MinMsgSize))
+		}
+		if m.Len() > maxSize {
+			m.Extra = extra
+		}
+	}
+	return m.Pack()
+}
@@ -0,0 +1,133 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseResponseExtraOptions(t *testing.T) {
+	opts, err := parseResponseExtraOptions("fde9000474657374fdea0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 2 || opts[0].Option() != 65001 || string(opts[0].(*dns.EDNS0_LOCAL).Data) != "test" || opts[1].Option() != 65002 {
+		t.Errorf("got options %v, want 65001 with data \"test\" and an empty 65002", opts)
+	}
+	for _, s := range []string{"zz", "fde9", "fde90004aa"} {
+		if _, err := parseResponseExtraOptions(s); err == nil {
+			t.Errorf("parseResponseExtraOptions(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestNameserverResponseExtras(t *testing.T) {
+	dir := t.TempDir()
+	zoneFile := filepath.Join(dir, "extra.zone")
+	if err := os.WriteFile(zoneFile, []byte("$ORIGIN bar.ts.net.\nextra 300 IN TXT \"operator extension\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Enough records for UDP responses to get larger than 512 bytes.
+	var big strings.Builder
+	for i := range 20 {
+		fmt.Fprintf(&big, "extra%d.bar.ts.net. 300 IN TXT \"%s\"\n", i, strings.Repeat("x", 20))
+	}
+	bigZoneFile := filepath.Join(dir, "big.zone")
+	if err := os.WriteFile(bigZoneFile, []byte(big.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := parseResponseExtraOptions("fde9000474657374")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		zoneFile    string
+		edns        bool
+		family      string
+		wantOption  bool
+		wantRecords int
+	}{
+		{"edns", zoneFile, true, "udp", true, 1},
+		{"no_edns", zoneFile, false, "udp", false, 1},
+		{"too_large_for_udp", bigZoneFile, false, "udp", false, 0},
+		{"large_edns_udp", bigZoneFile, true, "udp", true, 20},
+		{"tcp", bigZoneFile, false, "tcp", false, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrs, err := loadResponseExtraRecords(tt.zoneFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.responseExtras = &responseExtras{options: opts, records: rrs}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("foo.bar.ts.net.", dns.TypeA)
+			if tt.edns {
+				req.SetEdns0(4096, false)
+			}
+			b, err := req.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.queryFamily(ctx, b, tt.family, testSrc)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			var m dns.Msg
+			if err := m.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Answer) != 1 {
+				t.Errorf("got answers %v, want one", m.Answer)
+			}
+			var records int
+			for _, rr := range m.Extra {
+				if txt, ok := rr.(*dns.TXT); ok && strings.HasPrefix(txt.Hdr.Name, "extra") {
+					records++
+				}
+			}
+			if records != tt.wantRecords {
+				t.Errorf("got %d extra records, want %d", records, tt.wantRecords)
+			}
+			var gotOption bool
+			if opt := m.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if o, ok := o.(*dns.EDNS0_LOCAL); ok && o.Code == 65001 && string(o.Data) == "test" {
+						gotOption = true
+					}
+				}
+			}
+			if gotOption != tt.wantOption {
+				t.Errorf("got extra option: %v, want %v", gotOption, tt.wantOption)
+			}
+		})
+	}
+}
+
+func TestLoadResponseExtraRecordsError(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "bad.zone")
+	if err := os.WriteFile(zoneFile, []byte("extra.bar.ts.net. 300 IN BOGUS data\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadResponseExtraRecords(zoneFile); err == nil {
+		t.Error("loading an invalid zone file succeeded, want error")
+	}
+}
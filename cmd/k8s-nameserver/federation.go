@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+const (
+	// federationPriority is the priority of the records fetched from peer
+	// nameservers, below that of the local config, so that local records
+	// always win.
+	federationPriority = -1
+	// federationTimeout is the maximum time that fetching the config of a
+	// peer nameserver may take.
+	federationTimeout = 5 * time.Second
+	// maxPeerConfigSize is the maximum size of a peer nameserver config.
+	maxPeerConfigSize = 64 << 20
+)
+
+// parsePeers parses a comma-separated list of host:port addresses of the
+// HTTP servers of peer nameservers.
+func parsePeers(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var peers []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %w", p, err)
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// newFederatedConfigReader returns a configReaderFunc that merges the config
+// returned by local with the records served by each of peers, which are the
+// host:port addresses of the HTTP servers of other nameservers, for example
+// in other clusters. The peer records have a lower priority than the local
+// ones. Only the peers' own records are fetched, not those that they in turn
+// federate, so that nameservers may federate with each other without records
+// being passed back and forth after they are removed.
+func newFederatedConfigReader(logger *zap.SugaredLogger, local configReaderFunc, peers []string) configReaderFunc {
+	sources := []mergedConfigSource{{name: "local", read: local}}
+	client := &http.Client{Timeout: federationTimeout}
+	for _, peer := range peers {
+		r := &peerConfigReader{
+			logger: logger,
+			client: client,
+			url:    "http://" + peer + "/config?federated=false",
+		}
+		sources = append(sources, mergedConfigSource{
+			name:     "peer " + peer,
+			priority: federationPriority,
+			read:     r.read,
+		})
+	}
+	return newMergedConfigReader(logger, sources...)
+}
+
+// federatedNames returns the names in sourcePriority, the SourcePriority of
+// a merged config, whose records were fetched from peer nameservers.
+func federatedNames(sourcePriority map[string]int) set.Set[dnsname.FQDN] {
+	var names set.Set[dnsname.FQDN]
+	for name, priority := range sourcePriority {
+		if priority != federationPriority {
+			continue
+		}
+		if fqdn, err := dnsname.ToFQDN(name); err == nil {
+			mak.Set(&names, fqdn, struct{}{})
+		}
+	}
+	return names
+}
+
+// peerConfigReader reads the config served by a peer nameserver.
+type peerConfigReader struct {
+	logger *zap.SugaredLogger
+	client *http.Client
+	url    string
+
+	mu sync.Mutex
+	// last is the last config successfully fetched from the peer.
+	last []byte
+}
+
+// read fetches the peer's config. If that fails, it logs the error and
+// returns the last config that was successfully fetched, or none, so that
+// unavailable peers don't prevent the local config from being reloaded.
+func (r *peerConfigReader) read() ([]byte, error) {
+	b, err := r.fetch()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.logger.Warnf("error fetching federated config from %s, serving the last one fetched: %v", r.url, err)
+		return r.last, nil
+	}
+	r.last = b
+	return b, nil
+}
+
+func (r *peerConfigReader) fetch() ([]byte, error) {
+	resp, err := r.client.Get(r.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxPeerConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPeerConfigSize {
+		return nil, fmt.Errorf("config larger than %d bytes", maxPeerConfigSize)
+	}
+	// Invalid configs would fail the merge with the local one.
+	if err := json.Unmarshal(b, new(operatorutils.TSHosts)); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestNameserverFederation(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		peerStatus = http.StatusOK
+		peerConfig = `{"hosts":{"db.peer.ts.net.":["10.40.0.1"],"foo.bar.ts.net.":["10.40.0.2"]}}`
+	)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config" || r.URL.Query().Get("federated") != "false" {
+			t.Errorf("got request for %s, want /config?federated=false", r.URL)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(peerStatus)
+		w.Write([]byte(peerConfig))
+	}))
+	defer peer.Close()
+	peers, err := parsePeers(strings.TrimPrefix(peer.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := newTestNameserver(t, nil)
+	ns.configReader = newFederatedConfigReader(ns.logger, staticConfig(testHosts), peers)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	checkIPs := func(name, want string) {
+		t.Helper()
+		resp, err := ns.query(ctx, testQuery(t, name, dnsmessage.TypeA), testSrc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0].String() != want {
+			t.Errorf("%s: got IPs %v, want %s", name, ips, want)
+		}
+	}
+	checkIPs("db.peer.ts.net.", "10.40.0.1")
+	// Local records win over the peer's.
+	checkIPs("foo.bar.ts.net.", "10.20.30.40")
+
+	// Only the local records are served to other peers.
+	rec := httptest.NewRecorder()
+	ns.handleConfig(rec, httptest.NewRequest("GET", "/config?federated=false", nil))
+	var got operatorutils.TSHosts
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Hosts["db.peer.ts.net."]; ok || len(got.Hosts) != 2 {
+		t.Errorf("got local records %v, want those of the local config only", got.Hosts)
+	}
+
+	// The last config fetched from the peer is served while it is
+	// unavailable.
+	mu.Lock()
+	peerStatus, peerConfig = http.StatusInternalServerError, "unavailable"
+	mu.Unlock()
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	checkIPs("db.peer.ts.net.", "10.40.0.1")
+
+	mu.Lock()
+	peerStatus, peerConfig = http.StatusOK, `{"hosts":{"db.peer.ts.net.":["10.40.0.3"]}}`
+	mu.Unlock()
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	checkIPs("db.peer.ts.net.", "10.40.0.3")
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := parsePeers("ns.cluster-a.example.com:8080, 10.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[1] != "10.0.0.1:8080" {
+		t.Errorf("got peers %q, want 2", peers)
+	}
+	if _, err := parsePeers("ns.cluster-a.example.com"); err == nil {
+		t.Error("parsing a peer without a port succeeded")
+	}
+}
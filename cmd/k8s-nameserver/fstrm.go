@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// Frame Streams control frame types and fields.
+// https://farsightsec.github.io/fstrm/
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+
+	// fstrmMaxControlFrameSize is the largest control frame that is
+	// accepted from the receiver, as recommended by the Frame Streams
+	// specification.
+	fstrmMaxControlFrameSize = 512
+
+	// fstrmHandshakeTimeout is how long the receiver has to answer
+	// control frames.
+	fstrmHandshakeTimeout = 5 * time.Second
+)
+
+// frameStreamWriter writes data frames of a single content type to a
+// bidirectional Frame Streams connection, the framing protocol of dnstap.
+// There is no Go implementation of Frame Streams in the module, and the
+// subset that a writer needs is small.
+type frameStreamWriter struct {
+	conn        net.Conn
+	bw          *bufio.Writer
+	contentType string
+}
+
+// newFrameStreamWriter does the Frame Streams handshake for contentType on
+// conn and returns a writer for its data frames. It takes ownership of conn.
+func newFrameStreamWriter(conn net.Conn, contentType string) (*frameStreamWriter, error) {
+	w := &frameStreamWriter{conn: conn, bw: bufio.NewWriter(conn), contentType: contentType}
+	if err := w.handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("frame streams handshake: %w", err)
+	}
+	return w, nil
+}
+
+func (w *frameStreamWriter) handshake() error {
+	w.conn.SetDeadline(time.Now().Add(fstrmHandshakeTimeout))
+	defer w.conn.SetDeadline(time.Time{})
+	if err := w.writeControl(fstrmControlReady); err != nil {
+		return err
+	}
+	typ, contentTypes, err := readControlFrame(w.conn)
+	if err != nil {
+		return err
+	}
+	if typ != fstrmControlAccept {
+		return fmt.Errorf("got control frame type %d, want ACCEPT", typ)
+	}
+	// A receiver that accepts any content type may send none.
+	if len(contentTypes) > 0 && !slices.Contains(contentTypes, w.contentType) {
+		return fmt.Errorf("receiver doesn't accept content type %q, only %q", w.contentType, contentTypes)
+	}
+	return w.writeControl(fstrmControlStart)
+}
+
+// WriteFrame writes b as a data frame. Frames are buffered until Flush.
+func (w *frameStreamWriter) WriteFrame(b []byte) error {
+	if len(b) == 0 {
+		// A zero length is the escape sequence of control frames.
+		return nil
+	}
+	if _, err := w.bw.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b)))); err != nil {
+		return err
+	}
+	_, err := w.bw.Write(b)
+	return err
+}
+
+// Flush writes the buffered frames to the connection.
+func (w *frameStreamWriter) Flush() error {
+	return w.bw.Flush()
+}
+
+// Close ends the stream with a STOP frame, waits for the receiver to
+// confirm it with a FINISH frame and closes the connection.
+func (w *frameStreamWriter) Close() error {
+	defer w.conn.Close()
+	w.conn.SetDeadline(time.Now().Add(fstrmHandshakeTimeout))
+	if err := w.writeControl(fstrmControlStop); err != nil {
+		return err
+	}
+	typ, _, err := readControlFrame(w.conn)
+	if err != nil {
+		return err
+	}
+	if typ != fstrmControlFinish {
+		return fmt.Errorf("got control frame type %d, want FINISH", typ)
+	}
+	return nil
+}
+
+// writeControl writes and flushes a control frame of type typ. All but STOP
+// frames carry the content type.
+func (w *frameStreamWriter) writeControl(typ uint32) error {
+	var frame []byte
+	frame = binary.BigEndian.AppendUint32(frame, typ)
+	if typ != fstrmControlStop {
+		frame = binary.BigEndian.AppendUint32(frame, fstrmFieldContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(w.contentType)))
+		frame = append(frame, w.contentType...)
+	}
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 0) // escape
+	b = binary.BigEndian.AppendUint32(b, uint32(len(frame)))
+	b = append(b, frame...)
+	if _, err := w.bw.Write(b); err != nil {
+		return err
+	}
+	return w.bw.Flush()
+}
+
+// readControlFrame reads a control frame from r and returns its type and
+// content types.
+func readControlFrame(r io.Reader) (typ uint32, contentTypes []string, err error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if escape := binary.BigEndian.Uint32(hdr[:4]); escape != 0 {
+		return 0, nil, fmt.Errorf("got data frame, want control frame")
+	}
+	n := binary.BigEndian.Uint32(hdr[4:])
+	if n < 4 || n > fstrmMaxControlFrameSize {
+		return 0, nil, fmt.Errorf("invalid control frame length %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	typ, frame = binary.BigEndian.Uint32(frame), frame[4:]
+	for len(frame) > 0 {
+		if len(frame) < 8 {
+			return 0, nil, fmt.Errorf("truncated control frame field")
+		}
+		field, fn := binary.BigEndian.Uint32(frame), binary.BigEndian.Uint32(frame[4:])
+		frame = frame[8:]
+		if uint32(len(frame)) < fn {
+			return 0, nil, fmt.Errorf("truncated control frame field")
+		}
+		if field == fstrmFieldContentType {
+			contentTypes = append(contentTypes, string(frame[:fn]))
+		}
+		frame = frame[fn:]
+	}
+	return typ, contentTypes, nil
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/syncs"
+)
+
+// healthCheckDialTimeout is the maximum time that a single health check TCP
+// connection attempt may take before the IP address is considered unhealthy.
+const healthCheckDialTimeout = 3 * time.Second
+
+// runHealthChecks checks the health of all host IP addresses that have a
+// health check port configured every interval, until ctx is done.
+func (n *nameserver) runHealthChecks(ctx context.Context, interval time.Duration) {
+	n.logger.Infof("health checking hosts every %v", interval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n.checkHealth(ctx)
+		}
+	}
+}
+
+// checkHealth attempts a TCP connection to the health check port of each
+// host IP address and updates the resolver config if any addresses changed
+// between healthy and unhealthy. The loaded config is never modified, so
+// unhealthy addresses are served again as soon as they recover.
+func (n *nameserver) checkHealth(ctx context.Context) {
+	n.mu.Lock()
+	var targets []netip.AddrPort
+	for fqdn, port := range n.healthCheckPorts {
+		for _, ip := range n.hosts[fqdn] {
+			targets = append(targets, netip.AddrPortFrom(ip, port))
+		}
+	}
+	n.mu.Unlock()
+
+	var (
+		wg      syncs.WaitGroup
+		mu      sync.Mutex
+		changed bool
+	)
+	for _, ap := range targets {
+		wg.Go(func() {
+			err := dialHealthCheck(ctx, ap)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				if _, loaded := n.unhealthy.LoadOrStore(ap, time.Now()); !loaded {
+					n.logger.Infof("health check for %v failed, no longer serving it: %v", ap, err)
+					mu.Lock()
+					changed = true
+					mu.Unlock()
+				}
+				return
+			}
+			if since, loaded := n.unhealthy.LoadAndDelete(ap); loaded {
+				n.logger.Infof("health check for %v succeeded after failing for %v, serving it again", ap, time.Since(since).Round(time.Second))
+				mu.Lock()
+				changed = true
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	// Forget about addresses that are no longer in the config so that
+	// they are served if they get added back.
+	current := make(map[netip.AddrPort]bool, len(targets))
+	for _, ap := range targets {
+		current[ap] = true
+	}
+	var stale []netip.AddrPort
+	n.unhealthy.Range(func(ap netip.AddrPort, _ time.Time) bool {
+		if !current[ap] {
+			stale = append(stale, ap)
+		}
+		return true
+	})
+	for _, ap := range stale {
+		n.unhealthy.Delete(ap)
+	}
+
+	if !changed {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.setResolverConfigLocked(); err != nil {
+		n.logger.Errorf("error updating resolver config after health check: %v", err)
+	}
+}
+
+// dialHealthCheck reports whether a TCP connection to ap can be established.
+func dialHealthCheck(ctx context.Context, ap netip.AddrPort) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckDialTimeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", ap.String())
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestHealthCheck(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+
+	upPort := up.Addr().(*net.TCPAddr).Port
+	downPort := down.Addr().(*net.TCPAddr).Port
+	cfg := fmt.Sprintf(`{
+		"hosts": {
+			"up.bar.ts.net.": ["127.0.0.1"],
+			"down.bar.ts.net.": ["127.0.0.1"],
+			"unchecked.bar.ts.net.": ["127.0.0.1"]
+		},
+		"healthCheckPorts": {
+			"up.bar.ts.net.": %d,
+			"down.bar.ts.net.": %d
+		}
+	}`, upPort, downPort)
+
+	ns := newTestNameserver(t, staticConfig([]byte(cfg)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	loopback := netip.MustParseAddr("127.0.0.1")
+	check := func(name string, wantServed bool) {
+		t.Helper()
+		resp, err := ns.query(ctx, testQuery(t, name, dnsmessage.TypeA), testSrc)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		h, ips := answerIPs(t, resp)
+		if h.RCode != dnsmessage.RCodeSuccess {
+			t.Errorf("%s: got rcode %v, want %v", name, h.RCode, dnsmessage.RCodeSuccess)
+		}
+		served := len(ips) == 1 && ips[0] == loopback
+		if served != wantServed {
+			t.Errorf("%s: got IPs %v, want served=%v", name, ips, wantServed)
+		}
+	}
+
+	// Everything is served until the first health check.
+	check("up.bar.ts.net.", true)
+	check("down.bar.ts.net.", true)
+	check("unchecked.bar.ts.net.", true)
+
+	ns.checkHealth(ctx)
+	check("up.bar.ts.net.", true)
+	check("down.bar.ts.net.", false)
+	check("unchecked.bar.ts.net.", true)
+	if got := ns.Stats().RecordCount; got != 3 {
+		t.Errorf("got RecordCount %d, want 3; the loaded config should not change", got)
+	}
+
+	// The unhealthy host is served again once it recovers.
+	recovered, err := net.Listen("tcp", downAddr)
+	if err != nil {
+		t.Skipf("can't listen on %s again to test recovery: %v", downAddr, err)
+	}
+	defer recovered.Close()
+	ns.checkHealth(ctx)
+	check("up.bar.ts.net.", true)
+	check("down.bar.ts.net.", true)
+	check("unchecked.bar.ts.net.", true)
+}
@@ -0,0 +1,41 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+func TestNameserverHostsFormat(t *testing.T) {
+	cfg := []byte(`# migrated from CoreDNS
+10.20.30.40 foo.bar.ts.net
+fd7a:115c:a1e0::1 foo.bar.ts.net
+`)
+	ns := newTestNameserver(t, staticConfig(cfg))
+	ns.configFormat = nsconfig.FormatHosts
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	for typ, want := range map[dnsmessage.Type]netip.Addr{
+		dnsmessage.TypeA:    netip.MustParseAddr("10.20.30.40"),
+		dnsmessage.TypeAAAA: netip.MustParseAddr("fd7a:115c:a1e0::1"),
+	} {
+		resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", typ), testSrc)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != want {
+			t.Errorf("%v query: got IPs %v, want %v", typ, ips, want)
+		}
+	}
+}
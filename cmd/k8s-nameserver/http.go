@@ -0,0 +1,160 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	"tailscale.com/util/dnsname"
+)
+
+// RegisterHandlers registers the nameserver's HTTP endpoints on mux, so that
+// they can be served alongside other endpoints by an existing HTTP server.
+func (n *nameserver) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", n.handleHealthz)
+	mux.HandleFunc("/readyz", n.handleReadyz)
+	mux.HandleFunc("/stats", n.handleStats)
+	mux.HandleFunc("/reload", n.handleReload)
+	mux.HandleFunc("/config", n.handleConfig)
+	if n.metrics != nil {
+		mux.Handle("/metrics", n.metrics.handler())
+	}
+}
+
+// handleHealthz reports that the nameserver process is alive.
+func (n *nameserver) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the nameserver is ready to answer queries,
+// which is once it has successfully loaded a config with at least
+// n.minRecordCount host records and answered its startup queries, if any.
+// If the config has too few records, the reason is served as JSON.
+func (n *nameserver) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	st := n.Stats()
+	if st.LastReloadTime.IsZero() {
+		http.Error(w, "config not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	if n.minRecordCount > 0 && st.RecordCount < n.minRecordCount {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+			Have  int    `json:"have"`
+			Want  int    `json:"want"`
+		}{"insufficient records", st.RecordCount, n.minRecordCount}); err != nil {
+			n.logger.Errorf("error encoding readiness error: %v", err)
+		}
+		return
+	}
+	if err := n.checkStartupQueries(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleStats serves the nameserver's Stats as JSON.
+func (n *nameserver) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(n.Stats()); err != nil {
+		n.logger.Errorf("error encoding stats: %v", err)
+	}
+}
+
+// handleConfig serves the config that the nameserver is currently serving,
+// as returned by Dump, as JSON. With the federated=false query parameter,
+// records fetched from peer nameservers are left out, which is how peers
+// fetch the config for newFederatedConfigReader.
+func (n *nameserver) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dump := n.Dump()
+	if r.URL.Query().Get("federated") == "false" {
+		n.mu.Lock()
+		for fqdn := range n.federatedNames {
+			name := fqdn.WithTrailingDot()
+			delete(dump.Hosts, name)
+			delete(dump.ExternalRecords, name)
+			delete(dump.HealthCheckPorts, name)
+			delete(dump.ExpiresAt, name)
+		}
+		n.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dump); err != nil {
+		n.logger.Errorf("error encoding config: %v", err)
+	}
+}
+
+// handleReload reloads the nameserver config. It is the only way to pick up
+// config changes when file watching is disabled. If the config is invalid,
+// all of its errors are served as a JSON array of nsconfig.Error. Otherwise the response includes the
+// result of a TestProbe of the name in the probe query parameter, or of the
+// first host record if there is none, to show that the new config resolves.
+func (n *nameserver) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := n.updateResolverConfig(); err != nil {
+		n.logger.Errorf("error reloading config: %v", err)
+		var cfgErr *nsconfig.Error
+		if !errors.As(err, &cfgErr) {
+			http.Error(w, fmt.Sprintf("error reloading config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		if err := json.NewEncoder(w).Encode(nsconfig.Errors(err)); err != nil {
+			n.logger.Errorf("error encoding config error: %v", err)
+		}
+		return
+	}
+	fmt.Fprintf(w, "config reloaded, serving %d host records\n", n.Stats().RecordCount)
+	name := r.URL.Query().Get("probe")
+	if name == "" {
+		name = n.firstHostName()
+	}
+	if name == "" {
+		return
+	}
+	fqdn, err := dnsname.ToFQDN(name)
+	if err != nil {
+		fmt.Fprintf(w, "invalid probe name %q: %v\n", name, err)
+		return
+	}
+	if ips, err := n.TestProbe(fqdn); err != nil {
+		fmt.Fprintf(w, "probe: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "probe: %s resolves to %v\n", fqdn.WithTrailingDot(), ips)
+	}
+}
+
+// firstHostName returns the alphabetically first name of the host records
+// being served, or "" if there are none.
+func (n *nameserver) firstHostName() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var first dnsname.FQDN
+	for fqdn := range n.hosts {
+		if first == "" || fqdn < first {
+			first = fqdn
+		}
+	}
+	return first.WithTrailingDot()
+}
@@ -0,0 +1,315 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestNoFileWatchReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	cfg := testHosts
+	ns := newTestNameserver(t, func() ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return cfg, nil
+	})
+	// The directory does not exist, so setting up a file watcher for it
+	// would fail.
+	watcher, err := watchConfig(ctx, filepath.Join(t.TempDir(), "missing"), defaultDNSFile, true, ns.logger)
+	if err != nil {
+		t.Fatalf("watchConfig: %v", err)
+	}
+	if watcher != nil {
+		t.Fatal("watchConfig returned a watcher with file watching disabled")
+	}
+	ns.configWatcher = watcher
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	cfg = []byte(`{"hosts":{"new.bar.ts.net.":["10.20.30.60"]}}`)
+	mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	ns.handleReload(rec, httptest.NewRequest("GET", "/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /reload: got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	rec = httptest.NewRecorder()
+	ns.handleReload(rec, httptest.NewRequest("POST", "/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /reload: got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if want := "probe: new.bar.ts.net. resolves to [10.20.30.60]"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("POST /reload: got body %q, want it to contain %q", rec.Body, want)
+	}
+	rec = httptest.NewRecorder()
+	ns.handleReload(rec, httptest.NewRequest("POST", "/reload?probe=gone.bar.ts.net", nil))
+	if want := "probe: error resolving gone.bar.ts.net. TypeA: got rcode RCodeNameError"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("POST /reload?probe=gone.bar.ts.net: got body %q, want it to contain %q", rec.Body, want)
+	}
+	resp, err := ns.query(ctx, testQuery(t, "new.bar.ts.net.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0].String() != "10.20.30.60" {
+		t.Errorf("got IPs %v after reload, want [10.20.30.60]", ips)
+	}
+
+	mu.Lock()
+	cfg = []byte(`{"hosts":{"new.bar.ts.net.":["not-an-ip"]}}`)
+	mu.Unlock()
+	rec = httptest.NewRecorder()
+	ns.handleReload(rec, httptest.NewRequest("POST", "/reload", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("POST /reload with invalid config: got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	var cfgErrs []struct {
+		Field, Value, Error string
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&cfgErrs); err != nil {
+		t.Fatalf("decoding POST /reload errors: %v", err)
+	}
+	if len(cfgErrs) != 1 || cfgErrs[0].Field != `hosts["new.bar.ts.net."][0]` || cfgErrs[0].Value != "not-an-ip" || cfgErrs[0].Error == "" {
+		t.Errorf("POST /reload with invalid config: got errors %+v, want the invalid IP address", cfgErrs)
+	}
+
+	mu.Lock()
+	cfg = []byte(`{"hosts":{"new.bar.ts.net.":["not-an-ip"],"other.bar.ts.net.":["10.20.30.60","also-not-an-ip"]}}`)
+	mu.Unlock()
+	rec = httptest.NewRecorder()
+	ns.handleReload(rec, httptest.NewRequest("POST", "/reload", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("POST /reload with two invalid fields: got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	cfgErrs = nil
+	if err := json.NewDecoder(rec.Body).Decode(&cfgErrs); err != nil {
+		t.Fatalf("decoding POST /reload errors: %v", err)
+	}
+	gotFields := make(map[string]string)
+	for _, e := range cfgErrs {
+		gotFields[e.Field] = e.Value
+	}
+	wantFields := map[string]string{
+		`hosts["new.bar.ts.net."][0]`:   "not-an-ip",
+		`hosts["other.bar.ts.net."][1]`: "also-not-an-ip",
+	}
+	if len(cfgErrs) != len(wantFields) || !reflect.DeepEqual(gotFields, wantFields) {
+		t.Errorf("POST /reload with two invalid fields: got errors %+v, want both invalid IP addresses", cfgErrs)
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	cfg := []byte(`{
+		"hosts": {"foo.bar.ts.net.": ["10.20.30.40", "fd7a:115c:a1e0::1"]},
+		"healthCheckPorts": {"foo.bar.ts.net.": 80},
+		"rpz": [{"name": "blocked.bar.ts.net.", "action": "NXDOMAIN"}]
+	}`)
+	ns := newTestNameserver(t, func() ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return cfg, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	getConfig := func() *operatorutils.TSHosts {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ns.handleConfig(rec, httptest.NewRequest("GET", "/config", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /config: got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+		}
+		got := new(operatorutils.TSHosts)
+		if err := json.Unmarshal(rec.Body.Bytes(), got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	want := &operatorutils.TSHosts{
+		SchemaVersion:    nsconfig.SupportedSchemaVersion,
+		Hosts:            map[string][]string{"foo.bar.ts.net.": {"10.20.30.40", "fd7a:115c:a1e0::1"}},
+		HealthCheckPorts: map[string]uint16{"foo.bar.ts.net.": 80},
+		RPZ:              []operatorutils.RPZRule{{Name: "blocked.bar.ts.net.", Action: "NXDOMAIN"}},
+	}
+	if got := getConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got config %+v, want %+v", got, want)
+	}
+
+	mu.Lock()
+	cfg = []byte(`{"hosts":{"new.bar.ts.net.":["10.20.30.60"]}}`)
+	mu.Unlock()
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	want = &operatorutils.TSHosts{
+		SchemaVersion: nsconfig.SupportedSchemaVersion,
+		Hosts:         map[string][]string{"new.bar.ts.net.": {"10.20.30.60"}},
+	}
+	if got := getConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reload: got config %+v, want %+v", got, want)
+	}
+}
+
+func TestReadyzMinRecordCount(t *testing.T) {
+	// testHosts has 2 host records.
+	for _, tt := range []struct {
+		name      string
+		hosts     []byte
+		min       int
+		wantReady bool
+		wantHave  int
+	}{
+		{name: "zero_records", hosts: []byte(`{"hosts":{}}`), min: 1, wantHave: 0},
+		{name: "below_threshold", hosts: testHosts, min: 3, wantHave: 2},
+		{name: "at_threshold", hosts: testHosts, min: 2, wantReady: true},
+		{name: "disabled", hosts: []byte(`{"hosts":{}}`), wantReady: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(tt.hosts))
+			ns.minRecordCount = tt.min
+			if err := ns.updateResolverConfig(); err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			ns.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if tt.wantReady {
+				if rec.Code != http.StatusOK {
+					t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid response %q: %v", rec.Body, err)
+			}
+			want := map[string]any{"error": "insufficient records", "have": float64(tt.wantHave), "want": float64(tt.min)}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got response %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadyzStartupQuery(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		queries   string
+		block     bool
+		wantReady bool
+		wantErr   string
+	}{
+		{name: "answered", queries: "foo.bar.ts.net,A,baz.bar.ts.net,AAAA", wantReady: true},
+		{name: "default_type", queries: "foo.bar.ts.net", wantReady: true},
+		{name: "not_found", queries: "foo.bar.ts.net,missing.bar.ts.net", wantErr: "startup query missing.bar.ts.net. A: got rcode RCodeNameError"},
+		{name: "no_records", queries: "foo.bar.ts.net,AAAA", wantErr: "startup query foo.bar.ts.net. AAAA: no records"},
+		{name: "timeout", queries: "foo.bar.ts.net", block: true, wantErr: "startup query foo.bar.ts.net. A not answered within 50ms"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			var err error
+			if ns.startupQueries, err = parseStartupQueries(tt.queries); err != nil {
+				t.Fatal(err)
+			}
+			ns.startupQueryTimeout = 50 * time.Millisecond
+			if err := ns.updateResolverConfig(); err != nil {
+				t.Fatal(err)
+			}
+			release := make(chan struct{})
+			defer close(release)
+			if tt.block {
+				ns.res = &blockingResolver{dnsResolver: ns.res, release: release}
+			}
+			rec := httptest.NewRecorder()
+			ns.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if !tt.wantReady {
+				if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), tt.wantErr) {
+					t.Errorf("got status %d: %q, want %d: %q", rec.Code, rec.Body, http.StatusServiceUnavailable, tt.wantErr)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			// Once the startup queries have been answered, they aren't
+			// queried again.
+			ns.res = &blockingResolver{dnsResolver: ns.res, release: release}
+			rec = httptest.NewRecorder()
+			ns.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("after startup queries were answered: got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRegisterHandlers(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+	mux := http.NewServeMux()
+	ns.RegisterHandlers(mux)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	// The nameserver is alive, but not ready until it has loaded its
+	// config.
+	if rec := serve("GET", "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz before config load: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := serve("GET", "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz before config load: got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/healthz"},
+		{"GET", "/readyz"},
+		{"GET", "/stats"},
+		{"GET", "/config"},
+		{"GET", "/metrics"},
+		{"POST", "/reload"},
+	} {
+		if rec := serve(tt.method, tt.path); rec.Code != http.StatusOK {
+			t.Errorf("%s %s: got status %d, want %d: %s", tt.method, tt.path, rec.Code, http.StatusOK, rec.Body)
+		}
+	}
+}
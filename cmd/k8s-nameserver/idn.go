@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+// encodeIDNQuery returns the DNS query in payload with the queried name
+// Punycode encoded, and the original name, if the name isn't ASCII. Such
+// queries are sent by clients that don't encode names themselves, which
+// aren't found otherwise, because names in the config are encoded.
+func encodeIDNQuery(payload []byte) ([]byte, dnsmessage.Name, bool) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(payload); err != nil || len(msg.Questions) != 1 {
+		return nil, dnsmessage.Name{}, false
+	}
+	q := msg.Questions[0]
+	ascii, err := nsconfig.ToASCIIName(q.Name.String())
+	if err != nil || ascii == q.Name.String() {
+		return nil, dnsmessage.Name{}, false
+	}
+	encoded, err := dnsmessage.NewName(ascii)
+	if err != nil {
+		return nil, dnsmessage.Name{}, false
+	}
+	msg.Questions[0].Name = encoded
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, dnsmessage.Name{}, false
+	}
+	return b, q.Name, true
+}
+
+// restoreIDNName returns resp, the response to a query encoded by
+// encodeIDNQuery, with the encoded name in the question and answers replaced
+// by name, the name that the client queried for, so that it recognizes the
+// response. Signatures of DNSSEC signed responses are over the encoded name.
+func restoreIDNName(resp []byte, name dnsmessage.Name) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || len(msg.Questions) != 1 {
+		return resp, nil
+	}
+	encoded := msg.Questions[0].Name
+	msg.Questions[0].Name = name
+	for i := range msg.Answers {
+		if strings.EqualFold(msg.Answers[i].Header.Name.String(), encoded.String()) {
+			msg.Answers[i].Header.Name = name
+		}
+	}
+	return msg.Pack()
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNameserverIDN(t *testing.T) {
+	cfg := []byte(`{
+		"hosts": {
+			"münchen.bar.ts.net.": ["10.20.30.40"],
+			"foo.bar.ts.net.": ["10.20.30.41"]
+		}
+	}`)
+	tests := []struct {
+		name      string
+		enableIDN bool
+		query     string
+		wantIPs   string
+		wantRCode dnsmessage.RCode
+	}{
+		{"unicode", true, "münchen.bar.ts.net.", "[10.20.30.40]", dnsmessage.RCodeSuccess},
+		{"punycode", true, "xn--mnchen-3ya.bar.ts.net.", "[10.20.30.40]", dnsmessage.RCodeSuccess},
+		{"mapped", true, "MÜNCHEN.bar.ts.net.", "[10.20.30.40]", dnsmessage.RCodeSuccess},
+		{"ascii", true, "foo.bar.ts.net.", "[10.20.30.41]", dnsmessage.RCodeSuccess},
+		// Without --enable-idn, names are served as they are in the
+		// config.
+		{"disabled_unicode", false, "münchen.bar.ts.net.", "[10.20.30.40]", dnsmessage.RCodeSuccess},
+		{"disabled_punycode", false, "xn--mnchen-3ya.bar.ts.net.", "[]", dnsmessage.RCodeNameError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(cfg))
+			ns.enableIDN = tt.enableIDN
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, tt.query, dnsmessage.TypeA), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, ips := answerIPs(t, resp)
+			if h.RCode != tt.wantRCode || fmt.Sprint(ips) != tt.wantIPs {
+				t.Errorf("got rcode %v and IPs %v, want %v and %s", h.RCode, ips, tt.wantRCode, tt.wantIPs)
+			}
+			// The response is for the name that was queried.
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != tt.query {
+				t.Errorf("got questions %v, want %s", msg.Questions, tt.query)
+			}
+			for _, rr := range msg.Answers {
+				if rr.Header.Name.String() != tt.query {
+					t.Errorf("got answer for %s, want %s", rr.Header.Name, tt.query)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"tailscale.com/util/dnsname"
+)
+
+// interfaceAddrsFunc returns the IP addresses of the network interface with
+// the given name.
+type interfaceAddrsFunc func(name string) ([]netip.Addr, error)
+
+// systemInterfaceAddrs is the interfaceAddrsFunc that returns the addresses
+// of the interface as reported by the OS.
+func systemInterfaceAddrs(name string) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips, nil
+}
+
+// runInterfaceAddressSync serves the addresses of the network interface
+// iface, such as tailscale0 when running alongside tailscaled, as host
+// records for name, checking for changes every interval until ctx is done.
+func (n *nameserver) runInterfaceAddressSync(ctx context.Context, iface string, name dnsname.FQDN, interval time.Duration) {
+	n.logger.Infof("serving the addresses of %s as %s, checking for changes every %v", iface, name.WithTrailingDot(), interval)
+	n.syncInterfaceAddrs(iface, name)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n.syncInterfaceAddrs(iface, name)
+		}
+	}
+}
+
+// syncInterfaceAddrs updates the synced host records for name to the
+// current addresses of iface, and the resolver config if they changed.
+// Loopback and link-local addresses are left out, as they are not reachable
+// from other nodes. If the addresses can't be read, the previous ones keep
+// being served.
+func (n *nameserver) syncInterfaceAddrs(iface string, name dnsname.FQDN) {
+	all, err := n.interfaceAddrs(iface)
+	if err != nil {
+		n.logger.Warnf("error reading the addresses of %s: %v", iface, err)
+		return
+	}
+	var ips []netip.Addr
+	for _, ip := range all {
+		if !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			ips = append(ips, ip)
+		}
+	}
+	slices.SortFunc(ips, netip.Addr.Compare)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if slices.Equal(ips, n.syncedHosts[name]) {
+		return
+	}
+	n.logger.Infof("addresses of %s changed to %v, updating records for %s", iface, ips, name.WithTrailingDot())
+	if len(ips) == 0 {
+		delete(n.syncedHosts, name)
+	} else {
+		n.syncedHosts = map[dnsname.FQDN][]netip.Addr{name: ips}
+	}
+	if err := n.setResolverConfigLocked(); err != nil {
+		n.logger.Errorf("error updating resolver config after interface address change: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNameserverInterfaceAddressSync(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	var (
+		addrs []netip.Addr
+		err   error
+	)
+	ns.interfaceAddrs = func(name string) ([]netip.Addr, error) {
+		if name != "tailscale0" {
+			t.Errorf("got addresses of interface %q, want tailscale0", name)
+		}
+		return addrs, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	assertIPs := func(name string, typ dnsmessage.Type, want ...string) {
+		t.Helper()
+		resp, err := ns.query(ctx, testQuery(t, name, typ), testSrc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ips := answerIPs(t, resp)
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v IPs %v for %s, want %v", typ, got, name, want)
+		}
+	}
+
+	addrs = []netip.Addr{
+		netip.MustParseAddr("100.64.0.5"),
+		netip.MustParseAddr("fd7a:115c:a1e0::5"),
+		netip.MustParseAddr("fe80::1"),
+		netip.MustParseAddr("127.0.0.1"),
+	}
+	ns.syncInterfaceAddrs("tailscale0", "nameserver.bar.ts.net.")
+	assertIPs("nameserver.bar.ts.net.", dnsmessage.TypeA, "100.64.0.5")
+	assertIPs("nameserver.bar.ts.net.", dnsmessage.TypeAAAA, "fd7a:115c:a1e0::5")
+	// The records from the config are still served.
+	assertIPs("foo.bar.ts.net.", dnsmessage.TypeA, "10.20.30.40")
+
+	// Addresses that can't be read keep being served.
+	addrs, err = nil, errors.New("no such interface")
+	ns.syncInterfaceAddrs("tailscale0", "nameserver.bar.ts.net.")
+	assertIPs("nameserver.bar.ts.net.", dnsmessage.TypeA, "100.64.0.5")
+
+	// Synced addresses are merged into existing records, and follow
+	// changes to the interface.
+	addrs, err = []netip.Addr{netip.MustParseAddr("fd7a:115c:a1e0::6")}, nil
+	ns.syncInterfaceAddrs("tailscale0", "foo.bar.ts.net.")
+	assertIPs("foo.bar.ts.net.", dnsmessage.TypeA, "10.20.30.40")
+	assertIPs("foo.bar.ts.net.", dnsmessage.TypeAAAA, "fd7a:115c:a1e0::6")
+	assertIPs("nameserver.bar.ts.net.", dnsmessage.TypeA)
+	if got := ns.Dump().Hosts["foo.bar.ts.net."]; !slices.Equal(got, []string{"10.20.30.40", "fd7a:115c:a1e0::6"}) {
+		t.Errorf("got dumped records %v for foo.bar.ts.net., want [10.20.30.40 fd7a:115c:a1e0::6]", got)
+	}
+
+	// Reloading the config keeps the synced addresses.
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	assertIPs("foo.bar.ts.net.", dnsmessage.TypeAAAA, "fd7a:115c:a1e0::6")
+}
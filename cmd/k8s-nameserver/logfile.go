@@ -0,0 +1,169 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// backupTimeFormat is the format of the timestamp that is appended to the
+// names of rotated log files. It sorts lexically in time order.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// newLogger returns the nameserver logger. If w is nil, it logs to stderr.
+// Otherwise it logs to w, and also to stderr if alsoToStderr is set.
+func newLogger(w *rotatingFile, alsoToStderr bool) (*zap.SugaredLogger, error) {
+	if w == nil {
+		l, err := zap.NewProduction()
+		if err != nil {
+			return nil, err
+		}
+		return l.Sugar(), nil
+	}
+	ws := zapcore.AddSync(w)
+	if alsoToStderr {
+		ws = zapcore.NewMultiWriteSyncer(ws, zapcore.Lock(os.Stderr))
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), ws, zap.InfoLevel)
+	return zap.New(core, zap.AddCaller()).Sugar(), nil
+}
+
+// rotatingFile is an io.Writer that writes to a file and rotates it once it
+// would grow beyond maxSize bytes. Rotated files are renamed to the file's
+// path followed by a timestamp.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	// maxBackups is the number of rotated files to keep. If zero, all are
+	// kept.
+	maxBackups int
+	// maxAge is how long to keep rotated files for. If zero, they are kept
+	// regardless of age.
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex // protects following
+	f    *os.File
+	size int64
+}
+
+// newRotatingFile opens or creates the log file at path.
+func newRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid maximum log file size %d", maxSize)
+	}
+	w := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+		now:        time.Now,
+	}
+	if err := w.openLocked(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write implements io.Writer.
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Sync flushes the log file to disk.
+func (w *rotatingFile) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Sync()
+}
+
+// Close closes the log file.
+func (w *rotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+func (w *rotatingFile) openLocked() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+// rotateLocked moves the current log file aside, starts a new one and
+// removes backups that should no longer be kept. w.mu must be held.
+func (w *rotatingFile) rotateLocked() error {
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("error closing log file: %w", err)
+	}
+	ts := w.now().UTC().Format(backupTimeFormat)
+	backup := w.path + "." + ts
+	// Don't overwrite a backup from a rotation within the same millisecond.
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s-%d", w.path, ts, i)
+	}
+	if err := os.Rename(w.path, backup); err != nil {
+		return fmt.Errorf("error rotating log file: %w", err)
+	}
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+	// Failing to remove old backups shouldn't stop logging.
+	w.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups removes the rotated log files beyond the newest
+// maxBackups and those older than maxAge.
+func (w *rotatingFile) removeOldBackups() {
+	backups, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return
+	}
+	// Newest first.
+	slices.Sort(backups)
+	slices.Reverse(backups)
+	cutoff := w.now().Add(-w.maxAge)
+	for i, b := range backups {
+		remove := w.maxBackups > 0 && i >= w.maxBackups
+		if !remove && w.maxAge > 0 {
+			if fi, err := os.Stat(b); err == nil && fi.ModTime().Before(cutoff) {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(b)
+		}
+	}
+}
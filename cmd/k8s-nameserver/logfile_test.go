@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nameserver.log")
+	w, err := newRotatingFile(path, 1<<10, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	logger, err := newLogger(w, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		logger.Infof("log entry %d", i)
+	}
+	if err := logger.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 1<<10 {
+		t.Errorf("log file is %d bytes, want at most %d", fi.Size(), 1<<10)
+	}
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("got backups %v, want 2", backups)
+	}
+	cur, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(cur), "log entry 99") {
+		t.Errorf("log file does not contain the last entry:\n%s", cur)
+	}
+}
+
+func TestLogRotationMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nameserver.log")
+	old := path + ".2020-01-01T00-00-00.000"
+	if err := os.WriteFile(old, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newRotatingFile(path, 8, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for range 2 {
+		if _, err := w.Write([]byte("0123456\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("backup older than max age was not removed: %v", err)
+	}
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Errorf("got backups %v, want 1", backups)
+	}
+}
@@ -0,0 +1,1801 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+// k8s-nameserver is a simple nameserver implementation meant to be used with
+// k8s-operator to allow to resolve magicDNS names associated with tailnet
+// proxies in cluster.
+//
+// The nameserver config is read from a mounted ConfigMap by default. With
+// --config-source=secret it is read from a Secret mounted at /secret
+// instead, for clusters where the host records are considered sensitive,
+// i.e. because they reveal the internal network topology. kubelet updates
+// mounted Secrets the same way as ConfigMaps, so changes to the Secret are
+// picked up without a restart:
+//
+//	volumes:
+//	- name: dns-config
+//	  secret:
+//	    secretName: nameserver-config
+//	    defaultMode: 0400
+//	containers:
+//	- name: nameserver
+//	  args: ["--config-source=secret"]
+//	  volumeMounts:
+//	  - name: dns-config
+//	    mountPath: /secret
+//	    readOnly: true
+//
+// Configs can be checked before they are deployed, for example in CI, with
+// dns-config-lint, which validates them with the same code as the nameserver.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/syncs"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/set"
+	"tailscale.com/util/singleflight"
+	"tailscale.com/version"
+)
+
+const (
+	// The following constants are specific to the nameserver configuration
+	// provided by a mounted Kubernetes ConfigMap or Secret.
+	defaultDNSConfigDir    = "/config"
+	defaultDNSSecretDir    = "/secret"
+	defaultDNSFile         = "dns.json"
+	kubeletMountedConfigLn = "..data"
+
+	// Supported values of the --config-source flag.
+	configSourceConfigMap = "configmap"
+	configSourceSecret    = "secret"
+
+	// udpEndpoint and tcpEndpoint are the addresses on which the
+	// nameserver listens for DNS queries.
+	udpEndpoint = ":1053"
+	tcpEndpoint = ":1053"
+)
+
+var (
+	httpAddr                     = flag.String("http-addr", ":8080", "address on which to serve the debug HTTP endpoints")
+	strictConfig                 = flag.Bool("strict-config", false, "reject JSON configs that contain unknown fields, unless they were written for a newer schema version")
+	dnssecKey                    = flag.String("dnssec-key", "", "if set, path to a PKCS#8 PEM encoded RSA or ECDSA private key to DNSSEC sign ts.net responses with")
+	healthCheckInterval          = flag.Duration("health-check-interval", 0, "if non-zero, how often to check that host IPs with a configured health check port accept TCP connections; IPs that don't are not served until they do")
+	disableRecursion             = flag.Bool("disable-recursion", false, "never forward queries upstream, refuse queries for names outside of the local domains and unset the RA bit in all responses")
+	listenIPv6Only               = flag.Bool("listen-ipv6-only", false, "listen for DNS queries on [::]:1053 only, for IPv6-only clusters")
+	noFileWatch                  = flag.Bool("no-file-watch", false, "do not watch the mounted ConfigMap for changes, for environments without inotify support; the config can still be reloaded via POST /reload")
+	notifySlaves                 = flag.String("notify-slaves", "", "comma-separated list of IP:port addresses of secondary nameservers to send a DNS NOTIFY for the ts.net zone to whenever the config changes")
+	ipv4Disabled                 = flag.Bool("ipv4-disabled", false, "never serve A records for the configured hosts, for IPv6-only clusters; A queries for them are answered with an empty response")
+	configFormat                 = flag.String("config-format", nsconfig.FormatJSON, "format of the nameserver config: \"json\" for the format written by the operator, \"yaml\" or \"cbor\" for the same schema in YAML or CBOR, \"hosts\" for /etc/hosts format, or \"auto\" to pick JSON, YAML or CBOR based on the file extension of --config-key. JSON configs that start with a CBOR map are decoded as CBOR")
+	prometheusNamespace          = flag.String("prometheus-namespace", defaultPrometheusNamespace, "prefix of the names of the Prometheus metrics served at /metrics")
+	logFile                      = flag.String("log-file", "", "if set, path of a file to write logs to instead of stderr")
+	logMaxSize                   = flag.Int("log-max-size", 100, "maximum size in megabytes of the log file before it gets rotated")
+	logMaxBackups                = flag.Int("log-max-backups", 0, "maximum number of rotated log files to keep, or 0 to keep all")
+	logMaxAge                    = flag.Duration("log-max-age", 0, "maximum age of rotated log files to keep, or 0 to keep them regardless of age")
+	alsoLogToStderr              = flag.Bool("alsologtostderr", false, "with --log-file, also write logs to stderr")
+	configKey                    = flag.String("config-key", defaultDNSFile, "key of the nameserver config in the mounted ConfigMap")
+	tcpIdleTimeout               = flag.Duration("tcp-idle-timeout", defaultTCPIdleTimeout, "how long a DNS over TCP connection may be idle before it is closed")
+	maxConcurrentQueries         = flag.Int("max-concurrent-queries", 1000, "maximum number of DNS queries that are answered concurrently, or 0 for no limit")
+	queueTimeout                 = flag.Duration("queue-timeout", 100*time.Millisecond, "with --max-concurrent-queries, how long a query may wait to be answered before it gets a SERVFAIL response")
+	allowExternalRecords         = flag.Bool("allow-external-records", false, "serve the external records in the config, for names outside of ts.net; queries for other names outside of ts.net are still forwarded")
+	enableNSID                   = flag.Bool("enable-nsid", false, "add an EDNS0 NSID option with the pod name, from the POD_NAME environment variable or the hostname, to responses to EDNS0 queries")
+	configReloadMaxErrors        = flag.Int("config-reload-max-errors", 10, "number of consecutive failed config reloads after which the nameserver exits; the last good config is served until then")
+	startupTimeout               = flag.Duration("startup-timeout", 30*time.Second, "maximum time to wait for the initial config load at startup; 0 means wait forever")
+	requireConfig                = flag.Bool("require-config", true, "exit if the initial config load does not complete within --startup-timeout; if false, serve no records until it does")
+	axfrAllowFrom                = flag.String("axfr-allow-from", "", "comma-separated list of CIDRs of clients that may request zone transfers (AXFR) over TCP; other AXFR queries are refused")
+	bindInterface                = flag.String("bind-interface", "", "if set, name of the network interface, i.e. \"tailscale0\", to only serve DNS queries on")
+	listenFD                     = flag.Int("listen-fd", -1, "if set, file descriptor of a pre-bound UDP socket to serve DNS queries on instead of creating one, for socket activation; sockets passed with systemd's LISTEN_FDS are used automatically")
+	workerCount                  = flag.Int("worker-count", 1, "number of goroutines reading DNS queries from the UDP socket; with --reuse-port, number of UDP sockets bound to the same port instead, each with one goroutine")
+	reusePort                    = flag.Bool("reuse-port", false, "set SO_REUSEPORT on the UDP socket, so that --worker-count sockets can be bound to the same port and the kernel distributes queries between them")
+	prioritySources              = flag.String("priority-sources", "", "comma-separated list of CIDRs whose queries bypass the --max-concurrent-queries limit, i.e. health checks from the control plane; they are answered by a separate pool of --priority-max-concurrent-queries")
+	priorityMaxConcurrent        = flag.Int("priority-max-concurrent-queries", 100, "maximum number of queries from --priority-sources that are answered concurrently; further queries from them get a SERVFAIL response right away")
+	configSource                 = flag.String("config-source", configSourceConfigMap, "where the nameserver config is mounted from: \"configmap\" for a ConfigMap mounted at /config, or \"secret\" for a Secret mounted at /secret, for clusters where the host records are considered sensitive")
+	logQueriesToFile             = flag.String("log-queries-to-file", "", "if set, path of a file to append a log of all DNS queries to, rotated with the --log-max-* settings")
+	queryLogFormat               = flag.String("query-log-format", queryLogFormatJSON, "format of the --log-queries-to-file entries, either \"json\" for one JSON object per line or \"csv\" for time,source,protocol,name,type,rcode,latency_ms,error records")
+	corednsCompatible            = flag.Bool("coredns-compatible", false, "read the nameserver config from a CoreDNS Corefile, at the \"Corefile\" key unless --config-key is set, and serve the records of its hosts plugins")
+	refuseAny                    = flag.Bool("refuse-any", true, "answer queries for QTYPE ANY with REFUSED instead of resolving them, as they are commonly abused for DNS amplification")
+	dnsRebindProtection          = flag.Bool("dns-rebind-protection", true, "answer queries for names outside of the local domains with SERVFAIL if the forwarded response contains private, loopback, link-local or Tailscale IP addresses")
+	minRecordCount               = flag.Int("min-record-count", 0, "if positive, /readyz fails while the loaded config has fewer host records than this, to catch partially written or truncated configs")
+	interfaceAddressSync         = flag.String("interface-address-sync", "", "if set, name of a network interface, i.e. \"tailscale0\" when running alongside tailscaled, whose addresses to serve as host records for --interface-address-sync-name in addition to the records from the config")
+	interfaceAddressSyncName     = flag.String("interface-address-sync-name", "", "with --interface-address-sync, the DNS name to serve the interface addresses as, i.e. the MagicDNS name of the pod")
+	interfaceAddressSyncInterval = flag.Duration("interface-address-sync-interval", 30*time.Second, "with --interface-address-sync, how often to check the interface addresses for changes")
+	dotListen                    = flag.String("dot-listen", "", "if set, address such as \":853\" on which to serve DNS over TLS (RFC 7858) with the --tls-cert-file certificate")
+	tlsCertFile                  = flag.String("tls-cert-file", "", "path to the PEM encoded TLS certificate chain to serve DNS over TLS with")
+	tlsKeyFile                   = flag.String("tls-key-file", "", "path to the PEM encoded private key of --tls-cert-file")
+	dotMaxPerIP                  = flag.Int("dot-max-per-ip", 10, "maximum number of DNS over TLS connections that a single client IP address may have open at a time, or 0 for no limit")
+	responsePadding              = flag.Bool("response-padding", false, "pad responses to EDNS0 queries to a multiple of 128 bytes with an EDNS0 Padding option (RFC 7830), so that their size reveals less about the queried names over DNS over TLS")
+	auditLogFile                 = flag.String("audit-log-file", "", "if set, path of a file to append a CSV audit log of all DNS queries to, with time,source_ip,source_port,name,type,rcode,latency_ms,answers records, rotated with the --log-max-* settings")
+	requireTLSSNI                = flag.String("require-tls-sni", "", "if set, host name that DNS over TLS clients must send as their TLS SNI; handshakes without it fail with an unrecognized_name alert")
+	tlsMinVersion                = flag.String("tls-min-version", "1.2", "minimum TLS version for DNS over TLS: \"1.2\" or \"1.3\"")
+	tlsCipherSuites              = flag.String("tls-cipher-suites", "", "if set, comma-separated list of the cipher suites to allow for DNS over TLS with TLS 1.2, by their Go names such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256; the TLS 1.3 cipher suites are not configurable")
+	watchdogInterval             = flag.Duration("watchdog-interval", 5*time.Minute, "how often to check that queries are being answered, or 0 to disable the check")
+	watchdogTimeout              = flag.Duration("watchdog-timeout", 10*time.Minute, "with --watchdog-interval, how long queries may go unanswered while more are received before the nameserver exits to be restarted")
+	localDomainsFlag             = flag.String("local-domains", "", "comma-separated list of custom Tailscale domains that the nameserver is authoritative for, in addition to ts.net")
+	disableTSNetRootDomains      = flag.Bool("disable-ts-net-root-domains", false, "with --local-domains, don't be authoritative for ts.net, only for the custom domains")
+	federateWith                 = flag.String("federate-with", "", "comma-separated list of host:port addresses of the HTTP servers of peer nameservers, e.g. in other clusters, whose records are served with a lower priority than the local ones; they are fetched on every config reload")
+	responseMinTTL               = flag.Uint("response-min-ttl", 0, "if non-zero, minimum TTL in seconds of the records in responses; lower TTLs, e.g. of forwarded answers, are raised to it")
+	coalescingWindow             = flag.Duration("coalescing-window", 0, "if non-zero, how long to hold UDP responses so that those sent within the window are written in a single batch, which is cheaper during query bursts; e.g. 1ms")
+	autodiscoverLabelSelector    = flag.String("autodiscover-label-selector", "", "if set, label selector of Pods, e.g. tailscale.com/dns=true, whose IP addresses are served under the name in their tailscale.com/dns-name annotation, in addition to the records from the config; requires permission to list and watch Pods")
+	autodiscoverNamespace        = flag.String("autodiscover-namespace", "", "with --autodiscover-label-selector, namespace to autodiscover Pods in; empty means all namespaces")
+	enableIDN                    = flag.Bool("enable-idn", false, "serve internationalized names in the config, i.e. münchen.ts.net, as their Punycode encoding, and answer queries for them in either form")
+	listenOnAllProtocols         = flag.Bool("listen-on-all-protocols", false, "listen for DNS queries over UDP on separate IPv4 and IPv6 sockets, 0.0.0.0:1053 and [::]:1053, each with --worker-count goroutines, instead of on a single dual-stack socket")
+	safeReloadThreshold          = flag.Float64("safe-reload-threshold", 0, "if positive, refuse config reloads that remove more than this fraction of the names in the last good config, i.e. 0.1 for 10%, and keep serving the last good config")
+	forceReload                  = flag.Bool("force-reload", false, "apply config reloads that --safe-reload-threshold would refuse, logging a warning instead")
+	syslogEnabled                = flag.Bool("syslog", false, "log every DNS query to syslog, as a message with INFO severity and source, protocol, name, type, rcode, latency_ms and error fields; queries are logged to stderr if syslog is unavailable at startup")
+	syslogNetwork                = flag.String("syslog-network", "", "network of the --syslog server, i.e. \"udp\" or \"tcp\", or empty for the local syslog daemon")
+	syslogAddr                   = flag.String("syslog-addr", "", "address of the --syslog server, i.e. \"syslog.example.com:514\", ignored for the local syslog daemon")
+	enableChaos                  = flag.Bool("enable-query-class-chaos", false, "answer CHAOS class queries, i.e. \"dig CH TXT version.bind\", with the nameserver version, and refuse other CHAOS queries instead of forwarding them")
+	chaosVersion                 = flag.String("chaos-version", "", "with --enable-query-class-chaos, the version.bind. TXT record to serve instead of the nameserver version and build info")
+	clusterDomainFlag            = flag.String("cluster-domain", "cluster.local", "domain of the Kubernetes cluster, which Pods autodiscovered with a single label tailscale.com/dns-name annotation are served in, as <name>.<namespace>.svc.<cluster domain>, unless the config sets clusterDomain")
+	maxGoroutines                = flag.Int("max-goroutines", 10000, "if positive, log the stacks of all goroutines and count the goroutine_limit_exceeded_total metric when more than this many goroutines are running, checked every 30s, to catch goroutine leaks")
+	killOnGoroutineLimit         = flag.Bool("kill-on-goroutine-limit", false, "exit when more than --max-goroutines goroutines are running, so that the nameserver is restarted")
+	anyMaxTypes                  = flag.Int("any-max-types", 3, "maximum number of record types (A, AAAA, CNAME, TXT, MX and SRV, in that order) in the response to a query for QTYPE ANY if --refuse-any is false; 0 passes such queries to the resolver as they are, which only answers with a single address")
+	enableDnstap                 = flag.Bool("enable-dnstap", false, "stream every DNS query and response to --dnstap-socket in the dnstap format (https://dnstap.info/)")
+	dnstapSocket                 = flag.String("dnstap-socket", "/var/run/dnstap.sock", "dnstap receiver to stream to with --enable-dnstap: a Unix socket path, or tcp://host:port for a TCP address")
+	responseExtraOptions         = flag.String("response-extra-options", "", "hex encoded EDNS0 options in wire format (2 byte code, 2 byte length, data, repeated) to add to the OPT record of every response to a query with one")
+	responseExtraRecordsFile     = flag.String("response-extra-additional-records-file", "", "zone file of records to append to the additional section of every response; they are left out of UDP responses that would become too large for the client")
+	preferSameFamily             = flag.Bool("prefer-same-family", false, "in responses that combine A and AAAA records, such as to QTYPE ANY queries (see --any-max-types), put the records of the address family of the client first")
+	configDebounce               = flag.Duration("config-debounce", 0, "if positive, wait until the config has not changed for this long before reloading it, so that a burst of file events causes a single reload")
+	startupQueryFlag             = flag.String("startup-query", "", "comma-separated names, each optionally followed by a record type (default A), such as foo.ts.net,A,bar.ts.net,AAAA, that the nameserver must resolve from its config before /readyz reports it as ready")
+	startupQueryTimeout          = flag.Duration("startup-query-timeout", 5*time.Second, "how long /readyz waits for the --startup-query queries to be answered before reporting the nameserver as not ready")
+	endpointSliceSyncFlag        = flag.Bool("endpointslice-sync", false, "serve the IP addresses of the ready endpoints of each Service as <service>.<namespace>.<zone>, where the zone is the first of the local domains, e.g. web.default.ts.net, in addition to the records from the config; requires permission to list and watch EndpointSlices")
+	udpRecvBuf                   = flag.Int("udp-recv-buf", 4<<20, "size in bytes of the receive buffer of the UDP sockets that DNS queries are served on, so that query bursts are not dropped; the OS may grant less, i.e. on Linux no more than net.core.rmem_max; 0 leaves the OS default")
+	udpSendBuf                   = flag.Int("udp-send-buf", 0, "if non-zero, size in bytes of the send buffer of the UDP sockets that DNS queries are served on; the OS may grant less, i.e. on Linux no more than net.core.wmem_max")
+	configChecksumValidation     = flag.Bool("config-checksum-validation", false, "refuse to load configs that don't match the hex encoded SHA-256 checksum in the key next to them with a .sha256 suffix, i.e. dns.json.sha256, as written by sha256sum")
+	allowLongLabels              = flag.Bool("allow-long-labels", false, "accept host record names with labels longer than 63 bytes or that are longer than 253 bytes, which are otherwise refused as config errors; for testing environments only, as such names can't be queried by most clients")
+	enableRootHints              = flag.Bool("enable-root-hints", false, "resolve A and AAAA queries for names outside of the local domains by following the NS delegations from the root servers, instead of answering them with SERVFAIL for lack of an upstream resolver")
+	rootHintsFile                = flag.String("root-hints-file", "", "with --enable-root-hints, path to a root hints file in the format of https://www.internic.net/domain/named.root with the addresses of the root servers; empty means the built-in ones")
+	snapshotFile                 = flag.String("snapshot-file", "", "if set, path of a file that the nameserver writes a snapshot of its config and records to when it shuts down, and restores them from when it starts, so that a restarted nameserver serves the same records until it has loaded the config")
+)
+
+// nameserver is a simple nameserver that responds to DNS queries for A
+// records for ts.net domain names over UDP. It uses Tailscale's DNS resolver
+// to serve records that it reads from a mounted Kubernetes ConfigMap and it
+// reconfigures the resolver whenever the ConfigMap contents change.
+type nameserver struct {
+	res    dnsResolver
+	logger *zap.SugaredLogger
+	// clusterDomain is the domain of the Kubernetes cluster, from
+	// --cluster-domain, for configs that don't set one.
+	clusterDomain dnsname.FQDN
+	// localDomains, if non-empty, are the domains that the nameserver is
+	// authoritative for instead of nsconfig.DefaultLocalDomains. See domains.
+	localDomains []dnsname.FQDN
+	// configReader returns the latest desired configuration (host records)
+	// for the nameserver. By default it gets set to a reader that reads
+	// from a Kubernetes ConfigMap mounted at /config, but this can be
+	// overridden in tests.
+	configReader configReaderFunc
+	// configWatcher is a watcher that returns an event when the desired
+	// configuration has changed and the nameserver should update the
+	// resolver config. If nil, the config is only reloaded on request via
+	// the /reload endpoint.
+	configWatcher <-chan string
+	// strictConfig makes config loading fail if the config contains
+	// fields that are not known for its schema version.
+	strictConfig bool
+	// allowLongLabels makes host record names that exceed the DNS label
+	// and name length limits valid, as for nsconfig.Options.
+	allowLongLabels bool
+	// configFormat is the format of the config, as for
+	// nsconfig.Options.Format.
+	configFormat string
+	// numGoroutine returns the number of goroutines, for
+	// runGoroutineLimitCheck. If nil, runtime.NumGoroutine is used. It can
+	// be overridden in tests.
+	numGoroutine func() int
+	// interfaceAddrs returns the addresses of a network interface, for
+	// runInterfaceAddressSync. It can be overridden in tests.
+	interfaceAddrs interfaceAddrsFunc
+	// readConfigFile, if non-nil, reads other files from the config
+	// source by name, such as the hosts files referenced by a Corefile.
+	readConfigFile func(name string) ([]byte, error)
+	// disableRecursion makes the nameserver strictly authoritative: queries
+	// for names outside of the local domains are refused instead of
+	// forwarded and responses don't advertise recursion.
+	disableRecursion bool
+	// recursive, if set, resolves A and AAAA queries for names that the
+	// nameserver is not authoritative for from the root servers, rather
+	// than the resolver forwarding them upstream.
+	recursive *recursiveResolver
+	// refuseAny makes the nameserver answer queries for QTYPE ANY with
+	// REFUSED, as their large responses make them useful for DNS
+	// amplification attacks.
+	refuseAny bool
+	// anyMaxTypes, if positive, makes the nameserver answer queries for
+	// QTYPE ANY that aren't refused with the records of up to anyMaxTypes
+	// record types. See answerANY.
+	anyMaxTypes int
+	// preferSameFamily makes the nameserver put the addresses of the
+	// family of the client first in responses with both A and AAAA
+	// records. See anyTypesFor.
+	preferSameFamily bool
+	// chaosVersion, if non-empty, makes the nameserver answer CHAOS
+	// class queries itself, with chaosVersion as the version.bind. TXT
+	// record. See chaosResponse.
+	chaosVersion string
+	// enableIDN makes the nameserver Punycode encode internationalized
+	// names in the config and in queries, see encodeIDNConfig.
+	enableIDN bool
+	// rebindProtection makes the nameserver answer queries for names that
+	// it is not authoritative for with SERVFAIL if the forwarded response
+	// contains internal addresses. See checkRebinding.
+	rebindProtection bool
+	// ipv4Disabled makes the nameserver ignore the IPv4 addresses in the
+	// config, so that A queries for hosts get empty responses.
+	ipv4Disabled bool
+	// allowExternalRecords makes the nameserver serve the external
+	// records in the config, for names outside of the local domains.
+	allowExternalRecords bool
+	// nsid, if non-empty, is sent in an EDNS0 NSID option in responses to
+	// EDNS0 queries, to identify which nameserver replica answered.
+	nsid string
+	// responseExtras, if non-nil, are added to every response, see
+	// addResponseExtras.
+	responseExtras *responseExtras
+	// responsePadding makes the nameserver pad responses to EDNS0 queries
+	// with an EDNS0 Padding option, see padResponse.
+	responsePadding bool
+	// responseMinTTL, if non-zero, is the minimum TTL of the records in
+	// the responses to queries, see raiseTTLs.
+	responseMinTTL uint32
+	// coalescingWindow, if non-zero, is how long UDP responses are held
+	// to be sent in batches, see udpResponseBatcher.
+	coalescingWindow time.Duration
+	// dnssec, if non-nil, signs responses to queries that request DNSSEC
+	// records and serves the zone apex DNSKEY records.
+	dnssec *dnssecSigner
+	// notifyTargets are the secondary nameservers that are sent a DNS
+	// NOTIFY whenever the config is successfully reloaded.
+	notifyTargets []netip.AddrPort
+	// notifyTimeout is how long to wait for a NOTIFY to be acknowledged
+	// before retransmitting it. If zero, defaultNotifyTimeout is used.
+	notifyTimeout time.Duration
+	// axfrAllowFrom are the prefixes of the clients that may request zone
+	// transfers over TCP. AXFR queries from other clients are refused.
+	axfrAllowFrom []netip.Prefix
+
+	// querySem, if non-nil, limits the number of queries that are
+	// answered concurrently. Queries that can't acquire it within
+	// queueTimeout are answered with SERVFAIL.
+	querySem     *syncs.Semaphore
+	queueTimeout time.Duration
+	// prioritySources are the prefixes of the clients whose queries
+	// bypass querySem. They are limited by prioritySem instead, if
+	// non-nil, without waiting for a slot.
+	prioritySources []netip.Prefix
+	prioritySem     *syncs.Semaphore
+	// metrics, if non-nil, are the Prometheus metrics of the nameserver.
+	metrics *nameserverMetrics
+	// queryLog, if non-nil, is where every DNS query is logged.
+	queryLog *queryLogger
+	// auditLog, if non-nil, is where every DNS query is logged in the
+	// queryLogFormatAudit format.
+	auditLog *queryLogger
+	// syslogLog, if non-nil, is where every DNS query is logged for
+	// --syslog.
+	syslogLog *queryLogger
+	// dnstap, if non-nil, is where every DNS query and response is
+	// streamed for --enable-dnstap.
+	dnstap *dnstapLogger
+
+	queriesTotal    atomic.Uint64
+	queriesInFlight atomic.Int32
+	tcpConns        atomic.Int32 // number of open DNS over TCP connections
+	dotConns        atomic.Int32 // number of open DNS over TLS connections
+	// lastQueryReceivedTime and lastQueryTime are the times, in Unix
+	// nanoseconds, at which the last query was received and the last
+	// query was answered successfully, or zero if there were none.
+	lastQueryReceivedTime atomic.Int64
+	lastQueryTime         atomic.Int64
+
+	dotMu sync.Mutex
+	// dotConnsPerIP is the number of open DNS over TLS connections from
+	// each client IP address. It is protected by dotMu.
+	dotConnsPerIP map[netip.Addr]int
+
+	// inflight coalesces identical queries that are answered by res at the
+	// same time into a single call. It is keyed by dedupKey.
+	inflight singleflight.Group[string, []byte]
+
+	// unhealthy is the set of host IP address and health check port pairs
+	// that failed their last health check, mapped to the time at which
+	// they started failing.
+	unhealthy syncs.Map[netip.AddrPort, time.Time]
+
+	// maxReloadErrors is the number of consecutive config reloads
+	// triggered by configWatcher that may fail before run gives up and
+	// calls its cancelF. Values below 1 mean 1.
+	maxReloadErrors int
+	// configDebounce, if positive, makes run wait until configWatcher has
+	// reported no changes for configDebounce before updating the
+	// resolver config, so that a burst of changes causes one update.
+	configDebounce time.Duration
+	// migrationChecker refuses config reloads that remove too many of
+	// the records of the last good config.
+	migrationChecker MigrationChecker
+	// minRecordCount is the number of host records that the loaded
+	// config must have for the nameserver to be ready. Values below 1
+	// disable the check.
+	minRecordCount int
+	// startupQueries are queries that the resolver must have answered
+	// within startupQueryTimeout for the nameserver to be ready. See
+	// checkStartupQueries.
+	startupQueries         []startupQuery
+	startupQueryTimeout    time.Duration
+	startupQueriesAnswered atomic.Bool
+	// startupTimeout is how long run waits for the initial config load.
+	// Zero means no limit.
+	startupTimeout time.Duration
+	// requireConfig makes run fail if the initial config load takes longer
+	// than startupTimeout. Otherwise run returns and the nameserver serves
+	// no records until the load completes.
+	requireConfig bool
+
+	// reloadMu serializes config reloads, so that a config that was read
+	// earlier can never replace one that was read later.
+	reloadMu sync.Mutex
+	// consecutiveReloadErrors is the number of config reloads that failed
+	// since the last successful one. It is protected by reloadMu.
+	consecutiveReloadErrors int
+	// loadedConfig is the raw config that updateResolverConfig last
+	// loaded, and loadedOptions the options that it was loaded with, so
+	// that reloads of an unchanged config can be skipped. They are
+	// protected by reloadMu.
+	loadedConfig  []byte
+	loadedOptions nsconfig.Options
+
+	mu sync.Mutex // protects following
+	// config is the last config that was successfully loaded, see
+	// Snapshot.
+	config *operatorutils.TSHosts
+	// hosts are the host records from the last config that was
+	// successfully loaded.
+	hosts map[dnsname.FQDN][]netip.Addr
+	// healthCheckPorts are the health check ports for hosts, from the
+	// last config that was successfully loaded.
+	healthCheckPorts map[dnsname.FQDN]uint16
+	// expiresAt are the expiry times of the records of the last config
+	// that was successfully loaded that haven't expired yet.
+	expiresAt map[dnsname.FQDN]time.Time
+	// expiries are the times in expiresAt, see runRecordExpiry.
+	expiries expiryHeap
+	// expiriesChanged is signalled when expiries changes, if
+	// runRecordExpiry is running.
+	expiriesChanged chan struct{}
+	// rpz are the response policy rules from the last config that was
+	// successfully loaded.
+	rpz []nsconfig.RPZRule
+	// externalHosts are the records for names outside of the local
+	// domains from the last config that was successfully loaded, if
+	// allowExternalRecords is set.
+	externalHosts map[dnsname.FQDN][]netip.Addr
+	// rewrites are the response rewriting rules from the last config
+	// that was successfully loaded.
+	rewrites []nsconfig.RewriteRule
+	// views are the source-specific host records from the last config
+	// that was successfully loaded.
+	views []nsconfig.View
+	// searchDomains and ndots are the search domains from the last
+	// config that was successfully loaded, see answerFromSearchDomains.
+	searchDomains []dnsname.FQDN
+	ndots         int
+	// federatedNames are the names whose records in the last config
+	// that was successfully loaded were fetched from peer nameservers.
+	federatedNames set.Set[dnsname.FQDN]
+	// syncedHosts are the host records for the addresses of the network
+	// interface synced by runInterfaceAddressSync, served in addition to
+	// the records from the config.
+	syncedHosts map[dnsname.FQDN][]netip.Addr
+	// discoveredPods are the records of the Pods found by
+	// runPodAutodiscovery, served in addition to the records from the
+	// config, see discoveredHostsLocked.
+	discoveredPods []podRecord
+	// syncedEndpoints are the records of the ready endpoints of the
+	// EndpointSlices found by runEndpointSliceSync, served in addition to
+	// the records from the config, see endpointHostsLocked.
+	syncedEndpoints []endpointRecord
+	// podAutodiscovery is whether runPodAutodiscovery was started, which
+	// makes the cluster domain a local domain.
+	podAutodiscovery bool
+	// configClusterDomain is the cluster domain from the last config that
+	// was successfully loaded, if any, see clusterDomainLocked.
+	configClusterDomain dnsname.FQDN
+	// recordCount is the number of host records in the last config that
+	// was successfully loaded.
+	recordCount int
+	// lastReloadTime is the time at which the config was last
+	// successfully loaded.
+	lastReloadTime time.Time
+	// lastReloadDuration is how long the last successful config load
+	// took.
+	lastReloadDuration time.Duration
+}
+
+// configReaderFunc returns the raw contents of the nameserver config.
+type configReaderFunc func() ([]byte, error)
+
+// dnsResolver is the subset of the *resolver.Resolver methods that the
+// nameserver uses.
+type dnsResolver interface {
+	Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error)
+	SetConfig(cfg resolver.Config) error
+}
+
+func main() {
+	flag.Parse()
+	var logW *rotatingFile
+	if *logFile != "" {
+		var err error
+		logW, err = newRotatingFile(*logFile, int64(*logMaxSize)<<20, *logMaxBackups, *logMaxAge)
+		if err != nil {
+			log.Fatalf("error opening log file: %v", err)
+		}
+		defer logW.Close()
+	}
+	logger, err := newLogger(logW, *alsoLogToStderr)
+	if err != nil {
+		log.Fatalf("error creating logger: %v", err)
+	}
+	defer logger.Sync()
+	var queryLog *queryLogger
+	if *logQueriesToFile != "" {
+		w, err := newRotatingFile(*logQueriesToFile, int64(*logMaxSize)<<20, *logMaxBackups, *logMaxAge)
+		if err != nil {
+			logger.Fatalf("error opening query log file: %v", err)
+		}
+		if queryLog, err = newQueryLogger(w, *queryLogFormat, queryLogBufferSize, logger.Errorf); err != nil {
+			logger.Fatalf("error creating query log: %v", err)
+		}
+		defer queryLog.Close()
+	}
+	var auditLog *queryLogger
+	if *auditLogFile != "" {
+		w, err := newRotatingFile(*auditLogFile, int64(*logMaxSize)<<20, *logMaxBackups, *logMaxAge)
+		if err != nil {
+			logger.Fatalf("error opening audit log file: %v", err)
+		}
+		if auditLog, err = newQueryLogger(w, queryLogFormatAudit, queryLogBufferSize, logger.Errorf); err != nil {
+			logger.Fatalf("error creating audit log: %v", err)
+		}
+		defer auditLog.Close()
+	}
+	var syslogLog *queryLogger
+	if *syslogEnabled {
+		w, err := dialSyslog(*syslogNetwork, *syslogAddr)
+		if err != nil {
+			logger.Warnf("error connecting to syslog, logging DNS queries to stderr instead: %v", err)
+			w = nopCloser{os.Stderr}
+		}
+		if syslogLog, err = newQueryLogger(w, queryLogFormatSyslog, queryLogBufferSize, logger.Errorf); err != nil {
+			logger.Fatalf("error creating syslog query log: %v", err)
+		}
+		defer syslogLog.Close()
+	}
+	var dnstap *dnstapLogger
+	if *enableDnstap {
+		network, address := parseDnstapSocket(*dnstapSocket)
+		hostname, _ := os.Hostname()
+		dnstap = newDnstapLogger(func() (net.Conn, error) {
+			return net.DialTimeout(network, address, fstrmHandshakeTimeout)
+		}, hostname, version.Long(), queryLogBufferSize, logger.Errorf)
+		defer dnstap.Close()
+	}
+
+	ctx, cancelF := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancelF()
+
+	res := resolver.New(logger.Infof, nil, nil, &tsdial.Dialer{Logf: logger.Infof}, nil)
+	defer res.Close()
+
+	if *corednsCompatible {
+		*configFormat = nsconfig.FormatCorefile
+		if *configKey == defaultDNSFile {
+			*configKey = nsconfig.CorefileKey
+		}
+	}
+	switch *configFormat {
+	case nsconfig.FormatJSON, nsconfig.FormatYAML, nsconfig.FormatCBOR, nsconfig.FormatHosts, nsconfig.FormatCorefile:
+	case nsconfig.FormatAuto:
+		*configFormat = nsconfig.FormatForKey(*configKey)
+	default:
+		logger.Fatalf("invalid --config-format %q, must be one of %q, %q, %q, %q or %q", *configFormat, nsconfig.FormatJSON, nsconfig.FormatYAML, nsconfig.FormatCBOR, nsconfig.FormatHosts, nsconfig.FormatAuto)
+	}
+	configDir, err := configDirForSource(*configSource)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	watcher, err := watchConfig(ctx, configDir, *configKey, *noFileWatch, logger)
+	if err != nil {
+		logger.Fatalf("error watching nameserver config: %v", err)
+	}
+	localDomains, err := nsconfig.ParseLocalDomains(*localDomainsFlag, *disableTSNetRootDomains)
+	if err != nil {
+		logger.Fatalf("error parsing --local-domains: %v", err)
+	}
+	// https://datatracker.ietf.org/doc/html/rfc2181#section-8
+	if *responseMinTTL > math.MaxInt32 {
+		logger.Fatalf("--response-min-ttl must be at most %d", math.MaxInt32)
+	}
+	peers, err := parsePeers(*federateWith)
+	if err != nil {
+		logger.Fatalf("error parsing --federate-with: %v", err)
+	}
+	configReader := newConfigMapConfigReader(configDir, *configKey)
+	if *configChecksumValidation {
+		configReader = newChecksumConfigReader(configReader, configDir, *configKey, logger)
+	}
+	if len(peers) > 0 {
+		configReader = newFederatedConfigReader(logger, configReader, peers)
+	}
+	dotMinVersion, err := parseTLSMinVersion(*tlsMinVersion)
+	if err != nil {
+		logger.Fatalf("error parsing --tls-min-version: %v", err)
+	}
+	dotCipherSuites, err := parseTLSCipherSuites(*tlsCipherSuites, dotMinVersion)
+	if err != nil {
+		logger.Fatalf("error parsing --tls-cipher-suites: %v", err)
+	}
+	clusterDomain, err := nsconfig.ParseClusterDomain("--cluster-domain", *clusterDomainFlag)
+	if err != nil {
+		logger.Fatalf("error parsing --cluster-domain: %v", err)
+	}
+	if clusterDomain == "" {
+		logger.Fatalf("--cluster-domain must not be empty")
+	}
+	ns := &nameserver{
+		clusterDomain: clusterDomain,
+		localDomains:  localDomains,
+		res:           res,
+		logger:        logger,
+		configReader:  configReader,
+		configWatcher: watcher,
+		strictConfig:  *strictConfig,
+		configFormat:  *configFormat,
+		readConfigFile: func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(configDir, name))
+		},
+		disableRecursion:     *disableRecursion,
+		refuseAny:            *refuseAny,
+		allowLongLabels:      *allowLongLabels,
+		anyMaxTypes:          *anyMaxTypes,
+		preferSameFamily:     *preferSameFamily,
+		enableIDN:            *enableIDN,
+		rebindProtection:     *dnsRebindProtection,
+		responsePadding:      *responsePadding,
+		responseMinTTL:       uint32(*responseMinTTL),
+		coalescingWindow:     *coalescingWindow,
+		ipv4Disabled:         *ipv4Disabled,
+		allowExternalRecords: *allowExternalRecords,
+		maxReloadErrors:      *configReloadMaxErrors,
+		configDebounce:       *configDebounce,
+		minRecordCount:       *minRecordCount,
+		startupQueryTimeout:  *startupQueryTimeout,
+		migrationChecker:     MigrationChecker{Threshold: *safeReloadThreshold, Force: *forceReload},
+		startupTimeout:       *startupTimeout,
+		requireConfig:        *requireConfig,
+		queryLog:             queryLog,
+		auditLog:             auditLog,
+		syslogLog:            syslogLog,
+		dnstap:               dnstap,
+		interfaceAddrs:       systemInterfaceAddrs,
+	}
+	if *enableChaos {
+		ns.chaosVersion = *chaosVersion
+		if ns.chaosVersion == "" {
+			ns.chaosVersion = versionRecord()
+		}
+	}
+	if *enableNSID {
+		if ns.nsid, err = nameserverID(); err != nil {
+			logger.Fatalf("error determining NSID: %v", err)
+		}
+		logger.Infof("sending NSID %q in responses", ns.nsid)
+	}
+	if *responseExtraOptions != "" || *responseExtraRecordsFile != "" {
+		ns.responseExtras = new(responseExtras)
+		if *responseExtraOptions != "" {
+			if ns.responseExtras.options, err = parseResponseExtraOptions(*responseExtraOptions); err != nil {
+				logger.Fatalf("error parsing --response-extra-options: %v", err)
+			}
+		}
+		if *responseExtraRecordsFile != "" {
+			if ns.responseExtras.records, err = loadResponseExtraRecords(*responseExtraRecordsFile); err != nil {
+				logger.Fatalf("error loading --response-extra-additional-records-file: %v", err)
+			}
+		}
+	}
+	if *enableRootHints {
+		if *disableRecursion {
+			logger.Fatalf("--enable-root-hints can't be used with --disable-recursion")
+		}
+		roots := defaultRootServers
+		if *rootHintsFile != "" {
+			if roots, err = loadRootHints(*rootHintsFile); err != nil {
+				logger.Fatalf("error loading --root-hints-file: %v", err)
+			}
+		}
+		ns.recursive = newRecursiveResolver(roots)
+	}
+	if ns.startupQueries, err = parseStartupQueries(*startupQueryFlag); err != nil {
+		logger.Fatalf("error parsing --startup-query: %v", err)
+	}
+	if *maxConcurrentQueries > 0 {
+		sem := syncs.NewSemaphore(*maxConcurrentQueries)
+		ns.querySem, ns.queueTimeout = &sem, *queueTimeout
+	}
+	if ns.prioritySources, err = parseCIDRs(*prioritySources); err != nil {
+		logger.Fatalf("error parsing --priority-sources: %v", err)
+	}
+	if len(ns.prioritySources) > 0 && *priorityMaxConcurrent > 0 {
+		sem := syncs.NewSemaphore(*priorityMaxConcurrent)
+		ns.prioritySem = &sem
+	}
+	ns.metrics = newNameserverMetrics(*prometheusNamespace, ns)
+	ns.notifyTargets, err = parseNotifyTargets(*notifySlaves)
+	if err != nil {
+		logger.Fatalf("error parsing --notify-slaves: %v", err)
+	}
+	ns.axfrAllowFrom, err = parseCIDRs(*axfrAllowFrom)
+	if err != nil {
+		logger.Fatalf("error parsing --axfr-allow-from: %v", err)
+	}
+	if *dnssecKey != "" {
+		ns.dnssec, err = loadDNSSECSigner(*dnssecKey, ns.domains()[0].WithTrailingDot())
+		if err != nil {
+			logger.Fatalf("error loading DNSSEC key: %v", err)
+		}
+		logger.Infof("DNSSEC signing enabled, DS record for the parent zone: %s", ns.dnssec.DS())
+	}
+	if *snapshotFile != "" {
+		if b, err := os.ReadFile(*snapshotFile); err == nil {
+			if err := ns.RestoreFromSnapshot(b); err != nil {
+				logger.Errorf("error restoring --snapshot-file, starting without it: %v", err)
+			}
+		} else if !os.IsNotExist(err) {
+			logger.Errorf("error reading --snapshot-file, starting without it: %v", err)
+		}
+	}
+	if err := ns.run(ctx, cancelF); err != nil {
+		logger.Fatalf("error running nameserver: %v", err)
+	}
+	if *healthCheckInterval > 0 {
+		go ns.runHealthChecks(ctx, *healthCheckInterval)
+	}
+	if *watchdogInterval > 0 && *watchdogTimeout > 0 {
+		go ns.runWatchdog(ctx, cancelF, *watchdogInterval, *watchdogTimeout)
+	}
+	if *maxGoroutines > 0 {
+		go ns.runGoroutineLimitCheck(ctx, cancelF, goroutineCheckInterval, *maxGoroutines, *killOnGoroutineLimit)
+	}
+	if *interfaceAddressSync != "" {
+		if *interfaceAddressSyncName == "" {
+			logger.Fatalf("--interface-address-sync requires --interface-address-sync-name")
+		}
+		name, err := dnsname.ToFQDN(*interfaceAddressSyncName)
+		if err != nil {
+			logger.Fatalf("error parsing --interface-address-sync-name: %v", err)
+		}
+		go ns.runInterfaceAddressSync(ctx, *interfaceAddressSync, name, *interfaceAddressSyncInterval)
+	}
+	if *autodiscoverLabelSelector != "" {
+		selector, err := labels.Parse(*autodiscoverLabelSelector)
+		if err != nil {
+			logger.Fatalf("error parsing --autodiscover-label-selector: %v", err)
+		}
+		client, err := inClusterClient()
+		if err != nil {
+			logger.Fatalf("error creating Kubernetes client for Pod autodiscovery: %v", err)
+		}
+		if err := ns.runPodAutodiscovery(ctx, client, *autodiscoverNamespace, selector); err != nil {
+			logger.Fatalf("error starting Pod autodiscovery: %v", err)
+		}
+	}
+	if *endpointSliceSyncFlag {
+		client, err := inClusterClient()
+		if err != nil {
+			logger.Fatalf("error creating Kubernetes client for EndpointSlice sync: %v", err)
+		}
+		if err := ns.runEndpointSliceSync(ctx, client); err != nil {
+			logger.Fatalf("error starting EndpointSlice sync: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	ns.RegisterHandlers(mux)
+	go func() {
+		logger.Infof("HTTP server listening on %s", *httpAddr)
+		if err := http.ListenAndServe(*httpAddr, mux); err != nil {
+			logger.Errorf("HTTP server exited: %v", err)
+			cancelF()
+		}
+	}()
+
+	var fds []int
+	if *listenFD >= 0 {
+		fds = []int{*listenFD}
+	} else if fds, err = systemdListenFDs(); err != nil {
+		logger.Fatalf("error getting socket activation file descriptors: %v", err)
+	}
+	// conns are the UDP sockets to serve DNS queries on, each with
+	// workersPerConn goroutines.
+	var conns []*net.UDPConn
+	workersPerConn := max(*workerCount, 1)
+	var ln net.Listener
+	switch {
+	case len(fds) > 0:
+		var conn *net.UDPConn
+		if conn, ln, err = socketsFromFDs(fds); err != nil {
+			logger.Fatalf("error using pre-bound sockets: %v", err)
+		}
+		conns = []*net.UDPConn{conn}
+	case *listenOnAllProtocols:
+		if *listenIPv6Only || *reusePort {
+			logger.Fatalf("--listen-on-all-protocols can't be used with --listen-ipv6-only or --reuse-port")
+		}
+		if conns, err = listenUDPAllProtocols(udpEndpoint, *bindInterface); err != nil {
+			logger.Fatalf("error listening for DNS queries: %v", err)
+		}
+	case *reusePort && *workerCount > 1:
+		if conns, err = listenUDPReusePort(udpEndpoint, *listenIPv6Only, *bindInterface, *workerCount); err != nil {
+			logger.Fatalf("error listening for DNS queries: %v", err)
+		}
+		workersPerConn = 1
+	default:
+		conn, err := listenUDP(udpEndpoint, *listenIPv6Only, *bindInterface, *reusePort)
+		if err != nil {
+			logger.Fatalf("error listening for DNS queries: %v", err)
+		}
+		conns = []*net.UDPConn{conn}
+	}
+	for _, conn := range conns {
+		if err := ns.setUDPBufferSizes(conn, *udpRecvBuf, *udpSendBuf); err != nil {
+			logger.Fatalf("error setting UDP buffer sizes: %v", err)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	if ln == nil {
+		if ln, err = listenTCP(tcpEndpoint, *listenIPv6Only, *bindInterface); err != nil {
+			logger.Fatalf("error listening for DNS queries over TCP: %v", err)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go ns.serveTCP(ctx, ln, *tcpIdleTimeout)
+	if *dotListen != "" {
+		tlsConfig, err := loadDoTConfig(*tlsCertFile, *tlsKeyFile, *requireTLSSNI, dotMinVersion, dotCipherSuites)
+		if err != nil {
+			logger.Fatalf("error setting up DNS over TLS: %v", err)
+		}
+		dotLn, err := listenTCP(*dotListen, false, *bindInterface)
+		if err != nil {
+			logger.Fatalf("error listening for DNS queries over TLS: %v", err)
+		}
+		go func() {
+			<-ctx.Done()
+			dotLn.Close()
+		}()
+		go ns.serveDoT(ctx, dotLn, tlsConfig, *tcpIdleTimeout, *dotMaxPerIP)
+		logger.Infof("serving DNS over TLS on %s", dotLn.Addr())
+	}
+	logger.Infof("nameserver listening on %s with %d UDP sockets and %d workers each, and on %s", conns[0].LocalAddr(), len(conns), workersPerConn, ln.Addr())
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		for range workersPerConn {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ns.serve(ctx, conn)
+			}()
+		}
+	}
+	wg.Wait()
+	if *snapshotFile != "" {
+		if err := ns.writeSnapshot(*snapshotFile); err != nil {
+			logger.Errorf("error writing --snapshot-file: %v", err)
+		} else {
+			logger.Infof("wrote nameserver snapshot to %s", *snapshotFile)
+		}
+	}
+}
+
+// inClusterClient returns a Kubernetes client that uses the nameserver's
+// service account.
+func inClusterClient() (kubernetes.Interface, error) {
+	restCfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restCfg)
+}
+
+// listenUDP returns a UDP socket bound to addr. If ipv6Only is set, the host
+// part of addr is ignored and the socket is bound to the IPv6 unspecified
+// address only, so that it does not accept IPv4 traffic regardless of the
+// kernel's default for dual-stack sockets. If iface is non-empty, the socket
+// only receives traffic from the network interface with that name. If
+// reusePort is set, SO_REUSEPORT is set on the socket, so that more sockets
+// can be bound to the same address.
+func listenUDP(addr string, ipv6Only bool, iface string, reusePort bool) (*net.UDPConn, error) {
+	network := "udp"
+	if ipv6Only {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		// The net package sets IPV6_V6ONLY on sockets for the udp6
+		// network, so this never creates an IPv4-mapped socket.
+		network, addr = "udp6", net.JoinHostPort("::", port)
+	}
+	return listenUDPNetwork(network, addr, iface, reusePort)
+}
+
+// listenUDPNetwork is like listenUDP, but binds the socket to addr on the
+// given network, one of "udp", "udp4" or "udp6".
+func listenUDPNetwork(network, addr, iface string, reusePort bool) (*net.UDPConn, error) {
+	lc, addr, err := listenConfig(network, addr, iface)
+	if err != nil {
+		return nil, err
+	}
+	if reusePort {
+		control := lc.Control
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			if err := setReusePort(c); err != nil {
+				return fmt.Errorf("error setting SO_REUSEPORT: %w", err)
+			}
+			return nil
+		}
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s %q: %w", network, addr, err)
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenUDPReusePort returns n UDP sockets with SO_REUSEPORT set that are all
+// bound to addr, as described in listenUDP. If the port of addr is 0, the
+// sockets are bound to the port that the kernel picks for the first one.
+func listenUDPReusePort(addr string, ipv6Only bool, iface string, n int) ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+	for range n {
+		conn, err := listenUDP(addr, ipv6Only, iface, true)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		if len(conns) == 0 {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+			}
+			addr = net.JoinHostPort(host, strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port))
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// listenUDPAllProtocols returns two UDP sockets bound to the port of addr:
+// one for IPv4 on 0.0.0.0 and one for IPv6 only on [::]. Unlike a single
+// dual-stack socket, this receives queries over both protocols regardless of
+// the kernel's default for IPV6_V6ONLY (net.ipv6.bindv6only on Linux). The
+// host part of addr is ignored. If the port of addr is 0, the IPv6 socket is
+// bound to the port that the kernel picks for the IPv4 one.
+func listenUDPAllProtocols(addr, iface string) ([]*net.UDPConn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	conn4, err := listenUDPNetwork("udp4", net.JoinHostPort("0.0.0.0", port), iface, false)
+	if err != nil {
+		return nil, err
+	}
+	port = strconv.Itoa(conn4.LocalAddr().(*net.UDPAddr).Port)
+	conn6, err := listenUDPNetwork("udp6", net.JoinHostPort("::", port), iface, false)
+	if err != nil {
+		conn4.Close()
+		return nil, err
+	}
+	return []*net.UDPConn{conn4, conn6}, nil
+}
+
+// serve reads DNS queries from conn until ctx is done and answers each one
+// in its own goroutine. If n.coalescingWindow is set, the responses are sent
+// in batches, see udpResponseBatcher.
+func (n *nameserver) serve(ctx context.Context, conn *net.UDPConn) {
+	var batcher *udpResponseBatcher
+	if n.coalescingWindow > 0 {
+		batcher = newUDPResponseBatcher(n.logger, conn, n.coalescingWindow)
+	}
+	for {
+		payloadBuf := make([]byte, 10000)
+		metadataBuf := make([]byte, 512)
+		l, _, _, addr, err := conn.ReadMsgUDP(payloadBuf, metadataBuf)
+		if err != nil {
+			if ctx.Err() != nil {
+				n.logger.Info("nameserver stopped")
+				return
+			}
+			n.logger.Errorf("error reading from UDP socket: %v", err)
+			continue
+		}
+		go func() {
+			// Dual-stack sockets report IPv4 sources as
+			// IPv4-mapped IPv6 addresses; unmap them so that they
+			// are handled like any other IPv4 address.
+			src := addr.AddrPort()
+			src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+			dnsAnswer, err := n.query(ctx, payloadBuf[:l], src)
+			if err != nil {
+				n.logger.Errorf("error doing DNS query: %v", err)
+				// Note you might get some garbage in the response
+				// too; the resolver still returns a best effort
+				// error response in some cases.
+			}
+			if len(dnsAnswer) == 0 {
+				return
+			}
+			if batcher != nil {
+				batcher.write(dnsAnswer, addr)
+				return
+			}
+			if _, err := conn.WriteToUDP(dnsAnswer, addr); err != nil {
+				n.logger.Errorf("error writing DNS response to %v: %v", addr, err)
+			}
+		}()
+	}
+}
+
+// query answers the DNS query in payload that was received over UDP from
+// addr.
+func (n *nameserver) query(ctx context.Context, payload []byte, addr netip.AddrPort) ([]byte, error) {
+	return n.queryFamily(ctx, payload, "udp", addr)
+}
+
+// queryFamily answers the DNS query in payload that was received from addr
+// over family, which is either "udp" or "tcp".
+func (n *nameserver) queryFamily(ctx context.Context, payload []byte, family string, addr netip.AddrPort) ([]byte, error) {
+	if n.queryLog == nil && n.auditLog == nil && n.syslogLog == nil && n.dnstap == nil {
+		return n.handleQuery(ctx, payload, family, addr)
+	}
+	start := time.Now()
+	resp, err := n.handleQuery(ctx, payload, family, addr)
+	latency := time.Since(start)
+	for _, l := range []*queryLogger{n.queryLog, n.auditLog, n.syslogLog} {
+		if l != nil && !l.log(payload, resp, err, family, addr, latency) {
+			n.metrics.observeDroppedQueryLog()
+		}
+	}
+	if n.dnstap != nil && !n.dnstap.log(payload, resp, family, addr, start, latency) {
+		n.metrics.observeDroppedQueryLog()
+	}
+	return resp, err
+}
+
+// handleQuery does the work of queryFamily.
+func (n *nameserver) handleQuery(ctx context.Context, payload []byte, family string, addr netip.AddrPort) ([]byte, error) {
+	n.queriesTotal.Add(1)
+	n.lastQueryReceivedTime.Store(time.Now().UnixNano())
+	n.metrics.observeQuery(payload)
+	n.queriesInFlight.Add(1)
+	defer n.queriesInFlight.Add(-1)
+	if n.isPrioritySource(addr.Addr()) {
+		n.metrics.observePriorityQuery()
+		if n.prioritySem != nil {
+			if !n.prioritySem.TryAcquire() {
+				n.metrics.observeDroppedPriorityQuery()
+				return servFail(payload)
+			}
+			defer n.prioritySem.Release()
+		}
+	} else if n.querySem != nil {
+		if !n.acquireQuerySlot(ctx) {
+			n.metrics.observeDroppedQuery()
+			return servFail(payload)
+		}
+		defer n.querySem.Release()
+	}
+	resp, err := n.answer(ctx, payload, family, addr)
+	if n.nsid != "" && err == nil && len(resp) > 0 {
+		resp, err = addNSID(payload, resp, n.nsid)
+	}
+	if n.responseExtras != nil && err == nil && len(resp) > 0 {
+		resp, err = addResponseExtras(payload, resp, family, n.responseExtras)
+	}
+	// Padding goes last, so that it accounts for all other options.
+	if n.responsePadding && err == nil && len(resp) > 0 {
+		resp, err = padResponse(payload, resp, family)
+	}
+	if err == nil && len(resp) > 0 {
+		n.lastQueryTime.Store(time.Now().UnixNano())
+	}
+	return resp, err
+}
+
+// answer returns the response to the DNS query in payload that was received
+// from addr over family.
+func (n *nameserver) answer(ctx context.Context, payload []byte, family string, addr netip.AddrPort) ([]byte, error) {
+	if resp, ok := rejectMultipleQuestions(payload); ok {
+		return resp, nil
+	}
+	if n.enableIDN {
+		if encoded, name, ok := encodeIDNQuery(payload); ok {
+			resp, err := n.answer(ctx, encoded, family, addr)
+			if err != nil || resp == nil {
+				return resp, err
+			}
+			return restoreIDNName(resp, name)
+		}
+	}
+	if resp, ok := refuseZoneTransfer(payload); ok {
+		return resp, nil
+	}
+	if n.refuseAny {
+		if resp, ok := refuseANY(payload); ok {
+			n.metrics.observeRefusedANY()
+			return resp, nil
+		}
+	}
+	if resp, ok, err := versionResponse(payload); ok {
+		return resp, err
+	}
+	if n.chaosVersion != "" {
+		if resp, ok, err := chaosResponse(payload, n.chaosVersion); ok {
+			return resp, err
+		}
+	}
+	if resp, ok, err := n.answerFromPolicy(ctx, payload, addr); ok {
+		return resp, err
+	}
+	resp, ok, err := n.answerFromSearchDomains(ctx, payload, family, addr)
+	if ok && resp == nil && err == nil {
+		// Dropped by an RPZ rule for the name in a search domain.
+		return nil, nil
+	}
+	if !ok {
+		resp, ok, err = n.answerANY(ctx, payload, family, addr)
+	}
+	if !ok {
+		resp, err = n.lookup(ctx, payload, family, addr)
+	}
+	if err == nil {
+		// Rewrite before signing, so that the signatures cover the
+		// records that are actually served.
+		if resp, err = n.applyRewrites(resp, addr); err != nil {
+			return nil, err
+		}
+		if resp, err = raiseTTLs(resp, n.responseMinTTL); err != nil {
+			return nil, err
+		}
+	}
+	if n.dnssec != nil && err == nil && wantsDNSSEC(payload) {
+		if resp, err = n.dnssec.sign(resp); err != nil {
+			return nil, fmt.Errorf("error signing response: %w", err)
+		}
+	}
+	if n.disableRecursion {
+		clearRecursionAvailable(resp)
+	}
+	return resp, err
+}
+
+// answerFromPolicy returns the response to the DNS query in payload and true
+// if it is answered by policy rather than from the records: refused as
+// non-local with --disable-recursion, answered by an RPZ rule, or a DNSKEY
+// query for the signed zone. A nil response with a nil error means that the
+// query is dropped.
+func (n *nameserver) answerFromPolicy(ctx context.Context, payload []byte, addr netip.AddrPort) ([]byte, bool, error) {
+	if n.disableRecursion {
+		if resp, ok := n.refuseNonLocal(payload); ok {
+			return resp, true, nil
+		}
+	}
+	if resp, ok, err := n.applyRPZ(ctx, payload, addr); ok {
+		return resp, true, err
+	}
+	if n.dnssec != nil {
+		if resp, ok, err := n.dnssec.dnskeyResponse(payload); ok {
+			if err == nil && wantsDNSSEC(payload) {
+				resp, err = n.dnssec.sign(resp)
+			}
+			return resp, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// lookup returns the records for the DNS query in payload from the view for
+// addr, if any, from the root servers for external names with
+// --enable-root-hints, or from the resolver.
+func (n *nameserver) lookup(ctx context.Context, payload []byte, family string, addr netip.AddrPort) ([]byte, error) {
+	if resp, ok, err := n.answerFromView(payload, addr); ok {
+		return resp, err
+	}
+	resp, ok, err := n.answerRecursively(ctx, payload, family)
+	if !ok {
+		resp, err = n.resolve(ctx, payload, family, addr)
+	}
+	if n.rebindProtection && err == nil {
+		return n.checkRebinding(payload, resp, addr)
+	}
+	return resp, err
+}
+
+// refuseNonLocal returns a REFUSED response and true if the DNS query in
+// payload is for a name that the nameserver is not authoritative for.
+// Malformed queries and reverse lookups are left to the resolver.
+func (n *nameserver) refuseNonLocal(payload []byte) ([]byte, bool) {
+	h, q, err := parseQuestion(payload)
+	if err != nil {
+		return nil, false
+	}
+	name, err := dnsname.ToFQDN(strings.ToLower(q.Name.String()))
+	if err != nil || n.isLocal(name) || strings.HasSuffix(name.WithTrailingDot(), ".arpa.") {
+		return nil, false
+	}
+	resp, err := errorResponse(h, q, dnsmessage.RCodeRefused)
+	if err != nil {
+		n.logger.Errorf("error building REFUSED response: %v", err)
+		return nil, false
+	}
+	return resp, true
+}
+
+// isLocal reports whether the nameserver is authoritative for name, either
+// because it is within one of the local domains, or the cluster domain while
+// Pods are autodiscovered, or because it has an external record.
+func (n *nameserver) isLocal(name dnsname.FQDN) bool {
+	if n.isLocalDomain(name) {
+		return true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.podAutodiscovery {
+		if d := n.clusterDomainLocked(); d != "" && d.Contains(name) {
+			return true
+		}
+	}
+	_, ok := n.externalHosts[name]
+	return ok
+}
+
+// domains returns the local domains, which the nameserver is authoritative
+// for. The first one is the zone that is signed and announced with NOTIFY.
+func (n *nameserver) domains() []dnsname.FQDN {
+	if len(n.localDomains) > 0 {
+		return n.localDomains
+	}
+	return nsconfig.DefaultLocalDomains
+}
+
+// isLocalDomain reports whether name is within one of the local domains.
+func (n *nameserver) isLocalDomain(name dnsname.FQDN) bool {
+	for _, d := range n.domains() {
+		if d.Contains(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// run ensures that the resolver config is up to date with the nameserver
+// config now and starts a goroutine that updates it every time the
+// configWatcher reports a change, or once n.configDebounce after the last of
+// a burst of changes. Failed config updates leave the last good config in
+// place; after maxReloadErrors consecutive failures, it calls cancelF.
+func (n *nameserver) run(ctx context.Context, cancelF context.CancelFunc) error {
+	expiriesChanged := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.expiriesChanged = expiriesChanged
+	n.mu.Unlock()
+	if err := n.loadInitialConfig(ctx); err != nil {
+		return err
+	}
+	go n.runRecordExpiry(ctx, expiriesChanged)
+	// update updates the resolver config and reports whether run should
+	// keep watching for changes.
+	update := func() bool {
+		if err := n.updateResolverConfig(); err != nil {
+			errs := n.reloadErrors()
+			n.logger.Errorf("error updating resolver config (%d consecutive failures): %v", errs, err)
+			if errs >= max(n.maxReloadErrors, 1) {
+				n.logger.Errorf("giving up after %d consecutive failed config reloads", errs)
+				cancelF()
+				return false
+			}
+		}
+		return true
+	}
+	go func() {
+		// pending fires once no change has been reported for
+		// n.configDebounce, if a change is waiting to be applied.
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				n.logger.Info("configuration watcher stopped")
+				return
+			case event, ok := <-n.configWatcher:
+				if !ok {
+					n.logger.Info("configuration watcher closed")
+					return
+				}
+				n.logger.Infof("configuration update received: %s", event)
+				if n.configDebounce > 0 {
+					// ConfigMap updates are reported as several
+					// file events, and only the last of them
+					// needs to be applied.
+					pending = time.After(n.configDebounce)
+					continue
+				}
+				if !update() {
+					return
+				}
+			case <-pending:
+				pending = nil
+				if !update() {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// loadInitialConfig loads the config for the first time, waiting at most
+// n.startupTimeout for it. If the load takes longer and n.requireConfig is
+// false, it is left to complete in the background.
+func (n *nameserver) loadInitialConfig(ctx context.Context) error {
+	if n.startupTimeout <= 0 {
+		if err := n.updateResolverConfig(); err != nil {
+			return fmt.Errorf("error updating resolver config: %w", err)
+		}
+		return nil
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, n.startupTimeout)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- n.updateResolverConfig() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			return fmt.Errorf("error updating resolver config: %w", err)
+		}
+		return nil
+	case <-timeoutCtx.Done():
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := fmt.Errorf("initial config load did not complete within %v", n.startupTimeout)
+	if n.requireConfig {
+		return err
+	}
+	n.logger.Errorf("%v, serving no records until it does", err)
+	go func() {
+		if err := <-errc; err != nil {
+			n.logger.Errorf("error updating resolver config: %v", err)
+		}
+	}()
+	return nil
+}
+
+// updateResolverConfig reads the latest nameserver config and sets the
+// resolver's host records to match it.
+//
+// It is safe to call concurrently with query: resolver.SetConfig swaps in the
+// new records under the resolver's lock and each query reads the records
+// once, so in-flight queries are answered from either the old or the new
+// config, never a mix of both.
+func (n *nameserver) updateResolverConfig() (err error) {
+	n.reloadMu.Lock()
+	defer n.reloadMu.Unlock()
+	defer func() {
+		if err != nil {
+			n.consecutiveReloadErrors++
+		} else {
+			n.consecutiveReloadErrors = 0
+		}
+		n.metrics.observeReload(err)
+	}()
+	start := time.Now()
+	dnsCfgBytes, err := n.configReader()
+	if err != nil {
+		return fmt.Errorf("error reading nameserver config: %w", err)
+	}
+	opts := n.configOptions()
+	if n.configUnchanged(dnsCfgBytes, opts) {
+		n.logger.Debugf("nameserver config is unchanged, not reloading it")
+		return nil
+	}
+	dnsCfg, err := nsconfig.Decode(dnsCfgBytes, opts)
+	if err != nil {
+		return err
+	}
+	if err := n.applyConfig(dnsCfg, start); err != nil {
+		return err
+	}
+	n.loadedConfig, n.loadedOptions = dnsCfgBytes, opts
+	return nil
+}
+
+// configUnchanged reports whether loading the raw config b with opts would
+// serve the same records as the last loaded config, so that reloads after
+// file events that don't change the config, such as kubelet resyncing the
+// mounted ConfigMap, don't decode and parse large configs again. That is not
+// the case if records of the config have expired since, or if the config is
+// a Corefile, whose hosts files may have changed. n.reloadMu must be held.
+func (n *nameserver) configUnchanged(b []byte, opts nsconfig.Options) bool {
+	last := n.loadedOptions
+	if n.loadedConfig == nil || !bytes.Equal(b, n.loadedConfig) ||
+		opts.Format == nsconfig.FormatCorefile || opts.Format != last.Format ||
+		opts.Strict != last.Strict || !slices.Equal(opts.LocalDomains, last.LocalDomains) ||
+		opts.AllowExternalRecords != last.AllowExternalRecords ||
+		opts.AllowLongLabels != last.AllowLongLabels || opts.EnableIDN != last.EnableIDN {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	for _, t := range n.expiresAt {
+		if !t.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyConfig validates dnsCfg, as returned by nsconfig.Decode, and serves
+// it. start is when loading it began. n.reloadMu must be held.
+func (n *nameserver) applyConfig(dnsCfg *operatorutils.TSHosts, start time.Time) error {
+	n.loadedConfig = nil
+	cfg, err := nsconfig.Parse(dnsCfg, n.configOptions())
+	if err != nil {
+		return err
+	}
+	for _, w := range cfg.Warnings {
+		n.logger.Warnf("nameserver config: %v", w)
+	}
+	n.metrics.observeConfigWarnings(cfg.Warnings)
+	now := time.Now()
+	expired := append(removeExpired(cfg.Hosts, cfg.ExpiresAt, now), removeExpired(cfg.ExternalHosts, cfg.ExpiresAt, now)...)
+	if len(expired) > 0 {
+		n.logger.Infof("not serving %d expired host records: %v", len(expired), expired)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// Records that expired aren't counted as removed by the reload.
+	oldNames := allHostNames(n.hosts, n.externalHosts)
+	if len(expired) > 0 {
+		oldNames = maps.Clone(oldNames)
+		for _, name := range expired {
+			delete(oldNames, name)
+		}
+	}
+	if err := n.migrationChecker.Check(n.logger.Warnf, oldNames, allHostNames(cfg.Hosts, cfg.ExternalHosts)); err != nil {
+		return err
+	}
+	n.config = dnsCfg
+	n.hosts = cfg.Hosts
+	n.externalHosts = cfg.ExternalHosts
+	n.healthCheckPorts = cfg.HealthCheckPorts
+	n.setExpiriesLocked(cfg.ExpiresAt, now)
+	n.rpz = cfg.RPZ
+	n.rewrites = cfg.Rewrites
+	n.views = cfg.Views
+	n.searchDomains, n.ndots = cfg.SearchDomains, cfg.NDots
+	n.configClusterDomain = cfg.ClusterDomain
+	n.federatedNames = federatedNames(dnsCfg.SourcePriority)
+	if err := n.setResolverConfigLocked(); err != nil {
+		return err
+	}
+	n.recordCount = len(cfg.Hosts) + len(cfg.ExternalHosts)
+	n.lastReloadTime = time.Now()
+	n.lastReloadDuration = n.lastReloadTime.Sub(start)
+	n.logger.Infof("resolver config updated with %d host records", n.recordCount)
+	n.sendNotifies()
+	return nil
+}
+
+// configOptions returns the options that configs are loaded with.
+func (n *nameserver) configOptions() nsconfig.Options {
+	return nsconfig.Options{
+		Format:               n.configFormat,
+		Strict:               n.strictConfig,
+		ReadFile:             n.readConfigFile,
+		Logf:                 n.logger.Infof,
+		LocalDomains:         n.domains(),
+		AllowExternalRecords: n.allowExternalRecords,
+		AllowLongLabels:      n.allowLongLabels,
+		EnableIDN:            n.enableIDN,
+	}
+}
+
+// resolve answers the DNS query in payload with n.res. If an identical query
+// is already being answered, it waits for that query's response instead and
+// returns a copy of it with the ID of this query.
+func (n *nameserver) resolve(ctx context.Context, payload []byte, family string, addr netip.AddrPort) ([]byte, error) {
+	key, ok := dedupKey(payload, family)
+	if !ok {
+		return n.res.Query(ctx, payload, family, addr)
+	}
+	resp, err, shared := n.inflight.Do(key, func() ([]byte, error) {
+		return n.res.Query(ctx, payload, family, addr)
+	})
+	if !shared || len(resp) < 2 {
+		return resp, err
+	}
+	// All callers that shared the response get the same slice, and the
+	// response is modified in place later on.
+	resp = bytes.Clone(resp)
+	copy(resp[:2], payload[:2])
+	return resp, err
+}
+
+// dedupKey returns the key under which the query in payload is coalesced
+// with identical queries. Two queries are identical if they only differ in
+// their ID, since everything else, including the case of the name and EDNS0
+// options, may affect the response.
+func dedupKey(payload []byte, family string) (string, bool) {
+	if len(payload) < 2 {
+		return "", false
+	}
+	return family + "/" + string(payload[2:]), true
+}
+
+// isPrioritySource reports whether addr is in one of n.prioritySources.
+func (n *nameserver) isPrioritySource(addr netip.Addr) bool {
+	return slices.ContainsFunc(n.prioritySources, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// acquireQuerySlot reports whether a query slot from n.querySem was acquired
+// within n.queueTimeout.
+func (n *nameserver) acquireQuerySlot(ctx context.Context) bool {
+	if n.querySem.TryAcquire() {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.queueTimeout)
+	defer cancel()
+	return n.querySem.AcquireContext(ctx)
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs.
+func parseCIDRs(s string) ([]netip.Prefix, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var prefixes []netip.Prefix
+	for _, p := range strings.Split(s, ",") {
+		pfx, err := netip.ParsePrefix(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", p, err)
+		}
+		prefixes = append(prefixes, pfx.Masked())
+	}
+	return prefixes, nil
+}
+
+// reloadErrors returns the number of config reloads that failed since the
+// last successful one.
+func (n *nameserver) reloadErrors() int {
+	n.reloadMu.Lock()
+	defer n.reloadMu.Unlock()
+	return n.consecutiveReloadErrors
+}
+
+// setResolverConfigLocked sets the resolver config to serve the records
+// returned by servedHostsLocked. n.mu must be held.
+func (n *nameserver) setResolverConfigLocked() error {
+	c := resolver.Config{
+		Hosts:        n.servedHostsLocked(),
+		LocalDomains: n.resolverDomainsLocked(),
+	}
+	if err := n.res.SetConfig(c); err != nil {
+		return fmt.Errorf("error setting resolver config: %w", err)
+	}
+	return nil
+}
+
+// resolverDomainsLocked returns the domains that the resolver is
+// authoritative for: n.domains(), and the cluster domain while Pods are
+// autodiscovered. n.mu must be held.
+func (n *nameserver) resolverDomainsLocked() []dnsname.FQDN {
+	domains := n.domains()
+	if !n.podAutodiscovery {
+		return domains
+	}
+	if d := n.clusterDomainLocked(); d != "" && !slices.Contains(domains, d) {
+		domains = append(slices.Clip(domains), d)
+	}
+	return domains
+}
+
+// servedHostsLocked returns the host records that are served: n.hosts,
+// n.externalHosts, n.syncedHosts, n.discoveredPods and n.syncedEndpoints, leaving out any IP
+// addresses that are failing health checks, and all IPv4 addresses if
+// n.ipv4Disabled is set. n.mu must be held.
+//
+// Records that nothing is left out of share their IP address slices with
+// n.hosts and n.externalHosts, which are replaced rather than modified on
+// reload, so that reloading large configs doesn't copy every record.
+func (n *nameserver) servedHostsLocked() map[dnsname.FQDN][]netip.Addr {
+	hosts := make(map[dnsname.FQDN][]netip.Addr, len(n.hosts)+len(n.externalHosts))
+	for fqdn, ips := range n.externalHosts {
+		if !n.ipv4Disabled {
+			hosts[fqdn] = ips
+			continue
+		}
+		for _, ip := range ips {
+			if !ip.Is4() {
+				hosts[fqdn] = append(hosts[fqdn], ip)
+			}
+		}
+	}
+	for fqdn, ips := range n.hosts {
+		port := n.healthCheckPorts[fqdn]
+		if port == 0 && !n.ipv4Disabled {
+			hosts[fqdn] = ips
+			continue
+		}
+		served := make([]netip.Addr, 0, len(ips))
+		for _, ip := range ips {
+			if n.ipv4Disabled && ip.Is4() {
+				continue
+			}
+			if port != 0 {
+				if _, ok := n.unhealthy.Load(netip.AddrPortFrom(ip, port)); ok {
+					continue
+				}
+			}
+			served = append(served, ip)
+		}
+		hosts[fqdn] = served
+	}
+	for _, extra := range []map[dnsname.FQDN][]netip.Addr{n.syncedHosts, n.discoveredHostsLocked(), n.endpointHostsLocked()} {
+		for fqdn, ips := range extra {
+			// Copy rather than append to the config's record, which
+			// may be shared with n.hosts.
+			served := slices.Clone(hosts[fqdn])
+			for _, ip := range ips {
+				if n.ipv4Disabled && ip.Is4() || slices.Contains(served, ip) {
+					continue
+				}
+				served = append(served, ip)
+			}
+			hosts[fqdn] = served
+		}
+	}
+	return hosts
+}
+
+// Stats is a snapshot of the nameserver's internal state.
+type Stats struct {
+	// RecordCount is the number of host records currently served.
+	RecordCount int
+	// LastReloadTime is when the config was last successfully loaded.
+	LastReloadTime time.Time
+	// LastReloadDuration is how long the last successful config load took.
+	LastReloadDuration time.Duration
+	// QueriesTotal is the number of DNS queries received since startup.
+	QueriesTotal uint64
+	// QueriesInFlight is the number of DNS queries currently being
+	// processed.
+	QueriesInFlight int32
+}
+
+// Stats returns the current state of the nameserver. It is safe for
+// concurrent use.
+func (n *nameserver) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Stats{
+		RecordCount:        n.recordCount,
+		LastReloadTime:     n.lastReloadTime,
+		LastReloadDuration: n.lastReloadDuration,
+		QueriesTotal:       n.queriesTotal.Load(),
+		QueriesInFlight:    n.queriesInFlight.Load(),
+	}
+}
+
+// Dump returns the config that the nameserver is currently serving. Unlike the
+// last loaded config, its host records don't include IP addresses that are
+// not served because they are failing health checks or because IPv4 is
+// disabled. It is safe for concurrent use.
+func (n *nameserver) Dump() *operatorutils.TSHosts {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dump := &operatorutils.TSHosts{
+		SchemaVersion: nsconfig.SupportedSchemaVersion,
+		Hosts:         make(map[string][]string, len(n.hosts)),
+	}
+	for fqdn, ips := range n.servedHostsLocked() {
+		ipStrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			ipStrs = append(ipStrs, ip.String())
+		}
+		dump.Hosts[fqdn.WithTrailingDot()] = ipStrs
+	}
+	if len(n.healthCheckPorts) > 0 {
+		dump.HealthCheckPorts = make(map[string]uint16, len(n.healthCheckPorts))
+		for fqdn, port := range n.healthCheckPorts {
+			dump.HealthCheckPorts[fqdn.WithTrailingDot()] = port
+		}
+	}
+	if len(n.expiresAt) > 0 {
+		dump.ExpiresAt = make(map[string]time.Time, len(n.expiresAt))
+		for fqdn, t := range n.expiresAt {
+			dump.ExpiresAt[fqdn.WithTrailingDot()] = t
+		}
+	}
+	for _, r := range n.rpz {
+		dump.RPZ = append(dump.RPZ, r.Raw)
+	}
+	for _, r := range n.rewrites {
+		dump.RewriteRules = append(dump.RewriteRules, r.Raw)
+	}
+	for fqdn := range n.externalHosts {
+		if dump.ExternalRecords == nil {
+			dump.ExternalRecords = make(map[string][]string, len(n.externalHosts))
+		}
+		dump.ExternalRecords[fqdn.WithTrailingDot()] = dump.Hosts[fqdn.WithTrailingDot()]
+		delete(dump.Hosts, fqdn.WithTrailingDot())
+	}
+	return dump
+}
+
+// configDirForSource returns the directory that the nameserver config is
+// mounted at for the given --config-source.
+func configDirForSource(source string) (string, error) {
+	switch source {
+	case configSourceConfigMap:
+		return defaultDNSConfigDir, nil
+	case configSourceSecret:
+		return defaultDNSSecretDir, nil
+	}
+	return "", fmt.Errorf("invalid --config-source %q, must be %q or %q", source, configSourceConfigMap, configSourceSecret)
+}
+
+// newConfigMapConfigReader returns a configReaderFunc that reads the desired
+// nameserver configuration from the key named key of a ConfigMap mounted at
+// dir. Secrets are mounted the same way as ConfigMaps, with their data
+// decoded, so it reads the key of a mounted Secret as well.
+func newConfigMapConfigReader(dir, key string) configReaderFunc {
+	return func() ([]byte, error) {
+		if contents, err := os.ReadFile(filepath.Join(dir, key)); err == nil {
+			return contents, nil
+		} else if os.IsNotExist(err) {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	}
+}
+
+// watchConfig returns a channel that receives an event every time the key
+// named key of the ConfigMap mounted at dir changes. If noFileWatch is set,
+// no watcher is started and the returned channel is nil.
+func watchConfig(ctx context.Context, dir, key string, noFileWatch bool, logger *zap.SugaredLogger) (<-chan string, error) {
+	if noFileWatch {
+		logger.Info("file watching disabled, the config will only be reloaded via /reload")
+		return nil, nil
+	}
+	return ensureWatcherForKubeConfigMap(ctx, dir, key, logger)
+}
+
+// ensureWatcherForKubeConfigMap sets up a new file watcher for the key named
+// key of the ConfigMap that's expected to be mounted at dir. Returns a channel
+// that receives an event every time the contents get updated.
+func ensureWatcherForKubeConfigMap(ctx context.Context, dir, key string, logger *zap.SugaredLogger) (<-chan string, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating a new watcher for the mounted ConfigMap: %w", err)
+	}
+	// kubelet mounts configmap to a Pod using a series of symlinks, one of
+	// which is <mount-dir>/..data that Kubernetes recommends consumers to
+	// use if they need to monitor changes
+	// https://github.com/kubernetes/kubernetes/blob/v1.28.1/pkg/volume/util/atomic_writer.go#L39-L61
+	toWatch := filepath.Join(dir, kubeletMountedConfigLn)
+	// The config file itself only changes if dir is not a kubelet
+	// managed ConfigMap mount, for example in local development.
+	configFile := filepath.Join(dir, key)
+	// So is its checksum, see --config-checksum-validation, which may be
+	// fixed after the config was refused for not matching it.
+	checksumFile := configFile + configChecksumSuffix
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed setting up a watcher for the mounted ConfigMap: %w", err)
+	}
+	logger.Infof("Watching %s and %s for changes", toWatch, configFile)
+	c := make(chan string)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					logger.Info("watcher finished")
+					return
+				}
+				// kubelet updates the ConfigMap by atomically
+				// replacing the ..data symlink, which shows up as
+				// a Create event for it.
+				switch {
+				case event.Name == toWatch && event.Has(fsnotify.Create):
+				case (event.Name == configFile || event.Name == checksumFile) && (event.Has(fsnotify.Create) || event.Has(fsnotify.Write)):
+				default:
+					continue
+				}
+				select {
+				case c <- fmt.Sprintf("ConfigMap update received: %s", event):
+				case <-ctx.Done():
+					return
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					logger.Info("watcher finished")
+					return
+				}
+				if errors.Is(err, fsnotify.ErrEventOverflow) {
+					logger.Errorf("watcher event overflow: %v", err)
+					continue
+				}
+				logger.Errorf("watcher error: %v", err)
+			}
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,1747 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/syncs"
+	"tailscale.com/tstest"
+	"tailscale.com/types/logger"
+)
+
+var testHosts = []byte(`{"hosts":{"foo.bar.ts.net.":["10.20.30.40"],"baz.bar.ts.net.":["10.20.30.41","fd7a:115c:a1e0::1"]}}`)
+
+var testSrc = netip.MustParseAddrPort("10.0.0.1:12345")
+
+// newTestNameserver returns a nameserver that serves the config returned by
+// configReader and never receives config updates.
+func newTestNameserver(t testing.TB, configReader configReaderFunc) *nameserver {
+	t.Helper()
+	res := resolver.New(t.Logf, nil, nil, new(tsdial.Dialer), nil)
+	t.Cleanup(res.Close)
+	return &nameserver{
+		res:           res,
+		logger:        zap.NewNop().Sugar(),
+		configReader:  configReader,
+		configWatcher: make(chan string),
+	}
+}
+
+func staticConfig(b []byte) configReaderFunc {
+	return func() ([]byte, error) { return b, nil }
+}
+
+// testQuery returns a packed DNS query for name and typ.
+func testQuery(t testing.TB, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// answerIPs unpacks the DNS response in b and returns its header and the IP
+// addresses in its answer section.
+func answerIPs(t testing.TB, b []byte) (dnsmessage.Header, []netip.Addr) {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		t.Fatalf("unpacking response: %v", err)
+	}
+	var ips []netip.Addr
+	for _, a := range msg.Answers {
+		switch r := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, netip.AddrFrom4(r.A))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, netip.AddrFrom16(r.AAAA))
+		}
+	}
+	return msg.Header, ips
+}
+
+func TestNameserver(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   dnsmessage.Type
+		wantRC  dnsmessage.RCode
+		wantIPs []netip.Addr
+	}{
+		{
+			name:    "a_record",
+			qname:   "foo.bar.ts.net.",
+			qtype:   dnsmessage.TypeA,
+			wantRC:  dnsmessage.RCodeSuccess,
+			wantIPs: []netip.Addr{netip.MustParseAddr("10.20.30.40")},
+		},
+		{
+			name:    "aaaa_record",
+			qname:   "baz.bar.ts.net.",
+			qtype:   dnsmessage.TypeAAAA,
+			wantRC:  dnsmessage.RCodeSuccess,
+			wantIPs: []netip.Addr{netip.MustParseAddr("fd7a:115c:a1e0::1")},
+		},
+		{
+			name:   "unknown_name",
+			qname:  "nope.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantRC: dnsmessage.RCodeNameError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ns.query(ctx, testQuery(t, tt.qname, tt.qtype), testSrc)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			h, ips := answerIPs(t, resp)
+			if h.RCode != tt.wantRC {
+				t.Errorf("got rcode %v, want %v", h.RCode, tt.wantRC)
+			}
+			if len(ips) != len(tt.wantIPs) {
+				t.Fatalf("got IPs %v, want %v", ips, tt.wantIPs)
+			}
+			for i := range ips {
+				if ips[i] != tt.wantIPs[i] {
+					t.Errorf("got IPs %v, want %v", ips, tt.wantIPs)
+				}
+			}
+		})
+	}
+}
+
+// bufferWriteCloser is an io.WriteCloser that writes to a bytes.Buffer.
+type bufferWriteCloser struct {
+	bytes.Buffer
+}
+
+func (bufferWriteCloser) Close() error { return nil }
+
+// TestNameserverIPv6Query checks that queries from IPv6 sources, as on
+// clusters with IPv6 pod IPs, are answered and that their source address is
+// kept intact rather than treated as unspecified.
+func TestNameserverIPv6Query(t *testing.T) {
+	ln, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer ln.Close()
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	var logBuf bufferWriteCloser
+	if ns.queryLog, err = newQueryLogger(&logBuf, queryLogFormatJSON, queryLogBufferSize, t.Errorf); err != nil {
+		t.Fatal(err)
+	}
+	ns.prioritySources = []netip.Prefix{netip.MustParsePrefix("::1/128")}
+	ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	src := netip.MustParseAddrPort("[::1]:12345")
+	if src.Addr().IsUnspecified() || !src.Addr().Is6() {
+		t.Fatalf("source %v is not a specified IPv6 address", src)
+	}
+	resp, err := ns.query(ctx, testQuery(t, "baz.bar.ts.net.", dnsmessage.TypeAAAA), src)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("got rcode %v and answers %v, want one AAAA record", msg.Header.RCode, msg.Answers)
+	}
+	aaaa, ok := msg.Answers[0].Body.(*dnsmessage.AAAAResource)
+	if !ok {
+		t.Fatalf("got answer %T, want *dnsmessage.AAAAResource", msg.Answers[0].Body)
+	}
+	if got := netip.AddrFrom16(aaaa.AAAA); got != netip.MustParseAddr("fd7a:115c:a1e0::1") {
+		t.Errorf("got AAAA record %v, want fd7a:115c:a1e0::1", got)
+	}
+
+	// The same query received on an IPv6 socket.
+	go ns.serve(ctx, ln)
+	c, err := net.DialUDP("udp6", nil, ln.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	udpResp, err := exchangeUDP(c, testQuery(t, "baz.bar.ts.net.", dnsmessage.TypeAAAA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, udpResp); len(ips) != 1 || ips[0] != netip.MustParseAddr("fd7a:115c:a1e0::1") {
+		t.Errorf("got IPs %v over UDP, want [fd7a:115c:a1e0::1]", ips)
+	}
+
+	if err := ns.queryLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var sources []netip.Addr
+	for _, line := range bytes.Split(bytes.TrimSpace(logBuf.Bytes()), []byte("\n")) {
+		var e queryLogEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("invalid query log line %q: %v", line, err)
+		}
+		sources = append(sources, e.Source)
+	}
+	want := []netip.Addr{netip.IPv6Loopback(), netip.IPv6Loopback()}
+	if !slices.Equal(sources, want) {
+		t.Errorf("got logged query sources %v, want %v", sources, want)
+	}
+	// Both queries are from ::1, which is a priority source.
+	if got := testutil.ToFloat64(ns.metrics.priority); got != 2 {
+		t.Errorf("priority_queries_total = %v, want 2", got)
+	}
+}
+
+// exchangeUDP sends the DNS query q from c and returns the response.
+func exchangeUDP(c *net.UDPConn, q []byte) ([]byte, error) {
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+func TestNameserverConfigUpdate(t *testing.T) {
+	var mu sync.Mutex
+	cfg := testHosts
+	ns := newTestNameserver(t, func() ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return cfg, nil
+	})
+	watcher := make(chan string)
+	ns.configWatcher = watcher
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	cfg = []byte(`{"hosts":{"foo.bar.ts.net.":["10.20.30.50"]}}`)
+	mu.Unlock()
+	watcher <- "test update"
+
+	want := netip.MustParseAddr("10.20.30.50")
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+		if err != nil {
+			return err
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != want {
+			return fmt.Errorf("got IPs %v, want [%v]", ips, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.Stats().RecordCount; got != 1 {
+		t.Errorf("got RecordCount %d, want 1", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := ns.Stats()
+	if st.RecordCount != 2 {
+		t.Errorf("got RecordCount %d, want 2", st.RecordCount)
+	}
+	if st.QueriesTotal != 3 {
+		t.Errorf("got QueriesTotal %d, want 3", st.QueriesTotal)
+	}
+	if st.QueriesInFlight != 0 {
+		t.Errorf("got QueriesInFlight %d, want 0", st.QueriesInFlight)
+	}
+	if st.LastReloadTime.IsZero() {
+		t.Error("LastReloadTime is zero")
+	}
+
+	rec := httptest.NewRecorder()
+	ns.handleStats(rec, httptest.NewRequest("GET", "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RecordCount != st.RecordCount || got.QueriesTotal != st.QueriesTotal {
+		t.Errorf("got /stats %+v, want %+v", got, st)
+	}
+}
+
+// BenchmarkStats calls Stats from 100 goroutines while queries are being
+// served. Run with -race to check for data races.
+func BenchmarkStats(b *testing.B) {
+	ns := newTestNameserver(b, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		b.Fatal(err)
+	}
+	q := testQuery(b, "foo.bar.ts.net.", dnsmessage.TypeA)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < b.N; i++ {
+				ns.Stats()
+			}
+		}()
+	}
+	for i := 0; i < b.N; i++ {
+		ns.query(ctx, q, testSrc)
+	}
+	wg.Wait()
+}
+
+func TestNameserverNonFQDNNames(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig([]byte(`{"hosts":{"foo.bar.ts.net":["10.20.30.40"],"baz.bar.ts.net.":["10.20.30.41"]}}`)))
+	core, logs := observer.New(zap.WarnLevel)
+	ns.logger = zap.New(core).Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"foo.bar.ts.net.": "10.20.30.40", "baz.bar.ts.net.": "10.20.30.41"} {
+		resp, err := ns.query(ctx, testQuery(t, name, dnsmessage.TypeA), testSrc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr(want) {
+			t.Errorf("got IPs %v for %s, want [%s]", ips, name, want)
+		}
+	}
+	warnings := logs.FilterMessageSnippet("is not fully qualified").All()
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, `hosts["foo.bar.ts.net"]`) {
+		t.Errorf("got warnings %v, want one for foo.bar.ts.net", warnings)
+	}
+}
+
+// BenchmarkUpdateResolverConfig reloads configs with many host records.
+func BenchmarkUpdateResolverConfig(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		cfg := &operatorutils.TSHosts{Hosts: make(map[string][]string, n)}
+		for i := range n {
+			name := fmt.Sprintf("host-%d.bar.ts.net.", i)
+			cfg.Hosts[name] = []string{
+				fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+				fmt.Sprintf("fd7a:115c:a1e0::%x:%x", i>>16, i&0xffff),
+			}
+		}
+		// configs are the config and the same config with one record
+		// changed, which are reloaded in turn for changed configs.
+		var configs [2][]byte
+		for i := range configs {
+			cfg.Hosts["changed.bar.ts.net."] = []string{fmt.Sprintf("10.255.255.%d", i+1)}
+			var err error
+			if configs[i], err = json.Marshal(cfg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for _, changed := range []bool{false, true} {
+			b.Run(fmt.Sprintf("hosts=%d/changed=%v", n, changed), func(b *testing.B) {
+				var reads int
+				ns := newTestNameserver(b, func() ([]byte, error) {
+					reads++
+					// Copy the config like reading it from a file
+					// does, so that comparing it isn't free.
+					if !changed {
+						return bytes.Clone(configs[0]), nil
+					}
+					return bytes.Clone(configs[reads%2]), nil
+				})
+				if err := ns.updateResolverConfig(); err != nil {
+					b.Fatal(err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					if err := ns.updateResolverConfig(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// writeKubeConfigMap writes the config to the key named key in dir the same
+// way that kubelet updates a mounted ConfigMap: the data is written to a new
+// timestamped directory and the ..data symlink is atomically replaced to point
+// to it.
+func writeKubeConfigMap(t *testing.T, dir, key, version string, dnsJSON []byte) {
+	t.Helper()
+	tsDir := "..data_" + version
+	if err := os.Mkdir(filepath.Join(dir, tsDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, tsDir, key), dnsJSON, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(tsDir, tmpLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, kubeletMountedConfigLn)); err != nil {
+		t.Fatal(err)
+	}
+	userLink := filepath.Join(dir, key)
+	if _, err := os.Lstat(userLink); os.IsNotExist(err) {
+		if err := os.Symlink(filepath.Join(kubeletMountedConfigLn, key), userLink); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConfigHotReload(t *testing.T) {
+	for _, key := range []string{defaultDNSFile, "tailscale-hosts.json"} {
+		t.Run(key, func(t *testing.T) {
+			dir := t.TempDir()
+			writeKubeConfigMap(t, dir, key, "1", testHosts)
+			if key != defaultDNSFile {
+				// A config under the default key must be ignored.
+				if err := os.WriteFile(filepath.Join(dir, defaultDNSFile), []byte(`{"hosts":{"foo.bar.ts.net.":["10.20.30.99"]}}`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ns := newTestNameserver(t, newConfigMapConfigReader(dir, key))
+			watcher, err := ensureWatcherForKubeConfigMap(ctx, dir, key, ns.logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns.configWatcher = watcher
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+
+			resolves := func(name string, want netip.Addr) error {
+				resp, err := ns.query(ctx, testQuery(t, name, dnsmessage.TypeA), testSrc)
+				if err != nil {
+					return err
+				}
+				if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != want {
+					return fmt.Errorf("%s: got IPs %v, want [%v]", name, ips, want)
+				}
+				return nil
+			}
+			if err := resolves("foo.bar.ts.net.", netip.MustParseAddr("10.20.30.40")); err != nil {
+				t.Fatal(err)
+			}
+
+			writeKubeConfigMap(t, dir, key, "2", []byte(`{"hosts":{"foo.bar.ts.net.":["10.20.30.50"]}}`))
+			if err := tstest.WaitFor(5*time.Second, func() error {
+				return resolves("foo.bar.ts.net.", netip.MustParseAddr("10.20.30.50"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if ctx.Err() != nil {
+				t.Fatal("nameserver context was cancelled")
+			}
+		})
+	}
+}
+
+func TestSecretConfigHotReload(t *testing.T) {
+	for source, want := range map[string]string{
+		configSourceConfigMap: defaultDNSConfigDir,
+		configSourceSecret:    defaultDNSSecretDir,
+	} {
+		if got, err := configDirForSource(source); err != nil || got != want {
+			t.Errorf("configDirForSource(%q) = %q, %v, want %q", source, got, err, want)
+		}
+	}
+	if _, err := configDirForSource("etcd"); err == nil {
+		t.Error("configDirForSource(\"etcd\") succeeded, want error")
+	}
+
+	// kubelet mounts Secrets with the same ..data symlinks as ConfigMaps,
+	// typically with files that are only readable by their owner.
+	dir := t.TempDir()
+	writeSecret := func(version string, dnsJSON []byte) {
+		t.Helper()
+		writeKubeConfigMap(t, dir, defaultDNSFile, version, dnsJSON)
+		if err := os.Chmod(filepath.Join(dir, "..data_"+version, defaultDNSFile), 0400); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSecret("1", testHosts)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ns := newTestNameserver(t, newConfigMapConfigReader(dir, defaultDNSFile))
+	watcher, err := watchConfig(ctx, dir, defaultDNSFile, false, ns.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.configWatcher = watcher
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	writeSecret("2", []byte(`{"hosts":{"secret.bar.ts.net.":["10.20.30.70"]}}`))
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		resp, err := ns.query(ctx, testQuery(t, "secret.bar.ts.net.", dnsmessage.TypeA), testSrc)
+		if err != nil {
+			return err
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.70") {
+			return fmt.Errorf("got IPs %v, want [10.20.30.70]", ips)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartupTimeout(t *testing.T) {
+	for _, requireConfig := range []bool{true, false} {
+		t.Run(fmt.Sprintf("require_config=%v", requireConfig), func(t *testing.T) {
+			release := make(chan struct{})
+			ns := newTestNameserver(t, func() ([]byte, error) {
+				<-release
+				return testHosts, nil
+			})
+			ns.startupTimeout = 50 * time.Millisecond
+			ns.requireConfig = requireConfig
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			start := time.Now()
+			err := ns.run(ctx, cancel)
+			if d := time.Since(start); d > 5*time.Second {
+				t.Fatalf("run returned after %v, want about %v", d, ns.startupTimeout)
+			}
+			if requireConfig {
+				if err == nil {
+					t.Error("run succeeded, want timeout error")
+				}
+			} else if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !ns.Stats().LastReloadTime.IsZero() {
+				t.Fatal("config loaded before the reader was released")
+			}
+
+			// The initial load still completes in the background once
+			// the reader returns.
+			close(release)
+			if err := tstest.WaitFor(5*time.Second, func() error {
+				resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+				if err != nil {
+					return err
+				}
+				if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+					return fmt.Errorf("got IPs %v, want [10.20.30.40]", ips)
+				}
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestConfigReloadUnchanged(t *testing.T) {
+	config := testHosts
+	var reads int
+	ns := newTestNameserver(t, func() ([]byte, error) {
+		reads++
+		return config, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	loaded := ns.Stats().LastReloadTime
+
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.Stats().LastReloadTime; !got.Equal(loaded) || reads != 2 {
+		t.Errorf("got last reload at %v after %d reads, want the unchanged config to be read but not loaded again at %v", got, reads, loaded)
+	}
+
+	config = []byte(`{"hosts":{"foo.bar.ts.net.":["10.20.30.42"]}}`)
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.Stats().LastReloadTime; !got.After(loaded) {
+		t.Errorf("got last reload at %v, want the changed config to be loaded after %v", got, loaded)
+	}
+	if got := ns.Dump().Hosts["foo.bar.ts.net."]; !slices.Equal(got, []string{"10.20.30.42"}) {
+		t.Errorf("got foo.bar.ts.net. records %v after reloading a changed config, want [10.20.30.42]", got)
+	}
+
+	// A config that failed to load is loaded again even if it didn't
+	// change, so that reload errors are reported each time.
+	config = []byte(`{"hosts":{"foo.bar.ts.net.":["not-an-ip"]}}`)
+	for range 2 {
+		if err := ns.updateResolverConfig(); err == nil {
+			t.Error("reloading an invalid config succeeded")
+		}
+	}
+}
+
+func TestConfigReloadMaxErrors(t *testing.T) {
+	const (
+		goodCfg = `{"hosts":{"foo.bar.ts.net.":["10.20.30.50"]}}`
+		badCfg  = `{"hosts":{"foo.bar.ts.net.":["not-an-ip"]}}`
+	)
+	for _, tt := range []struct {
+		name         string
+		failures     int
+		wantShutdown bool
+	}{
+		{"max_failures", 10, true},
+		{"recovers_before_max", 9, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			cfg := testHosts
+			ns := newTestNameserver(t, func() ([]byte, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return cfg, nil
+			})
+			ns.maxReloadErrors = 10
+			watcher := make(chan string)
+			ns.configWatcher = watcher
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			// reload triggers a reload of c and waits for it to
+			// finish, which it has once there have been wantErrs
+			// consecutive failures.
+			reload := func(c string, wantErrs int) {
+				t.Helper()
+				mu.Lock()
+				cfg = []byte(c)
+				mu.Unlock()
+				select {
+				case watcher <- "update":
+				case <-ctx.Done():
+					t.Fatal("nameserver shut down")
+				}
+				if err := tstest.WaitFor(5*time.Second, func() error {
+					if got := ns.reloadErrors(); got != wantErrs {
+						return fmt.Errorf("got %d consecutive reload errors, want %d", got, wantErrs)
+					}
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := range tt.failures {
+				reload(badCfg, i+1)
+			}
+			if tt.wantShutdown {
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Second):
+					t.Fatalf("nameserver did not shut down after %d failed reloads", tt.failures)
+				}
+				return
+			}
+
+			// The failures before a successful reload don't count
+			// towards the next ones.
+			reload(goodCfg, 0)
+			for i := range tt.failures {
+				reload(badCfg, i+1)
+			}
+			if ctx.Err() != nil {
+				t.Fatal("nameserver shut down")
+			}
+			// The last good config is still served.
+			resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.50") {
+				t.Errorf("got IPs %v, want [10.20.30.50]", ips)
+			}
+		})
+	}
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	const window = 100 * time.Millisecond
+	var updates atomic.Int32
+	ns := newTestNameserver(t, func() ([]byte, error) {
+		updates.Add(1)
+		return testHosts, nil
+	})
+	ns.configDebounce = window
+	watcher := make(chan string)
+	ns.configWatcher = watcher
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	// The initial config load isn't an update.
+	updates.Store(0)
+
+	// burst sends 20 events 10ms apart, and waits for them to cause
+	// wantUpdates updates in total.
+	burst := func(wantUpdates int32) {
+		t.Helper()
+		for range 20 {
+			watcher <- "update"
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			if got := updates.Load(); got != wantUpdates {
+				return fmt.Errorf("got %d updates, want %d", got, wantUpdates)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// No more updates follow after the debounce window.
+		time.Sleep(2 * window)
+		if got := updates.Load(); got != wantUpdates {
+			t.Fatalf("got %d updates after the burst, want %d", got, wantUpdates)
+		}
+	}
+	burst(1)
+	// A second burst, after more than the debounce window, causes a
+	// second update.
+	time.Sleep(500*time.Millisecond - 2*window)
+	burst(2)
+}
+
+func TestParseConfigSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       string
+		strict    bool
+		wantErr   bool
+		wantWarn  bool
+		wantHosts int
+	}{
+		{
+			name:      "v1",
+			cfg:       `{"schemaVersion":1,"hosts":{"foo.bar.ts.net.":["10.20.30.40"]}}`,
+			strict:    true,
+			wantHosts: 1,
+		},
+		{
+			name:      "unversioned",
+			cfg:       `{"hosts":{"foo.bar.ts.net.":["10.20.30.40"]}}`,
+			strict:    true,
+			wantHosts: 1,
+		},
+		{
+			name:      "v1_unknown_field",
+			cfg:       `{"schemaVersion":1,"hosts":{"foo.bar.ts.net.":["10.20.30.40"]},"srv":{}}`,
+			wantHosts: 1,
+		},
+		{
+			name:    "v1_unknown_field_strict",
+			cfg:     `{"schemaVersion":1,"hosts":{"foo.bar.ts.net.":["10.20.30.40"]},"srv":{}}`,
+			strict:  true,
+			wantErr: true,
+		},
+		{
+			name:      "v2_strict",
+			cfg:       `{"schemaVersion":2,"hosts":{"foo.bar.ts.net.":["10.20.30.40"]},"srv":{"_http._tcp.foo.bar.ts.net.":["foo.bar.ts.net.:80"]}}`,
+			strict:    true,
+			wantWarn:  true,
+			wantHosts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			ns := newTestNameserver(t, staticConfig([]byte(tt.cfg)))
+			ns.logger = zap.New(core).Sugar()
+			ns.strictConfig = tt.strict
+			if err := ns.updateResolverConfig(); (err != nil) != tt.wantErr {
+				t.Fatalf("updateResolverConfig: got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := logs.Len() > 0; got != tt.wantWarn {
+				t.Errorf("got warning %v, want %v", got, tt.wantWarn)
+			}
+			if got := ns.Stats().RecordCount; got != tt.wantHosts {
+				t.Errorf("got %d records, want %d", got, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestNameserverDisableRecursion(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.disableRecursion = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := ns.query(ctx, testQuery(t, "example.com.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	h, ips := answerIPs(t, resp)
+	if h.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("out of zone query: got rcode %v, want %v", h.RCode, dnsmessage.RCodeRefused)
+	}
+	if h.ID != 1234 || !h.Response {
+		t.Errorf("out of zone query: got header %+v, want response with ID 1234", h)
+	}
+	if len(ips) != 0 {
+		t.Errorf("out of zone query: got IPs %v, want none", ips)
+	}
+
+	resp, err = ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	h, ips = answerIPs(t, resp)
+	if h.RCode != dnsmessage.RCodeSuccess || len(ips) != 1 {
+		t.Errorf("in zone query: got rcode %v and IPs %v, want success with 1 IP", h.RCode, ips)
+	}
+	if h.RecursionAvailable {
+		t.Error("in zone query: RA bit set with recursion disabled")
+	}
+}
+
+func TestNameserverLocalDomains(t *testing.T) {
+	domains, err := nsconfig.ParseLocalDomains("corp.tailnet.example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newTestNameserver(t, staticConfig([]byte(`{"hosts":{"db.corp.tailnet.example.com.":["10.20.30.40"],"foo.bar.ts.net.":["10.20.30.41"]}}`)))
+	ns.localDomains = domains
+	ns.disableRecursion = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		wantRCode dnsmessage.RCode
+		wantIPs   int
+	}{
+		{"db.corp.tailnet.example.com.", dnsmessage.RCodeSuccess, 1},
+		// Unknown names in a local domain don't exist, rather than being
+		// forwarded upstream.
+		{"missing.corp.tailnet.example.com.", dnsmessage.RCodeNameError, 0},
+		// ts.net is no longer local, so with recursion disabled its
+		// records aren't served.
+		{"foo.bar.ts.net.", dnsmessage.RCodeRefused, 0},
+	} {
+		resp, err := ns.query(ctx, testQuery(t, tc.name, dnsmessage.TypeA), testSrc)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		h, ips := answerIPs(t, resp)
+		if h.RCode != tc.wantRCode || len(ips) != tc.wantIPs {
+			t.Errorf("%s: got rcode %v and IPs %v, want %v with %d IPs", tc.name, h.RCode, ips, tc.wantRCode, tc.wantIPs)
+		}
+	}
+}
+
+func TestNameserverIPv4Disabled(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.ipv4Disabled = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   dnsmessage.Type
+		wantIPs []netip.Addr
+	}{
+		{
+			name:  "ipv4_only_host_a",
+			qname: "foo.bar.ts.net.",
+			qtype: dnsmessage.TypeA,
+		},
+		{
+			name:  "dual_stack_host_a",
+			qname: "baz.bar.ts.net.",
+			qtype: dnsmessage.TypeA,
+		},
+		{
+			name:    "dual_stack_host_aaaa",
+			qname:   "baz.bar.ts.net.",
+			qtype:   dnsmessage.TypeAAAA,
+			wantIPs: []netip.Addr{netip.MustParseAddr("fd7a:115c:a1e0::1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ns.query(ctx, testQuery(t, tt.qname, tt.qtype), testSrc)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			h, ips := answerIPs(t, resp)
+			if h.RCode != dnsmessage.RCodeSuccess {
+				t.Errorf("got rcode %v, want %v", h.RCode, dnsmessage.RCodeSuccess)
+			}
+			if !slices.Equal(ips, tt.wantIPs) {
+				t.Errorf("got IPs %v, want %v", ips, tt.wantIPs)
+			}
+		})
+	}
+}
+
+// TestNameserverMultipleQuestionsInOneMessage checks that queries with more
+// than one question are answered with FORMERR, rather than only the first
+// question being answered.
+func TestNameserverMultipleQuestionsInOneMessage(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo.bar.ts.net.", "baz.bar.ts.net."} {
+		if err := b.Question(dnsmessage.Question{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ns.query(ctx, q, testSrc)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 1234 || !msg.Header.Response {
+		t.Errorf("got header %+v, want response with ID 1234", msg.Header)
+	}
+	if msg.Header.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("got rcode %v, want %v", msg.Header.RCode, dnsmessage.RCodeFormatError)
+	}
+	if len(msg.Answers) != 0 {
+		t.Errorf("got answers %v, want none", msg.Answers)
+	}
+}
+
+func TestNameserverRefuseANY(t *testing.T) {
+	for _, refuse := range []bool{true, false} {
+		t.Run(fmt.Sprintf("refuse=%v", refuse), func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			res := &slowResolver{dnsResolver: ns.res}
+			ns.res = res
+			ns.refuseAny = refuse
+			ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeALL), testSrc)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			wantQueries, wantRefused := int32(1), 0.0
+			if refuse {
+				if msg.Header.RCode != dnsmessage.RCodeRefused {
+					t.Errorf("got rcode %v, want %v", msg.Header.RCode, dnsmessage.RCodeRefused)
+				}
+				wantQueries, wantRefused = 0, 1
+			}
+			if got := res.queries.Load(); got != wantQueries {
+				t.Errorf("resolver got %d queries, want %d", got, wantQueries)
+			}
+			if got := testutil.ToFloat64(ns.metrics.anyRefused); got != wantRefused {
+				t.Errorf("any_queries_refused_total = %v, want %v", got, wantRefused)
+			}
+		})
+	}
+}
+
+func TestNameserverMaxConcurrentQueries(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	sem := syncs.NewSemaphore(100)
+	ns.querySem, ns.queueTimeout = &sem, 50*time.Millisecond
+	ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	rcodes := func(n int) map[dnsmessage.RCode]int {
+		var mu sync.Mutex
+		got := make(map[dnsmessage.RCode]int)
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := ns.query(ctx, q, testSrc)
+				if err != nil {
+					t.Errorf("query: %v", err)
+					return
+				}
+				h, _ := answerIPs(t, resp)
+				mu.Lock()
+				got[h.RCode]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return got
+	}
+
+	// With all slots taken, queries time out waiting for one.
+	for range 100 {
+		sem.Acquire()
+	}
+	if got := rcodes(10); got[dnsmessage.RCodeServerFailure] != 10 {
+		t.Errorf("with all slots taken: got rcodes %v, want 10 SERVFAIL", got)
+	}
+	if got := testutil.ToFloat64(ns.metrics.dropped); got != 10 {
+		t.Errorf("got %v dropped queries, want 10", got)
+	}
+	for range 100 {
+		sem.Release()
+	}
+
+	// Queries beyond the limit wait for a slot.
+	sem2 := syncs.NewSemaphore(100)
+	ns.querySem, ns.queueTimeout = &sem2, 10*time.Second
+	if got := rcodes(2000); got[dnsmessage.RCodeSuccess] != 2000 {
+		t.Errorf("got rcodes %v, want 2000 successful responses", got)
+	}
+}
+
+func TestNameserverPrioritySources(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	sem := syncs.NewSemaphore(10)
+	ns.querySem, ns.queueTimeout = &sem, 50*time.Millisecond
+	prioritySem := syncs.NewSemaphore(1)
+	ns.prioritySem = &prioritySem
+	var err error
+	if ns.prioritySources, err = parseCIDRs("10.96.0.0/12, fd00::/8"); err != nil {
+		t.Fatal(err)
+	}
+	ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	rcode := func(src string) dnsmessage.RCode {
+		t.Helper()
+		resp, err := ns.query(ctx, q, netip.MustParseAddrPort(src))
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		h, _ := answerIPs(t, resp)
+		return h.RCode
+	}
+
+	// Regular queries are dropped while all slots are held, but queries
+	// from priority sources are still answered.
+	for range 10 {
+		sem.Acquire()
+	}
+	if got := rcode("10.0.0.1:53"); got != dnsmessage.RCodeServerFailure {
+		t.Errorf("regular query with all slots taken: got rcode %v, want SERVFAIL", got)
+	}
+	for _, src := range []string{"10.96.0.1:53", "10.100.5.6:53", "[fd00::1]:53"} {
+		if got := rcode(src); got != dnsmessage.RCodeSuccess {
+			t.Errorf("priority query from %s with all slots taken: got rcode %v, want success", src, got)
+		}
+	}
+	for range 10 {
+		sem.Release()
+	}
+
+	// Priority queries don't wait for a slot of their own pool.
+	prioritySem.Acquire()
+	if got := rcode("10.96.0.1:53"); got != dnsmessage.RCodeServerFailure {
+		t.Errorf("priority query with all priority slots taken: got rcode %v, want SERVFAIL", got)
+	}
+	if got := rcode("10.0.0.1:53"); got != dnsmessage.RCodeSuccess {
+		t.Errorf("regular query with all priority slots taken: got rcode %v, want success", got)
+	}
+	prioritySem.Release()
+
+	for _, tc := range []struct {
+		name string
+		c    prometheus.Collector
+		want float64
+	}{
+		{"dropped", ns.metrics.dropped, 1},
+		{"priority", ns.metrics.priority, 4},
+		{"priorityDropped", ns.metrics.priorityDropped, 1},
+	} {
+		if got := testutil.ToFloat64(tc.c); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNameserverExternalRecords(t *testing.T) {
+	cfg := []byte(`{
+		"hosts": {"foo.bar.ts.net.": ["10.20.30.40"]},
+		"externalRecords": {"db.internal.": ["10.0.0.5"]}
+	}`)
+	for _, allow := range []bool{true, false} {
+		t.Run(fmt.Sprintf("allow=%v", allow), func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(cfg))
+			ns.allowExternalRecords = allow
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			query := func(name string) (dnsmessage.Header, []netip.Addr) {
+				t.Helper()
+				resp, err := ns.query(ctx, testQuery(t, name, dnsmessage.TypeA), testSrc)
+				if err != nil {
+					t.Fatalf("query: %v", err)
+				}
+				return answerIPs(t, resp)
+			}
+
+			h, ips := query("db.internal.")
+			served := h.RCode == dnsmessage.RCodeSuccess && len(ips) == 1 && ips[0] == netip.MustParseAddr("10.0.0.5")
+			if served != allow {
+				t.Errorf("db.internal.: got rcode %v and IPs %v, want served=%v", h.RCode, ips, allow)
+			}
+			// Other names in the external record's domain are not
+			// local and are forwarded rather than answered with
+			// NXDOMAIN.
+			if h, _ := query("other.internal."); h.RCode == dnsmessage.RCodeNameError {
+				t.Errorf("other.internal.: got rcode %v, want the query to be forwarded", h.RCode)
+			}
+			if h, _ := query("missing.bar.ts.net."); h.RCode != dnsmessage.RCodeNameError {
+				t.Errorf("missing.bar.ts.net.: got rcode %v, want %v", h.RCode, dnsmessage.RCodeNameError)
+			}
+			if h, ips := query("foo.bar.ts.net."); h.RCode != dnsmessage.RCodeSuccess || len(ips) != 1 {
+				t.Errorf("foo.bar.ts.net.: got rcode %v and IPs %v, want 1 IP", h.RCode, ips)
+			}
+		})
+	}
+
+	t.Run("in_local_domain", func(t *testing.T) {
+		ns := newTestNameserver(t, staticConfig([]byte(`{"hosts":{},"externalRecords":{"db.bar.ts.net.":["10.0.0.5"]}}`)))
+		ns.allowExternalRecords = true
+		if err := ns.updateResolverConfig(); err == nil {
+			t.Error("got nil error for external record within ts.net")
+		}
+	})
+}
+
+// slowResolver is a dnsResolver that counts queries and delays them.
+type slowResolver struct {
+	dnsResolver
+	delay   time.Duration
+	queries atomic.Int32
+}
+
+func (r *slowResolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+	r.queries.Add(1)
+	time.Sleep(r.delay)
+	return r.dnsResolver.Query(ctx, bs, family, from)
+}
+
+// blockingResolver is a dnsResolver whose queries block until release is
+// closed or their context is done.
+type blockingResolver struct {
+	dnsResolver
+	release chan struct{}
+}
+
+func (r *blockingResolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+	select {
+	case <-r.release:
+		return r.dnsResolver.Query(ctx, bs, family, from)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestNameserverQueryTimeout(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	res := &blockingResolver{dnsResolver: ns.res, release: make(chan struct{})}
+	defer close(res.release)
+	ns.res = res
+	runCtx, runCancel := context.WithCancel(context.Background())
+	defer runCancel()
+	if err := ns.run(runCtx, runCancel); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("query returned after %v, want it to return when its context is cancelled after 100ms", d)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got response %x, error %v, want %v", resp, err, context.Canceled)
+	}
+}
+
+func TestNameserverQueryDeduplication(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	res := &slowResolver{dnsResolver: ns.res, delay: 200 * time.Millisecond}
+	ns.res = res
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := uint16(i)
+			qi := bytes.Clone(q)
+			binary.BigEndian.PutUint16(qi, id)
+			resp, err := ns.query(ctx, qi, testSrc)
+			if err != nil {
+				t.Errorf("query: %v", err)
+				return
+			}
+			h, ips := answerIPs(t, resp)
+			if h.ID != id {
+				t.Errorf("got response ID %d, want %d", h.ID, id)
+			}
+			if len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+				t.Errorf("got IPs %v, want [10.20.30.40]", ips)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := res.queries.Load(); got > 5 {
+		t.Errorf("resolver got %d queries for 100 identical concurrent queries, want them coalesced", got)
+	}
+
+	// Queries that differ in more than their ID are not coalesced.
+	res.queries.Store(0)
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ns.query(ctx, testQuery(t, "baz.bar.ts.net.", typ), testSrc)
+		}()
+	}
+	wg.Wait()
+	if got := res.queries.Load(); got != 2 {
+		t.Errorf("resolver got %d queries for 2 different queries, want 2", got)
+	}
+}
+
+// TestNameserverConcurrentReload checks that queries that are in flight
+// while the config is being reloaded are answered from either the old or the
+// new config.
+func TestNameserverConcurrentReload(t *testing.T) {
+	cfgs := [][]byte{
+		[]byte(`{"hosts":{"foo.bar.ts.net.":["10.0.0.1"]}}`),
+		[]byte(`{"hosts":{"foo.bar.ts.net.":["10.0.0.3"]}}`),
+	}
+	var reloads atomic.Int64
+	ns := newTestNameserver(t, func() ([]byte, error) {
+		return cfgs[reloads.Add(1)%2], nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func(ips []netip.Addr) bool {
+		return len(ips) == 1 && (ips[0] == netip.MustParseAddr("10.0.0.1") || ips[0] == netip.MustParseAddr("10.0.0.3"))
+	}
+	q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ns.updateResolverConfig(); err != nil {
+				t.Errorf("updateResolverConfig: %v", err)
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := ns.query(ctx, q, testSrc)
+			if err != nil {
+				t.Errorf("query: %v", err)
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Errorf("unpacking response: %v", err)
+				return
+			}
+			if _, ips := answerIPs(t, resp); !valid(ips) {
+				t.Errorf("got IPs %v, want IPs from one of the configs", ips)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestNameserverConfigRaceCondition reloads configs that use every kind of
+// record and rule while queries that are answered from each of them and
+// HTTP requests for the served config are being handled, for the race
+// detector to check that all of the config is read under the right locks.
+func TestNameserverConfigRaceCondition(t *testing.T) {
+	t.Parallel()
+	cfgs := [][]byte{
+		[]byte(`{
+			"hosts": {"foo.bar.ts.net.": ["10.0.0.1"], "db.svc.bar.ts.net.": ["10.0.1.1"]},
+			"rpz": [{"name": "old.bar.ts.net.", "action": "REDIRECT foo.bar.ts.net."}],
+			"rewriteRules": [{"sourceCIDR": "10.0.0.0/8", "originalIP": "10.0.1.1", "replacementIP": "10.0.1.2"}],
+			"views": [{"sourceCIDR": "10.0.0.0/8", "hosts": {"view.bar.ts.net.": ["10.0.2.1"]}}],
+			"searchDomains": ["svc.bar.ts.net."]
+		}`),
+		[]byte(`{
+			"hosts": {"foo.bar.ts.net.": ["10.0.0.3"], "db.svc.bar.ts.net.": ["10.0.1.3"]},
+			"rpz": [{"name": "old.bar.ts.net.", "action": "NXDOMAIN"}],
+			"views": [{"sourceCIDR": "10.0.0.0/8", "hosts": {"view.bar.ts.net.": ["10.0.2.3"]}}],
+			"searchDomains": ["svc.bar.ts.net."]
+		}`),
+	}
+	var reloads atomic.Int64
+	ns := newTestNameserver(t, func() ([]byte, error) {
+		return cfgs[reloads.Add(1)%2], nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"foo.bar.ts.net.", "db.svc.bar.ts.net.", "old.bar.ts.net.", "view.bar.ts.net.", "db."}
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ns.updateResolverConfig(); err != nil {
+				t.Errorf("updateResolverConfig: %v", err)
+			}
+		}()
+	}
+	for i := range 500 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := ns.query(ctx, testQuery(t, names[i%len(names)], dnsmessage.TypeA), testSrc)
+			if err != nil {
+				t.Errorf("query for %s: %v", names[i%len(names)], err)
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Errorf("unpacking response for %s: %v", names[i%len(names)], err)
+			}
+		}()
+	}
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			ns.handleConfig(rec, httptest.NewRequest("GET", "/config", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET /config: got status %d", rec.Code)
+			}
+			ns.Stats()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestListenIPv6Only(t *testing.T) {
+	conn, err := listenUDP(":0", true, "", false)
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	defer conn.Close()
+	la := conn.LocalAddr().(*net.UDPAddr)
+	if la.IP.To4() != nil || !la.IP.IsUnspecified() {
+		t.Errorf("got local address %v, want [::]", la)
+	}
+	// The socket must not have claimed the IPv4 port.
+	c4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: la.Port})
+	if err != nil {
+		t.Errorf("IPv6-only socket also bound the IPv4 port: %v", err)
+	} else {
+		c4.Close()
+	}
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	go ns.serve(ctx, conn)
+
+	client, err := net.DialUDP("udp6", nil, &net.UDPAddr{IP: net.IPv6loopback, Port: la.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, buf[:n]); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+		t.Errorf("got IPs %v, want [10.20.30.40]", ips)
+	}
+}
+
+func TestListenUDPAllProtocols(t *testing.T) {
+	conns, err := listenUDPAllProtocols(":0", "")
+	if err != nil {
+		t.Skipf("IPv4 and IPv6 not both available: %v", err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("got %d sockets, want 2", len(conns))
+	}
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range conns {
+		defer conn.Close()
+		go ns.serve(ctx, conn)
+	}
+	la4, la6 := conns[0].LocalAddr().(*net.UDPAddr), conns[1].LocalAddr().(*net.UDPAddr)
+	if !la4.IP.Equal(net.IPv4zero) || la6.IP.To4() != nil || !la6.IP.IsUnspecified() || la4.Port != la6.Port {
+		t.Fatalf("got local addresses %v and %v, want 0.0.0.0 and [::] on the same port", la4, la6)
+	}
+
+	q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	for _, tc := range []struct {
+		network string
+		ip      net.IP
+	}{
+		{"udp4", net.IPv4(127, 0, 0, 1)},
+		{"udp6", net.IPv6loopback},
+	} {
+		c, err := net.DialUDP(tc.network, nil, &net.UDPAddr{IP: tc.ip, Port: la4.Port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		resp, err := exchangeUDP(c, q)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.network, err)
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+			t.Errorf("%s: got IPs %v, want [10.20.30.40]", tc.network, ips)
+		}
+	}
+}
+
+func TestNameserverIPv4MappedSource(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	src := netip.MustParseAddrPort("[::ffff:10.0.0.1]:12345")
+	resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+		t.Errorf("got IPs %v, want [10.20.30.40]", ips)
+	}
+}
+
+// TestNameserverConcurrency sends many parallel queries through the UDP
+// serving loop. Run with -race to check for data races.
+func TestNameserverConcurrency(t *testing.T) {
+	t.Parallel()
+	const numHosts = 100
+	hosts := make(map[string][]string, numHosts)
+	for i := 0; i < numHosts; i++ {
+		hosts[fmt.Sprintf("host-%d.bar.ts.net.", i)] = []string{fmt.Sprintf("10.1.%d.%d", i/256, i%256)}
+	}
+	cfg, err := json.Marshal(operatorutils.TSHosts{Hosts: hosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newTestNameserver(t, staticConfig(cfg))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go ns.serve(ctx, conn)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := rand.N(numHosts)
+			name := fmt.Sprintf("host-%d.bar.ts.net.", h)
+			want := netip.MustParseAddr(hosts[name][0])
+			client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer client.Close()
+			// Like real DNS clients, retry in case the query or
+			// response was dropped because a socket buffer was
+			// full.
+			buf := make([]byte, 512)
+			var n int
+			for try := 0; ; try++ {
+				if _, err := client.Write(testQuery(t, name, dnsmessage.TypeA)); err != nil {
+					t.Error(err)
+					return
+				}
+				client.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, err = client.Read(buf)
+				if err == nil {
+					break
+				}
+				if try == 4 {
+					t.Errorf("%s: %v", name, err)
+					return
+				}
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil {
+				t.Errorf("%s: mangled response: %v", name, err)
+				return
+			}
+			if msg.Header.ID != 1234 || len(msg.Questions) != 1 || msg.Questions[0].Name.String() != name {
+				t.Errorf("%s: response for the wrong query: %+v", name, msg)
+				return
+			}
+			if len(msg.Answers) != 1 {
+				t.Errorf("%s: got %d answers, want 1", name, len(msg.Answers))
+				return
+			}
+			a, ok := msg.Answers[0].Body.(*dnsmessage.AResource)
+			if !ok || netip.AddrFrom4(a.A) != want {
+				t.Errorf("%s: got answer %v, want %v", name, msg.Answers[0].Body, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func FuzzNameserverQuery(f *testing.F) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	signer, err := newDNSSECSigner("ts.net.", ecKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	cfg := []byte(`{
+		"hosts": {
+			"foo.bar.ts.net.": ["10.20.30.40", "fd7a:115c:a1e0::1"],
+			"baz.bar.ts.net.": ["10.20.30.41"]
+		},
+		"rpz": [
+			{"name": "blocked.bar.ts.net.", "action": "NXDOMAIN"},
+			{"name": "alias.bar.ts.net.", "action": "REDIRECT foo.bar.ts.net."}
+		],
+		"rewriteRules": [
+			{"sourceCIDR": "10.0.0.0/8", "originalIP": "10.20.30.41", "replacementIP": "10.20.30.42"}
+		]
+	}`)
+	ns := newTestNameserver(f, staticConfig(cfg))
+	// The fuzz target must not log to f.
+	res := resolver.New(logger.Discard, nil, nil, new(tsdial.Dialer), nil)
+	f.Cleanup(res.Close)
+	ns.res = res
+	ns.dnssec = signer
+	ns.nsid = "fuzz"
+	ns.disableRecursion = true
+	ctx, cancel := context.WithCancel(context.Background())
+	f.Cleanup(cancel)
+	if err := ns.run(ctx, cancel); err != nil {
+		f.Fatal(err)
+	}
+
+	for _, name := range []string{"foo.bar.ts.net.", "blocked.bar.ts.net.", "alias.bar.ts.net.", "ts.net.", "example.com."} {
+		for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.Type(48)} { // 48 is DNSKEY
+			q := testQuery(f, name, typ)
+			f.Add(q)
+			// The same query with an EDNS0 OPT record with the DO
+			// bit set.
+			var p dnsmessage.Parser
+			h, err := p.Start(q)
+			if err != nil {
+				f.Fatal(err)
+			}
+			question, err := p.Question()
+			if err != nil {
+				f.Fatal(err)
+			}
+			b := dnsmessage.NewBuilder(nil, h)
+			b.StartQuestions()
+			b.Question(question)
+			b.StartAdditionals()
+			var rh dnsmessage.ResourceHeader
+			if err := rh.SetEDNS0(dns.DefaultMsgSize, dnsmessage.RCodeSuccess, true); err != nil {
+				f.Fatal(err)
+			}
+			b.OPTResource(rh, dnsmessage.OPTResource{})
+			edns, err := b.Finish()
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(edns)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		resp, err := ns.query(ctx, payload, testSrc)
+		if err != nil || resp == nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatalf("unparseable response %x to query %x: %v", resp, payload, err)
+		}
+	})
+}
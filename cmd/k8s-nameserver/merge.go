@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/mak"
+)
+
+// mergedConfigSource is one of the sources of a merged config.
+type mergedConfigSource struct {
+	// name identifies the source in logs.
+	name string
+	// priority is the trust level of the source. Records from a source
+	// with a higher priority override those for the same DNS name from
+	// sources with a lower priority.
+	priority int
+	// read returns the source's config in JSON format.
+	read configReaderFunc
+}
+
+// newMergedConfigReader returns a configReaderFunc that reads all of sources
+// and merges them into a single JSON config. For each DNS name, the records
+// are taken from the source with the highest priority that has any. Between
+// sources of the same priority, the one listed first wins. Response policy
+// rules, rewrite rules and views of all sources are combined, in order of
+// priority, and the search domains are taken from the source with the
+// highest priority that has any.
+//
+// Every record that is overridden is logged, so that conflicts between the
+// sources are visible to operators.
+func newMergedConfigReader(logger *zap.SugaredLogger, sources ...mergedConfigSource) configReaderFunc {
+	// Stable so that sources of the same priority keep their order.
+	sources = slices.Clone(sources)
+	slices.SortStableFunc(sources, func(a, b mergedConfigSource) int {
+		return cmp.Compare(b.priority, a.priority)
+	})
+	return func() ([]byte, error) {
+		merged := &operatorutils.TSHosts{
+			Hosts:          make(map[string][]string),
+			SourcePriority: make(map[string]int),
+		}
+		// owners are the sources that the records of each DNS name
+		// were taken from.
+		owners := make(map[string]mergedConfigSource)
+		for _, src := range sources {
+			b, err := src.read()
+			if err != nil {
+				return nil, fmt.Errorf("error reading config source %q: %w", src.name, err)
+			}
+			if len(b) == 0 {
+				continue
+			}
+			cfg := &operatorutils.TSHosts{}
+			if err := json.Unmarshal(b, cfg); err != nil {
+				return nil, fmt.Errorf("error unmarshalling config source %q: %w", src.name, err)
+			}
+			merged.SchemaVersion = max(merged.SchemaVersion, cfg.SchemaVersion)
+			mergeSourceRecords(logger, merged, &merged.Hosts, cfg.Hosts, owners, src)
+			mergeSourceRecords(logger, merged, &merged.ExternalRecords, cfg.ExternalRecords, owners, src)
+			for name, port := range cfg.HealthCheckPorts {
+				if owner, ok := owners[name]; !ok || owner.name == src.name {
+					mak.Set(&merged.HealthCheckPorts, name, port)
+				}
+			}
+			for name, t := range cfg.ExpiresAt {
+				if owner, ok := owners[name]; !ok || owner.name == src.name {
+					mak.Set(&merged.ExpiresAt, name, t)
+				}
+			}
+			merged.RPZ = append(merged.RPZ, cfg.RPZ...)
+			merged.RewriteRules = append(merged.RewriteRules, cfg.RewriteRules...)
+			merged.Views = append(merged.Views, cfg.Views...)
+			if len(merged.SearchDomains) == 0 {
+				merged.SearchDomains, merged.NDots = cfg.SearchDomains, cfg.NDots
+			}
+			if merged.ClusterDomain == "" {
+				merged.ClusterDomain = cfg.ClusterDomain
+			}
+		}
+		return json.Marshal(merged)
+	}
+}
+
+// mergeSourceRecords adds the records in recs from src to *dst, unless a
+// source that was merged earlier already has records for the same name.
+// owners records which source the records of each name in *dst came from.
+func mergeSourceRecords(logger *zap.SugaredLogger, merged *operatorutils.TSHosts, dst *map[string][]string, recs map[string][]string, owners map[string]mergedConfigSource, src mergedConfigSource) {
+	// Sorted so that the logs are deterministic.
+	names := make([]string, 0, len(recs))
+	for name := range recs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if owner, ok := owners[name]; ok {
+			logger.Infof("config source %q (priority %d) overrides the records for %s from %q (priority %d)", owner.name, owner.priority, name, src.name, src.priority)
+			continue
+		}
+		owners[name] = src
+		mak.Set(dst, name, recs[name])
+		merged.SourcePriority[name] = src.priority
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/dns/dnsmessage"
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestMergedConfigReader(t *testing.T) {
+	static := `{"hosts":{"foo.bar.ts.net.":["10.20.30.40"],"baz.bar.ts.net.":["10.20.30.41"]},"healthCheckPorts":{"foo.bar.ts.net.":8080}}`
+	tests := []struct {
+		name     string
+		sources  []mergedConfigSource
+		want     *operatorutils.TSHosts
+		wantLogs int
+	}{
+		{
+			name: "override",
+			sources: []mergedConfigSource{
+				{name: "dynamic", priority: 0, read: staticConfig([]byte(`{"hosts":{"foo.bar.ts.net.":["10.0.0.1"],"pod.bar.ts.net.":["10.0.0.2"]},"healthCheckPorts":{"foo.bar.ts.net.":9090}}`))},
+				{name: "static", priority: 10, read: staticConfig([]byte(static))},
+			},
+			want: &operatorutils.TSHosts{
+				Hosts: map[string][]string{
+					"foo.bar.ts.net.": {"10.20.30.40"},
+					"baz.bar.ts.net.": {"10.20.30.41"},
+					"pod.bar.ts.net.": {"10.0.0.2"},
+				},
+				HealthCheckPorts: map[string]uint16{"foo.bar.ts.net.": 8080},
+				SourcePriority: map[string]int{
+					"foo.bar.ts.net.": 10,
+					"baz.bar.ts.net.": 10,
+					"pod.bar.ts.net.": 0,
+				},
+			},
+			wantLogs: 1,
+		},
+		{
+			name: "no_conflict",
+			sources: []mergedConfigSource{
+				{name: "static", priority: 10, read: staticConfig([]byte(static))},
+				{name: "dynamic", priority: 0, read: staticConfig([]byte(`{"hosts":{"pod.bar.ts.net.":["10.0.0.2"]},"rpz":[{"name":"blocked.bar.ts.net.","action":"NXDOMAIN"}]}`))},
+				{name: "empty", priority: 5, read: staticConfig(nil)},
+			},
+			want: &operatorutils.TSHosts{
+				Hosts: map[string][]string{
+					"foo.bar.ts.net.": {"10.20.30.40"},
+					"baz.bar.ts.net.": {"10.20.30.41"},
+					"pod.bar.ts.net.": {"10.0.0.2"},
+				},
+				HealthCheckPorts: map[string]uint16{"foo.bar.ts.net.": 8080},
+				RPZ:              []operatorutils.RPZRule{{Name: "blocked.bar.ts.net.", Action: "NXDOMAIN"}},
+				SourcePriority: map[string]int{
+					"foo.bar.ts.net.": 10,
+					"baz.bar.ts.net.": 10,
+					"pod.bar.ts.net.": 0,
+				},
+			},
+		},
+		{
+			name: "tie",
+			sources: []mergedConfigSource{
+				{name: "first", priority: 1, read: staticConfig([]byte(`{"hosts":{"foo.bar.ts.net.":["10.0.0.1"]}}`))},
+				{name: "second", priority: 1, read: staticConfig([]byte(`{"hosts":{"foo.bar.ts.net.":["10.0.0.2"]}}`))},
+			},
+			want: &operatorutils.TSHosts{
+				Hosts:          map[string][]string{"foo.bar.ts.net.": {"10.0.0.1"}},
+				SourcePriority: map[string]int{"foo.bar.ts.net.": 1},
+			},
+			wantLogs: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			read := newMergedConfigReader(zap.New(core).Sugar(), tt.sources...)
+			// Merging is deterministic across reloads.
+			var first []byte
+			for i := range 5 {
+				b, err := read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					first = b
+				} else if string(b) != string(first) {
+					t.Fatalf("reload %d: got merged config %s, want %s", i, b, first)
+				}
+			}
+			got := &operatorutils.TSHosts{}
+			if err := json.Unmarshal(first, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got merged config %+v, want %+v", got, tt.want)
+			}
+			if n := logs.Len(); n != tt.wantLogs*5 {
+				t.Errorf("got %d override logs over 5 reloads, want %d: %v", n, tt.wantLogs*5, logs.All())
+			}
+		})
+	}
+}
+
+func TestNameserverMergedConfig(t *testing.T) {
+	ns := newTestNameserver(t, newMergedConfigReader(zap.NewNop().Sugar(),
+		mergedConfigSource{name: "dynamic", priority: 0, read: staticConfig([]byte(`{"hosts":{"foo.bar.ts.net.":["10.0.0.1"]}}`))},
+		mergedConfigSource{name: "static", priority: 1, read: staticConfig(testHosts)},
+	))
+	ns.strictConfig = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+		t.Errorf("got IPs %v, want [10.20.30.40]", ips)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+// defaultPrometheusNamespace is the default prefix of all metric names.
+const defaultPrometheusNamespace = "tailscale_dns"
+
+// nameserverMetrics are the Prometheus metrics of a nameserver. A nil
+// *nameserverMetrics is valid and records nothing.
+type nameserverMetrics struct {
+	registry *prometheus.Registry
+	queries  *prometheus.CounterVec // by query type
+	dropped  prometheus.Counter
+	// priority and priorityDropped count the queries from priority
+	// sources, which are not included in dropped.
+	priority        prometheus.Counter
+	priorityDropped prometheus.Counter
+	reloads         *prometheus.CounterVec // by result
+	queryLogDropped prometheus.Counter
+	anyRefused      prometheus.Counter
+	configWarnings  *prometheus.CounterVec // by type
+	goroutineLimit  prometheus.Counter
+	udpReceiveBuf   prometheus.Gauge
+}
+
+// newNameserverMetrics returns metrics for n with all names prefixed with
+// namespace.
+func newNameserverMetrics(namespace string, n *nameserver) *nameserverMetrics {
+	m := &nameserverMetrics{
+		registry: prometheus.NewRegistry(),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "queries_total",
+			Help:      "Total number of DNS queries received, by query type.",
+		}, []string{"type"}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "queries_dropped_total",
+			Help:      "Total number of DNS queries answered with SERVFAIL because too many queries were in flight.",
+		}),
+		priority: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "priority_queries_total",
+			Help:      "Total number of DNS queries received from priority sources.",
+		}),
+		priorityDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "priority_queries_dropped_total",
+			Help:      "Total number of DNS queries from priority sources answered with SERVFAIL because too many of them were in flight.",
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "config_reloads_total",
+			Help:      "Total number of config reloads, by result.",
+		}, []string{"result"}),
+		queryLogDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "query_log_dropped_total",
+			Help:      "Total number of DNS queries left out of the query or audit log because too many entries were waiting to be written.",
+		}),
+		anyRefused: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "any_queries_refused_total",
+			Help:      "Total number of DNS queries for QTYPE ANY answered with REFUSED.",
+		}),
+		configWarnings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "config_warnings_total",
+			Help:      "Total number of warnings about likely mistakes in loaded configs, by type.",
+		}, []string{"type"}),
+		goroutineLimit: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "goroutine_limit_exceeded_total",
+			Help:      "Total number of goroutine count checks that found more goroutines running than --max-goroutines.",
+		}),
+		udpReceiveBuf: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "udp_receive_buffer_size_bytes",
+			Help:      "Receive buffer size of the UDP sockets that DNS queries are served on, as granted by the OS.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.queries,
+		m.dropped,
+		m.priority,
+		m.priorityDropped,
+		m.reloads,
+		m.queryLogDropped,
+		m.anyRefused,
+		m.configWarnings,
+		m.goroutineLimit,
+		m.udpReceiveBuf,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "goroutines",
+			Help:      "Number of goroutines that currently exist.",
+		}, func() float64 { return float64(runtime.NumGoroutine()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queries_in_flight",
+			Help:      "Number of DNS queries currently being answered.",
+		}, func() float64 { return float64(n.queriesInFlight.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tcp_connections",
+			Help:      "Number of open DNS over TCP connections.",
+		}, func() float64 { return float64(n.tcpConns.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "dot_connections",
+			Help:      "Number of open DNS over TLS connections.",
+		}, func() float64 { return float64(n.dotConns.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "host_records",
+			Help:      "Number of host records in the currently loaded config.",
+		}, func() float64 { return float64(n.Stats().RecordCount) }),
+	)
+	return m
+}
+
+// observeQuery records the DNS query in payload.
+func (m *nameserverMetrics) observeQuery(payload []byte) {
+	if m == nil {
+		return
+	}
+	typ := "invalid"
+	if _, q, err := parseQuestion(payload); err == nil {
+		typ = strings.TrimPrefix(q.Type.String(), "Type")
+	}
+	m.queries.WithLabelValues(typ).Inc()
+}
+
+// observeDroppedQuery records a query that was not answered because too many
+// queries were in flight.
+func (m *nameserverMetrics) observeDroppedQuery() {
+	if m == nil {
+		return
+	}
+	m.dropped.Inc()
+}
+
+// observePriorityQuery records a query from a priority source.
+func (m *nameserverMetrics) observePriorityQuery() {
+	if m == nil {
+		return
+	}
+	m.priority.Inc()
+}
+
+// observeDroppedPriorityQuery records a query from a priority source that
+// was not answered because too many of them were in flight.
+func (m *nameserverMetrics) observeDroppedPriorityQuery() {
+	if m == nil {
+		return
+	}
+	m.priorityDropped.Inc()
+}
+
+// observeDroppedQueryLog records a query that was left out of the query log.
+func (m *nameserverMetrics) observeDroppedQueryLog() {
+	if m == nil {
+		return
+	}
+	m.queryLogDropped.Inc()
+}
+
+// observeGoroutineLimitExceeded records a goroutine count check that found
+// more goroutines than the limit.
+func (m *nameserverMetrics) observeGoroutineLimitExceeded() {
+	if m == nil {
+		return
+	}
+	m.goroutineLimit.Inc()
+}
+
+// observeUDPReceiveBuffer records the receive buffer size of a UDP socket
+// that DNS queries are served on.
+func (m *nameserverMetrics) observeUDPReceiveBuffer(size int) {
+	if m == nil {
+		return
+	}
+	m.udpReceiveBuf.Set(float64(size))
+}
+
+// observeRefusedANY records a query for QTYPE ANY that was refused.
+func (m *nameserverMetrics) observeRefusedANY() {
+	if m == nil {
+		return
+	}
+	m.anyRefused.Inc()
+}
+
+// observeConfigWarnings records the warnings about a loaded config.
+func (m *nameserverMetrics) observeConfigWarnings(warnings []nsconfig.Warning) {
+	if m == nil {
+		return
+	}
+	for _, w := range warnings {
+		m.configWarnings.WithLabelValues(w.Type).Inc()
+	}
+}
+
+// observeReload records a config reload that failed with err, if non-nil.
+func (m *nameserverMetrics) observeReload(err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.reloads.WithLabelValues(result).Inc()
+}
+
+// handler returns an HTTP handler that serves the metrics in the Prometheus
+// exposition format.
+func (m *nameserverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
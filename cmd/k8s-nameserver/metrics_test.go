@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMetricsNamespace(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.metrics = newNameserverMetrics("custom_ns", ns)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	ns.metrics.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`custom_ns_queries_total{type="A"} 1`,
+		`custom_ns_config_reloads_total{result="success"} 1`,
+		`custom_ns_queries_in_flight 0`,
+		`custom_ns_host_records 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, defaultPrometheusNamespace) {
+		t.Errorf("metrics contain the default namespace %q:\n%s", defaultPrometheusNamespace, body)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"tailscale.com/util/dnsname"
+)
+
+// maxRemovedNamesLogged is the number of removed names that are listed in
+// the error for a refused config.
+const maxRemovedNamesLogged = 10
+
+// MigrationChecker guards against config updates that accidentally remove
+// most records, i.e. because a ConfigMap was only partially written during
+// a rolling update, by comparing each new config to the last good one.
+type MigrationChecker struct {
+	// Threshold is the largest fraction of the names in the last good
+	// config that a new config may remove, i.e. 0.1 for 10%. Values of 0
+	// or less disable the check.
+	Threshold float64
+	// Force makes Check log configs that remove too many names instead of
+	// refusing them.
+	Force bool
+}
+
+// Check returns an error if the records in newHosts are missing more than
+// c.Threshold of the names in oldHosts, the records of the last good config.
+// There is nothing to compare the first config with, so it is always
+// accepted.
+func (c MigrationChecker) Check(logf func(string, ...any), oldHosts, newHosts map[dnsname.FQDN][]netip.Addr) error {
+	if c.Threshold <= 0 || len(oldHosts) == 0 {
+		return nil
+	}
+	var removed []string
+	for name := range oldHosts {
+		if _, ok := newHosts[name]; !ok {
+			removed = append(removed, name.WithTrailingDot())
+		}
+	}
+	fraction := float64(len(removed)) / float64(len(oldHosts))
+	if fraction <= c.Threshold {
+		return nil
+	}
+	slices.Sort(removed)
+	examples := strings.Join(removed[:min(len(removed), maxRemovedNamesLogged)], ", ")
+	if len(removed) > maxRemovedNamesLogged {
+		examples += ", ..."
+	}
+	msg := fmt.Sprintf("new config removes %d of %d names (%.1f%%), more than --safe-reload-threshold of %.1f%%: %s", len(removed), len(oldHosts), fraction*100, c.Threshold*100, examples)
+	if c.Force {
+		logf("applying config anyway, as --force-reload is set: %s", msg)
+		return nil
+	}
+	return fmt.Errorf("refusing config update, keeping the last good config: %s; set --force-reload to apply it anyway", msg)
+}
+
+// allHostNames returns the host records in hosts and external combined, for
+// MigrationChecker.
+func allHostNames(hosts, external map[dnsname.FQDN][]netip.Addr) map[dnsname.FQDN][]netip.Addr {
+	if len(external) == 0 {
+		return hosts
+	}
+	all := make(map[dnsname.FQDN][]netip.Addr, len(hosts)+len(external))
+	for name, ips := range hosts {
+		all[name] = ips
+	}
+	for name, ips := range external {
+		all[name] = ips
+	}
+	return all
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testConfigWithHosts returns a config with host records for the names
+// host0.bar.ts.net. to host<n-1>.bar.ts.net.
+func testConfigWithHosts(n int) []byte {
+	var hosts []string
+	for i := range n {
+		hosts = append(hosts, fmt.Sprintf(`"host%d.bar.ts.net.": ["10.20.30.%d"]`, i, i+1))
+	}
+	return []byte(`{"hosts": {` + strings.Join(hosts, ",") + `}}`)
+}
+
+func TestNameserverSafeReload(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		force     bool
+		newHosts  int
+		wantErr   bool
+	}{
+		{name: "within_threshold", threshold: 0.1, newHosts: 9},
+		{name: "above_threshold", threshold: 0.1, newHosts: 8, wantErr: true},
+		{name: "all_removed", threshold: 0.1, newHosts: 0, wantErr: true},
+		{name: "forced", threshold: 0.1, force: true, newHosts: 8},
+		{name: "disabled", newHosts: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfigWithHosts(10)
+			ns := newTestNameserver(t, func() ([]byte, error) { return cfg, nil })
+			ns.migrationChecker = MigrationChecker{Threshold: tt.threshold, Force: tt.force}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg = testConfigWithHosts(tt.newHosts)
+			err := ns.updateResolverConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "host9.bar.ts.net.") {
+				t.Errorf("error %q doesn't name the removed host9.bar.ts.net.", err)
+			}
+			wantRecords := tt.newHosts
+			if tt.wantErr {
+				// The last good config is still served.
+				wantRecords = 10
+			}
+			if got := ns.Stats().RecordCount; got != wantRecords {
+				t.Errorf("got %d records, want %d", got, wantRecords)
+			}
+			resp, err := ns.query(ctx, testQuery(t, "host9.bar.ts.net.", dnsmessage.TypeA), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ips := answerIPs(t, resp); (len(ips) == 1) != (wantRecords == 10) {
+				t.Errorf("got IPs %v for host9.bar.ts.net. with %d records served", ips, wantRecords)
+			}
+		})
+	}
+}
+
+func TestMigrationCheckerFirstConfig(t *testing.T) {
+	c := MigrationChecker{Threshold: 0.1}
+	if err := c.Check(t.Logf, nil, nil); err != nil {
+		t.Errorf("first config: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+func TestNameserverLongLabelConfigError(t *testing.T) {
+	long := "foo.bar.ts.net" + strings.Repeat("t", 61) + "."
+	cfg := []byte(`{"hosts":{"` + long + `":["10.20.30.40"]}}`)
+	for _, allow := range []bool{false, true} {
+		ns := newTestNameserver(t, staticConfig(cfg))
+		ns.allowLongLabels = allow
+		ctx, cancel := context.WithCancel(context.Background())
+		err := ns.run(ctx, cancel)
+		cancel()
+		if allow {
+			if err != nil {
+				t.Errorf("with --allow-long-labels: %v", err)
+			}
+			continue
+		}
+		var cfgErr *nsconfig.Error
+		if !errors.As(err, &cfgErr) {
+			t.Fatalf("got error %v, want an nsconfig.Error", err)
+		}
+		if want := `hosts["` + long + `"]`; cfgErr.Field != want || cfgErr.Value != long {
+			t.Errorf("got error for %s = %q, want %s = %q", cfgErr.Field, cfgErr.Value, want, long)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultNotifyTimeout is how long to wait for a secondary nameserver
+	// to acknowledge a NOTIFY before retransmitting it.
+	defaultNotifyTimeout = 5 * time.Second
+	// notifyRetransmits is how many times a NOTIFY is retransmitted to a
+	// secondary nameserver that does not acknowledge it.
+	notifyRetransmits = 3
+)
+
+// parseNotifyTargets parses a comma-separated list of IP:port pairs.
+func parseNotifyTargets(s string) ([]netip.AddrPort, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var targets []netip.AddrPort
+	for _, t := range strings.Split(s, ",") {
+		ap, err := netip.ParseAddrPort(strings.TrimSpace(t))
+		if err != nil {
+			return nil, fmt.Errorf("invalid NOTIFY target %q: %w", t, err)
+		}
+		targets = append(targets, ap)
+	}
+	return targets, nil
+}
+
+// sendNotifies sends a DNS NOTIFY for the first local domain to all of the
+// configured secondary nameservers, so that they know to refresh the zone.
+// https://datatracker.ietf.org/doc/html/rfc1996
+func (n *nameserver) sendNotifies() {
+	zone := n.domains()[0].WithTrailingDot()
+	for _, target := range n.notifyTargets {
+		go func() {
+			if err := n.sendNotify(zone, target); err != nil {
+				n.logger.Errorf("error sending NOTIFY for %s to %v: %v", zone, target, err)
+			}
+		}()
+	}
+}
+
+// sendNotify sends a NOTIFY for zone to target and waits for it to be
+// acknowledged, retransmitting it if it isn't.
+func (n *nameserver) sendNotify(zone string, target netip.AddrPort) error {
+	timeout := n.notifyTimeout
+	if timeout == 0 {
+		timeout = defaultNotifyTimeout
+	}
+	c := &dns.Client{Net: "udp", Timeout: timeout}
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	var err error
+	for i := 0; i <= notifyRetransmits; i++ {
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(m, target.String())
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("NOTIFY rejected with %s", dns.RcodeToString[resp.Rcode])
+		}
+		n.logger.Debugf("NOTIFY for %s acknowledged by %v", zone, target)
+		return nil
+	}
+	return fmt.Errorf("no response after %d attempts: %w", notifyRetransmits+1, err)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// notifyRecorder is a mock secondary nameserver that records the NOTIFY
+// messages that it receives.
+type notifyRecorder struct {
+	pc net.PacketConn
+	// drop is the number of NOTIFYs to not respond to, to exercise
+	// retransmission.
+	drop int
+	msgs chan *dns.Msg
+}
+
+func newNotifyRecorder(t *testing.T, drop int) *notifyRecorder {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	r := &notifyRecorder{pc: pc, drop: drop, msgs: make(chan *dns.Msg, 10)}
+	go r.serve()
+	return r
+}
+
+func (r *notifyRecorder) addr() netip.AddrPort {
+	return r.pc.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func (r *notifyRecorder) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, src, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		r.msgs <- m
+		if r.drop > 0 {
+			r.drop--
+			continue
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		b, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		r.pc.WriteTo(b, src)
+	}
+}
+
+// wait returns the next recorded NOTIFY.
+func (r *notifyRecorder) wait(t *testing.T) *dns.Msg {
+	t.Helper()
+	select {
+	case m := <-r.msgs:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for NOTIFY")
+		return nil
+	}
+}
+
+func TestNotify(t *testing.T) {
+	reliable := newNotifyRecorder(t, 0)
+	flaky := newNotifyRecorder(t, 2)
+
+	config := testHosts
+	ns := newTestNameserver(t, func() ([]byte, error) { return config, nil })
+	ns.notifyTargets = []netip.AddrPort{reliable.addr(), flaky.addr()}
+	ns.notifyTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	checkNotify := func(m *dns.Msg) {
+		t.Helper()
+		if m.Opcode != dns.OpcodeNotify || !m.Authoritative {
+			t.Errorf("got opcode %s, AA=%v, want NOTIFY with AA set", dns.OpcodeToString[m.Opcode], m.Authoritative)
+		}
+		if len(m.Question) != 1 || m.Question[0].Name != "ts.net." || m.Question[0].Qtype != dns.TypeSOA {
+			t.Errorf("got questions %v, want ts.net. SOA", m.Question)
+		}
+	}
+	checkNotify(reliable.wait(t))
+	// The flaky secondary doesn't respond to the first two NOTIFYs, so it
+	// must get the NOTIFY three times.
+	var ids []uint16
+	for range 3 {
+		m := flaky.wait(t)
+		checkNotify(m)
+		ids = append(ids, m.Id)
+	}
+	if ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Errorf("got message IDs %v, want retransmissions to reuse the ID", ids)
+	}
+
+	// Reloads of an unchanged config are skipped, and don't send one.
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-reliable.msgs:
+		t.Errorf("got NOTIFY %v for an unchanged config", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Every reload of a changed config sends a new NOTIFY.
+	config = []byte(`{"hosts":{"foo.bar.ts.net.":["10.20.30.42"]}}`)
+	if err := ns.updateResolverConfig(); err != nil {
+		t.Fatal(err)
+	}
+	checkNotify(reliable.wait(t))
+	checkNotify(flaky.wait(t))
+
+	select {
+	case m := <-reliable.msgs:
+		t.Errorf("got unexpected NOTIFY %v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestParseNotifyTargets(t *testing.T) {
+	got, err := parseNotifyTargets("10.0.0.1:53, [fd7a:115c:a1e0::1]:5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.1:53"),
+		netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:5353"),
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := parseNotifyTargets("10.0.0.1"); err == nil {
+		t.Error("got nil error for target without port")
+	}
+}
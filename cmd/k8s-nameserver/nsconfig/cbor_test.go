@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/must"
+)
+
+// cborEncMode encodes the CBOR configs of tests with their map keys sorted,
+// so that the same config always has the same encoding.
+var cborEncMode = must.Get(cbor.CoreDetEncOptions().EncMode())
+
+// encodeCBOR returns the CBOR encoding of h.
+func encodeCBOR(h *operatorutils.TSHosts) ([]byte, error) {
+	return cborEncMode.Marshal(h)
+}
+
+func TestCBORConfig(t *testing.T) {
+	want := &operatorutils.TSHosts{
+		Hosts:            map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}, "baz.bar.ts.net.": {"10.20.30.41", "fd7a:115c:a1e0::1"}},
+		HealthCheckPorts: map[string]uint16{"foo.bar.ts.net.": 8080},
+	}
+	b, err := encodeCBOR(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isCBOR(b) || !isCBOR(append(cborSelfDescribe, b...)) {
+		t.Errorf("isCBOR(%x) = false, want true", b)
+	}
+	for _, notCBOR := range []string{"", `{"hosts":{}}`, " \n{}", "hosts:\n"} {
+		if isCBOR([]byte(notCBOR)) {
+			t.Errorf("isCBOR(%q) = true, want false", notCBOR)
+		}
+	}
+	got, err := decodeCBOR(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got decoded config %+v, want %+v", got, want)
+	}
+	// The encoding uses the JSON field names.
+	var generic map[string]any
+	if err := cborDecMode.Unmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := generic["healthCheckPorts"]; !ok {
+		t.Errorf("got CBOR fields %v, want healthCheckPorts", generic)
+	}
+
+	var cfgErr *Error
+	if _, err := decodeCBOR(b[:len(b)-3]); !errors.As(err, &cfgErr) {
+		t.Errorf("decoding truncated CBOR config: got error %v, want *Error", err)
+	}
+}
+
+// BenchmarkDecodeConfig compares decoding JSON and CBOR configs with 100k
+// host records, and reports the size of each encoding.
+func BenchmarkDecodeConfig(b *testing.B) {
+	cfg := &operatorutils.TSHosts{Hosts: make(map[string][]string, 100000)}
+	for i := range 100000 {
+		cfg.Hosts[fmt.Sprintf("host-%d.bar.ts.net.", i)] = []string{
+			fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+			fmt.Sprintf("fd7a:115c:a1e0::%x:%x", i>>16, i&0xffff),
+		}
+	}
+	jsonBytes, err := json.Marshal(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cborBytes, err := encodeCBOR(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		decode func([]byte) error
+	}{
+		{"json", jsonBytes, func(data []byte) error { return json.Unmarshal(data, &operatorutils.TSHosts{}) }},
+		{"cbor", cborBytes, func(data []byte) error { _, err := decodeCBOR(data); return err }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(tc.data)), "config-bytes")
+			for range b.N {
+				if err := tc.decode(tc.data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/mak"
+)
+
+// Types of Warning.
+const (
+	// WarningDanglingRedirect is an RPZ REDIRECT rule to a name in
+	// the local domains that has no host record.
+	WarningDanglingRedirect = "dangling_redirect"
+	// WarningDuplicateIP is an IP address that is a record for
+	// more than one name.
+	WarningDuplicateIP = "duplicate_ip"
+	// WarningUnreachableIP is a loopback or link-local IP address
+	// record, which clients of the nameserver can't reach.
+	WarningUnreachableIP = "unreachable_ip"
+	// WarningRedirectLoop is an RPZ REDIRECT rule whose chain of
+	// redirects to other rules loops or is longer than MaxRPZRedirects,
+	// which is answered with SERVFAIL.
+	WarningRedirectLoop = "redirect_loop"
+	// WarningNotFQDN is a record name that doesn't end with a dot, which
+	// is served as if it did.
+	WarningNotFQDN = "not_fqdn"
+	// WarningExternalRecordsIgnored is a config with external records,
+	// which are not served without --allow-external-records.
+	WarningExternalRecordsIgnored = "external_records_ignored"
+	// WarningSchemaVersion is a config written for a newer schema version
+	// than SupportedSchemaVersion, whose new fields are ignored.
+	WarningSchemaVersion = "schema_version"
+)
+
+// Warning is a value in the nameserver config that is valid, but is
+// likely a mistake.
+type Warning struct {
+	// Type is the kind of the problem, one of the Warning constants.
+	Type string `json:"type"`
+	// Field is the path of the field in the config, in the same form as
+	// in Error.
+	Field string `json:"field,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Field, w.Message)
+}
+
+// checkConfig returns warnings for the likely mistakes in cfg, which has
+// been successfully loaded and is served for localDomains. The warnings are
+// sorted by field.
+//
+// It runs on every reload, so the common case of a config without warnings
+// must not allocate per record: fields are only formatted for warnings.
+func checkConfig(cfg *operatorutils.TSHosts, localDomains []dnsname.FQDN) []Warning {
+	var warnings []Warning
+	sets := []recordSet{{"hosts", cfg.Hosts}, {"externalRecords", cfg.ExternalRecords}}
+	n := 0
+	for _, set := range sets {
+		for _, ips := range set.hosts {
+			n += len(ips)
+		}
+	}
+	// Duplicate IPs are found by sorting all of them, rather than with a
+	// map of the records of each IP, which is much slower to fill.
+	all := make([]netip.Addr, 0, n)
+	for _, set := range sets {
+		for name, ips := range set.hosts {
+			for i, s := range ips {
+				ip, err := netip.ParseAddr(s)
+				if err != nil {
+					continue
+				}
+				if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+					warnings = append(warnings, Warning{
+						Type:    WarningUnreachableIP,
+						Field:   set.recordField(name, i),
+						Message: fmt.Sprintf("%v is a loopback or link-local address, which clients can't reach", ip),
+					})
+				}
+				all = append(all, ip)
+			}
+		}
+	}
+	slices.SortFunc(all, netip.Addr.Compare)
+	var dups map[netip.Addr]bool
+	for i := 1; i < len(all); i++ {
+		if all[i] == all[i-1] {
+			mak.Set(&dups, all[i], true)
+		}
+	}
+	if len(dups) > 0 {
+		warnings = append(warnings, duplicateIPWarnings(sets, dups)...)
+	}
+
+	// names are the names with records, for finding dangling redirects.
+	// They are only collected if there are redirects to local names.
+	var names map[dnsname.FQDN]bool
+	for i, r := range cfg.RPZ {
+		action, target, _ := strings.Cut(strings.TrimSpace(r.Action), " ")
+		if !strings.EqualFold(action, "REDIRECT") {
+			continue
+		}
+		target = strings.TrimSpace(target)
+		if _, err := netip.ParseAddr(target); err == nil {
+			continue
+		}
+		fqdn, err := dnsname.ToFQDN(target)
+		if err != nil || !slices.ContainsFunc(localDomains, func(d dnsname.FQDN) bool { return d.Contains(fqdn) }) {
+			// Targets outside of the local domains are resolved
+			// upstream.
+			continue
+		}
+		if names == nil {
+			names = make(map[dnsname.FQDN]bool, len(cfg.Hosts)+len(cfg.ExternalRecords))
+			for _, set := range sets {
+				for name := range set.hosts {
+					if fqdn, err := dnsname.ToFQDN(name); err == nil {
+						names[fqdn] = true
+					}
+				}
+			}
+		}
+		if names[fqdn] {
+			continue
+		}
+		warnings = append(warnings, Warning{
+			Type:    WarningDanglingRedirect,
+			Field:   fmt.Sprintf("rpz[%d].action", i),
+			Message: fmt.Sprintf("REDIRECT target %q has no host record, queries for %q will get NXDOMAIN", target, r.Name),
+		})
+	}
+	slices.SortFunc(warnings, func(a, b Warning) int { return strings.Compare(a.Field, b.Field) })
+	return warnings
+}
+
+// recordSet is a field of the config with host records.
+type recordSet struct {
+	field string
+	hosts map[string][]string
+}
+
+// recordField returns the path of the i-th IP address of name in s.
+func (s recordSet) recordField(name string, i int) string {
+	return fmt.Sprintf("%s[%q][%d]", s.field, name, i)
+}
+
+// duplicateIPWarnings returns warnings for the records in sets of the IPs
+// in dups, other than the first one of each IP by field.
+func duplicateIPWarnings(sets []recordSet, dups map[netip.Addr]bool) []Warning {
+	type record struct {
+		fqdn  dnsname.FQDN
+		field string
+	}
+	byIP := make(map[netip.Addr][]record, len(dups))
+	for _, set := range sets {
+		for name, ips := range set.hosts {
+			for i, s := range ips {
+				ip, err := netip.ParseAddr(s)
+				if err != nil || !dups[ip] {
+					continue
+				}
+				fqdn, err := dnsname.ToFQDN(name)
+				if err != nil {
+					continue
+				}
+				byIP[ip] = append(byIP[ip], record{fqdn, set.recordField(name, i)})
+			}
+		}
+	}
+	var warnings []Warning
+	for ip, records := range byIP {
+		slices.SortFunc(records, func(a, b record) int { return strings.Compare(a.field, b.field) })
+		first := records[0]
+		// Names that only differ by the trailing dot are the same
+		// record, and are merged when the config is loaded.
+		seen := map[dnsname.FQDN]bool{first.fqdn: true}
+		for _, r := range records[1:] {
+			if seen[r.fqdn] {
+				continue
+			}
+			seen[r.fqdn] = true
+			warnings = append(warnings, Warning{
+				Type:    WarningDuplicateIP,
+				Field:   r.field,
+				Message: fmt.Sprintf("%v is also a record in %s", ip, first.field),
+			})
+		}
+	}
+	return warnings
+}
+
+// checkRedirectLoops returns warnings for the REDIRECT rules in rules whose
+// chain of redirects to names matched by other rules is followed more than
+// MaxRPZRedirects times when answering a query.
+func checkRedirectLoops(rules []RPZRule) []Warning {
+	var warnings []Warning
+	for i, r := range rules {
+		if r.Action != RPZRedirect || r.RedirectIP.IsValid() {
+			continue
+		}
+		chain := []string{r.Raw.Name, r.RedirectName.WithTrailingDot()}
+		cur, tooLong := &rules[i], false
+		for j := 0; ; j++ {
+			next := MatchRPZ(rules, cur.RedirectName)
+			if next == nil {
+				break
+			}
+			if j == MaxRPZRedirects {
+				tooLong = true
+				break
+			}
+			if next.Action != RPZRedirect || next.RedirectIP.IsValid() {
+				break
+			}
+			cur = next
+			chain = append(chain, cur.RedirectName.WithTrailingDot())
+		}
+		if !tooLong {
+			continue
+		}
+		warnings = append(warnings, Warning{
+			Type:    WarningRedirectLoop,
+			Field:   fmt.Sprintf("rpz[%d].action", i),
+			Message: fmt.Sprintf("REDIRECT chain %s ... is longer than %d redirects, queries for %q will get SERVFAIL", strings.Join(chain, " -> "), MaxRPZRedirects, r.Raw.Name),
+		})
+	}
+	return warnings
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestCheckConfig(t *testing.T) {
+	type warning struct{ typ, field string }
+	tests := []struct {
+		name string
+		cfg  *operatorutils.TSHosts
+		want []warning
+	}{
+		{
+			name: "clean",
+			cfg: &operatorutils.TSHosts{
+				Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}, "baz.bar.ts.net.": {"10.20.30.41"}},
+				RPZ:   []operatorutils.RPZRule{{Name: "old.bar.ts.net.", Action: "REDIRECT foo.bar.ts.net."}},
+			},
+		},
+		{
+			name: "dangling_redirect",
+			cfg: &operatorutils.TSHosts{
+				Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+				RPZ: []operatorutils.RPZRule{
+					{Name: "old.bar.ts.net.", Action: "REDIRECT gone.bar.ts.net."},
+					// IP address targets and names outside of the
+					// local domains don't need host records.
+					{Name: "ip.bar.ts.net.", Action: "REDIRECT 10.20.30.50"},
+					{Name: "ext.bar.ts.net.", Action: "redirect example.com."},
+					{Name: "blocked.bar.ts.net.", Action: "NXDOMAIN"},
+				},
+			},
+			want: []warning{{WarningDanglingRedirect, "rpz[0].action"}},
+		},
+		{
+			name: "duplicate_ip",
+			cfg: &operatorutils.TSHosts{
+				Hosts: map[string][]string{
+					"foo.bar.ts.net.": {"10.20.30.40"},
+					"baz.bar.ts.net.": {"10.20.30.41", "10.20.30.40"},
+					// The same name without the trailing dot is the
+					// same record.
+					"foo.bar.ts.net": {"10.20.30.40"},
+				},
+				ExternalRecords: map[string][]string{"db.internal.": {"10.20.30.41"}},
+			},
+			want: []warning{
+				{WarningDuplicateIP, `hosts["baz.bar.ts.net."][0]`},
+				{WarningDuplicateIP, `hosts["foo.bar.ts.net"][0]`},
+			},
+		},
+		{
+			name: "unreachable_ip",
+			cfg: &operatorutils.TSHosts{
+				Hosts: map[string][]string{
+					"foo.bar.ts.net.": {"10.20.30.40", "127.0.0.1"},
+					"baz.bar.ts.net.": {"fe80::1"},
+					"ok.bar.ts.net.":  {"fd7a:115c:a1e0::1"},
+				},
+			},
+			want: []warning{
+				{WarningUnreachableIP, `hosts["baz.bar.ts.net."][0]`},
+				{WarningUnreachableIP, `hosts["foo.bar.ts.net."][1]`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []warning
+			for _, w := range checkConfig(tt.cfg, DefaultLocalDomains) {
+				if w.Message == "" {
+					t.Errorf("warning for %s has no message", w.Field)
+				}
+				got = append(got, warning{w.Type, w.Field})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got warnings %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkCheckConfig(b *testing.B) {
+	const n = 100000
+	cfg := &operatorutils.TSHosts{Hosts: make(map[string][]string, n)}
+	for i := range n {
+		cfg.Hosts[fmt.Sprintf("host-%d.bar.ts.net.", i)] = []string{
+			fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+			fmt.Sprintf("fd7a:115c:a1e0::%x:%x", i>>16, i&0xffff),
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if w := checkConfig(cfg, DefaultLocalDomains); len(w) > 0 {
+			b.Fatalf("got warnings %v", w)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+// Package nsconfig decodes, validates and parses the config of k8s-nameserver.
+// It is shared by k8s-nameserver and dns-config-lint, so that configs that
+// lint without errors load with the same flags.
+package nsconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
+)
+
+// SupportedSchemaVersion is the latest operatorutils.TSHosts schema version
+// that the nameserver understands.
+const SupportedSchemaVersion = 1
+
+// Supported config formats, the values of the nameserver's --config-format
+// flag.
+const (
+	FormatJSON  = "json"
+	FormatHosts = "hosts"
+	FormatYAML  = "yaml"
+	FormatCBOR  = "cbor"
+	// FormatCorefile is the CoreDNS Corefile format, set by the
+	// nameserver's --coredns-compatible.
+	FormatCorefile = "corefile"
+	// FormatAuto picks JSON, YAML or CBOR based on the file extension of
+	// the config key, see FormatForKey.
+	FormatAuto = "auto"
+)
+
+// DefaultLocalDomains are the domains that the nameserver is authoritative
+// for, unless overridden with --local-domains and
+// --disable-ts-net-root-domains. Queries for names within these domains are
+// never forwarded upstream.
+var DefaultLocalDomains = []dnsname.FQDN{"ts.net."}
+
+// Options are the nameserver flags that affect how its config is loaded.
+type Options struct {
+	// Format is the format of the config, one of FormatJSON, FormatYAML,
+	// FormatCBOR, FormatHosts or FormatCorefile. If empty, FormatJSON is
+	// used.
+	Format string
+	// Strict makes decoding fail if a JSON config contains fields that
+	// are not known for its schema version.
+	Strict bool
+	// ReadFile reads the hosts files referenced by a Corefile, by base
+	// name. If nil, hosts plugins that reference a file are an error.
+	ReadFile func(name string) ([]byte, error)
+	// Logf logs informational messages about the config, such as the
+	// Corefile directives that are ignored. If nil, they are discarded.
+	Logf logger.Logf
+	// LocalDomains are the domains that the nameserver is authoritative
+	// for. If empty, DefaultLocalDomains are used.
+	LocalDomains []dnsname.FQDN
+	// AllowExternalRecords makes the records in the externalRecords field
+	// valid. Without it, they are ignored.
+	AllowExternalRecords bool
+	// AllowLongLabels makes host record names that exceed the DNS label
+	// and name length limits valid, see parseHostName.
+	AllowLongLabels bool
+	// EnableIDN makes internationalized names in the config valid; they
+	// are served Punycode encoded.
+	EnableIDN bool
+}
+
+func (o *Options) logf(format string, args ...any) {
+	if o.Logf != nil {
+		o.Logf(format, args...)
+	}
+}
+
+func (o *Options) localDomains() []dnsname.FQDN {
+	if len(o.LocalDomains) > 0 {
+		return o.LocalDomains
+	}
+	return DefaultLocalDomains
+}
+
+// isLocalDomain reports whether name is within one of the local domains.
+func (o *Options) isLocalDomain(name dnsname.FQDN) bool {
+	return slices.ContainsFunc(o.localDomains(), func(d dnsname.FQDN) bool { return d.Contains(name) })
+}
+
+// Config is a nameserver config that has been validated and parsed by Parse.
+type Config struct {
+	Hosts map[dnsname.FQDN][]netip.Addr
+	// ExternalHosts are the records of the externalRecords field, or nil
+	// if Options.AllowExternalRecords is not set.
+	ExternalHosts    map[dnsname.FQDN][]netip.Addr
+	HealthCheckPorts map[dnsname.FQDN]uint16
+	ExpiresAt        map[dnsname.FQDN]time.Time
+	RPZ              []RPZRule
+	Rewrites         []RewriteRule
+	Views            []View
+	SearchDomains    []dnsname.FQDN
+	// NDots is the ndots field, or 1 if it is unset.
+	NDots         int
+	ClusterDomain dnsname.FQDN
+	// Warnings are the likely mistakes in the config, sorted by field.
+	Warnings []Warning
+}
+
+// Decode decodes the config in b, in the format given by opts.Format. JSON
+// configs that are actually CBOR, as detected by isCBOR, are decoded as
+// CBOR, so that the operator can switch to the smaller encoding without
+// reconfiguring the nameserver. JSON, YAML and CBOR configs written for a
+// newer schema version than SupportedSchemaVersion are decoded on a best
+// effort basis, with any fields that the nameserver doesn't know about
+// ignored; Parse warns about them.
+func Decode(b []byte, opts Options) (*operatorutils.TSHosts, error) {
+	dnsCfg := &operatorutils.TSHosts{}
+	if len(b) == 0 {
+		opts.logf("nameserver config is empty, no records will be served")
+		return dnsCfg, nil
+	}
+	format := opts.Format
+	if (format == "" || format == FormatJSON) && isCBOR(b) {
+		format = FormatCBOR
+	}
+	switch format {
+	case FormatCBOR:
+		return decodeCBOR(b)
+	case FormatHosts:
+		return parseHostsFile(bytes.NewReader(b))
+	case FormatCorefile:
+		return parseCorefile(bytes.NewReader(b), opts.ReadFile, opts.logf)
+	case FormatYAML:
+		dnsCfg, err := parseYAMLConfig(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling nameserver config: %w", err)
+		}
+		return dnsCfg, nil
+	}
+	if err := json.Unmarshal(b, dnsCfg); err != nil {
+		return nil, jsonConfigError(b, err)
+	}
+	if opts.Strict && dnsCfg.SchemaVersion <= SupportedSchemaVersion {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&operatorutils.TSHosts{}); err != nil {
+			return nil, jsonConfigError(b, err)
+		}
+	}
+	return dnsCfg, nil
+}
+
+// Parse validates and parses dnsCfg, as returned by Decode, and returns it
+// along with warnings for its likely mistakes. All invalid values are
+// reported: the error wraps an *Error for each of them, sorted by field,
+// which Errors returns.
+func Parse(dnsCfg *operatorutils.TSHosts, opts Options) (*Config, error) {
+	if opts.EnableIDN {
+		if err := encodeIDNConfig(dnsCfg); err != nil {
+			return nil, err
+		}
+	}
+	cfg := &Config{}
+	var errs []error
+	var err error
+	cfg.Hosts, err = parseHosts("hosts", dnsCfg.Hosts, opts.AllowLongLabels)
+	errs = append(errs, err)
+	if len(dnsCfg.ExternalRecords) > 0 && !opts.AllowExternalRecords {
+		cfg.Warnings = append(cfg.Warnings, Warning{
+			Type:    WarningExternalRecordsIgnored,
+			Field:   "externalRecords",
+			Message: fmt.Sprintf("ignoring %d external records, as --allow-external-records is not set", len(dnsCfg.ExternalRecords)),
+		})
+	} else {
+		cfg.ExternalHosts, err = parseHosts("externalRecords", dnsCfg.ExternalRecords, opts.AllowLongLabels)
+		errs = append(errs, err)
+		for name := range dnsCfg.ExternalRecords {
+			if fqdn, err := dnsname.ToFQDN(name); err == nil && opts.isLocalDomain(fqdn) {
+				errs = append(errs, fieldError(fmt.Sprintf("externalRecords[%q]", name), name, errors.New("name is within a local domain, it must be in hosts instead")))
+			}
+		}
+	}
+	cfg.HealthCheckPorts = make(map[dnsname.FQDN]uint16, len(dnsCfg.HealthCheckPorts))
+	for name, port := range dnsCfg.HealthCheckPorts {
+		fqdn, err := dnsname.ToFQDN(name)
+		if err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("healthCheckPorts[%q]", name), name, err))
+			continue
+		}
+		cfg.HealthCheckPorts[fqdn] = port
+	}
+	cfg.ExpiresAt, err = parseExpiresAt(dnsCfg.ExpiresAt)
+	errs = append(errs, err)
+	cfg.RPZ, err = parseRPZRules(dnsCfg.RPZ)
+	errs = append(errs, err)
+	cfg.Rewrites, err = parseRewriteRules(dnsCfg.RewriteRules)
+	errs = append(errs, err)
+	cfg.Views, err = parseViews(dnsCfg.Views, opts.AllowLongLabels)
+	errs = append(errs, err)
+	cfg.SearchDomains, cfg.NDots, err = parseSearchDomains(dnsCfg.SearchDomains, dnsCfg.NDots)
+	errs = append(errs, err)
+	cfg.ClusterDomain, err = ParseClusterDomain("clusterDomain", dnsCfg.ClusterDomain)
+	errs = append(errs, err)
+	if cfgErrs := Errors(errors.Join(errs...)); len(cfgErrs) > 0 {
+		slices.SortStableFunc(cfgErrs, func(a, b *Error) int { return strings.Compare(a.Field, b.Field) })
+		errs = errs[:0]
+		for _, e := range cfgErrs {
+			errs = append(errs, e)
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	if dnsCfg.SchemaVersion > SupportedSchemaVersion {
+		cfg.Warnings = append(cfg.Warnings, Warning{
+			Type:    WarningSchemaVersion,
+			Field:   "schemaVersion",
+			Message: fmt.Sprintf("the config has schema version %d, but the latest supported version is %d; fields that are not supported are ignored", dnsCfg.SchemaVersion, SupportedSchemaVersion),
+		})
+	}
+	cfg.Warnings = append(cfg.Warnings, nonFQDNWarnings("hosts", dnsCfg.Hosts)...)
+	cfg.Warnings = append(cfg.Warnings, nonFQDNWarnings("externalRecords", dnsCfg.ExternalRecords)...)
+	cfg.Warnings = append(cfg.Warnings, checkConfig(dnsCfg, opts.localDomains())...)
+	cfg.Warnings = append(cfg.Warnings, checkRedirectLoops(cfg.RPZ)...)
+	slices.SortStableFunc(cfg.Warnings, func(a, b Warning) int { return strings.Compare(a.Field, b.Field) })
+	return cfg, nil
+}
+
+// Errors returns the invalid values that err, as returned by Decode or Parse,
+// reports. Errors that are not about a value, such as failing to read a
+// hosts file referenced by a Corefile, are returned as an Error without a
+// Field.
+func Errors(err error) []*Error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []*Error
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, Errors(e)...)
+		}
+		return errs
+	}
+	var cfgErr *Error
+	if errors.As(err, &cfgErr) {
+		return []*Error{cfgErr}
+	}
+	return []*Error{{OriginalError: err}}
+}
+
+// parseHosts parses host records from the field of the nameserver config
+// named field. Their names are parsed with parseHostName.
+func parseHosts(field string, m map[string][]string, allowLongLabels bool) (map[dnsname.FQDN][]netip.Addr, error) {
+	hosts := make(map[dnsname.FQDN][]netip.Addr, len(m))
+	var errs []error
+	// Names that only differ by the leading or trailing dot are the same
+	// record. They can only be merged once a name that isn't already an
+	// FQDN has been seen, which saves a lookup per name for large configs.
+	var sawAlias bool
+	for name, ips := range m {
+		fqdn, err := parseHostName(name, allowLongLabels)
+		if err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("%s[%q]", field, name), name, err))
+			continue
+		}
+		if string(fqdn) != name {
+			sawAlias = true
+		}
+		addrs := make([]netip.Addr, len(ips))
+		for i, ipS := range ips {
+			if addrs[i], err = netip.ParseAddr(ipS); err != nil {
+				errs = append(errs, fieldError(fmt.Sprintf("%s[%q][%d]", field, name, i), ipS, err))
+			}
+		}
+		if sawAlias {
+			if prev, ok := hosts[fqdn]; ok {
+				addrs = append(prev, addrs...)
+			}
+		}
+		hosts[fqdn] = addrs
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return hosts, nil
+}
+
+// nonFQDNWarnings returns a warning for each name in m, the records in the
+// given config field, that doesn't end with a dot. Such names are completed
+// to FQDNs by appending the dot, but are likely a mistake in hand-written
+// configs, as the operator always writes FQDNs.
+func nonFQDNWarnings(field string, m map[string][]string) []Warning {
+	var warnings []Warning
+	for name := range m {
+		if name != "" && !strings.HasSuffix(name, ".") {
+			warnings = append(warnings, Warning{
+				Type:    WarningNotFQDN,
+				Field:   fmt.Sprintf("%s[%q]", field, name),
+				Message: fmt.Sprintf("name is not fully qualified, serving it as %q", name+"."),
+			})
+		}
+	}
+	return warnings
+}
+
+// ParseLocalDomains parses a comma-separated list of domains that are served
+// along with DefaultLocalDomains, or instead of them if disableDefaults is
+// set. It returns nil if s is empty and disableDefaults is not set, meaning
+// that only DefaultLocalDomains are served.
+func ParseLocalDomains(s string, disableDefaults bool) ([]dnsname.FQDN, error) {
+	if s == "" {
+		if disableDefaults {
+			return nil, errors.New("--disable-ts-net-root-domains requires --local-domains")
+		}
+		return nil, nil
+	}
+	var domains []dnsname.FQDN
+	if !disableDefaults {
+		domains = slices.Clone(DefaultLocalDomains)
+	}
+	for _, d := range strings.Split(s, ",") {
+		fqdn, err := dnsname.ToFQDN(strings.ToLower(strings.TrimSpace(d)))
+		if err == nil && fqdn == "." {
+			err = errors.New("must not be the root domain")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid local domain %q: %w", d, err)
+		}
+		if !slices.Contains(domains, fqdn) {
+			domains = append(domains, fqdn)
+		}
+	}
+	return domains, nil
+}
+
+// ParseClusterDomain validates and parses the cluster domain in s, the value
+// of field, which may be empty.
+func ParseClusterDomain(field, s string) (dnsname.FQDN, error) {
+	if s == "" {
+		return "", nil
+	}
+	fqdn, err := dnsname.ToFQDN(s)
+	if err == nil && fqdn == "." {
+		err = errors.New("must not be the root domain")
+	}
+	if err != nil {
+		return "", fieldError(field, s, err)
+	}
+	return fqdn, nil
+}
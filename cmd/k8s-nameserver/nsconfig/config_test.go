@@ -0,0 +1,106 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// load decodes and parses the config in b with opts.
+func load(b []byte, opts Options) (*Config, error) {
+	dnsCfg, err := Decode(b, opts)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(dnsCfg, opts)
+}
+
+func TestParseHostsAliases(t *testing.T) {
+	for _, m := range []map[string][]string{
+		{"foo.bar.ts.net.": {"10.20.30.40"}, "foo.bar.ts.net": {"10.20.30.41"}},
+		{"foo.bar.ts.net": {"10.20.30.40"}, ".foo.bar.ts.net.": {"10.20.30.41"}},
+	} {
+		hosts, err := parseHosts("hosts", m, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips := hosts["foo.bar.ts.net."]
+		slices.SortFunc(ips, netip.Addr.Compare)
+		if want := []netip.Addr{netip.MustParseAddr("10.20.30.40"), netip.MustParseAddr("10.20.30.41")}; len(hosts) != 1 || !slices.Equal(ips, want) {
+			t.Errorf("parseHosts(%v) = %v, want foo.bar.ts.net.: %v", m, hosts, want)
+		}
+	}
+}
+
+func TestParseLocalDomains(t *testing.T) {
+	for _, tc := range []struct {
+		s               string
+		disableDefaults bool
+		want            string
+		wantErr         bool
+	}{
+		{"", false, "[]", false},
+		{"corp.example.com, Other.example.com.", false, "[ts.net. corp.example.com. other.example.com.]", false},
+		{"corp.example.com,ts.net", false, "[ts.net. corp.example.com.]", false},
+		{"corp.example.com", true, "[corp.example.com.]", false},
+		{"", true, "", true},
+		{"corp..example.com", false, "", true},
+		{".", false, "", true},
+	} {
+		got, err := ParseLocalDomains(tc.s, tc.disableDefaults)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseLocalDomains(%q, %v): got error %v, want error %v", tc.s, tc.disableDefaults, err, tc.wantErr)
+			continue
+		}
+		if err == nil && fmt.Sprint(got) != tc.want {
+			t.Errorf("ParseLocalDomains(%q, %v) = %v, want %v", tc.s, tc.disableDefaults, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cfg := `{
+		"hosts": {"foo.ts.net.": ["nope"]},
+		"rpz": [{"name": "ads.example.com.", "action": "BLOCK"}],
+		"clusterDomain": ".",
+		"expiresAt": {"foo..ts.net.": "2030-01-01T00:00:00Z"}
+	}`
+	_, err := load([]byte(cfg), Options{})
+	var fields []string
+	for _, e := range Errors(err) {
+		fields = append(fields, e.Field)
+	}
+	want := []string{"clusterDomain", `expiresAt["foo..ts.net."]`, `hosts["foo.ts.net."][0]`, "rpz[0].action"}
+	if !slices.Equal(fields, want) {
+		t.Errorf("got errors %v for fields %q, want fields %q", err, fields, want)
+	}
+}
+
+func TestParseWarnings(t *testing.T) {
+	cfg := `{
+		"schemaVersion": 1000,
+		"hosts": {"foo.ts.net": ["10.0.0.1"]},
+		"externalRecords": {"foo.example.com.": ["10.0.0.2"]}
+	}`
+	c, err := load([]byte(cfg), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, w := range c.Warnings {
+		types = append(types, w.Type)
+	}
+	want := []string{WarningExternalRecordsIgnored, WarningNotFQDN, WarningSchemaVersion}
+	if !slices.Equal(types, want) {
+		t.Errorf("got warnings %+v, want types %q", c.Warnings, want)
+	}
+	if len(c.ExternalHosts) != 0 {
+		t.Errorf("got external records %v without AllowExternalRecords, want none", c.ExternalHosts)
+	}
+}
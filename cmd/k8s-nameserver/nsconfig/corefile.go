@@ -0,0 +1,334 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+)
+
+// CorefileKey is the key of the Corefile in the CoreDNS ConfigMap, used
+// as the config key with --coredns-compatible unless --config-key is set.
+const CorefileKey = "Corefile"
+
+// corefileParser parses the hosts plugin entries of a CoreDNS Corefile.
+type corefileParser struct {
+	// readFile reads a hosts file referenced by a hosts plugin, by base
+	// name. If nil, hosts plugins that reference a file are an error.
+	readFile func(name string) ([]byte, error)
+	// logf logs directives that are accepted but don't change how records
+	// are served.
+	logf func(format string, args ...any)
+
+	dnsCfg *operatorutils.TSHosts
+}
+
+// parseCorefile parses the Corefile in r and returns the host records of all
+// of its hosts plugins:
+//
+//	.:53 {
+//	    hosts /etc/coredns/custom.hosts bar.ts.net {
+//	        10.20.30.40 foo.bar.ts.net
+//	        ttl 60
+//	        reload 15s
+//	        fallthrough
+//	    }
+//	    forward . /etc/resolv.conf
+//	}
+//
+// Only the hosts plugin is supported; all other plugins are ignored. Hosts
+// files are read with readFile by base name, as they are usually mounted
+// from the same ConfigMap as the Corefile. Entries for names outside of the
+// zones of the hosts plugin, or of its server block if it has none, are
+// skipped, the same as CoreDNS does.
+//
+// The ttl, reload, fallthrough and no_reverse options are validated but
+// otherwise ignored: records are served with the nameserver's TTL, the
+// config is reloaded whenever the ConfigMap changes, and queries for names
+// without records are answered the same way regardless.
+func parseCorefile(r io.Reader, readFile func(name string) ([]byte, error), logf func(format string, args ...any)) (*operatorutils.TSHosts, error) {
+	p := &corefileParser{
+		readFile: readFile,
+		logf:     logf,
+		dnsCfg:   &operatorutils.TSHosts{Hosts: make(map[string][]string)},
+	}
+	lines, err := corefileLines(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		if !l.opens() {
+			return nil, fmt.Errorf("line %d: expected server block, got %q", l.num, strings.Join(l.tokens, " "))
+		}
+		end, err := blockEnd(lines, i)
+		if err != nil {
+			return nil, err
+		}
+		zones, err := serverBlockZones(l.args())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.num, err)
+		}
+		if err := p.parseServerBlock(lines[i+1:end], zones); err != nil {
+			return nil, err
+		}
+		i = end + 1
+	}
+	return p.dnsCfg, nil
+}
+
+// parseServerBlock parses the directives of a server block for zones.
+func (p *corefileParser) parseServerBlock(lines []corefileLine, zones []dnsname.FQDN) error {
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		if l.closes() {
+			return fmt.Errorf("line %d: unexpected '}'", l.num)
+		}
+		var body []corefileLine
+		if l.opens() {
+			end, err := blockEnd(lines, i)
+			if err != nil {
+				return err
+			}
+			body, i = lines[i+1:end], end
+		}
+		if l.tokens[0] == "hosts" {
+			if err := p.parseHosts(l, body, zones); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseHosts parses the hosts plugin on line l with the lines of its block
+// in body, in a server block for zones.
+func (p *corefileParser) parseHosts(l corefileLine, body []corefileLine, zones []dnsname.FQDN) error {
+	args := l.args()[1:]
+	var file string
+	if len(args) > 0 {
+		file, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		zones = make([]dnsname.FQDN, 0, len(args))
+		for _, z := range args {
+			fqdn, err := dnsname.ToFQDN(z)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid zone %q: %w", l.num, z, err)
+			}
+			zones = append(zones, fqdn)
+		}
+	}
+	hosts := &operatorutils.TSHosts{Hosts: make(map[string][]string)}
+	if file != "" {
+		if p.readFile == nil {
+			return fmt.Errorf("line %d: hosts file %q can't be read", l.num, file)
+		}
+		b, err := p.readFile(path.Base(file))
+		if err != nil {
+			return fmt.Errorf("line %d: error reading hosts file %q, it must be in the same ConfigMap as the Corefile: %w", l.num, file, err)
+		}
+		if hosts, err = parseHostsFile(bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("hosts file %q: %w", file, err)
+		}
+	}
+	for _, bl := range body {
+		if err := p.parseHostsLine(hosts, bl); err != nil {
+			return fmt.Errorf("line %d: %w", bl.num, err)
+		}
+	}
+	for name, ips := range hosts.Hosts {
+		if !inZones(dnsname.FQDN(name), zones) {
+			p.logf("skipping hosts entry for %q on line %d of the Corefile, as it is not within the zones of the hosts plugin", name, l.num)
+			continue
+		}
+		p.dnsCfg.Hosts[name] = append(p.dnsCfg.Hosts[name], ips...)
+	}
+	return nil
+}
+
+// parseHostsLine parses the line l of a hosts plugin block, which is either
+// an inline hosts entry or an option, adding entries to hosts.
+func (p *corefileParser) parseHostsLine(hosts *operatorutils.TSHosts, l corefileLine) error {
+	if l.opens() || l.closes() {
+		return fmt.Errorf("unexpected block in hosts plugin")
+	}
+	args := l.tokens[1:]
+	switch opt := l.tokens[0]; opt {
+	case "ttl":
+		if len(args) != 1 {
+			return fmt.Errorf("ttl needs one argument")
+		}
+		// TTLs are 0 to 2^31-1 seconds, see RFC 2181, section 8.
+		if _, err := strconv.ParseUint(args[0], 10, 31); err != nil {
+			return fmt.Errorf("invalid ttl %q: %w", args[0], err)
+		}
+		p.logf("ignoring hosts plugin option %q on line %d of the Corefile, records are served with the nameserver's TTL", opt, l.num)
+	case "reload":
+		if len(args) != 1 {
+			return fmt.Errorf("reload needs one argument")
+		}
+		if _, err := time.ParseDuration(args[0]); err != nil {
+			return fmt.Errorf("invalid reload interval %q: %w", args[0], err)
+		}
+	case "fallthrough":
+		for _, z := range args {
+			if _, err := dnsname.ToFQDN(z); err != nil {
+				return fmt.Errorf("invalid fallthrough zone %q: %w", z, err)
+			}
+		}
+	case "no_reverse":
+		if len(args) != 0 {
+			return fmt.Errorf("no_reverse takes no arguments")
+		}
+	default:
+		if _, err := netip.ParseAddr(opt); err != nil {
+			return fmt.Errorf("unknown hosts plugin option %q", opt)
+		}
+		return addHostsEntry(hosts, l.tokens)
+	}
+	return nil
+}
+
+// inZones reports whether name is within any of zones.
+func inZones(name dnsname.FQDN, zones []dnsname.FQDN) bool {
+	for _, z := range zones {
+		if z == "." || z.Contains(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverBlockZones returns the zones of a server block with keys, such as
+// ".:53" or "dns://bar.ts.net".
+func serverBlockZones(keys []string) ([]dnsname.FQDN, error) {
+	var zones []dnsname.FQDN
+	for _, k := range keys {
+		k = strings.TrimSuffix(k, ",")
+		if k == "" {
+			continue
+		}
+		if _, rest, ok := strings.Cut(k, "://"); ok {
+			k = rest
+		}
+		if host, _, ok := strings.Cut(k, ":"); ok {
+			k = host
+		}
+		if k == "" {
+			k = "."
+		}
+		fqdn, err := dnsname.ToFQDN(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server block zone %q: %w", k, err)
+		}
+		zones = append(zones, fqdn)
+	}
+	return zones, nil
+}
+
+// corefileLine is a line of a Corefile, split into tokens, with comments
+// removed. Opening braces are separate tokens.
+type corefileLine struct {
+	num    int
+	tokens []string
+}
+
+// opens reports whether the line opens a block.
+func (l corefileLine) opens() bool {
+	return l.tokens[len(l.tokens)-1] == "{"
+}
+
+// closes reports whether the line closes a block.
+func (l corefileLine) closes() bool {
+	return len(l.tokens) == 1 && l.tokens[0] == "}"
+}
+
+// args returns the tokens of the line without the opening brace.
+func (l corefileLine) args() []string {
+	if l.opens() {
+		return l.tokens[:len(l.tokens)-1]
+	}
+	return l.tokens
+}
+
+// corefileLines returns the non-empty lines of the Corefile in r.
+func corefileLines(r io.Reader) ([]corefileLine, error) {
+	var lines []corefileLine
+	s := bufio.NewScanner(r)
+	for num := 1; s.Scan(); num++ {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		var tokens []string
+		for _, f := range strings.Fields(line) {
+			// Braces may be attached to the tokens around them, i.e.
+			// ".:53{" or "}" on the same line as the last directive.
+			for f != "" {
+				i := strings.IndexAny(f, "{}")
+				if i < 0 {
+					tokens = append(tokens, f)
+					break
+				}
+				if i > 0 {
+					tokens = append(tokens, f[:i])
+				}
+				tokens = append(tokens, f[i:i+1])
+				f = f[i+1:]
+			}
+		}
+		// Split lines so that braces are only ever at the end of a line
+		// or on a line on their own.
+		var cur []string
+		for _, t := range tokens {
+			switch t {
+			case "{":
+				lines = append(lines, corefileLine{num, append(cur, t)})
+				cur = nil
+			case "}":
+				if len(cur) > 0 {
+					lines = append(lines, corefileLine{num, cur})
+					cur = nil
+				}
+				lines = append(lines, corefileLine{num, []string{t}})
+			default:
+				cur = append(cur, t)
+			}
+		}
+		if len(cur) > 0 {
+			lines = append(lines, corefileLine{num, cur})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("error reading Corefile: %w", err)
+	}
+	return lines, nil
+}
+
+// blockEnd returns the index of the line that closes the block opened by
+// lines[start].
+func blockEnd(lines []corefileLine, start int) (int, error) {
+	depth := 0
+	for i := start; i < len(lines); i++ {
+		if lines[i].opens() {
+			depth++
+		} else if lines[i].closes() {
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("line %d: block is not closed", lines[start].num)
+}
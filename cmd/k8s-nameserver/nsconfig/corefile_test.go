@@ -0,0 +1,156 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// kubeCorefile is the default Corefile of a kubeadm cluster, with a hosts
+// plugin added for Tailscale services.
+const kubeCorefile = `.:53 {
+    errors
+    health {
+       lameduck 5s
+    }
+    ready
+    kubernetes cluster.local in-addr.arpa ip6.arpa {
+       pods insecure
+       fallthrough in-addr.arpa ip6.arpa
+       ttl 30
+    }
+    hosts {
+        10.20.30.40 foo.bar.ts.net
+        fd7a:115c:a1e0::1 foo.bar.ts.net baz.bar.ts.net
+        ttl 60
+        reload 1m0s
+        fallthrough
+    }
+    prometheus :9153
+    forward . /etc/resolv.conf {
+       max_concurrent 1000
+    }
+    cache 30
+    loop
+    reload
+    loadbalance
+}
+`
+
+func TestParseCorefile(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		files   map[string]string
+		want    map[string][]string
+		wantErr string
+	}{
+		{
+			name: "kubeadm",
+			in:   kubeCorefile,
+			want: map[string][]string{
+				"foo.bar.ts.net.": {"10.20.30.40", "fd7a:115c:a1e0::1"},
+				"baz.bar.ts.net.": {"fd7a:115c:a1e0::1"},
+			},
+		},
+		{
+			name: "hosts_file",
+			in: `. {
+    hosts /etc/coredns/ts.hosts bar.ts.net {
+        10.20.30.42 inline.bar.ts.net
+        no_reverse
+        fallthrough bar.ts.net
+    }
+    whoami
+}`,
+			files: map[string]string{"ts.hosts": "# from the ConfigMap\n10.20.30.41 file.bar.ts.net\n10.0.0.1 other.example.com\n"},
+			want: map[string][]string{
+				"file.bar.ts.net.":   {"10.20.30.41"},
+				"inline.bar.ts.net.": {"10.20.30.42"},
+			},
+		},
+		{
+			name: "server_block_zones",
+			in: `bar.ts.net:53 {
+    hosts {
+        10.20.30.40 foo.bar.ts.net
+        10.20.30.41 foo.baz.ts.net
+    }
+}
+dns://baz.ts.net {
+    hosts {
+        10.20.30.42 foo.baz.ts.net
+    }
+}`,
+			want: map[string][]string{
+				"foo.bar.ts.net.": {"10.20.30.40"},
+				"foo.baz.ts.net.": {"10.20.30.42"},
+			},
+		},
+		{
+			name: "braces_on_same_line",
+			in:   `.:53{ hosts { 10.20.30.40 foo.bar.ts.net } }`,
+			want: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+		},
+		{
+			name: "no_hosts_plugin",
+			in:   ".:53 {\n    forward . 8.8.8.8\n}\n",
+			want: map[string][]string{},
+		},
+		{
+			name:    "invalid_ip",
+			in:      ".:53 {\n    hosts {\n        10.20.30.400 foo.bar.ts.net\n    }\n}\n",
+			wantErr: "line 3: unknown hosts plugin option",
+		},
+		{
+			name:    "invalid_ttl",
+			in:      ".:53 {\n    hosts {\n        ttl forever\n    }\n}\n",
+			wantErr: `line 3: invalid ttl "forever"`,
+		},
+		{
+			name:    "ttl_out_of_range",
+			in:      ".:53 {\n    hosts {\n        ttl 2147483648\n    }\n}\n",
+			wantErr: `line 3: invalid ttl "2147483648"`,
+		},
+		{
+			name:    "missing_file",
+			in:      ".:53 {\n    hosts /etc/coredns/missing.hosts\n}\n",
+			wantErr: "line 2: error reading hosts file",
+		},
+		{
+			name:    "unclosed_block",
+			in:      ".:53 {\n    hosts {\n        10.20.30.40 foo.bar.ts.net\n}\n",
+			wantErr: "line 1: block is not closed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readFile := func(name string) ([]byte, error) {
+				b, ok := tt.files[name]
+				if !ok {
+					return nil, os.ErrNotExist
+				}
+				return []byte(b), nil
+			}
+			got, err := parseCorefile(strings.NewReader(tt.in), readFile, t.Logf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Hosts, tt.want) {
+				t.Errorf("got hosts %v, want %v", got.Hosts, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Error is an invalid value in the nameserver config.
+type Error struct {
+	// Field is the path of the invalid field in the config, in the
+	// form used by the JSON config, i.e `hosts["foo.bar.ts.net."][1]` or
+	// `rpz[0].action`. It is empty if the error is not specific to a
+	// field, for example a syntax error.
+	Field string
+	// Value is the invalid value.
+	Value string
+	// OriginalError is the reason that the value is invalid.
+	OriginalError error
+}
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("invalid nameserver config: %v", e.OriginalError)
+	}
+	return fmt.Sprintf("invalid value %q for %s: %v", e.Value, e.Field, e.OriginalError)
+}
+
+func (e *Error) Unwrap() error {
+	return e.OriginalError
+}
+
+// MarshalJSON implements json.Marshaler. OriginalError is encoded as its
+// message.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	var msg string
+	if e.OriginalError != nil {
+		msg = e.OriginalError.Error()
+	}
+	return json.Marshal(struct {
+		Field string `json:"field,omitempty"`
+		Value string `json:"value,omitempty"`
+		Error string `json:"error"`
+	}{e.Field, e.Value, msg})
+}
+
+// fieldError returns a Error for the invalid value of field.
+func fieldError(field, value string, err error) *Error {
+	return &Error{Field: field, Value: value, OriginalError: err}
+}
+
+// jsonConfigError returns a Error for err, the error from decoding the
+// JSON config in b.
+func jsonConfigError(b []byte, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fieldError(typeErr.Field, typeErr.Value, err)
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line := 1 + bytes.Count(b[:min(int(syntaxErr.Offset), len(b))], []byte("\n"))
+		return &Error{OriginalError: fmt.Errorf("line %d: %w", line, err)}
+	}
+	return &Error{OriginalError: err}
+}
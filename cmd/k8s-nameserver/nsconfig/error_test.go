@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		field     string
+		value     string
+		wantInErr string // in OriginalError, if field is empty
+	}{
+		{
+			name:   "host_name",
+			config: `{"hosts":{"foo..bar.ts.net.":["10.20.30.40"]}}`,
+			field:  `hosts["foo..bar.ts.net."]`,
+			value:  "foo..bar.ts.net.",
+		},
+		{
+			name:   "host_ip",
+			config: `{"hosts":{"foo.bar.ts.net.":["10.20.30.40","10.20.30"]}}`,
+			field:  `hosts["foo.bar.ts.net."][1]`,
+			value:  "10.20.30",
+		},
+		{
+			name:   "external_record_ip",
+			config: `{"externalRecords":{"db.internal.":["db"]}}`,
+			field:  `externalRecords["db.internal."][0]`,
+			value:  "db",
+		},
+		{
+			name:   "external_record_in_local_domain",
+			config: `{"externalRecords":{"db.bar.ts.net.":["10.0.0.1"]}}`,
+			field:  `externalRecords["db.bar.ts.net."]`,
+			value:  "db.bar.ts.net.",
+		},
+		{
+			name:   "health_check_port_name",
+			config: `{"healthCheckPorts":{"foo..bar":80}}`,
+			field:  `healthCheckPorts["foo..bar"]`,
+			value:  "foo..bar",
+		},
+		{
+			name:   "rpz_name",
+			config: `{"rpz":[{"name":"ok.bar.ts.net.","action":"DROP"},{"name":"-bad..ts.net.","action":"NXDOMAIN"}]}`,
+			field:  "rpz[1].name",
+			value:  "-bad..ts.net.",
+		},
+		{
+			name:   "rpz_action",
+			config: `{"rpz":[{"name":"foo.bar.ts.net.","action":"BLOCK"}]}`,
+			field:  "rpz[0].action",
+			value:  "BLOCK",
+		},
+		{
+			name:   "rpz_redirect_target",
+			config: `{"rpz":[{"name":"foo.bar.ts.net.","action":"REDIRECT"}]}`,
+			field:  "rpz[0].action",
+			value:  "REDIRECT",
+		},
+		{
+			name:   "rewrite_source_cidr",
+			config: `{"rewriteRules":[{"sourceCIDR":"10.1.0.0","originalIP":"10.0.0.1","replacementIP":"10.0.0.2"}]}`,
+			field:  "rewriteRules[0].sourceCIDR",
+			value:  "10.1.0.0",
+		},
+		{
+			name:   "rewrite_match_name",
+			config: `{"rewriteRules":[{"sourceCIDR":"10.1.0.0/16","matchName":"a..b","originalIP":"10.0.0.1","replacementIP":"10.0.0.2"}]}`,
+			field:  "rewriteRules[0].matchName",
+			value:  "a..b",
+		},
+		{
+			name:   "rewrite_original_ip",
+			config: `{"rewriteRules":[{"sourceCIDR":"10.1.0.0/16","originalIP":"x","replacementIP":"10.0.0.2"}]}`,
+			field:  "rewriteRules[0].originalIP",
+			value:  "x",
+		},
+		{
+			name:   "rewrite_address_family",
+			config: `{"rewriteRules":[{"sourceCIDR":"10.1.0.0/16","originalIP":"10.0.0.1","replacementIP":"fd7a:115c:a1e0::1"}]}`,
+			field:  "rewriteRules[0].replacementIP",
+			value:  "fd7a:115c:a1e0::1",
+		},
+		{
+			name:   "json_type",
+			config: `{"hosts":{"foo.bar.ts.net.":"10.20.30.40"}}`,
+			field:  "hosts.foo.bar.ts.net.",
+			value:  "string",
+		},
+		{
+			name:      "json_syntax",
+			config:    "{\n\"hosts\": {\n}}}",
+			wantInErr: "line 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load([]byte(tt.config), Options{AllowExternalRecords: true})
+			var cfgErr *Error
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("got error %v, want an Error", err)
+			}
+			if cfgErr.Field != tt.field || cfgErr.Value != tt.value {
+				t.Errorf("got error for field %q with value %q, want field %q with value %q", cfgErr.Field, cfgErr.Value, tt.field, tt.value)
+			}
+			if cfgErr.OriginalError == nil || !strings.Contains(cfgErr.OriginalError.Error(), tt.wantInErr) {
+				t.Errorf("got original error %v, want it to contain %q", cfgErr.OriginalError, tt.wantInErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"tailscale.com/util/dnsname"
+)
+
+// parseExpiresAt returns the expiry times of the expiresAt config field by
+// DNS name.
+func parseExpiresAt(expiresAt map[string]time.Time) (map[dnsname.FQDN]time.Time, error) {
+	if len(expiresAt) == 0 {
+		return nil, nil
+	}
+	m := make(map[dnsname.FQDN]time.Time, len(expiresAt))
+	var errs []error
+	for name, t := range expiresAt {
+		fqdn, err := dnsname.ToFQDN(name)
+		if err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("expiresAt[%q]", name), name, err))
+			continue
+		}
+		m[fqdn] = t
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return m, nil
+}
@@ -0,0 +1,17 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpiresAtError(t *testing.T) {
+	if _, err := parseExpiresAt(map[string]time.Time{"bad..name": time.Now()}); err == nil {
+		t.Error("parsing an invalid name succeeded, want error")
+	}
+}
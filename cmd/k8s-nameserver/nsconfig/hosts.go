@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+)
+
+// parseHostsFile parses a config in /etc/hosts format, as used by the CoreDNS
+// hosts plugin. Each line contains an IP address followed by one or more host
+// names, and everything after a '#' is a comment. IP addresses for the same
+// host name on multiple lines are accumulated in the order they appear.
+func parseHostsFile(r io.Reader) (*operatorutils.TSHosts, error) {
+	dnsCfg := &operatorutils.TSHosts{Hosts: make(map[string][]string)}
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := addHostsEntry(dnsCfg, fields); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("error reading hosts file: %w", err)
+	}
+	return dnsCfg, nil
+}
+
+// addHostsEntry adds the records of the hosts file entry with fields, an IP
+// address followed by one or more host names, to dnsCfg.
+func addHostsEntry(dnsCfg *operatorutils.TSHosts, fields []string) error {
+	if len(fields) == 1 {
+		return fmt.Errorf("no host names for %q", fields[0])
+	}
+	ip, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid IP address %q: %w", fields[0], err)
+	}
+	for _, name := range fields[1:] {
+		fqdn, err := dnsname.ToFQDN(name)
+		if err != nil {
+			return fmt.Errorf("invalid DNS name %q: %w", name, err)
+		}
+		key := fqdn.WithTrailingDot()
+		dnsCfg.Hosts[key] = append(dnsCfg.Hosts[key], ip.String())
+	}
+	return nil
+}
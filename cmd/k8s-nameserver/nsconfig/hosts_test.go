@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHostsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: map[string][]string{},
+		},
+		{
+			name: "single",
+			in:   "10.20.30.40 foo.bar.ts.net\n",
+			want: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+		},
+		{
+			name: "trailing_dot",
+			in:   "10.20.30.40 foo.bar.ts.net.",
+			want: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+		},
+		{
+			name: "comments_and_blank_lines",
+			in: `# Tailscale services
+
+10.20.30.40	foo.bar.ts.net   # the foo service
+   # indented comment
+10.20.30.41 baz.bar.ts.net
+`,
+			want: map[string][]string{
+				"foo.bar.ts.net.": {"10.20.30.40"},
+				"baz.bar.ts.net.": {"10.20.30.41"},
+			},
+		},
+		{
+			name: "multiple_lines_accumulate",
+			in: `10.20.30.40 foo.bar.ts.net
+fd7a:115c:a1e0::1 foo.bar.ts.net
+10.20.30.41 foo.bar.ts.net`,
+			want: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40", "fd7a:115c:a1e0::1", "10.20.30.41"}},
+		},
+		{
+			name: "aliases",
+			in:   "10.20.30.40 foo.bar.ts.net foo-alias.bar.ts.net",
+			want: map[string][]string{
+				"foo.bar.ts.net.":       {"10.20.30.40"},
+				"foo-alias.bar.ts.net.": {"10.20.30.40"},
+			},
+		},
+		{
+			name: "ipv6_normalized",
+			in:   "FD7A:115C:A1E0:0:0:0:0:1 foo.bar.ts.net",
+			want: map[string][]string{"foo.bar.ts.net.": {"fd7a:115c:a1e0::1"}},
+		},
+		{
+			name:    "invalid_ip",
+			in:      "10.20.30 foo.bar.ts.net",
+			wantErr: true,
+		},
+		{
+			name:    "missing_name",
+			in:      "10.20.30.40 # foo.bar.ts.net",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_name",
+			in:      "10.20.30.40 foo..bar.ts.net",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHostsFile(strings.NewReader(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got hosts %v, want error", got.Hosts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Hosts, tt.want) {
+				t.Errorf("got hosts %v, want %v", got.Hosts, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"fmt"
+	"slices"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+// ToASCIIName returns name, a DNS name that may contain internationalized
+// labels, with those labels Punycode encoded, i.e. "xn--mnchen-3ya.ts.net."
+// for "münchen.ts.net.". Names that are already ASCII are returned as they
+// are, as they may contain characters such as underscores that IDNA doesn't
+// allow.
+// https://datatracker.ietf.org/doc/html/rfc5891
+func ToASCIIName(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+	return idna.Lookup.ToASCII(name)
+}
+
+func isASCII(s string) bool {
+	for i := range len(s) {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeIDNConfig replaces the internationalized names in the records and
+// health check ports of dnsCfg with their Punycode encoding, so that they
+// are served as the names that clients look up. The maps of dnsCfg are
+// replaced rather than modified, as they may be shared with other configs.
+func encodeIDNConfig(dnsCfg *operatorutils.TSHosts) error {
+	var err error
+	if dnsCfg.Hosts, err = encodeIDNKeys("hosts", dnsCfg.Hosts, appendIPs); err != nil {
+		return err
+	}
+	if dnsCfg.ExternalRecords, err = encodeIDNKeys("externalRecords", dnsCfg.ExternalRecords, appendIPs); err != nil {
+		return err
+	}
+	if dnsCfg.HealthCheckPorts, err = encodeIDNKeys("healthCheckPorts", dnsCfg.HealthCheckPorts, nil); err != nil {
+		return err
+	}
+	if dnsCfg.ExpiresAt, err = encodeIDNKeys("expiresAt", dnsCfg.ExpiresAt, nil); err != nil {
+		return err
+	}
+	dnsCfg.Views = slices.Clone(dnsCfg.Views)
+	for i := range dnsCfg.Views {
+		if dnsCfg.Views[i].Hosts, err = encodeIDNKeys(fmt.Sprintf("views[%d].hosts", i), dnsCfg.Views[i].Hosts, appendIPs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendIPs(a, b []string) []string {
+	return append(slices.Clip(a), b...)
+}
+
+// encodeIDNKeys returns m, the given config field, with its keys encoded by
+// ToASCIIName. If both the Unicode and the Punycode form of a name are in m,
+// their values are combined with merge, or the Unicode one is used if merge
+// is nil.
+func encodeIDNKeys[V any](field string, m map[string]V, merge func(a, b V) V) (map[string]V, error) {
+	if m == nil {
+		return nil, nil
+	}
+	encoded := make(map[string]V, len(m))
+	var idns []string
+	for name, v := range m {
+		if isASCII(name) {
+			encoded[name] = v
+		} else {
+			idns = append(idns, name)
+		}
+	}
+	// Merge in a fixed order, so that the order of the IP addresses of
+	// records doesn't change between reloads.
+	slices.Sort(idns)
+	for _, name := range idns {
+		ascii, err := ToASCIIName(name)
+		if err != nil {
+			return nil, fieldError(fmt.Sprintf("%s[%q]", field, name), name, err)
+		}
+		v := m[name]
+		if prev, ok := encoded[ascii]; ok && merge != nil {
+			v = merge(prev, v)
+		}
+		encoded[ascii] = v
+	}
+	return encoded, nil
+}
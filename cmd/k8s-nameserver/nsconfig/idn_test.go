@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestEncodeIDNConfig(t *testing.T) {
+	cfg := &operatorutils.TSHosts{
+		Hosts: map[string][]string{
+			"münchen.bar.ts.net.":        {"10.20.30.40"},
+			"xn--mnchen-3ya.bar.ts.net.": {"10.20.30.41"},
+			"_dns.bar.ts.net.":           {"10.20.30.42"},
+		},
+		HealthCheckPorts: map[string]uint16{"münchen.bar.ts.net.": 8080},
+		Views: []operatorutils.View{
+			{SourceCIDR: "10.1.0.0/16", Hosts: map[string][]string{"zürich.bar.ts.net.": {"10.20.30.43"}}},
+		},
+	}
+	views := cfg.Views
+	if err := encodeIDNConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// Both forms of the name are the same record.
+	if got := fmt.Sprint(cfg.Hosts); got != "map[_dns.bar.ts.net.:[10.20.30.42] xn--mnchen-3ya.bar.ts.net.:[10.20.30.41 10.20.30.40]]" {
+		t.Errorf("got hosts %s", got)
+	}
+	if got := fmt.Sprint(cfg.HealthCheckPorts); got != "map[xn--mnchen-3ya.bar.ts.net.:8080]" {
+		t.Errorf("got health check ports %s", got)
+	}
+	if got := fmt.Sprint(cfg.Views[0].Hosts); got != "map[xn--zrich-kva.bar.ts.net.:[10.20.30.43]]" {
+		t.Errorf("got view hosts %s", got)
+	}
+	if _, ok := views[0].Hosts["zürich.bar.ts.net."]; !ok {
+		t.Error("views of the original config were modified")
+	}
+
+	// Labels must not start with a combining mark.
+	err := encodeIDNConfig(&operatorutils.TSHosts{Hosts: map[string][]string{"\u0301foo.bar.ts.net.": {"10.20.30.40"}}})
+	var cfgErr *Error
+	if !errors.As(err, &cfgErr) || cfgErr.Field != "hosts[\"\u0301foo.bar.ts.net.\"]" {
+		t.Errorf("got error %v, want a config error for the invalid name", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// maxLabelLength is the maximum length of a DNS label.
+	// https://datatracker.ietf.org/doc/html/rfc1035#section-2.3.4
+	maxLabelLength = 63
+	// maxNameLength is the maximum length of a DNS name, including the
+	// trailing dot, the same as for dnsname.ToFQDN.
+	maxNameLength = 253
+)
+
+// parseHostName returns the FQDN of name, the name of a host record in the
+// config. Names with labels longer than maxLabelLength or that are longer
+// than maxNameLength are an error, including those whose last label is too
+// long, which dnsname.ToFQDN lets through. With allowLongLabels, only empty
+// labels are an error, so that testing environments can use names that
+// don't fit the limits; such names can't be queried by clients that enforce
+// them, which includes the golang.org/x/net/dns/dnsmessage package.
+func parseHostName(name string, allowLongLabels bool) (dnsname.FQDN, error) {
+	if allowLongLabels {
+		return toFQDNAllowLong(name)
+	}
+	fqdn, err := dnsname.ToFQDN(name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkNameLength(fqdn); err != nil {
+		return "", err
+	}
+	return fqdn, nil
+}
+
+// checkNameLength returns an error if name has a label longer than
+// maxLabelLength or is longer than maxNameLength.
+func checkNameLength(name dnsname.FQDN) error {
+	s := name.WithTrailingDot()
+	if len(s) > maxNameLength {
+		return fmt.Errorf("name is %d bytes long, max length is %d bytes", len(s), maxNameLength)
+	}
+	// Labels are split without strings.Split, which allocates, as this is
+	// called for every record on every reload.
+	for rest := name.WithoutTrailingDot(); rest != ""; {
+		label, after, _ := strings.Cut(rest, ".")
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("label %q is %d bytes long, max length is %d bytes", label, len(label), maxLabelLength)
+		}
+		rest = after
+	}
+	return nil
+}
+
+// toFQDNAllowLong is like dnsname.ToFQDN, but doesn't limit the length of
+// labels and names.
+func toFQDNAllowLong(name string) (dnsname.FQDN, error) {
+	name = strings.TrimPrefix(name, ".")
+	if name == "" || name == "." {
+		return ".", nil
+	}
+	name = strings.TrimSuffix(name, ".")
+	if slices.Contains(strings.Split(name, "."), "") {
+		return "", errors.New("empty DNS label")
+	}
+	return dnsname.FQDN(name + "."), nil
+}
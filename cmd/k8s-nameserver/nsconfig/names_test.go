@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHostName(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	label64 := strings.Repeat("a", 64)
+	// Names of 253 and 254 bytes, including the trailing dot.
+	name253 := label63 + "." + label63 + "." + label63 + "." + strings.Repeat("b", 60) + "."
+	name254 := label63 + "." + label63 + "." + label63 + "." + strings.Repeat("b", 61) + "."
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{label63 + ".ts.net.", false},
+		{label64 + ".ts.net.", true},
+		// dnsname.ToFQDN doesn't check the last label.
+		{"foo.ts." + label63 + ".", false},
+		{"foo.ts." + label64 + ".", true},
+		{name253, false},
+		{name254, true},
+		{"foo..ts.net.", true},
+	}
+	for _, tt := range tests {
+		_, err := parseHostName(tt.name, false)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("parseHostName(%d byte name %q) = %v, want error: %v", len(tt.name), tt.name, err, tt.wantErr)
+		}
+		// Only empty labels are an error with allowLongLabels.
+		fqdn, err := parseHostName(tt.name, true)
+		if wantErr := strings.Contains(tt.name, ".."); (err != nil) != wantErr {
+			t.Errorf("parseHostName(%d byte name %q, allowLongLabels) = %v, want error: %v", len(tt.name), tt.name, err, wantErr)
+		} else if err == nil && fqdn.WithTrailingDot() != tt.name {
+			t.Errorf("parseHostName(%q, allowLongLabels) = %q, want the same name", tt.name, fqdn)
+		}
+	}
+}
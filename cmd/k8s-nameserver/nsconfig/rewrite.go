@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+)
+
+// RewriteRule is a parsed operatorutils.RewriteRule.
+type RewriteRule struct {
+	Raw    operatorutils.RewriteRule
+	Source netip.Prefix
+	Name   dnsname.FQDN // or empty to match all names
+	From   netip.Addr
+	To     netip.Addr
+}
+
+// parseRewriteRules validates and parses the given response rewriting rules.
+func parseRewriteRules(rules []operatorutils.RewriteRule) ([]RewriteRule, error) {
+	parsed := make([]RewriteRule, 0, len(rules))
+	var errs []error
+	for i, r := range rules {
+		pr, err := parseRewriteRule(i, r)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		parsed = append(parsed, pr)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return parsed, nil
+}
+
+// parseRewriteRule validates and parses r, the i-th rewrite rule.
+func parseRewriteRule(i int, r operatorutils.RewriteRule) (RewriteRule, error) {
+	pr := RewriteRule{Raw: r}
+	field := func(name string) string { return fmt.Sprintf("rewriteRules[%d].%s", i, name) }
+	var err error
+	if pr.Source, err = netip.ParsePrefix(r.SourceCIDR); err != nil {
+		return pr, fieldError(field("sourceCIDR"), r.SourceCIDR, err)
+	}
+	pr.Source = pr.Source.Masked()
+	if r.MatchName != "" {
+		if pr.Name, err = dnsname.ToFQDN(strings.ToLower(r.MatchName)); err != nil {
+			return pr, fieldError(field("matchName"), r.MatchName, err)
+		}
+	}
+	if pr.From, err = netip.ParseAddr(r.OriginalIP); err != nil {
+		return pr, fieldError(field("originalIP"), r.OriginalIP, err)
+	}
+	if pr.To, err = netip.ParseAddr(r.ReplacementIP); err != nil {
+		return pr, fieldError(field("replacementIP"), r.ReplacementIP, err)
+	}
+	if pr.From.Is4() != pr.To.Is4() {
+		return pr, fieldError(field("replacementIP"), r.ReplacementIP, fmt.Errorf("address family differs from original IP %v", pr.From))
+	}
+	return pr, nil
+}
@@ -0,0 +1,25 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"testing"
+
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestParseRewriteRulesErrors(t *testing.T) {
+	for _, r := range []operatorutils.RewriteRule{
+		{SourceCIDR: "10.1.0.0", OriginalIP: "10.0.0.1", ReplacementIP: "10.0.0.2"},
+		{SourceCIDR: "10.1.0.0/16", MatchName: "foo..ts.net.", OriginalIP: "10.0.0.1", ReplacementIP: "10.0.0.2"},
+		{SourceCIDR: "10.1.0.0/16", OriginalIP: "foo", ReplacementIP: "10.0.0.2"},
+		{SourceCIDR: "10.1.0.0/16", OriginalIP: "10.0.0.1", ReplacementIP: "fd00::1"},
+	} {
+		if _, err := parseRewriteRules([]operatorutils.RewriteRule{r}); err == nil {
+			t.Errorf("parseRewriteRules(%+v): got nil error", r)
+		}
+	}
+}
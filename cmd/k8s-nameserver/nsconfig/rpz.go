@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+)
+
+// MaxRPZRedirects is the maximum number of REDIRECT rules that are followed
+// for a single query, to protect against redirect loops.
+const MaxRPZRedirects = 8
+
+// RPZAction is the action of an RPZRule.
+type RPZAction int
+
+const (
+	RPZNXDomain RPZAction = iota
+	RPZNoData
+	RPZDrop
+	RPZRedirect
+)
+
+// RPZRule is a parsed operatorutils.RPZRule.
+type RPZRule struct {
+	Raw      operatorutils.RPZRule
+	Name     dnsname.FQDN
+	Wildcard bool // whether the rule applies to subdomains of Name
+	Action   RPZAction
+	// For RPZRedirect, exactly one of the following is set.
+	RedirectIP   netip.Addr
+	RedirectName dnsname.FQDN
+}
+
+// parseRPZRules validates and parses the given response policy rules. Names
+// and REDIRECT targets are lowercased, as queries are matched in lowercase.
+func parseRPZRules(rules []operatorutils.RPZRule) ([]RPZRule, error) {
+	parsed := make([]RPZRule, 0, len(rules))
+	var errs []error
+	for i, r := range rules {
+		pr := RPZRule{Raw: r}
+		name, wildcard := strings.CutPrefix(r.Name, "*.")
+		fqdn, err := dnsname.ToFQDN(strings.ToLower(name))
+		if err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("rpz[%d].name", i), r.Name, err))
+			continue
+		}
+		pr.Name, pr.Wildcard = fqdn, wildcard
+
+		action, target, _ := strings.Cut(strings.TrimSpace(r.Action), " ")
+		switch strings.ToUpper(action) {
+		case "NXDOMAIN":
+			pr.Action = RPZNXDomain
+		case "NODATA":
+			pr.Action = RPZNoData
+		case "DROP":
+			pr.Action = RPZDrop
+		case "REDIRECT":
+			pr.Action = RPZRedirect
+			target = strings.TrimSpace(target)
+			if ip, err := netip.ParseAddr(target); err == nil {
+				pr.RedirectIP = ip
+			} else if fqdn, err := dnsname.ToFQDN(strings.ToLower(target)); err == nil && target != "" {
+				pr.RedirectName = fqdn
+			} else {
+				errs = append(errs, fieldError(fmt.Sprintf("rpz[%d].action", i), r.Action, fmt.Errorf("REDIRECT target %q is neither an IP address nor a DNS name", target)))
+				continue
+			}
+		default:
+			errs = append(errs, fieldError(fmt.Sprintf("rpz[%d].action", i), r.Action, errors.New("unknown action, must be one of NXDOMAIN, NODATA, DROP or REDIRECT")))
+			continue
+		}
+		parsed = append(parsed, pr)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return parsed, nil
+}
+
+// MatchRPZ returns the rule that applies to name, or nil if there is none.
+// Rules for the exact name take precedence over wildcard rules and longer
+// wildcard suffixes take precedence over shorter ones.
+func MatchRPZ(rules []RPZRule, name dnsname.FQDN) *RPZRule {
+	var best *RPZRule
+	for i := range rules {
+		r := &rules[i]
+		if !r.Wildcard {
+			if r.Name == name {
+				return r
+			}
+			continue
+		}
+		if r.Name != name && r.Name.Contains(name) {
+			if best == nil || len(r.Name) > len(best.Name) {
+				best = r
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,24 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"testing"
+
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestParseRPZRulesErrors(t *testing.T) {
+	for _, r := range []operatorutils.RPZRule{
+		{Name: "foo.ts.net.", Action: "BLOCK"},
+		{Name: "foo.ts.net.", Action: "REDIRECT"},
+		{Name: "foo..ts.net.", Action: "NXDOMAIN"},
+	} {
+		if _, err := parseRPZRules([]operatorutils.RPZRule{r}); err == nil {
+			t.Errorf("parseRPZRules(%+v): got nil error", r)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"tailscale.com/util/dnsname"
+)
+
+// parseSearchDomains validates and parses the given search domains and
+// ndots. An ndots of zero is returned as 1, the resolv.conf default.
+func parseSearchDomains(domains []string, ndots int) ([]dnsname.FQDN, int, error) {
+	var errs []error
+	if ndots < 0 {
+		errs = append(errs, fieldError("ndots", strconv.Itoa(ndots), errors.New("must not be negative")))
+	}
+	parsed := make([]dnsname.FQDN, 0, len(domains))
+	for i, d := range domains {
+		fqdn, err := dnsname.ToFQDN(d)
+		if err == nil && fqdn == "." {
+			err = errors.New("must not be the root domain")
+		}
+		if err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("searchDomains[%d]", i), d, err))
+			continue
+		}
+		parsed = append(parsed, fqdn)
+	}
+	if len(errs) > 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	return parsed, max(ndots, 1), nil
+}
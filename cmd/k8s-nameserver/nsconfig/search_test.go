@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseSearchDomains(t *testing.T) {
+	domains, ndots, err := parseSearchDomains([]string{"svc.bar.ts.net", "bar.ts.net."}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(domains) != "[svc.bar.ts.net. bar.ts.net.]" || ndots != 1 {
+		t.Errorf("got search domains %v and ndots %d, want [svc.bar.ts.net. bar.ts.net.] and 1", domains, ndots)
+	}
+	for _, tc := range []struct {
+		domains   []string
+		ndots     int
+		wantField string
+	}{
+		{nil, -1, "ndots"},
+		{[]string{"svc.bar.ts.net.", ""}, 1, "searchDomains[1]"},
+		{[]string{"svc..bar.ts.net."}, 1, "searchDomains[0]"},
+	} {
+		_, _, err := parseSearchDomains(tc.domains, tc.ndots)
+		var cfgErr *Error
+		if !errors.As(err, &cfgErr) || cfgErr.Field != tc.wantField {
+			t.Errorf("parseSearchDomains(%q, %d) = %v, want error for %s", tc.domains, tc.ndots, err, tc.wantField)
+		}
+	}
+}
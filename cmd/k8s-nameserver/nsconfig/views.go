@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+)
+
+// View is a parsed operatorutils.View.
+type View struct {
+	Source netip.Prefix
+	// Hosts are the records of the view, with lowercase names.
+	Hosts map[dnsname.FQDN][]netip.Addr
+}
+
+// parseViews validates and parses the given views. allowLongLabels is as for
+// parseHostName.
+func parseViews(views []operatorutils.View, allowLongLabels bool) ([]View, error) {
+	parsed := make([]View, 0, len(views))
+	var errs []error
+	for i, v := range views {
+		source, err := netip.ParsePrefix(v.SourceCIDR)
+		if err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("views[%d].sourceCIDR", i), v.SourceCIDR, err))
+		}
+		hosts, hostsErr := parseHosts(fmt.Sprintf("views[%d].hosts", i), v.Hosts, allowLongLabels)
+		if err != nil || hostsErr != nil {
+			errs = append(errs, hostsErr)
+			continue
+		}
+		parsed = append(parsed, View{Source: source.Masked(), Hosts: lowercaseHosts(hosts)})
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return parsed, nil
+}
+
+// lowercaseHosts returns hosts with its names lowercased, as queries are
+// matched against them in lowercase. The addresses of names that only differ
+// in case are merged.
+func lowercaseHosts(hosts map[dnsname.FQDN][]netip.Addr) map[dnsname.FQDN][]netip.Addr {
+	lower := make(map[dnsname.FQDN][]netip.Addr, len(hosts))
+	for fqdn, ips := range hosts {
+		name := dnsname.FQDN(strings.ToLower(string(fqdn)))
+		lower[name] = append(lower[name], ips...)
+	}
+	return lower
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+
+	"gopkg.in/yaml.v3"
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+// parseYAMLConfig parses a config in YAML format. The YAML representation
+// mirrors the JSON one, i.e. it uses the same field names. A stream of
+// multiple documents is merged into a single config, see mergeConfig.
+func parseYAMLConfig(r io.Reader) (*operatorutils.TSHosts, error) {
+	var docs []*operatorutils.TSHosts
+	dec := yaml.NewDecoder(r)
+	for i := 0; ; i++ {
+		var doc any
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+		if doc == nil {
+			continue
+		}
+		// Round trip through JSON so that the YAML config uses the
+		// same field names as the JSON one.
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+		docCfg := &operatorutils.TSHosts{}
+		if err := json.Unmarshal(b, docCfg); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+		docs = append(docs, docCfg)
+	}
+	switch len(docs) {
+	case 0:
+		return &operatorutils.TSHosts{}, nil
+	case 1:
+		return docs[0], nil
+	}
+	dnsCfg := &operatorutils.TSHosts{}
+	for i, doc := range docs {
+		if err := mergeConfig(dnsCfg, doc); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+	}
+	return dnsCfg, nil
+}
+
+// mergeConfig merges src into dst. Host records are accumulated in the
+// order they appear, rules, views and search domains are appended, and map
+// entries of src replace those of dst. Scalar fields may only be set to
+// different values by one of them; the schema version is the highest one.
+func mergeConfig(dst, src *operatorutils.TSHosts) error {
+	dst.SchemaVersion = max(dst.SchemaVersion, src.SchemaVersion)
+	dst.Hosts = mergeRecords(dst.Hosts, src.Hosts)
+	dst.ExternalRecords = mergeRecords(dst.ExternalRecords, src.ExternalRecords)
+	dst.HealthCheckPorts = mergeMap(dst.HealthCheckPorts, src.HealthCheckPorts)
+	dst.ExpiresAt = mergeMap(dst.ExpiresAt, src.ExpiresAt)
+	dst.SourcePriority = mergeMap(dst.SourcePriority, src.SourcePriority)
+	dst.RPZ = append(dst.RPZ, src.RPZ...)
+	dst.RewriteRules = append(dst.RewriteRules, src.RewriteRules...)
+	dst.Views = append(dst.Views, src.Views...)
+	dst.SearchDomains = append(dst.SearchDomains, src.SearchDomains...)
+	if err := mergeScalar("ndots", &dst.NDots, src.NDots); err != nil {
+		return err
+	}
+	return mergeScalar("clusterDomain", &dst.ClusterDomain, src.ClusterDomain)
+}
+
+// mergeMap copies the entries of src into dst and returns the result.
+func mergeMap[M ~map[K]V, K comparable, V any](dst, src M) M {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(M, len(src))
+	}
+	maps.Copy(dst, src)
+	return dst
+}
+
+// mergeScalar sets *dst to src, unless src is the zero value. It fails if
+// *dst is already set to a different value.
+func mergeScalar[T comparable](field string, dst *T, src T) error {
+	var zero T
+	if src == zero || *dst == src {
+		return nil
+	}
+	if *dst != zero {
+		return fmt.Errorf("%s is set to %v, but an earlier document sets it to %v", field, src, *dst)
+	}
+	*dst = src
+	return nil
+}
+
+// mergeRecords appends the IP addresses of the records in src to those in
+// dst and returns the result.
+func mergeRecords(dst, src map[string][]string) map[string][]string {
+	if dst == nil && src != nil {
+		dst = make(map[string][]string, len(src))
+	}
+	for name, ips := range src {
+		dst[name] = append(dst[name], ips...)
+	}
+	return dst
+}
+
+// FormatForKey returns the config format for a config stored under
+// key, based on its file extension.
+func FormatForKey(key string) string {
+	switch path.Ext(key) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".cbor":
+		return FormatCBOR
+	default:
+		return FormatJSON
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package nsconfig
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	operatorutils "tailscale.com/k8s-operator"
+)
+
+func TestParseYAMLConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    *operatorutils.TSHosts
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: &operatorutils.TSHosts{},
+		},
+		{
+			name: "json_field_names",
+			in: `
+schemaVersion: 1
+hosts:
+  foo.bar.ts.net.: [10.20.30.40]
+healthCheckPorts:
+  foo.bar.ts.net.: 8080
+externalRecords:
+  db.internal.:
+    - 10.0.0.1
+`,
+			want: &operatorutils.TSHosts{
+				SchemaVersion:    1,
+				Hosts:            map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+				HealthCheckPorts: map[string]uint16{"foo.bar.ts.net.": 8080},
+				ExternalRecords:  map[string][]string{"db.internal.": {"10.0.0.1"}},
+			},
+		},
+		{
+			name: "anchors",
+			in: `
+hosts:
+  foo.bar.ts.net.: &ingress
+    - 10.20.30.40
+    - fd7a:115c:a1e0::1
+  baz.bar.ts.net.: *ingress
+`,
+			want: &operatorutils.TSHosts{
+				Hosts: map[string][]string{
+					"foo.bar.ts.net.": {"10.20.30.40", "fd7a:115c:a1e0::1"},
+					"baz.bar.ts.net.": {"10.20.30.40", "fd7a:115c:a1e0::1"},
+				},
+			},
+		},
+		{
+			name: "merge_keys",
+			in: `
+common: &common
+  foo.bar.ts.net.: [10.20.30.40]
+  baz.bar.ts.net.: [10.20.30.41]
+hosts:
+  <<: *common
+  baz.bar.ts.net.: [10.20.30.42]
+  qux.bar.ts.net.: [10.20.30.43]
+`,
+			want: &operatorutils.TSHosts{
+				Hosts: map[string][]string{
+					"foo.bar.ts.net.": {"10.20.30.40"},
+					"baz.bar.ts.net.": {"10.20.30.42"},
+					"qux.bar.ts.net.": {"10.20.30.43"},
+				},
+			},
+		},
+		{
+			name: "multiple_documents",
+			in: `
+hosts:
+  foo.bar.ts.net.: [10.20.30.40]
+rpz:
+  - name: blocked.bar.ts.net.
+    action: NXDOMAIN
+---
+# A document with only a comment is skipped.
+---
+schemaVersion: 1
+hosts:
+  foo.bar.ts.net.: [10.20.30.41]
+  baz.bar.ts.net.: [10.20.30.42]
+`,
+			want: &operatorutils.TSHosts{
+				SchemaVersion: 1,
+				Hosts: map[string][]string{
+					"foo.bar.ts.net.": {"10.20.30.40", "10.20.30.41"},
+					"baz.bar.ts.net.": {"10.20.30.42"},
+				},
+				RPZ: []operatorutils.RPZRule{{Name: "blocked.bar.ts.net.", Action: "NXDOMAIN"}},
+			},
+		},
+		{
+			name: "views",
+			in: `
+hosts:
+  foo.bar.ts.net.: [10.20.30.40]
+views:
+  - sourceCIDR: 10.1.0.0/16
+    hosts:
+      foo.bar.ts.net.: [10.1.0.40]
+---
+views:
+  - sourceCIDR: 10.2.0.0/16
+    hosts:
+      foo.bar.ts.net.: [10.2.0.40]
+`,
+			want: &operatorutils.TSHosts{
+				Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+				Views: []operatorutils.View{
+					{SourceCIDR: "10.1.0.0/16", Hosts: map[string][]string{"foo.bar.ts.net.": {"10.1.0.40"}}},
+					{SourceCIDR: "10.2.0.0/16", Hosts: map[string][]string{"foo.bar.ts.net.": {"10.2.0.40"}}},
+				},
+			},
+		},
+		{
+			name: "search_domains",
+			in: `
+searchDomains: [svc.bar.ts.net.]
+ndots: 2
+---
+searchDomains: [bar.ts.net.]
+ndots: 2
+`,
+			want: &operatorutils.TSHosts{
+				SearchDomains: []string{"svc.bar.ts.net.", "bar.ts.net."},
+				NDots:         2,
+			},
+		},
+		{
+			name:    "invalid_yaml",
+			in:      "hosts: [foo",
+			wantErr: true,
+		},
+		{
+			name:    "wrong_type",
+			in:      "hosts: [10.20.30.40]",
+			wantErr: true,
+		},
+		{
+			name:    "conflicting_documents",
+			in:      "ndots: 2\n---\nndots: 3\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_second_document",
+			in:      "hosts: {}\n---\nhosts: {foo.bar.ts.net.: 10.20.30.40}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAMLConfig(strings.NewReader(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got config %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got config %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fullConfig returns a config with every field set.
+func fullConfig() *operatorutils.TSHosts {
+	return &operatorutils.TSHosts{
+		SchemaVersion:    1,
+		Hosts:            map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+		HealthCheckPorts: map[string]uint16{"foo.bar.ts.net.": 8080},
+		RPZ:              []operatorutils.RPZRule{{Name: "blocked.bar.ts.net.", Action: "NXDOMAIN"}},
+		RewriteRules:     []operatorutils.RewriteRule{{SourceCIDR: "10.1.0.0/16", OriginalIP: "10.20.30.40", ReplacementIP: "10.1.0.40"}},
+		ExternalRecords:  map[string][]string{"db.internal.": {"10.0.0.1"}},
+		SourcePriority:   map[string]int{"foo.bar.ts.net.": 1},
+		Views:            []operatorutils.View{{SourceCIDR: "10.1.0.0/16", Hosts: map[string][]string{"foo.bar.ts.net.": {"10.1.0.40"}}}},
+		SearchDomains:    []string{"svc.bar.ts.net."},
+		NDots:            2,
+		ClusterDomain:    "cluster.local.",
+		ExpiresAt:        map[string]time.Time{"foo.bar.ts.net.": time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+}
+
+// TestParseYAMLConfigFields checks that every config field is decoded from
+// a single document and merged from multiple ones, so that new fields can't
+// be dropped by the YAML format.
+func TestParseYAMLConfigFields(t *testing.T) {
+	want := fullConfig()
+	v := reflect.ValueOf(want).Elem()
+	var docs []string
+	for i := range v.NumField() {
+		f := v.Type().Field(i)
+		if v.Field(i).IsZero() {
+			t.Fatalf("fullConfig doesn't set %s", f.Name)
+		}
+		// Each document of the stream has one of the fields.
+		doc := &operatorutils.TSHosts{}
+		reflect.ValueOf(doc).Elem().Field(i).Set(v.Field(i))
+		b, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, string(b))
+	}
+	// JSON is valid YAML.
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, in := range map[string]string{
+		"single_document":    string(b),
+		"multiple_documents": strings.Join(docs, "\n---\n"),
+	} {
+		got, err := parseYAMLConfig(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got config %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestConfigFormatForKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"dns.json":      FormatJSON,
+		"dns.yaml":      FormatYAML,
+		"dns.yml":       FormatYAML,
+		"dns":           FormatJSON,
+		"dns.yaml.json": FormatJSON,
+	} {
+		if got := FormatForKey(key); got != want {
+			t.Errorf("FormatForKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
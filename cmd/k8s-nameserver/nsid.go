@@ -0,0 +1,49 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// nameserverID returns the name to identify this nameserver replica with in
+// NSID options: the pod name if the POD_NAME environment variable is set, or
+// the hostname otherwise.
+func nameserverID() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// addNSID returns resp with an EDNS0 NSID option containing nsid added, if
+// the query in payload has an OPT record. Otherwise resp is returned
+// unmodified, as clients that don't support EDNS0 can't parse the option.
+// https://datatracker.ietf.org/doc/html/rfc5001
+func addNSID(payload, resp []byte, nsid string) ([]byte, error) {
+	var req dns.Msg
+	if err := req.Unpack(payload); err != nil || req.IsEdns0() == nil {
+		return resp, nil
+	}
+	var m dns.Msg
+	if err := m.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("error parsing response to add NSID to: %w", err)
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+		Code: dns.EDNS0NSID,
+		Nsid: hex.EncodeToString([]byte(nsid)),
+	})
+	return m.Pack()
+}
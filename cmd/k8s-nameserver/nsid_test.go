@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNSID(t *testing.T) {
+	t.Setenv("POD_NAME", "nameserver-7d9f8-x2x4q")
+	nsid, err := nameserverID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsid != "nameserver-7d9f8-x2x4q" {
+		t.Fatalf("got NSID %q, want the pod name", nsid)
+	}
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.nsid = nsid
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, edns := range []bool{true, false} {
+		req := new(dns.Msg)
+		req.SetQuestion("foo.bar.ts.net.", dns.TypeA)
+		if edns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ns.query(ctx, b, testSrc)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		var m dns.Msg
+		if err := m.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		if m.Id != req.Id || len(m.Answer) != 1 {
+			t.Errorf("edns=%v: got response %v, want one answer", edns, m)
+		}
+		var got []string
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if o, ok := o.(*dns.EDNS0_NSID); ok {
+					b, err := hex.DecodeString(o.Nsid)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, string(b))
+				}
+			}
+		}
+		switch {
+		case edns && (len(got) != 1 || got[0] != nsid):
+			t.Errorf("EDNS0 query: got NSIDs %q, want [%q]", got, nsid)
+		case !edns && m.IsEdns0() != nil:
+			t.Errorf("non-EDNS0 query: got OPT record %v, want none", m.IsEdns0())
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the size that padded responses are a multiple of.
+const paddingBlockSize = 128
+
+// padResponse returns resp padded with an EDNS0 Padding option to a multiple
+// of paddingBlockSize bytes, so that the size of responses over encrypted
+// transports reveals less about the names that were queried. As with NSID,
+// resp is returned unmodified if the query in payload has no OPT record, and
+// UDP responses are not padded beyond the payload size that the client
+// advertised.
+// https://datatracker.ietf.org/doc/html/rfc7830
+func padResponse(payload, resp []byte, family string) ([]byte, error) {
+	var req dns.Msg
+	if err := req.Unpack(payload); err != nil || req.IsEdns0() == nil {
+		return resp, nil
+	}
+	var m dns.Msg
+	if err := m.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("error parsing response to pad: %w", err)
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	unpadded, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// The option itself takes 4 bytes for its code and length.
+	size := len(unpadded) + 4
+	padded := (size + paddingBlockSize - 1) / paddingBlockSize * paddingBlockSize
+	if family == "udp" && padded > int(max(req.IsEdns0().UDPSize(), dns.MinMsgSize)) {
+		return resp, nil
+	}
+	// The padding must consist of zero bytes.
+	// https://datatracker.ietf.org/doc/html/rfc7830#section-4
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padded-size)})
+	return m.Pack()
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// paddingOption returns the EDNS0 Padding option of m, if any.
+func paddingOption(m *dns.Msg) *dns.EDNS0_PADDING {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if o, ok := o.(*dns.EDNS0_PADDING); ok {
+			return o
+		}
+	}
+	return nil
+}
+
+func TestNameserverResponsePadding(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.responsePadding = true
+	ns.nsid = "nameserver-7d9f8-x2x4q"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		qtype  uint16
+		family string
+		edns   bool
+	}{
+		{"foo.bar.ts.net.", dns.TypeA, "udp", true},
+		{"baz.bar.ts.net.", dns.TypeAAAA, "tcp", true},
+		{"missing.bar.ts.net.", dns.TypeA, "udp", true},
+		{"_tailscale.ts.net.", dns.TypeTXT, "tcp", true},
+		{"foo.bar.ts.net.", dns.TypeA, "udp", false},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		if tt.edns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ns.queryFamily(ctx, b, tt.family, testSrc)
+		if err != nil {
+			t.Fatalf("query for %s: %v", tt.name, err)
+		}
+		var m dns.Msg
+		if err := m.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		pad := paddingOption(&m)
+		if !tt.edns {
+			if m.IsEdns0() != nil {
+				t.Errorf("non-EDNS0 query for %s: got OPT record %v, want none", tt.name, m.IsEdns0())
+			}
+			continue
+		}
+		if len(resp)%paddingBlockSize != 0 {
+			t.Errorf("%s %s: got response of %d bytes, want a multiple of %d", tt.name, dns.TypeToString[tt.qtype], len(resp), paddingBlockSize)
+		}
+		if pad == nil {
+			t.Errorf("%s %s: got no padding option", tt.name, dns.TypeToString[tt.qtype])
+		} else if !bytes.Equal(pad.Padding, make([]byte, len(pad.Padding))) {
+			t.Errorf("%s %s: got padding %x, want all zeros", tt.name, dns.TypeToString[tt.qtype], pad.Padding)
+		}
+		if len(m.IsEdns0().Option) != 2 {
+			t.Errorf("%s %s: got EDNS0 options %v, want NSID and padding", tt.name, dns.TypeToString[tt.qtype], m.IsEdns0().Option)
+		}
+	}
+}
+
+func TestPadResponseUDPSize(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("foo.bar.ts.net.", dns.TypeTXT)
+	req.SetEdns0(dns.MinMsgSize, false)
+	payload, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: "foo.bar.ts.net.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{strings.Repeat("a", 240), strings.Repeat("b", 200)},
+	}}
+	resp, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With an 11 byte OPT record and the 4 byte option header, padding the
+	// response to the next block takes it over the client's 512 bytes.
+	if len(resp) > dns.MinMsgSize || len(resp)+11+4 <= dns.MinMsgSize {
+		t.Fatalf("test response is %d bytes, want it to fit in %d bytes only without padding", len(resp), dns.MinMsgSize)
+	}
+
+	// Padding would make the response larger than what the client can
+	// receive over UDP.
+	got, err := padResponse(payload, resp, "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, resp) {
+		t.Errorf("UDP: got %d byte response, want it unpadded at %d bytes", len(got), len(resp))
+	}
+	got, err = padResponse(payload, resp, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5*paddingBlockSize {
+		t.Errorf("TCP: got %d byte response, want %d", len(got), 5*paddingBlockSize)
+	}
+}
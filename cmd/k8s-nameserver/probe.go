@@ -0,0 +1,163 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// probeTimeout is the maximum time that TestProbe waits for the resolver to
+// answer each query.
+const probeTimeout = 5 * time.Second
+
+// probeSrc is the source address of the queries sent by TestProbe.
+var probeSrc = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 0)
+
+// TestProbe resolves name with the resolver as configured right now, without
+// going through the network, and returns its IPv4 and IPv6 addresses. It is
+// meant for checking that a newly loaded config resolves the names it should.
+// Names that don't exist or have no addresses are an error.
+func (n *nameserver) TestProbe(name dnsname.FQDN) ([]netip.Addr, error) {
+	qname, err := dnsmessage.NewName(name.WithTrailingDot())
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		got, err := n.probe(qname, typ)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s %v: %w", name, typ, err)
+		}
+		ips = append(ips, got...)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s has no IP addresses", name)
+	}
+	return ips, nil
+}
+
+// probe queries the resolver for the records of type typ for name and
+// returns the IP addresses in the answer.
+func (n *nameserver) probe(name dnsmessage.Name, typ dnsmessage.Type) ([]netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	msg, err := n.probeMessage(ctx, name, typ)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	for _, a := range msg.Answers {
+		switch r := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, netip.AddrFrom4(r.A))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, netip.AddrFrom16(r.AAAA))
+		}
+	}
+	return ips, nil
+}
+
+// probeMessage queries the resolver for the records of type typ for name and
+// returns the response, which is an error unless its rcode is NOERROR.
+func (n *nameserver) probeMessage(ctx context.Context, name dnsmessage.Name, typ dnsmessage.Type) (*dnsmessage.Message, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.res.Query(ctx, query, "udp", probeSrc)
+	if err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("got rcode %v", msg.Header.RCode)
+	}
+	return &msg, nil
+}
+
+// startupQuery is a query that must be answered for the nameserver to be
+// ready, see --startup-query.
+type startupQuery struct {
+	name dnsmessage.Name
+	typ  dnsmessage.Type
+}
+
+func (q startupQuery) String() string {
+	return fmt.Sprintf("%v %s", q.name, dns.TypeToString[uint16(q.typ)])
+}
+
+// parseStartupQueries parses s, the value of --startup-query: a
+// comma-separated list of names, each optionally followed by the record
+// type to query it for, such as "foo.ts.net,A,bar.ts.net,AAAA". Names
+// without a type are queried for A records.
+func parseStartupQueries(s string) ([]startupQuery, error) {
+	var qs []startupQuery
+	typed := true // whether the last query has an explicit type
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if typ, ok := dns.StringToType[strings.ToUpper(f)]; ok && !typed {
+			qs[len(qs)-1].typ, typed = dnsmessage.Type(typ), true
+			continue
+		}
+		fqdn, err := dnsname.ToFQDN(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid startup query name %q: %w", f, err)
+		}
+		name, err := dnsmessage.NewName(fqdn.WithTrailingDot())
+		if err != nil {
+			return nil, fmt.Errorf("invalid startup query name %q: %w", f, err)
+		}
+		qs = append(qs, startupQuery{name: name, typ: dnsmessage.TypeA})
+		typed = false
+	}
+	return qs, nil
+}
+
+// checkStartupQueries returns an error unless all of n.startupQueries are
+// answered with at least one record within n.startupQueryTimeout. Once they
+// have been, the nameserver stays ready and they aren't queried again.
+func (n *nameserver) checkStartupQueries() error {
+	if len(n.startupQueries) == 0 || n.startupQueriesAnswered.Load() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.startupQueryTimeout)
+	defer cancel()
+	for _, q := range n.startupQueries {
+		msg, err := n.probeMessage(ctx, q.name, q.typ)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("startup query %v not answered within %v", q, n.startupQueryTimeout)
+			}
+			return fmt.Errorf("startup query %v: %w", q, err)
+		}
+		if len(msg.Answers) == 0 {
+			return fmt.Errorf("startup query %v: no records", q)
+		}
+	}
+	n.startupQueriesAnswered.Store(true)
+	return nil
+}
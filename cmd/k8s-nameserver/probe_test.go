@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestNameserverTestProbe(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := ns.TestProbe("baz.bar.ts.net.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(ips); got != "[10.20.30.41 fd7a:115c:a1e0::1]" {
+		t.Errorf("got IPs %s, want [10.20.30.41 fd7a:115c:a1e0::1]", got)
+	}
+	if ips, err := ns.TestProbe("unknown.bar.ts.net."); err == nil {
+		t.Errorf("probing an unknown name returned %v, want an error", ips)
+	}
+}
+
+func TestParseStartupQueries(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: "[]"},
+		{in: "foo.ts.net,A", want: "[foo.ts.net. A]"},
+		{in: "foo.ts.net,bar.ts.net,aaaa,baz.ts.net.,TXT", want: "[foo.ts.net. A bar.ts.net. AAAA baz.ts.net. TXT]"},
+		{in: "foo..ts.net", wantErr: true},
+	} {
+		qs, err := parseStartupQueries(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStartupQueries(%q): got error %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got := fmt.Sprint(qs); !tt.wantErr && got != tt.want {
+			t.Errorf("parseStartupQueries(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	queryLogFormatJSON = "json"
+	queryLogFormatCSV  = "csv"
+	// queryLogFormatAudit is the CSV format of the --audit-log-file
+	// entries, which identify the client down to the source port and
+	// include the answer IP addresses.
+	queryLogFormatAudit = "audit"
+	// queryLogFormatSyslog is the format of the --syslog entries, which
+	// are space-separated key=value pairs, one per syslog message.
+	queryLogFormatSyslog = "syslog"
+
+	// syslogTag is the tag of the --syslog messages.
+	syslogTag = "k8s-nameserver"
+
+	// queryLogBufferSize is the number of query log entries that can be
+	// waiting to be written before new entries are dropped.
+	queryLogBufferSize = 4096
+)
+
+// queryLogEntry is a DNS query in the query log.
+type queryLogEntry struct {
+	Time     time.Time  `json:"time"`
+	Source   netip.Addr `json:"source"`
+	Protocol string     `json:"protocol"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	// RCode is the response code of the response, or empty if the query
+	// wasn't answered.
+	RCode     string  `json:"rcode"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+
+	// SourcePort and Answers, the A and AAAA records in the response, are
+	// only set in the audit log.
+	SourcePort uint16       `json:"sourcePort,omitempty"`
+	Answers    []netip.Addr `json:"answers,omitempty"`
+}
+
+// queryLogger writes a log of the DNS queries that the nameserver answers,
+// separate from the application log. Entries are written by a background
+// goroutine, so that a slow log file doesn't add latency to queries.
+type queryLogger struct {
+	w       io.WriteCloser
+	format  string
+	entries chan *queryLogEntry
+	stop    chan struct{}
+	done    chan struct{}
+	// writeErrorf logs errors writing to w.
+	writeErrorf func(format string, args ...any)
+}
+
+// newQueryLogger returns a queryLogger that writes entries in format to w,
+// with up to bufSize entries waiting to be written. It takes ownership of w.
+func newQueryLogger(w io.WriteCloser, format string, bufSize int, errorf func(string, ...any)) (*queryLogger, error) {
+	switch format {
+	case queryLogFormatJSON, queryLogFormatCSV, queryLogFormatAudit, queryLogFormatSyslog:
+	default:
+		return nil, fmt.Errorf("invalid query log format %q, must be %q or %q", format, queryLogFormatJSON, queryLogFormatCSV)
+	}
+	l := &queryLogger{
+		w:           w,
+		format:      format,
+		entries:     make(chan *queryLogEntry, bufSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		writeErrorf: errorf,
+	}
+	go l.run()
+	return l, nil
+}
+
+// log adds the query in payload, received from addr over family and
+// answered with resp and err after latency, to the query log. It never
+// blocks, and reports false if the entry was dropped because too many
+// entries are waiting to be written.
+func (l *queryLogger) log(payload, resp []byte, err error, family string, addr netip.AddrPort, latency time.Duration) bool {
+	e := &queryLogEntry{
+		Time:      time.Now(),
+		Source:    addr.Addr(),
+		Protocol:  family,
+		LatencyMs: float64(latency) / float64(time.Millisecond),
+	}
+	if _, q, err := parseQuestion(payload); err == nil {
+		e.Name = q.Name.String()
+		e.Type = dns.TypeToString[uint16(q.Type)]
+	}
+	// The RCODE is the low 4 bits of the 4th byte of the header.
+	if err == nil && len(resp) >= 4 {
+		e.RCode = dns.RcodeToString[int(resp[3]&0xf)]
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if l.format == queryLogFormatAudit {
+		e.SourcePort = addr.Port()
+		e.Answers = answerAddrs(resp)
+	}
+	select {
+	case l.entries <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close writes the entries that are waiting to be written and closes the
+// underlying writer. Entries logged after Close are dropped.
+func (l *queryLogger) Close() error {
+	close(l.stop)
+	<-l.done
+	return l.w.Close()
+}
+
+func (l *queryLogger) run() {
+	defer close(l.done)
+	for {
+		select {
+		case e := <-l.entries:
+			l.write(e)
+		case <-l.stop:
+			for {
+				select {
+				case e := <-l.entries:
+					l.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes e as one line, so that a rotation of the log file never
+// splits an entry.
+func (l *queryLogger) write(e *queryLogEntry) {
+	var line []byte
+	var err error
+	switch l.format {
+	case queryLogFormatCSV:
+		line, err = e.appendCSV(nil)
+	case queryLogFormatAudit:
+		line, err = e.appendAuditCSV(nil)
+	case queryLogFormatSyslog:
+		line = e.appendKeyValues(nil)
+	default:
+		line, err = json.Marshal(e)
+		line = append(line, '\n')
+	}
+	if err == nil {
+		_, err = l.w.Write(line)
+	}
+	if err != nil && l.writeErrorf != nil {
+		l.writeErrorf("error writing query log: %v", err)
+	}
+}
+
+// appendCSV appends e to b as a CSV record with the fields time, source,
+// protocol, name, type, rcode, latency in milliseconds and error.
+func (e *queryLogEntry) appendCSV(b []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(b)
+	w := csv.NewWriter(buf)
+	w.Write([]string{
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Source.String(),
+		e.Protocol,
+		e.Name,
+		e.Type,
+		e.RCode,
+		strconv.FormatFloat(e.LatencyMs, 'f', 3, 64),
+		e.Error,
+	})
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// appendAuditCSV appends e to b as a CSV record with the fields time, source
+// IP, source port, name, type, rcode, latency in milliseconds and the
+// space-separated answer IP addresses.
+func (e *queryLogEntry) appendAuditCSV(b []byte) ([]byte, error) {
+	answers := make([]string, len(e.Answers))
+	for i, ip := range e.Answers {
+		answers[i] = ip.String()
+	}
+	buf := bytes.NewBuffer(b)
+	w := csv.NewWriter(buf)
+	w.Write([]string{
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Source.String(),
+		strconv.Itoa(int(e.SourcePort)),
+		e.Name,
+		e.Type,
+		e.RCode,
+		strconv.FormatFloat(e.LatencyMs, 'f', 3, 64),
+		strings.Join(answers, " "),
+	})
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// appendKeyValues appends e to b as a line of space-separated key=value
+// pairs with the fields source, protocol, name, type, rcode, latency_ms and,
+// for failed queries, error. Values that are empty or contain spaces, quotes
+// or equals signs are quoted. The time of the query is left to the syslog
+// message header.
+func (e *queryLogEntry) appendKeyValues(b []byte) []byte {
+	for i, kv := range [][2]string{
+		{"source", e.Source.String()},
+		{"protocol", e.Protocol},
+		{"name", e.Name},
+		{"type", e.Type},
+		{"rcode", e.RCode},
+		{"latency_ms", strconv.FormatFloat(e.LatencyMs, 'f', 3, 64)},
+		{"error", e.Error},
+	} {
+		if kv[0] == "error" && kv[1] == "" {
+			continue
+		}
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, kv[0]...)
+		b = append(b, '=')
+		if kv[1] == "" || strings.ContainsAny(kv[1], " \t\r\n\"=") {
+			b = strconv.AppendQuote(b, kv[1])
+		} else {
+			b = append(b, kv[1]...)
+		}
+	}
+	return append(b, '\n')
+}
+
+// nopCloser is an io.WriteCloser with a no-op Close, for query logs written
+// to os.Stderr.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// answerAddrs returns the addresses of the A and AAAA records in the answer
+// section of the DNS response in b.
+func answerAddrs(b []byte) []netip.Addr {
+	var m dns.Msg
+	if err := m.Unpack(b); err != nil {
+		return nil
+	}
+	var ips []netip.Addr
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			ips = append(ips, addr.Unmap())
+		}
+	}
+	return ips
+}
@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestQueryLog(t *testing.T) {
+	for _, format := range []string{queryLogFormatJSON, queryLogFormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "queries.log")
+			w, err := newRotatingFile(path, 1<<20, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ql, err := newQueryLogger(w, format, queryLogBufferSize, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.queryLog = ql
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ns.queryFamily(ctx, testQuery(t, "missing.bar.ts.net.", dnsmessage.TypeAAAA), "tcp", testSrc); err != nil {
+				t.Fatal(err)
+			}
+			if err := ql.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var got []queryLogEntry
+			if format == queryLogFormatJSON {
+				s := bufio.NewScanner(f)
+				for s.Scan() {
+					var e queryLogEntry
+					if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+						t.Fatalf("invalid query log line %q: %v", s.Text(), err)
+					}
+					got = append(got, e)
+				}
+			} else {
+				records, err := csv.NewReader(f).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range records {
+					if len(r) != 8 {
+						t.Fatalf("got query log record %q, want 8 fields", r)
+					}
+					got = append(got, queryLogEntry{Source: netip.MustParseAddr(r[1]), Protocol: r[2], Name: r[3], Type: r[4], RCode: r[5]})
+				}
+			}
+			want := []queryLogEntry{
+				{Source: testSrc.Addr(), Protocol: "udp", Name: "foo.bar.ts.net.", Type: "A", RCode: "NOERROR"},
+				{Source: testSrc.Addr(), Protocol: "tcp", Name: "missing.bar.ts.net.", Type: "AAAA", RCode: "NXDOMAIN"},
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d query log entries, want %d: %+v", len(got), len(want), got)
+			}
+			for i, e := range got {
+				if format == queryLogFormatJSON && (e.Time.IsZero() || e.LatencyMs <= 0) {
+					t.Errorf("entry %d: got time %v and latency %vms, want both set", i, e.Time, e.LatencyMs)
+				}
+				e.Time, e.LatencyMs = want[i].Time, 0
+				if !reflect.DeepEqual(e, want[i]) {
+					t.Errorf("entry %d: got %+v, want %+v", i, e, want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := newQueryLogger(nopWriteCloser{}, "xml", 1, nil); err == nil {
+		t.Error("newQueryLogger with format \"xml\" succeeded, want error")
+	}
+}
+
+func TestQueryLogEntryKeyValues(t *testing.T) {
+	e := &queryLogEntry{
+		Source:    netip.MustParseAddr("10.0.0.1"),
+		Protocol:  "tcp",
+		Name:      "foo.bar.ts.net.",
+		Type:      "AAAA",
+		LatencyMs: 1.5,
+		Error:     `lookup failed: "upstream" timed out`,
+	}
+	want := `source=10.0.0.1 protocol=tcp name=foo.bar.ts.net. type=AAAA rcode="" latency_ms=1.500 error="lookup failed: \"upstream\" timed out"` + "\n"
+	if got := string(e.appendKeyValues(nil)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w, err := newRotatingFile(path, 1<<20, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al, err := newQueryLogger(w, queryLogFormatAudit, queryLogBufferSize, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.auditLog = al
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	type query struct {
+		name    string
+		typ     dnsmessage.Type
+		rcode   string
+		answers string
+	}
+	queries := []query{
+		{"foo.bar.ts.net.", dnsmessage.TypeA, "NOERROR", "10.20.30.40"},
+		{"baz.bar.ts.net.", dnsmessage.TypeA, "NOERROR", "10.20.30.41"},
+		{"baz.bar.ts.net.", dnsmessage.TypeAAAA, "NOERROR", "fd7a:115c:a1e0::1"},
+		{"foo.bar.ts.net.", dnsmessage.TypeAAAA, "NOERROR", ""},
+		{"missing.bar.ts.net.", dnsmessage.TypeA, "NXDOMAIN", ""},
+	}
+	queries = append(queries, queries...)
+	start := time.Now()
+	for i, q := range queries {
+		src := netip.AddrPortFrom(netip.MustParseAddr(fmt.Sprintf("10.1.0.%d", i+1)), uint16(40000+i))
+		if _, err := ns.query(ctx, testQuery(t, q.name, q.typ), src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := al.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(queries) {
+		t.Fatalf("got %d audit log records, want %d: %q", len(records), len(queries), records)
+	}
+	for i, r := range records {
+		q := queries[i]
+		if len(r) != 8 {
+			t.Fatalf("record %d: got %q, want 8 fields", i, r)
+		}
+		ts, err := time.Parse(time.RFC3339Nano, r[0])
+		if err != nil || ts.Before(start.Add(-time.Second)) || ts.After(time.Now()) {
+			t.Errorf("record %d: got time %q, want the time of the query: %v", i, r[0], err)
+		}
+		if want := fmt.Sprintf("10.1.0.%d", i+1); r[1] != want {
+			t.Errorf("record %d: got source IP %q, want %q", i, r[1], want)
+		}
+		if want := fmt.Sprint(40000 + i); r[2] != want {
+			t.Errorf("record %d: got source port %q, want %q", i, r[2], want)
+		}
+		if r[3] != q.name || r[4] != strings.TrimPrefix(q.typ.String(), "Type") || r[5] != q.rcode {
+			t.Errorf("record %d: got name, type and rcode %q, want %s %v %s", i, r[3:6], q.name, q.typ, q.rcode)
+		}
+		if latency, err := strconv.ParseFloat(r[6], 64); err != nil || latency < 0 {
+			t.Errorf("record %d: got latency %q, want milliseconds", i, r[6])
+		}
+		if r[7] != q.answers {
+			t.Errorf("record %d: got answers %q, want %q", i, r[7], q.answers)
+		}
+	}
+}
+
+// blockingWriter is an io.WriteCloser whose writes block until unblock is
+// closed.
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func (w blockingWriter) Close() error { return nil }
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopWriteCloser) Close() error                { return nil }
+
+func TestQueryLogNonBlocking(t *testing.T) {
+	w := blockingWriter{unblock: make(chan struct{})}
+	ql, err := newQueryLogger(w, queryLogFormatJSON, 2, t.Errorf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	var dropped int
+	// One entry is being written and two are buffered, so at least 7 of
+	// these are dropped rather than blocking.
+	for range 10 {
+		if !ql.log(q, nil, nil, "udp", testSrc, 0) {
+			dropped++
+		}
+	}
+	if dropped < 7 {
+		t.Errorf("got %d dropped entries, want at least 7", dropped)
+	}
+	close(w.unblock)
+	if err := ql.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
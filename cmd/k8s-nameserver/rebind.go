@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// isRebindingAddr reports whether ip is an internal address that forwarded
+// responses for names outside of the local domains must not contain: a
+// private (RFC 1918 or RFC 4193), loopback, link-local or unspecified
+// address, or a Tailscale IP.
+func isRebindingAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || tsaddr.IsTailscaleIP(ip)
+}
+
+// checkRebinding returns a SERVFAIL response instead of resp, the response
+// to the DNS query in payload from addr, if the query is for a name that the
+// nameserver is not authoritative for and resp contains A or AAAA records
+// with internal addresses. Such responses can only come from an upstream
+// resolver, and would let whoever controls it make clients connect to
+// internal services via names that they control (DNS rebinding).
+func (n *nameserver) checkRebinding(payload, resp []byte, addr netip.AddrPort) ([]byte, error) {
+	_, q, err := parseQuestion(payload)
+	if err != nil {
+		return resp, nil
+	}
+	name, err := dnsname.ToFQDN(strings.ToLower(q.Name.String()))
+	if err != nil || n.isLocal(name) {
+		return resp, nil
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return resp, nil
+	}
+	for _, rr := range msg.Answers {
+		var ip netip.Addr
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = netip.AddrFrom4(b.A)
+		case *dnsmessage.AAAAResource:
+			ip = netip.AddrFrom16(b.AAAA)
+		default:
+			continue
+		}
+		if isRebindingAddr(ip) {
+			// The resolver doesn't say which upstream the response
+			// came from, only that it was forwarded.
+			n.logger.Warnf("blocked forwarded response to %v for %q containing internal address %v for %q", addr, name, ip, rr.Header.Name)
+			return servFail(payload)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	"tailscale.com/util/dnsname"
+)
+
+// upstreamResolver is a dnsResolver that answers queries for names outside
+// of the local domains with ips, as if it had forwarded them to an upstream
+// resolver.
+type upstreamResolver struct {
+	dnsResolver
+	ips []netip.Addr
+}
+
+func (r *upstreamResolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+	h, q, err := parseQuestion(bs)
+	if err != nil {
+		return nil, err
+	}
+	if name, err := dnsname.ToFQDN(q.Name.String()); err == nil && slices.ContainsFunc(nsconfig.DefaultLocalDomains, func(d dnsname.FQDN) bool { return d.Contains(name) }) {
+		return r.dnsResolver.Query(ctx, bs, family, from)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionDesired: h.RecursionDesired, RecursionAvailable: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, ip := range r.ips {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		if ip.Is4() {
+			err = b.AResource(rh, dnsmessage.AResource{A: ip.As4()})
+		} else {
+			err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: ip.As16()})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func TestNameserverRebindProtection(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		typ      dnsmessage.Type
+		upstream []string
+		disabled bool
+		want     dnsmessage.RCode
+	}{
+		{name: "public", query: "example.com.", typ: dnsmessage.TypeA, upstream: []string{"93.184.216.34"}, want: dnsmessage.RCodeSuccess},
+		{name: "rfc1918", query: "example.com.", typ: dnsmessage.TypeA, upstream: []string{"93.184.216.34", "192.168.1.1"}, want: dnsmessage.RCodeServerFailure},
+		{name: "rfc4193", query: "example.com.", typ: dnsmessage.TypeAAAA, upstream: []string{"fd12:3456:789a::1"}, want: dnsmessage.RCodeServerFailure},
+		{name: "loopback", query: "example.com.", typ: dnsmessage.TypeA, upstream: []string{"127.0.0.1"}, want: dnsmessage.RCodeServerFailure},
+		{name: "tailscale", query: "example.com.", typ: dnsmessage.TypeA, upstream: []string{"100.64.0.1"}, want: dnsmessage.RCodeServerFailure},
+		{name: "mapped", query: "example.com.", typ: dnsmessage.TypeAAAA, upstream: []string{"::ffff:10.0.0.1"}, want: dnsmessage.RCodeServerFailure},
+		{name: "disabled", query: "example.com.", typ: dnsmessage.TypeA, upstream: []string{"10.0.0.1"}, disabled: true, want: dnsmessage.RCodeSuccess},
+		// Records in the local domains are served by the nameserver
+		// itself, and are expected to have internal addresses.
+		{name: "local", query: "foo.bar.ts.net.", typ: dnsmessage.TypeA, want: dnsmessage.RCodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			core, logs := observer.New(zap.WarnLevel)
+			ns.logger = zap.New(core).Sugar()
+			res := &upstreamResolver{dnsResolver: ns.res}
+			for _, s := range tt.upstream {
+				res.ips = append(res.ips, netip.MustParseAddr(s))
+			}
+			ns.res = res
+			ns.rebindProtection = !tt.disabled
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, tt.query, tt.typ), testSrc)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != tt.want {
+				t.Errorf("got rcode %v, want %v", msg.Header.RCode, tt.want)
+			}
+			blocked := tt.want == dnsmessage.RCodeServerFailure
+			if blocked && len(msg.Answers) != 0 {
+				t.Errorf("got answers %v, want none", msg.Answers)
+			}
+			if gotLog := logs.FilterMessageSnippet("blocked forwarded response").Len() == 1; gotLog != blocked {
+				t.Errorf("got blocked response log %v, want %v: %v", gotLog, blocked, logs.All())
+			}
+			if blocked {
+				if msg := logs.All()[0].Message; !strings.Contains(msg, tt.upstream[len(tt.upstream)-1]) {
+					t.Errorf("log %q does not contain the internal address", msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// maxDelegationHops is the number of referrals, CNAMEs and lookups of
+	// nameserver addresses that a recursiveResolver follows for a query
+	// before giving up.
+	maxDelegationHops = 10
+	// recursiveQueryTimeout is how long a recursiveResolver waits for
+	// each nameserver to respond.
+	recursiveQueryTimeout = 2 * time.Second
+)
+
+// defaultRootServers are the addresses of the root servers, from the root
+// hints file published by IANA.
+// https://www.internic.net/domain/named.root
+var defaultRootServers = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),     // a.root-servers.net
+	netip.MustParseAddr("170.247.170.2"),  // b.root-servers.net
+	netip.MustParseAddr("192.33.4.12"),    // c.root-servers.net
+	netip.MustParseAddr("199.7.91.13"),    // d.root-servers.net
+	netip.MustParseAddr("192.203.230.10"), // e.root-servers.net
+	netip.MustParseAddr("192.5.5.241"),    // f.root-servers.net
+	netip.MustParseAddr("192.112.36.4"),   // g.root-servers.net
+	netip.MustParseAddr("198.97.190.53"),  // h.root-servers.net
+	netip.MustParseAddr("192.36.148.17"),  // i.root-servers.net
+	netip.MustParseAddr("192.58.128.30"),  // j.root-servers.net
+	netip.MustParseAddr("193.0.14.129"),   // k.root-servers.net
+	netip.MustParseAddr("199.7.83.42"),    // l.root-servers.net
+	netip.MustParseAddr("202.12.27.33"),   // m.root-servers.net
+}
+
+// loadRootHints returns the addresses of the root servers in the root hints
+// file at path, which is in the zone file format of named.root.
+func loadRootHints(path string) ([]netip.Addr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zp := dns.NewZoneParser(f, ".", path)
+	var roots []netip.Addr
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		var ip netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			ip, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		roots = append(roots, ip)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("error parsing root hints: %w", err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no root server addresses in %s", path)
+	}
+	return roots, nil
+}
+
+// recursiveResolver resolves A and AAAA records by following the chain of NS
+// delegations from the root servers, for nameservers that have no upstream
+// resolver to forward queries for external names to, see --enable-root-hints.
+// It keeps no cache, so every query starts from the root.
+type recursiveResolver struct {
+	// roots are the addresses of the root servers.
+	roots []netip.Addr
+	// exchange sends query to the nameserver at server and returns its
+	// response. It is exchangeDNS, other than in tests.
+	exchange func(ctx context.Context, query *dns.Msg, server netip.Addr) (*dns.Msg, error)
+}
+
+// newRecursiveResolver returns a recursiveResolver that starts from roots.
+func newRecursiveResolver(roots []netip.Addr) *recursiveResolver {
+	return &recursiveResolver{roots: roots, exchange: exchangeDNS}
+}
+
+// exchangeDNS sends query to port 53 of server over UDP, and again over TCP
+// if the response is truncated.
+func exchangeDNS(ctx context.Context, query *dns.Msg, server netip.Addr) (*dns.Msg, error) {
+	addr := netip.AddrPortFrom(server, 53).String()
+	c := &dns.Client{Net: "udp", Timeout: recursiveQueryTimeout}
+	resp, _, err := c.ExchangeContext(ctx, query, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, query, addr)
+	}
+	return resp, err
+}
+
+// recursion is the state of the resolution of one query.
+type recursion struct {
+	r *recursiveResolver
+	// hops is the number of delegation hops followed so far.
+	hops int
+}
+
+// hop counts a delegation hop and returns an error if there have been too
+// many of them.
+func (rc *recursion) hop() error {
+	rc.hops++
+	if rc.hops > maxDelegationHops {
+		return fmt.Errorf("more than %d delegation hops", maxDelegationHops)
+	}
+	return nil
+}
+
+// Resolve returns the records of type typ, which must be A or AAAA, for
+// name, preceded by the CNAME records followed to get to them, and the rcode
+// of the final response. For negative responses, authorities are the
+// records from its authority section, i.e. the zone's SOA.
+func (r *recursiveResolver) Resolve(ctx context.Context, name string, typ uint16) (answers, authorities []dns.RR, rcode int, err error) {
+	rc := &recursion{r: r}
+	return rc.resolve(ctx, dns.Fqdn(name), typ)
+}
+
+func (rc *recursion) resolve(ctx context.Context, name string, typ uint16) (answers, authorities []dns.RR, rcode int, err error) {
+	servers := rc.r.roots
+	zone := "."
+	for {
+		resp, err := rc.query(ctx, servers, name, typ)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return answers, resp.Ns, resp.Rcode, nil
+		}
+		found, cname := matchAnswers(resp.Answer, name, typ)
+		if len(found) > 0 {
+			return append(answers, found...), nil, dns.RcodeSuccess, nil
+		}
+		if cname != nil {
+			answers = append(answers, cname)
+			if err := rc.hop(); err != nil {
+				return nil, nil, 0, err
+			}
+			name, servers, zone = cname.Target, rc.r.roots, "."
+			continue
+		}
+		child, nsNames := referral(resp, name, zone)
+		if child == "" {
+			// An authoritative answer without records of typ.
+			return answers, resp.Ns, dns.RcodeSuccess, nil
+		}
+		if err := rc.hop(); err != nil {
+			return nil, nil, 0, err
+		}
+		if servers, err = rc.nameserverAddrs(ctx, resp, nsNames); err != nil {
+			return nil, nil, 0, fmt.Errorf("error resolving the nameservers of %s: %w", child, err)
+		}
+		zone = child
+	}
+}
+
+// query sends a query for the records of type typ for name to servers in
+// order until one of them responds.
+func (rc *recursion) query(ctx context.Context, servers []netip.Addr, name string, typ uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, typ)
+	q.RecursionDesired = false
+	q.SetEdns0(1232, false)
+	var errs []error
+	for _, server := range servers {
+		resp, err := rc.r.exchange(ctx, q, server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", server, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			errs = append(errs, fmt.Errorf("%v: got rcode %s", server, dns.RcodeToString[resp.Rcode]))
+			continue
+		}
+		return resp, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no nameservers to query")
+	}
+	return nil, fmt.Errorf("no nameserver responded for %s: %w", name, errors.Join(errs...))
+}
+
+// matchAnswers returns the records of type typ for name in rrs or, if there
+// are none, the CNAME record for name, if any.
+func matchAnswers(rrs []dns.RR, name string, typ uint16) ([]dns.RR, *dns.CNAME) {
+	var found []dns.RR
+	var cname *dns.CNAME
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if rr.Header().Rrtype == typ {
+			found = append(found, rr)
+		} else if c, ok := rr.(*dns.CNAME); ok && cname == nil {
+			cname = c
+		}
+	}
+	if len(found) > 0 {
+		return found, nil
+	}
+	return nil, cname
+}
+
+// referral returns the zone that resp delegates name to and the names of its
+// nameservers, if it is a referral to a zone below zone. Referrals that
+// don't get closer to name are ignored, so that broken delegations can't
+// make the resolution loop.
+func referral(resp *dns.Msg, name, zone string) (child string, nsNames []string) {
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := ns.Hdr.Name
+		if !dns.IsSubDomain(owner, name) || !dns.IsSubDomain(zone, owner) || dns.CountLabel(owner) <= dns.CountLabel(zone) {
+			continue
+		}
+		if child == "" {
+			child = owner
+		}
+		if strings.EqualFold(owner, child) {
+			nsNames = append(nsNames, ns.Ns)
+		}
+	}
+	return child, nsNames
+}
+
+// nameserverAddrs returns the addresses of the nameservers named nsNames
+// from the glue records in resp, or if it has none, by resolving the A
+// records of the first of them that resolves.
+func (rc *recursion) nameserverAddrs(ctx context.Context, resp *dns.Msg, nsNames []string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, rr := range resp.Extra {
+		var ip netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			ip, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		for _, ns := range nsNames {
+			if strings.EqualFold(rr.Header().Name, ns) {
+				addrs = append(addrs, ip)
+				break
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	var errs []error
+	for _, ns := range nsNames {
+		if err := rc.hop(); err != nil {
+			return nil, err
+		}
+		rrs, _, rcode, err := rc.resolve(ctx, ns, dns.TypeA)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range rrs {
+			if a, ok := rr.(*dns.A); ok {
+				if ip, ok := netip.AddrFromSlice(a.A.To4()); ok {
+					addrs = append(addrs, ip)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+		errs = append(errs, fmt.Errorf("%s has no addresses (rcode %s)", ns, dns.RcodeToString[rcode]))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// answerRecursively returns the response to the DNS query in payload and true
+// if it is an A or AAAA query for a name that the nameserver is not
+// authoritative for and n.recursive is set. Queries that can't be resolved
+// are answered with SERVFAIL.
+func (n *nameserver) answerRecursively(ctx context.Context, payload []byte, family string) ([]byte, bool, error) {
+	if n.recursive == nil {
+		return nil, false, nil
+	}
+	var q dns.Msg
+	if err := q.Unpack(payload); err != nil || len(q.Question) != 1 {
+		return nil, false, nil
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET || question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return nil, false, nil
+	}
+	fqdn, err := dnsname.ToFQDN(strings.ToLower(question.Name))
+	if err != nil || n.isLocal(fqdn) {
+		return nil, false, nil
+	}
+	answers, authorities, rcode, err := n.recursive.Resolve(ctx, question.Name, question.Qtype)
+	if err != nil {
+		n.logger.Warnf("error resolving %s %s from the root servers: %v", question.Name, dns.TypeToString[question.Qtype], err)
+		resp, err := servFail(payload)
+		return resp, true, err
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(&q, rcode)
+	resp.RecursionAvailable = true
+	resp.Answer = answers
+	resp.Ns = authorities
+	size := dns.MinMsgSize
+	if opt := q.IsEdns0(); opt != nil {
+		size = max(int(opt.UDPSize()), dns.MinMsgSize)
+		resp.SetEdns0(1232, false)
+	}
+	if family == "udp" {
+		resp.Truncate(size)
+	}
+	b, err := resp.Pack()
+	return b, true, err
+}
@@ -0,0 +1,228 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mockZoneServer is a DNS server for tests that answers queries
+// authoritatively from records and with referrals for the zones in
+// delegations.
+type mockZoneServer struct {
+	// records are the records that the server is authoritative for.
+	records []dns.RR
+	// delegations are the NS records, and glue, of the zones that the
+	// server delegates, by zone.
+	delegations map[string][]dns.RR
+}
+
+func (s *mockZoneServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	for zone, rrs := range s.delegations {
+		if dns.IsSubDomain(zone, q.Name) {
+			for _, rr := range rrs {
+				if rr.Header().Rrtype == dns.TypeNS {
+					resp.Ns = append(resp.Ns, rr)
+				} else {
+					resp.Extra = append(resp.Extra, rr)
+				}
+			}
+			w.WriteMsg(resp)
+			return
+		}
+	}
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range s.records {
+		if !strings.EqualFold(rr.Header().Name, q.Name) {
+			continue
+		}
+		exists = true
+		if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(resp)
+}
+
+// mustRRs parses the records in the zone file format in ss.
+func mustRRs(t testing.TB, ss ...string) []dns.RR {
+	t.Helper()
+	var rrs []dns.RR
+	for _, s := range ss {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// startMockNameservers starts the servers in servers on loopback ports and
+// returns a recursiveResolver that starts from root and sends the queries
+// for each of the addresses in servers to its server instead of port 53.
+func startMockNameservers(t testing.TB, root netip.Addr, servers map[netip.Addr]*mockZoneServer) *recursiveResolver {
+	t.Helper()
+	ports := make(map[netip.Addr]string)
+	for ip, s := range servers {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan struct{})
+		srv := &dns.Server{PacketConn: pc, Handler: s, NotifyStartedFunc: func() { close(started) }}
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { srv.Shutdown() })
+		ports[ip] = pc.LocalAddr().String()
+	}
+	r := newRecursiveResolver([]netip.Addr{root})
+	r.exchange = func(ctx context.Context, query *dns.Msg, server netip.Addr) (*dns.Msg, error) {
+		addr, ok := ports[server]
+		if !ok {
+			return nil, fmt.Errorf("no mock nameserver at %v", server)
+		}
+		c := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+		resp, _, err := c.ExchangeContext(ctx, query, addr)
+		return resp, err
+	}
+	return r
+}
+
+func TestNameserverRootHints(t *testing.T) {
+	rootIP := netip.MustParseAddr("198.51.100.1")
+	tldIP := netip.MustParseAddr("198.51.100.2")
+	authIP := netip.MustParseAddr("198.51.100.3")
+	r := startMockNameservers(t, rootIP, map[netip.Addr]*mockZoneServer{
+		rootIP: {delegations: map[string][]dns.RR{
+			"net.": mustRRs(t, "net. 3600 IN NS a.gtld.net.", "a.gtld.net. 3600 IN A 198.51.100.2"),
+			// Without glue, the address of the nameserver is
+			// resolved first.
+			"example.": mustRRs(t, "example. 3600 IN NS ns.example.net."),
+		}},
+		tldIP: {delegations: map[string][]dns.RR{
+			"example.net.": mustRRs(t, "example.net. 3600 IN NS ns.example.net.", "ns.example.net. 3600 IN A 198.51.100.3"),
+		}},
+		authIP: {records: mustRRs(t,
+			"ns.example.net. 300 IN A 198.51.100.3",
+			"www.example.net. 300 IN A 192.0.2.10",
+			"www.example.net. 300 IN AAAA 2001:db8::10",
+			"alias.example.net. 300 IN CNAME www.example.net.",
+			"loop.example.net. 300 IN CNAME loop.example.net.",
+			"www.example. 300 IN A 192.0.2.20",
+		)},
+	})
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.recursive = r
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		typ       dnsmessage.Type
+		wantRCode dnsmessage.RCode
+		wantIPs   []string
+	}{
+		{"www.example.net.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.10"}},
+		{"www.example.net.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"2001:db8::10"}},
+		{"alias.example.net.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.10"}},
+		{"www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.20"}},
+		{"ns.example.net.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil},
+		{"nope.example.net.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		// CNAME loops run out of delegation hops.
+		{"loop.example.net.", dnsmessage.TypeA, dnsmessage.RCodeServerFailure, nil},
+		// Local names are still answered by the resolver.
+		{"foo.bar.ts.net.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.20.30.40"}},
+		// Including when the query has 0x20 randomised case.
+		{"FoO.bAr.Ts.NeT.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.20.30.40"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%v", tt.name, tt.typ), func(t *testing.T) {
+			resp, err := ns.query(ctx, testQuery(t, tt.name, tt.typ), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, ips := answerIPs(t, resp)
+			if h.RCode != tt.wantRCode {
+				t.Errorf("got rcode %v, want %v", h.RCode, tt.wantRCode)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !slices.Equal(got, tt.wantIPs) {
+				t.Errorf("got IPs %v, want %v", got, tt.wantIPs)
+			}
+		})
+	}
+}
+
+func TestRecursiveResolverMaxHops(t *testing.T) {
+	// Each zone delegates one label further down, which takes more hops
+	// than allowed to get to the name.
+	servers := make(map[netip.Addr]*mockZoneServer)
+	name := "."
+	for i := range maxDelegationHops + 2 {
+		child := fmt.Sprintf("z%d.%s", i, strings.TrimPrefix(name, "."))
+		ip := netip.AddrFrom4([4]byte{198, 51, 100, byte(i + 1)})
+		next := netip.AddrFrom4([4]byte{198, 51, 100, byte(i + 2)})
+		servers[ip] = &mockZoneServer{delegations: map[string][]dns.RR{
+			child: mustRRs(t, fmt.Sprintf("%s 3600 IN NS ns.%s", child, child), fmt.Sprintf("ns.%s 3600 IN A %v", child, next)),
+		}}
+		name = child
+	}
+	r := startMockNameservers(t, netip.MustParseAddr("198.51.100.1"), servers)
+	if _, _, _, err := r.Resolve(context.Background(), "www."+name, dns.TypeA); err == nil || !strings.Contains(err.Error(), "delegation hops") {
+		t.Errorf("got error %v, want too many delegation hops", err)
+	}
+}
+
+func TestLoadRootHints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "named.root")
+	hints := `.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+`
+	if err := os.WriteFile(path, []byte(hints), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := loadRootHints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("198.41.0.4"), netip.MustParseAddr("2001:503:ba3e::2:30")}
+	if !slices.Equal(roots, want) {
+		t.Errorf("got roots %v, want %v", roots, want)
+	}
+	if err := os.WriteFile(path, []byte(". 3600000 NS A.ROOT-SERVERS.NET.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRootHints(path); err == nil {
+		t.Error("loading root hints without addresses succeeded, want error")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// parseQuestion returns the header and the first question of the DNS
+// message in b.
+func parseQuestion(b []byte) (dnsmessage.Header, dnsmessage.Question, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return dnsmessage.Header{}, dnsmessage.Question{}, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsmessage.Header{}, dnsmessage.Question{}, err
+	}
+	return h, q, nil
+}
+
+// errorResponse returns a DNS response to the query with header h and
+// question q that has no records and the given rcode.
+func errorResponse(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		OpCode:           h.OpCode,
+		RecursionDesired: h.RecursionDesired,
+		RCode:            rcode,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// servFail returns a SERVFAIL response to the DNS query in payload, or nil if
+// payload can't be parsed.
+func servFail(payload []byte) ([]byte, error) {
+	h, q, err := parseQuestion(payload)
+	if err != nil {
+		return nil, nil
+	}
+	return errorResponse(h, q, dnsmessage.RCodeServerFailure)
+}
+
+// rejectMultipleQuestions returns a FORMERR response and true if the DNS
+// query in payload has more than one question. RFC 1035 allows multiple
+// questions in a message, but there is no way to give a separate rcode for
+// each of them, so in practice nameservers refuse such queries instead of
+// silently answering only the first question.
+func rejectMultipleQuestions(payload []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(payload)
+	if err != nil {
+		return nil, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) < 2 {
+		return nil, false
+	}
+	resp, err := errorResponse(h, qs[0], dnsmessage.RCodeFormatError)
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// refuseANY returns a REFUSED response and true if the DNS query in payload
+// is for QTYPE ANY.
+func refuseANY(payload []byte) ([]byte, bool) {
+	h, q, err := parseQuestion(payload)
+	if err != nil || q.Type != dnsmessage.TypeALL {
+		return nil, false
+	}
+	resp, err := errorResponse(h, q, dnsmessage.RCodeRefused)
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// clearRecursionAvailable unsets the RA bit in the header of the DNS
+// message in b.
+func clearRecursionAvailable(b []byte) {
+	if len(b) < 4 {
+		return
+	}
+	// The RA bit is the most significant bit of the fourth header byte.
+	// https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.1
+	b[3] &^= 0x80
+}
@@ -0,0 +1,17 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setReusePort returns an error, as SO_REUSEPORT is not supported on this
+// platform.
+func setReusePort(c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveReusePort starts a nameserver that serves DNS queries on sockets UDP
+// sockets bound to the same port and returns the address of the port.
+func serveReusePort(tb testing.TB, sockets int) *net.UDPAddr {
+	tb.Helper()
+	ns := newTestNameserver(tb, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	if err := ns.run(ctx, cancel); err != nil {
+		tb.Fatal(err)
+	}
+	conns, err := listenUDPReusePort("127.0.0.1:0", false, "", sockets)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(conns) != sockets {
+		tb.Fatalf("got %d sockets, want %d", len(conns), sockets)
+	}
+	for _, conn := range conns {
+		tb.Cleanup(func() { conn.Close() })
+		go ns.serve(ctx, conn)
+	}
+	return conns[0].LocalAddr().(*net.UDPAddr)
+}
+
+func TestListenUDPReusePort(t *testing.T) {
+	addr := serveReusePort(t, 4)
+
+	// Queries from many source ports are answered, whichever of the
+	// sockets the kernel picks for them.
+	q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+	for i := range 20 {
+		c, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		resp, err := exchangeUDP(c, q)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+			t.Errorf("query %d: got IPs %v, want [10.20.30.40]", i, ips)
+		}
+		c.Close()
+	}
+
+	// Without SO_REUSEPORT, the port can't be bound again.
+	if conn, err := listenUDP(addr.String(), false, "", false); err == nil {
+		conn.Close()
+		t.Error("binding the port again without SO_REUSEPORT succeeded, want error")
+	}
+}
+
+func BenchmarkServeUDP(b *testing.B) {
+	for _, sockets := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			addr := serveReusePort(b, sockets)
+			q := testQuery(b, "foo.bar.ts.net.", dnsmessage.TypeA)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c, err := net.DialUDP("udp", nil, addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(time.Minute))
+				for pb.Next() {
+					if _, err := exchangeUDP(c, q); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	"tailscale.com/util/dnsname"
+)
+
+// applyRewrites returns the DNS response in resp with the IP addresses in its
+// answer records replaced according to the rewrite rules that apply to queries
+// from src. The first matching rule wins. If no rule applies, resp is returned
+// unmodified.
+func (n *nameserver) applyRewrites(resp []byte, src netip.AddrPort) ([]byte, error) {
+	n.mu.Lock()
+	all := n.rewrites
+	n.mu.Unlock()
+	var rules []nsconfig.RewriteRule
+	for _, r := range all {
+		if r.Source.Contains(src.Addr()) {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return resp, nil
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("error parsing response to rewrite: %w", err)
+	}
+	rewritten := false
+	for i := range msg.Answers {
+		a := &msg.Answers[i]
+		var ip netip.Addr
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			ip = netip.AddrFrom16(body.AAAA)
+		default:
+			continue
+		}
+		name := dnsname.FQDN(strings.ToLower(a.Header.Name.String()))
+		for _, r := range rules {
+			if r.From != ip || (r.Name != "" && r.Name != name) {
+				continue
+			}
+			if r.To.Is4() {
+				a.Body = &dnsmessage.AResource{A: r.To.As4()}
+			} else {
+				a.Body = &dnsmessage.AAAAResource{AAAA: r.To.As16()}
+			}
+			n.logger.Debugf("rewrote %v to %v in answer for %s to %v", ip, r.To, name, src)
+			rewritten = true
+			break
+		}
+	}
+	if !rewritten {
+		return resp, nil
+	}
+	return msg.Pack()
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRewriteRules(t *testing.T) {
+	cfg := []byte(`{
+		"hosts": {
+			"foo.bar.ts.net.": ["10.20.30.40"],
+			"baz.bar.ts.net.": ["10.20.30.40"],
+			"v6.bar.ts.net.": ["fd7a:115c:a1e0::1"]
+		},
+		"rewriteRules": [
+			{"sourceCIDR": "10.1.0.0/16", "matchName": "foo.bar.ts.net.", "originalIP": "10.20.30.40", "replacementIP": "192.168.0.1"},
+			{"sourceCIDR": "10.2.0.0/16", "originalIP": "10.20.30.40", "replacementIP": "192.168.0.2"},
+			{"sourceCIDR": "fd00::/8", "originalIP": "fd7a:115c:a1e0::1", "replacementIP": "fd00::1"}
+		]
+	}`)
+	ns := newTestNameserver(t, staticConfig(cfg))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		src    string
+		qname  string
+		qtype  dnsmessage.Type
+		wantIP string
+	}{
+		{
+			name:   "non_matching_source",
+			src:    "10.3.0.1:53000",
+			qname:  "foo.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantIP: "10.20.30.40",
+		},
+		{
+			name:   "matching_source_and_name",
+			src:    "10.1.2.3:53000",
+			qname:  "foo.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantIP: "192.168.0.1",
+		},
+		{
+			name:   "matching_source_other_name",
+			src:    "10.1.2.3:53000",
+			qname:  "baz.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantIP: "10.20.30.40",
+		},
+		{
+			name:   "any_name",
+			src:    "10.2.2.3:53000",
+			qname:  "baz.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantIP: "192.168.0.2",
+		},
+		{
+			name:   "ipv6",
+			src:    "[fd00::5]:53000",
+			qname:  "v6.bar.ts.net.",
+			qtype:  dnsmessage.TypeAAAA,
+			wantIP: "fd00::1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ns.query(ctx, testQuery(t, tt.qname, tt.qtype), netip.MustParseAddrPort(tt.src))
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			h, ips := answerIPs(t, resp)
+			if h.ID != 1234 || h.RCode != dnsmessage.RCodeSuccess {
+				t.Errorf("got header %+v, want successful response with ID 1234", h)
+			}
+			if len(ips) != 1 || ips[0] != netip.MustParseAddr(tt.wantIP) {
+				t.Errorf("got IPs %v, want [%s]", ips, tt.wantIP)
+			}
+		})
+	}
+}
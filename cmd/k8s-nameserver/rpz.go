@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	"tailscale.com/util/dnsname"
+)
+
+// rpzTTL is the TTL of records synthesized by REDIRECT rules.
+const rpzTTL = 600
+
+// applyRPZ returns the response to the DNS query in payload and true if the
+// queried name matches a response policy rule. A nil response means that the
+// query should not be responded to.
+func (n *nameserver) applyRPZ(ctx context.Context, payload []byte, addr netip.AddrPort) ([]byte, bool, error) {
+	n.mu.Lock()
+	rules := n.rpz
+	n.mu.Unlock()
+	if len(rules) == 0 {
+		return nil, false, nil
+	}
+	h, q, err := parseQuestion(payload)
+	if err != nil {
+		return nil, false, nil
+	}
+	name, err := dnsname.ToFQDN(strings.ToLower(q.Name.String()))
+	if err != nil {
+		return nil, false, nil
+	}
+	r := nsconfig.MatchRPZ(rules, name)
+	if r == nil {
+		return nil, false, nil
+	}
+	for i := 0; ; i++ {
+		n.logger.Infof("RPZ rule %s %q matched query for %s %v from %v", r.Raw.Name, r.Raw.Action, name, q.Type, addr)
+		if r.Action != nsconfig.RPZRedirect || r.RedirectIP.IsValid() {
+			break
+		}
+		// The rule redirects to another name. That name may itself be
+		// subject to a rule; otherwise serve its records.
+		next := nsconfig.MatchRPZ(rules, r.RedirectName)
+		if next == nil {
+			resp, err := n.redirectToName(ctx, h, q, r.RedirectName, addr)
+			return resp, true, err
+		}
+		if i == nsconfig.MaxRPZRedirects {
+			n.logger.Errorf("RPZ redirect chain for %s is longer than %d, responding SERVFAIL", name, nsconfig.MaxRPZRedirects)
+			resp, err := errorResponse(h, q, dnsmessage.RCodeServerFailure)
+			return resp, true, err
+		}
+		r = next
+	}
+
+	var resp []byte
+	switch r.Action {
+	case nsconfig.RPZNXDomain:
+		resp, err = errorResponse(h, q, dnsmessage.RCodeNameError)
+	case nsconfig.RPZNoData:
+		resp, err = errorResponse(h, q, dnsmessage.RCodeSuccess)
+	case nsconfig.RPZDrop:
+		return nil, true, nil
+	case nsconfig.RPZRedirect:
+		resp, err = ipResponse(h, q, rpzTTL, r.RedirectIP)
+	}
+	return resp, true, err
+}
+
+// redirectToName responds to the query with header h and question q with the
+// records of target, renamed to the queried name.
+func (n *nameserver) redirectToName(ctx context.Context, h dnsmessage.Header, q dnsmessage.Question, target dnsname.FQDN, addr netip.AddrPort) ([]byte, error) {
+	tq := q
+	tq.Name = dnsmessage.MustNewName(target.WithTrailingDot())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, RecursionDesired: h.RecursionDesired})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(tq); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.res.Query(ctx, query, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	msg.Questions = []dnsmessage.Question{q}
+	for i := range msg.Answers {
+		msg.Answers[i].Header.Name = q.Name
+	}
+	return msg.Pack()
+}
+
+// ipResponse returns a successful response to the query with header h and
+// question q that contains those of ips that match the queried type.
+func ipResponse(h dnsmessage.Header, q dnsmessage.Question, ttl uint32, ips ...netip.Addr) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: h.RecursionDesired,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+	for _, ip := range ips {
+		switch {
+		case q.Type == dnsmessage.TypeA && ip.Is4():
+			if err := b.AResource(rh, dnsmessage.AResource{A: ip.As4()}); err != nil {
+				return nil, err
+			}
+		case q.Type == dnsmessage.TypeAAAA && ip.Is6():
+			if err := b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: ip.As16()}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
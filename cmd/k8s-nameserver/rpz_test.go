@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRPZ(t *testing.T) {
+	cfg := []byte(`{
+		"hosts": {
+			"foo.bar.ts.net.": ["10.20.30.40"],
+			"blocked.bar.ts.net.": ["10.20.30.41"],
+			"sub.blocked.bar.ts.net.": ["10.20.30.42"],
+			"mixed.bar.ts.net.": ["10.20.30.43"],
+			"sub.wild.bar.ts.net.": ["10.20.30.44"]
+		},
+		"rpz": [
+			{"name": "blocked.bar.ts.net.", "action": "NXDOMAIN"},
+			{"name": "*.blocked.bar.ts.net.", "action": "NODATA"},
+			{"name": "dropped.bar.ts.net.", "action": "DROP"},
+			{"name": "sinkhole.bar.ts.net.", "action": "REDIRECT 10.0.0.1"},
+			{"name": "alias.bar.ts.net.", "action": "REDIRECT foo.bar.ts.net."},
+			{"name": "chained.bar.ts.net.", "action": "REDIRECT blocked.bar.ts.net."},
+			{"name": "chained-ip.bar.ts.net.", "action": "REDIRECT sinkhole.bar.ts.net."},
+			{"name": "loop1.bar.ts.net.", "action": "REDIRECT loop2.bar.ts.net."},
+			{"name": "loop2.bar.ts.net.", "action": "REDIRECT loop1.bar.ts.net."},
+			{"name": "Mixed.Bar.TS.net.", "action": "NXDOMAIN"},
+			{"name": "*.Wild.bar.ts.net.", "action": "NXDOMAIN"},
+			{"name": "upper-alias.bar.ts.net.", "action": "REDIRECT FOO.Bar.ts.net."}
+		]
+	}`)
+	ns := newTestNameserver(t, staticConfig(cfg))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    dnsmessage.Type
+		wantDrop bool
+		wantRC   dnsmessage.RCode
+		wantIPs  []netip.Addr
+	}{
+		{
+			name:    "no_rule",
+			qname:   "foo.bar.ts.net.",
+			qtype:   dnsmessage.TypeA,
+			wantIPs: []netip.Addr{netip.MustParseAddr("10.20.30.40")},
+		},
+		{
+			name:   "nxdomain",
+			qname:  "blocked.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantRC: dnsmessage.RCodeNameError,
+		},
+		{
+			name:  "nodata_wildcard",
+			qname: "sub.blocked.bar.ts.net.",
+			qtype: dnsmessage.TypeA,
+		},
+		{
+			name:     "drop",
+			qname:    "dropped.bar.ts.net.",
+			qtype:    dnsmessage.TypeA,
+			wantDrop: true,
+		},
+		{
+			name:   "mixed_case_rule",
+			qname:  "mixed.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantRC: dnsmessage.RCodeNameError,
+		},
+		{
+			name:   "mixed_case_wildcard_rule",
+			qname:  "sub.wild.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantRC: dnsmessage.RCodeNameError,
+		},
+		{
+			name:    "mixed_case_redirect_target",
+			qname:   "upper-alias.bar.ts.net.",
+			qtype:   dnsmessage.TypeA,
+			wantIPs: []netip.Addr{netip.MustParseAddr("10.20.30.40")},
+		},
+		{
+			name:    "redirect_ip",
+			qname:   "sinkhole.bar.ts.net.",
+			qtype:   dnsmessage.TypeA,
+			wantIPs: []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		},
+		{
+			name:  "redirect_ip_other_family",
+			qname: "sinkhole.bar.ts.net.",
+			qtype: dnsmessage.TypeAAAA,
+		},
+		{
+			name:    "redirect_name",
+			qname:   "alias.bar.ts.net.",
+			qtype:   dnsmessage.TypeA,
+			wantIPs: []netip.Addr{netip.MustParseAddr("10.20.30.40")},
+		},
+		{
+			name:   "redirect_to_blocked_name",
+			qname:  "chained.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantRC: dnsmessage.RCodeNameError,
+		},
+		{
+			name:    "redirect_to_redirected_name",
+			qname:   "chained-ip.bar.ts.net.",
+			qtype:   dnsmessage.TypeA,
+			wantIPs: []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		},
+		{
+			name:   "redirect_loop",
+			qname:  "loop1.bar.ts.net.",
+			qtype:  dnsmessage.TypeA,
+			wantRC: dnsmessage.RCodeServerFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ns.query(ctx, testQuery(t, tt.qname, tt.qtype), testSrc)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			if tt.wantDrop {
+				if resp != nil {
+					t.Fatalf("got response %x, want none", resp)
+				}
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.ID != 1234 || !msg.Header.Response {
+				t.Errorf("got header %+v, want response with ID 1234", msg.Header)
+			}
+			if msg.Header.RCode != tt.wantRC {
+				t.Errorf("got rcode %v, want %v", msg.Header.RCode, tt.wantRC)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != tt.qname {
+				t.Errorf("got questions %v, want %s", msg.Questions, tt.qname)
+			}
+			for _, a := range msg.Answers {
+				if a.Header.Name.String() != tt.qname {
+					t.Errorf("got answer for %s, want %s", a.Header.Name, tt.qname)
+				}
+			}
+			_, ips := answerIPs(t, resp)
+			if len(ips) != len(tt.wantIPs) {
+				t.Fatalf("got IPs %v, want %v", ips, tt.wantIPs)
+			}
+			for i := range ips {
+				if ips[i] != tt.wantIPs[i] {
+					t.Errorf("got IPs %v, want %v", ips, tt.wantIPs)
+				}
+			}
+		})
+	}
+}
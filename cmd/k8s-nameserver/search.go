@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// answerFromSearchDomains returns the response to the DNS query in payload
+// and true if the queried name has fewer than n.ndots dots and is found in
+// one of n.searchDomains, which are tried in order. Only the first search
+// domain in which the name exists applies, even if it has no records of the
+// queried type, as with resolv.conf. The response is for the queried name,
+// as clients expect, rather than for the name in the search domain.
+//
+// The expanded names are subject to the same policy as queried names, see
+// answerFromPolicy, so that a name that is blocked by an RPZ rule stays
+// blocked when it is queried through a search domain.
+func (n *nameserver) answerFromSearchDomains(ctx context.Context, payload []byte, family string, addr netip.AddrPort) ([]byte, bool, error) {
+	n.mu.Lock()
+	domains, ndots := n.searchDomains, n.ndots
+	n.mu.Unlock()
+	if len(domains) == 0 {
+		return nil, false, nil
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(payload); err != nil || len(msg.Questions) != 1 {
+		return nil, false, nil
+	}
+	q := msg.Questions[0]
+	name, err := dnsname.ToFQDN(q.Name.String())
+	if err != nil || name == "." || strings.Count(name.WithoutTrailingDot(), ".") >= ndots {
+		return nil, false, nil
+	}
+	for _, d := range domains {
+		expanded, err := dnsmessage.NewName(name.WithoutTrailingDot() + "." + d.WithTrailingDot())
+		if err != nil {
+			// Too long to be a DNS name.
+			continue
+		}
+		msg.Questions[0].Name = expanded
+		expandedPayload, err := msg.Pack()
+		if err != nil {
+			return nil, true, err
+		}
+		resp, ok, err := n.answerFromPolicy(ctx, expandedPayload, addr)
+		if ok && (err != nil || resp == nil) {
+			return nil, true, err
+		}
+		if !ok {
+			if resp, err = n.lookup(ctx, expandedPayload, family, addr); err != nil {
+				return nil, true, err
+			}
+		}
+		var rm dnsmessage.Message
+		if err := rm.Unpack(resp); err != nil {
+			continue
+		}
+		// Responses from policy apply even if they are negative, other
+		// than refusals of non-local names.
+		if rm.Header.RCode != dnsmessage.RCodeSuccess && (!ok || rm.Header.RCode == dnsmessage.RCodeRefused) {
+			continue
+		}
+		for i := range rm.Questions {
+			rm.Questions[i].Name = q.Name
+		}
+		for i := range rm.Answers {
+			if strings.EqualFold(rm.Answers[i].Header.Name.String(), expanded.String()) {
+				rm.Answers[i].Header.Name = q.Name
+			}
+		}
+		resp, err = rm.Pack()
+		return resp, true, err
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNameserverSearchDomains(t *testing.T) {
+	tests := []struct {
+		name      string
+		ndots     int
+		query     string
+		typ       dnsmessage.Type
+		wantRCode dnsmessage.RCode
+		wantIPs   []string
+	}{
+		{name: "expanded", query: "db.", typ: dnsmessage.TypeA, wantIPs: []string{"10.20.30.40"}},
+		{name: "case_insensitive", query: "DB.", typ: dnsmessage.TypeA, wantIPs: []string{"10.20.30.40"}},
+		// The first search domain that has the name applies, even if it
+		// has no records of the queried type.
+		{name: "nodata", query: "db.", typ: dnsmessage.TypeAAAA},
+		{name: "second_domain", query: "cache.", typ: dnsmessage.TypeAAAA, wantIPs: []string{"fd7a:115c:a1e0::2"}},
+		// Names with at least ndots dots are looked up as is.
+		{name: "enough_dots", query: "web.prod.", typ: dnsmessage.TypeA, wantIPs: []string{"93.184.216.34"}},
+		{name: "ndots", ndots: 2, query: "web.prod.", typ: dnsmessage.TypeA, wantIPs: []string{"10.20.30.42"}},
+		// Names that aren't in any search domain are looked up as is.
+		{name: "not_found", query: "printer.", typ: dnsmessage.TypeA, wantIPs: []string{"93.184.216.34"}},
+		{name: "fqdn_local", query: "db.svc.bar.ts.net.", typ: dnsmessage.TypeA, wantIPs: []string{"10.20.30.40"}},
+		// RPZ rules apply to the names in the search domains, and stop
+		// the search even though a later search domain has the name.
+		{name: "rpz_blocked", query: "blocked.", typ: dnsmessage.TypeA, wantRCode: dnsmessage.RCodeNameError},
+		{name: "rpz_redirect", query: "sinkhole.", typ: dnsmessage.TypeA, wantIPs: []string{"10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fmt.Sprintf(`{
+				"hosts": {
+					"db.svc.bar.ts.net.": ["10.20.30.40"],
+					"cache.other.bar.ts.net.": ["fd7a:115c:a1e0::2"],
+					"web.prod.svc.bar.ts.net.": ["10.20.30.42"],
+					"blocked.svc.bar.ts.net.": ["10.20.30.43"],
+					"blocked.other.bar.ts.net.": ["10.20.30.44"]
+				},
+				"rpz": [
+					{"name": "blocked.svc.bar.ts.net.", "action": "NXDOMAIN"},
+					{"name": "sinkhole.svc.bar.ts.net.", "action": "REDIRECT 10.0.0.1"}
+				],
+				"searchDomains": ["svc.bar.ts.net.", "other.bar.ts.net"],
+				"ndots": %d
+			}`, tt.ndots)
+			ns := newTestNameserver(t, staticConfig([]byte(cfg)))
+			ns.res = &upstreamResolver{dnsResolver: ns.res, ips: []netip.Addr{netip.MustParseAddr("93.184.216.34")}}
+			// Names found in search domains may have internal
+			// addresses, as they are local.
+			ns.rebindProtection = true
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, tt.query, tt.typ), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != tt.wantRCode {
+				t.Errorf("got rcode %v, want %v", msg.Header.RCode, tt.wantRCode)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != tt.query {
+				t.Errorf("got questions %v, want %s", msg.Questions, tt.query)
+			}
+			var got []string
+			for _, rr := range msg.Answers {
+				if !strings.EqualFold(rr.Header.Name.String(), tt.query) {
+					t.Errorf("got answer for %s, want %s", rr.Header.Name, tt.query)
+				}
+				switch b := rr.Body.(type) {
+				case *dnsmessage.AResource:
+					got = append(got, netip.AddrFrom4(b.A).String())
+				case *dnsmessage.AAAAResource:
+					got = append(got, netip.AddrFrom16(b.AAAA).String())
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantIPs) {
+				t.Errorf("got IPs %v, want %v", got, tt.wantIPs)
+			}
+		})
+	}
+}
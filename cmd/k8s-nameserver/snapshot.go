@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"tailscale.com/atomicfile"
+	operatorutils "tailscale.com/k8s-operator"
+	"tailscale.com/util/dnsname"
+)
+
+// snapshotVersion is the version of the snapshot format written by Snapshot.
+// It must be incremented when the format changes in a way that older
+// nameservers can't restore.
+const snapshotVersion = 1
+
+// nameserverSnapshot is the state of a nameserver that is handed over to a
+// new instance on restart, see Snapshot.
+type nameserverSnapshot struct {
+	Version int `json:"version"`
+	// Config is the last config that was successfully loaded, if any.
+	Config *operatorutils.TSHosts `json:"config,omitempty"`
+	// LastReloadTime is when Config was loaded. It is kept so that the
+	// SOA serial, which is derived from it, doesn't change on restart.
+	LastReloadTime time.Time `json:"lastReloadTime"`
+	// SyncedHosts, DiscoveredPods and SyncedEndpoints are the records
+	// that are served in addition to those from Config, from
+	// runInterfaceAddressSync, runPodAutodiscovery and
+	// runEndpointSliceSync.
+	SyncedHosts     map[dnsname.FQDN][]netip.Addr `json:"syncedHosts,omitempty"`
+	DiscoveredPods  []snapshotRecord              `json:"discoveredPods,omitempty"`
+	SyncedEndpoints []snapshotRecord              `json:"syncedEndpoints,omitempty"`
+}
+
+// snapshotRecord is a podRecord or endpointRecord in a nameserverSnapshot.
+// For endpointRecords, Name is the name of the Service.
+type snapshotRecord struct {
+	Name      string       `json:"name"`
+	Namespace string       `json:"namespace"`
+	IPs       []netip.Addr `json:"ips"`
+}
+
+// Snapshot returns the state of the nameserver as JSON, for a new instance
+// of the nameserver to continue from with RestoreFromSnapshot, so that it
+// serves the same records before it has loaded the config itself. It is
+// safe for concurrent use.
+func (n *nameserver) Snapshot() ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := nameserverSnapshot{
+		Version:        snapshotVersion,
+		Config:         n.config,
+		LastReloadTime: n.lastReloadTime,
+		SyncedHosts:    n.syncedHosts,
+	}
+	for _, rec := range n.discoveredPods {
+		s.DiscoveredPods = append(s.DiscoveredPods, snapshotRecord{rec.name, rec.namespace, rec.ips})
+	}
+	for _, rec := range n.syncedEndpoints {
+		s.SyncedEndpoints = append(s.SyncedEndpoints, snapshotRecord{rec.service, rec.namespace, rec.ips})
+	}
+	return json.Marshal(s)
+}
+
+// RestoreFromSnapshot loads the state in data, as returned by Snapshot, into
+// n. It must be called before n.run, which then reloads the config as usual;
+// until it has, the records from the snapshot are served. The synced records
+// are replaced once the sync that they came from runs in n.
+func (n *nameserver) RestoreFromSnapshot(data []byte) error {
+	var s nameserverSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, want %d", s.Version, snapshotVersion)
+	}
+	for name := range s.SyncedHosts {
+		if _, err := dnsname.ToFQDN(name.WithTrailingDot()); err != nil {
+			return fmt.Errorf("invalid synced host name %q in snapshot: %w", name, err)
+		}
+	}
+
+	n.reloadMu.Lock()
+	defer n.reloadMu.Unlock()
+	if s.Config != nil {
+		if err := n.applyConfig(s.Config, time.Now()); err != nil {
+			return fmt.Errorf("error loading the config from the snapshot: %w", err)
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !s.LastReloadTime.IsZero() {
+		n.lastReloadTime = s.LastReloadTime
+	}
+	n.syncedHosts = s.SyncedHosts
+	n.discoveredPods = nil
+	for _, rec := range s.DiscoveredPods {
+		n.discoveredPods = append(n.discoveredPods, podRecord{name: rec.Name, namespace: rec.Namespace, ips: rec.IPs})
+	}
+	n.syncedEndpoints = nil
+	for _, rec := range s.SyncedEndpoints {
+		n.syncedEndpoints = append(n.syncedEndpoints, endpointRecord{service: rec.Name, namespace: rec.Namespace, ips: rec.IPs})
+	}
+	if err := n.setResolverConfigLocked(); err != nil {
+		return err
+	}
+	n.logger.Infof("restored nameserver state from snapshot of config loaded at %v", n.lastReloadTime)
+	return nil
+}
+
+// writeSnapshot writes the Snapshot of n to path, replacing it atomically.
+func (n *nameserver) writeSnapshot(path string) error {
+	b, err := n.Snapshot()
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b, 0o600)
+}
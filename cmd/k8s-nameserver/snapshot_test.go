@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNameserverSnapshot(t *testing.T) {
+	config := []byte(`{
+		"hosts": {"foo.bar.ts.net.": ["10.20.30.40"], "baz.bar.ts.net.": ["10.20.30.41", "fd7a:115c:a1e0::1"]},
+		"rpz": [{"name": "old.bar.ts.net.", "action": "REDIRECT foo.bar.ts.net."}]
+	}`)
+	ns := newTestNameserver(t, staticConfig(config))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	ns.mu.Lock()
+	ns.syncedEndpoints = []endpointRecord{{service: "web", namespace: "default", ips: []netip.Addr{netip.MustParseAddr("10.1.0.1")}}}
+	if err := ns.setResolverConfigLocked(); err != nil {
+		t.Fatal(err)
+	}
+	ns.mu.Unlock()
+	snap, err := ns.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new instance has no config to load yet.
+	restored := newTestNameserver(t, func() ([]byte, error) { return nil, errors.New("config not mounted yet") })
+	if err := restored.RestoreFromSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []struct {
+		name string
+		typ  dnsmessage.Type
+	}{
+		{"foo.bar.ts.net.", dnsmessage.TypeA},
+		{"baz.bar.ts.net.", dnsmessage.TypeAAAA},
+		{"web.default.ts.net.", dnsmessage.TypeA},
+		{"old.bar.ts.net.", dnsmessage.TypeA},
+		{"nope.bar.ts.net.", dnsmessage.TypeA},
+	} {
+		t.Run(fmt.Sprintf("%s_%v", q.name, q.typ), func(t *testing.T) {
+			want, err := ns.query(ctx, testQuery(t, q.name, q.typ), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := restored.query(ctx, testQuery(t, q.name, q.typ), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got response %x from restored nameserver, want %x", got, want)
+			}
+		})
+	}
+	resp, err := restored.query(ctx, testQuery(t, "web.default.ts.net.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0].String() != "10.1.0.1" {
+		t.Errorf("got IPs %v for the restored EndpointSlice record, want [10.1.0.1]", ips)
+	}
+	if got, err := restored.Snapshot(); err != nil || !bytes.Equal(got, snap) {
+		t.Errorf("got snapshot %s, %v of restored nameserver, want %s", got, err, snap)
+	}
+}
+
+func TestRestoreFromSnapshotErrors(t *testing.T) {
+	for _, snap := range []string{
+		`{`,
+		`{"version":0}`,
+		fmt.Sprintf(`{"version":%d}`, snapshotVersion+1),
+		fmt.Sprintf(`{"version":%d,"config":{"hosts":{"foo.bar.ts.net.":["nope"]}}}`, snapshotVersion),
+		fmt.Sprintf(`{"version":%d,"syncedHosts":{"foo..ts.net.":["10.0.0.1"]}}`, snapshotVersion),
+	} {
+		ns := newTestNameserver(t, staticConfig(testHosts))
+		if err := ns.RestoreFromSnapshot([]byte(snap)); err == nil {
+			t.Errorf("RestoreFromSnapshot(%s) succeeded, want error", snap)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// setUDPBufferSizes sets the receive and send buffer sizes of conn to recv
+// and send bytes, leaving those that are 0 or less at the OS default, so that
+// query bursts don't overflow the receive buffer. The OS may grant less than
+// requested, i.e. on Linux no more than net.core.rmem_max and wmem_max, so
+// the sizes obtained are logged and the receive buffer size is recorded.
+func (n *nameserver) setUDPBufferSizes(conn *net.UDPConn, recv, send int) error {
+	if recv > 0 {
+		if err := conn.SetReadBuffer(recv); err != nil {
+			return fmt.Errorf("error setting UDP receive buffer size: %w", err)
+		}
+	}
+	if send > 0 {
+		if err := conn.SetWriteBuffer(send); err != nil {
+			return fmt.Errorf("error setting UDP send buffer size: %w", err)
+		}
+	}
+	gotRecv, gotSend, err := socketBufferSizes(conn)
+	if err != nil {
+		n.logger.Warnf("error getting UDP buffer sizes of %v: %v", conn.LocalAddr(), err)
+		return nil
+	}
+	n.logger.Infof("UDP buffer sizes of %v: %d bytes receive, %d bytes send", conn.LocalAddr(), gotRecv, gotSend)
+	if recv > 0 && gotRecv < recv {
+		n.logger.Warnf("UDP receive buffer of %v is %d bytes, less than the %d requested with --udp-recv-buf", conn.LocalAddr(), gotRecv, recv)
+	}
+	if send > 0 && gotSend < send {
+		n.logger.Warnf("UDP send buffer of %v is %d bytes, less than the %d requested with --udp-send-buf", conn.LocalAddr(), gotSend, send)
+	}
+	n.metrics.observeUDPReceiveBuffer(gotRecv)
+	return nil
+}
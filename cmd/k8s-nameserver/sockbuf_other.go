@@ -0,0 +1,17 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !plan9
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// socketBufferSizes returns an error, as getting the buffer sizes of sockets
+// is not supported on this platform.
+func socketBufferSizes(conn *net.UDPConn) (recv, send int, err error) {
+	return 0, 0, errors.New("getting socket buffer sizes is not supported on this platform")
+}
@@ -0,0 +1,57 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetUDPBufferSizes(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+	conn, err := listenUDP("127.0.0.1:0", false, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Small enough to be below the default net.core.rmem_max and
+	// wmem_max, so that the kernel grants them.
+	const recv, send = 96 << 10, 48 << 10
+	if err := ns.setUDPBufferSizes(conn, recv, send); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotRecv, gotSend int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		if gotRecv, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		gotSend, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	// Linux doubles the requested sizes.
+	if gotRecv != 2*recv {
+		t.Errorf("got SO_RCVBUF %d, want %d", gotRecv, 2*recv)
+	}
+	if gotSend != 2*send {
+		t.Errorf("got SO_SNDBUF %d, want %d", gotSend, 2*send)
+	}
+	if got := testutil.ToFloat64(ns.metrics.udpReceiveBuf); got != recv {
+		t.Errorf("got udp_receive_buffer_size_bytes %v, want %d", got, recv)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"net"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketBufferSizes returns the receive and send buffer sizes of conn, as
+// they would have been requested. Linux doubles the requested sizes to
+// leave room for its bookkeeping and reports the doubled sizes, which are
+// halved again.
+func socketBufferSizes(conn *net.UDPConn) (recv, send int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		if recv, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		send, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	}); err != nil {
+		return 0, 0, err
+	}
+	if sockErr != nil {
+		return 0, 0, sockErr
+	}
+	if runtime.GOOS == "linux" {
+		recv, send = recv/2, send/2
+	}
+	return recv, send, nil
+}
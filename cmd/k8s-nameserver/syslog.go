@@ -0,0 +1,21 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog returns a writer that sends each write as a message with INFO
+// severity and the daemon facility to the syslog server at addr over
+// network, i.e. "udp" or "tcp", or to the local syslog daemon, over
+// /dev/log or similar, if network is empty. The log/syslog package uses the
+// BSD syslog message format (RFC 3164), which RFC 5424 servers also accept.
+// It reconnects to the server when a write fails.
+func dialSyslog(network, addr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// syslogServer is a TCP syslog server that records the messages that it
+// receives, one per line.
+func syslogServer(t *testing.T) (addr string, msgs <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 10)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		s := bufio.NewScanner(c)
+		for s.Scan() {
+			ch <- s.Text()
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestSyslogQueryLog(t *testing.T) {
+	addr, msgs := syslogServer(t)
+	w, err := dialSyslog("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newQueryLogger(w, queryLogFormatSyslog, 10, t.Errorf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ns.syslogLog = l
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg string
+	select {
+	case msg = <-msgs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no syslog message received")
+	}
+	// <30> is the daemon facility (3) with INFO severity (6).
+	if !strings.HasPrefix(msg, "<30>") || !strings.Contains(msg, " "+syslogTag+"[") {
+		t.Errorf("got message %q, want an INFO message tagged %s", msg, syslogTag)
+	}
+	for _, want := range []string{
+		"source=10.0.0.1",
+		"protocol=udp",
+		"name=foo.bar.ts.net.",
+		"type=A",
+		"rcode=NOERROR",
+		"latency_ms=",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q is missing %q", msg, want)
+		}
+	}
+	if strings.Contains(msg, "error=") {
+		t.Errorf("message %q has an error for a successful query", msg)
+	}
+}
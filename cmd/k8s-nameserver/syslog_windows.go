@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog returns an error, as there's no syslog on Windows.
+func dialSyslog(network, addr string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTCPIdleTimeout is how long a TCP connection may go without a
+// complete query before the nameserver closes it.
+const defaultTCPIdleTimeout = 30 * time.Second
+
+// listenTCP returns a TCP listener bound to addr. If ipv6Only is set, the
+// host part of addr is ignored and the listener is bound to the IPv6
+// unspecified address only, and if iface is non-empty it only accepts
+// connections from the network interface with that name, as in listenUDP.
+func listenTCP(addr string, ipv6Only bool, iface string) (net.Listener, error) {
+	network := "tcp"
+	if ipv6Only {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		network, addr = "tcp6", net.JoinHostPort("::", port)
+	}
+	lc, addr, err := listenConfig(network, addr, iface)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s %q: %w", network, addr, err)
+	}
+	return ln, nil
+}
+
+// serveTCP accepts TCP connections from ln until ctx is done and answers the
+// DNS queries on each one in its own goroutine. Connections that don't send
+// a complete query within idleTimeout are closed.
+func (n *nameserver) serveTCP(ctx context.Context, ln net.Listener, idleTimeout time.Duration) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			n.logger.Errorf("error accepting TCP connection: %v", err)
+			continue
+		}
+		go n.handleTCPConn(ctx, c, idleTimeout, &n.tcpConns)
+	}
+}
+
+// handleTCPConn answers the length-prefixed DNS queries on c until the client
+// closes it, it is idle for idleTimeout or ctx is done. conns is incremented
+// for as long as c is open.
+// https://datatracker.ietf.org/doc/html/rfc7766#section-8
+func (n *nameserver) handleTCPConn(ctx context.Context, c net.Conn, idleTimeout time.Duration, conns *atomic.Int32) {
+	conns.Add(1)
+	defer conns.Add(-1)
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	src, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil {
+		n.logger.Errorf("invalid TCP client address %v: %v", c.RemoteAddr(), err)
+		return
+	}
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	var lenBuf [2]byte
+	for {
+		// The deadline is reset for every query, so the timeout only
+		// applies to idle connections.
+		if err := c.SetDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				n.logger.Debugf("closing TCP connection from %v after being idle for %v", src, idleTimeout)
+			}
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(c, payload); err != nil {
+			return
+		}
+		if isZoneTransfer(payload) && n.zoneTransferAllowed(src.Addr()) {
+			n.queriesTotal.Add(1)
+			n.metrics.observeQuery(payload)
+			msgs, err := n.zoneTransfer(payload)
+			if err != nil {
+				n.logger.Errorf("error doing zone transfer to %v: %v", src, err)
+				return
+			}
+			for _, msg := range msgs {
+				if !n.writeTCPMessage(c, src, msg) {
+					return
+				}
+			}
+			continue
+		}
+		resp, err := n.queryFamily(ctx, payload, "tcp", src)
+		if err != nil {
+			n.logger.Errorf("error doing DNS query: %v", err)
+		}
+		if len(resp) == 0 {
+			continue
+		}
+		if !n.writeTCPMessage(c, src, resp) {
+			return
+		}
+	}
+}
+
+// writeTCPMessage writes the length-prefixed DNS message b to c, which is
+// connected to src, and reports whether it succeeded.
+func (n *nameserver) writeTCPMessage(c net.Conn, src netip.AddrPort, b []byte) bool {
+	if len(b) > 0xffff {
+		n.logger.Errorf("DNS response to %v is too large for TCP: %d bytes", src, len(b))
+		return false
+	}
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(b)), uint16(len(b)))
+	if _, err := c.Write(append(msg, b...)); err != nil {
+		n.logger.Errorf("error writing DNS response to %v: %v", src, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstest"
+)
+
+func TestTCPIdleTimeout(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listenTCP("127.0.0.1:0", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	const idleTimeout = 200 * time.Millisecond
+	go ns.serveTCP(ctx, ln, idleTimeout)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Queries on the connection are answered and keep it open for longer
+	// than the idle timeout.
+	for range 3 {
+		q := testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA)
+		if _, err := c.Write(binary.BigEndian.AppendUint16(nil, uint16(len(q)))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write(q); err != nil {
+			t.Fatal(err)
+		}
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(c, resp); err != nil {
+			t.Fatal(err)
+		}
+		if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+			t.Fatalf("got IPs %v, want [10.20.30.40]", ips)
+		}
+		time.Sleep(idleTimeout / 2)
+	}
+
+	// An idle connection gets closed by the nameserver.
+	start := time.Now()
+	_, err = c.Read(make([]byte, 1))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("idle connection was not closed")
+	}
+	if err != io.EOF {
+		t.Fatalf("got error %v reading from idle connection, want EOF", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle connection closed after %v, want about %v", d, idleTimeout)
+	}
+	if err := tstest.WaitFor(2*time.Second, func() error {
+		if n := ns.tcpConns.Load(); n != 0 {
+			return fmt.Errorf("%d TCP connections open, want 0", n)
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	// Connections that never send anything are closed as well.
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got error %v reading from connection without queries, want EOF", err)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// raiseTTLs returns resp with the TTLs of all records that are below minTTL
+// raised to it, so that clients which respect very short TTLs, typically of
+// forwarded upstream answers, don't query the nameserver for the same names
+// over and over. The TTL field of OPT records holds flags and is left as is.
+func raiseTTLs(resp []byte, minTTL uint32) ([]byte, error) {
+	if minTTL == 0 {
+		return resp, nil
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("error parsing response to raise TTLs: %w", err)
+	}
+	raised := false
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			h := &section[i].Header
+			if h.Type != dnsmessage.TypeOPT && h.TTL < minTTL {
+				h.TTL = minTTL
+				raised = true
+			}
+		}
+	}
+	if !raised {
+		return resp, nil
+	}
+	return msg.Pack()
+}
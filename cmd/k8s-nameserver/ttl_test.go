@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	"tailscale.com/util/dnsname"
+)
+
+// shortTTLResolver answers queries for names outside of the local domains
+// with ip and a TTL of 1 second.
+type shortTTLResolver struct {
+	dnsResolver
+	ip netip.Addr
+}
+
+func (r *shortTTLResolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+	h, q, err := parseQuestion(bs)
+	if err != nil {
+		return nil, err
+	}
+	if name, err := dnsname.ToFQDN(q.Name.String()); err == nil && nsconfig.DefaultLocalDomains[0].Contains(name) {
+		return r.dnsResolver.Query(ctx, bs, family, from)
+	}
+	return ipResponse(h, q, 1, r.ip)
+}
+
+func TestNameserverResponseMinTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		minTTL uint32
+		query  string
+		want   uint32
+	}{
+		{"forwarded", 30, "example.com.", 30},
+		{"disabled", 0, "example.com.", 1},
+		// TTLs above the floor are left as is.
+		{"local", 30, "foo.bar.ts.net.", 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.res = &shortTTLResolver{dnsResolver: ns.res, ip: netip.MustParseAddr("93.184.216.34")}
+			ns.responseMinTTL = tt.minTTL
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := ns.run(ctx, cancel); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ns.query(ctx, testQuery(t, tt.query, dnsmessage.TypeA), testSrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != tt.want {
+				t.Errorf("got answers %v, want one with TTL %d", msg.Answers, tt.want)
+			}
+		})
+	}
+}
+
+func TestRaiseTTLsOPT(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	if err := b.StartAdditionals(); err != nil {
+		t.Fatal(err)
+	}
+	var opt dnsmessage.ResourceHeader
+	// The DO bit is in the OPT record's TTL field.
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := raiseTTLs(resp, 0x7fffffff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(got); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Additionals) != 1 || msg.Additionals[0].Header.TTL != opt.TTL {
+		t.Errorf("got additionals %v, want the OPT record unchanged", msg.Additionals)
+	}
+}
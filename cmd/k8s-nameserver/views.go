@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"net/netip"
+	"strings"
+
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+	"tailscale.com/util/dnsname"
+)
+
+// viewTTL is the TTL of records served from views, the same as the TTL of
+// the resolver's responses for host records.
+const viewTTL = 600
+
+// answerFromView returns the response to the DNS query in payload and true
+// if the query is from a source address that has a view with records for the
+// queried name. Views are checked in order and only the first one that
+// contains addr applies; names that it doesn't have records for are left to
+// the resolver, which serves the default records.
+func (n *nameserver) answerFromView(payload []byte, addr netip.AddrPort) ([]byte, bool, error) {
+	n.mu.Lock()
+	views := n.views
+	ipv4Disabled := n.ipv4Disabled
+	n.mu.Unlock()
+	if len(views) == 0 {
+		return nil, false, nil
+	}
+	var view *nsconfig.View
+	for i := range views {
+		if views[i].Source.Contains(addr.Addr()) {
+			view = &views[i]
+			break
+		}
+	}
+	if view == nil {
+		return nil, false, nil
+	}
+	h, q, err := parseQuestion(payload)
+	if err != nil {
+		return nil, false, nil
+	}
+	name, err := dnsname.ToFQDN(strings.ToLower(q.Name.String()))
+	if err != nil {
+		return nil, false, nil
+	}
+	all, ok := view.Hosts[name]
+	if !ok {
+		return nil, false, nil
+	}
+	ips := make([]netip.Addr, 0, len(all))
+	for _, ip := range all {
+		if !ipv4Disabled || !ip.Is4() {
+			ips = append(ips, ip)
+		}
+	}
+	resp, err := ipResponse(h, q, viewTTL, ips...)
+	return resp, true, err
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+func TestNameserverViews(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig([]byte(`{
+		"hosts": {
+			"foo.bar.ts.net.": ["10.20.30.40"],
+			"baz.bar.ts.net.": ["10.20.30.41"]
+		},
+		"views": [
+			{"sourceCIDR": "10.1.0.0/16", "hosts": {"foo.bar.ts.net.": ["10.1.30.40", "fd7a:115c:a1e0::1"]}},
+			{"sourceCIDR": "10.2.0.0/16", "hosts": {"foo.bar.ts.net.": ["10.2.30.40"], "only.bar.ts.net.": ["10.2.30.42"], "Mixed.Bar.TS.net.": ["10.2.30.43"]}},
+			{"sourceCIDR": "10.0.0.0/8", "hosts": {"foo.bar.ts.net.": ["10.0.30.40"]}}
+		]
+	}`)))
+	ns.strictConfig = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		qname   string
+		qtype   dnsmessage.Type
+		wantRC  dnsmessage.RCode
+		wantIPs []string
+	}{
+		// 10.1.2.3 is also in the last view, but only the first match
+		// applies.
+		{name: "first_view", src: "10.1.2.3:53", qname: "foo.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.1.30.40"}},
+		{name: "first_view_aaaa", src: "10.1.2.3:53", qname: "foo.bar.ts.net.", qtype: dnsmessage.TypeAAAA, wantIPs: []string{"fd7a:115c:a1e0::1"}},
+		{name: "second_view", src: "10.2.2.3:53", qname: "foo.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.2.30.40"}},
+		{name: "catch_all_view", src: "10.3.2.3:53", qname: "foo.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.0.30.40"}},
+		{name: "no_view", src: "192.168.1.1:53", qname: "foo.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.20.30.40"}},
+		{name: "falls_back_to_hosts", src: "10.2.2.3:53", qname: "baz.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.20.30.41"}},
+		{name: "view_only_record", src: "10.2.2.3:53", qname: "only.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.2.30.42"}},
+		{name: "mixed_case_view_record", src: "10.2.2.3:53", qname: "mixed.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.2.30.43"}},
+		{name: "mixed_case_query", src: "10.2.2.3:53", qname: "MIXED.bar.ts.net.", qtype: dnsmessage.TypeA, wantIPs: []string{"10.2.30.43"}},
+		{name: "view_only_record_other_view", src: "10.1.2.3:53", qname: "only.bar.ts.net.", qtype: dnsmessage.TypeA, wantRC: dnsmessage.RCodeNameError},
+		{name: "no_data", src: "10.2.2.3:53", qname: "foo.bar.ts.net.", qtype: dnsmessage.TypeAAAA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ns.query(ctx, testQuery(t, tt.qname, tt.qtype), netip.MustParseAddrPort(tt.src))
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			h, ips := answerIPs(t, resp)
+			if h.RCode != tt.wantRC {
+				t.Errorf("got rcode %v, want %v", h.RCode, tt.wantRC)
+			}
+			var want []netip.Addr
+			for _, s := range tt.wantIPs {
+				want = append(want, netip.MustParseAddr(s))
+			}
+			if !slices.Equal(ips, want) {
+				t.Errorf("got IPs %v, want %v", ips, want)
+			}
+		})
+	}
+}
+
+func TestParseViewsErrors(t *testing.T) {
+	for _, tt := range []struct {
+		cfg       string
+		wantField string
+	}{
+		{`{"views":[{"sourceCIDR":"10.1.0.0","hosts":{}}]}`, "views[0].sourceCIDR"},
+		{`{"views":[{"sourceCIDR":"10.1.0.0/16","hosts":{"foo.bar.ts.net.":["nope"]}}]}`, `views[0].hosts["foo.bar.ts.net."][0]`},
+	} {
+		ns := newTestNameserver(t, staticConfig([]byte(tt.cfg)))
+		var cfgErr *nsconfig.Error
+		if err := ns.updateResolverConfig(); !errors.As(err, &cfgErr) || cfgErr.Field != tt.wantField {
+			t.Errorf("config %s: got error %v, want nsconfig.Error for %s", tt.cfg, err, tt.wantField)
+		}
+	}
+}
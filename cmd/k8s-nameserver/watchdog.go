@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"time"
+)
+
+const (
+	// goroutineCheckInterval is how often runGoroutineLimitCheck counts
+	// the goroutines.
+	goroutineCheckInterval = 30 * time.Second
+	// maxGoroutineDumpSize is the size at which the goroutine stacks that
+	// are logged when the limit is exceeded are truncated.
+	maxGoroutineDumpSize = 1 << 20
+)
+
+// runWatchdog checks every interval whether the nameserver has stopped
+// answering queries, until ctx is done. If queries were received but none
+// were answered successfully for longer than timeout, for example because
+// the resolver is deadlocked, it calls cancelF so that the process exits
+// and is restarted. A nameserver that receives no queries is never
+// considered stalled.
+func (n *nameserver) runWatchdog(ctx context.Context, cancelF context.CancelFunc, interval, timeout time.Duration) {
+	n.logger.Infof("restarting if no queries are answered for %v, checking every %v", timeout, interval)
+	start := time.Now()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if stalled, since := n.stalled(start, timeout); stalled {
+				n.logger.Errorf("no queries answered successfully for %v while receiving queries, giving up", since.Round(time.Second))
+				cancelF()
+				return
+			}
+		}
+	}
+}
+
+// stalled reports whether queries were received after the last one that was
+// answered successfully, or after start if none were, and that answer is
+// older than timeout. It also returns how long ago the last answer was.
+func (n *nameserver) stalled(start time.Time, timeout time.Duration) (bool, time.Duration) {
+	received := n.lastQueryReceivedTime.Load()
+	if received == 0 {
+		return false, 0
+	}
+	last := start
+	if answered := n.lastQueryTime.Load(); answered != 0 {
+		last = time.Unix(0, answered)
+	}
+	since := time.Since(last)
+	return time.Unix(0, received).After(last) && since > timeout, since
+}
+
+// runGoroutineLimitCheck counts the goroutines every interval until ctx is
+// done, to catch goroutine leaks before they exhaust the memory of the
+// nameserver. Every check that finds more than limit goroutines is counted
+// in the goroutine_limit_exceeded_total metric, and the first one after the
+// count was below the limit logs the stacks of all goroutines. If kill is
+// set, it calls cancelF instead of continuing, so that the process exits and
+// is restarted.
+func (n *nameserver) runGoroutineLimitCheck(ctx context.Context, cancelF context.CancelFunc, interval time.Duration, limit int, kill bool) {
+	numGoroutine := n.numGoroutine
+	if numGoroutine == nil {
+		numGoroutine = runtime.NumGoroutine
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	exceeded := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		count := numGoroutine()
+		if count <= limit {
+			exceeded = false
+			continue
+		}
+		n.metrics.observeGoroutineLimitExceeded()
+		if !exceeded {
+			buf := make([]byte, maxGoroutineDumpSize)
+			buf = buf[:runtime.Stack(buf, true)]
+			n.logger.Errorf("%d goroutines running, more than --max-goroutines=%d; stacks:\n%s", count, limit, buf)
+		} else {
+			n.logger.Errorf("%d goroutines running, more than --max-goroutines=%d", count, limit)
+		}
+		exceeded = true
+		if kill {
+			n.logger.Errorf("giving up, as --kill-on-goroutine-limit is set")
+			cancelF()
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstest"
+)
+
+func TestNameserverWatchdog(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig(testHosts))
+	res := &blockingResolver{dnsResolver: ns.res, release: make(chan struct{})}
+	ns.res = res
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	const timeout = 100 * time.Millisecond
+	go ns.runWatchdog(ctx, cancel, 10*time.Millisecond, timeout)
+
+	// A successful query followed by no queries at all is not a stall.
+	close(res.release)
+	if _, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * timeout)
+	if ctx.Err() != nil {
+		t.Fatal("watchdog cancelled the context of an idle nameserver")
+	}
+
+	// Queries that the resolver never answers are.
+	ns.res = &blockingResolver{dnsResolver: res.dnsResolver, release: make(chan struct{})}
+	queryCtx, queryCancel := context.WithCancel(context.Background())
+	defer queryCancel()
+	go ns.query(queryCtx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog didn't cancel the context of a stalled nameserver")
+	}
+}
+
+// goroutineLeak starts goroutines that block until it is released and
+// counts them, as a stand-in for runtime.NumGoroutine that other tests
+// running in parallel don't affect.
+type goroutineLeak struct {
+	release chan struct{}
+	wg      sync.WaitGroup
+	leaked  atomic.Int64
+}
+
+func (l *goroutineLeak) leak(n int) {
+	for range n {
+		l.leaked.Add(1)
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			<-l.release
+		}()
+	}
+}
+
+func (l *goroutineLeak) count() int { return int(l.leaked.Load()) }
+
+func TestNameserverGoroutineLimit(t *testing.T) {
+	for _, kill := range []bool{false, true} {
+		t.Run(fmt.Sprintf("kill=%v", kill), func(t *testing.T) {
+			core, logs := observer.New(zap.ErrorLevel)
+			ns := newTestNameserver(t, staticConfig(testHosts))
+			ns.logger = zap.New(core).Sugar()
+			ns.metrics = newNameserverMetrics(defaultPrometheusNamespace, ns)
+			l := &goroutineLeak{release: make(chan struct{})}
+			defer func() {
+				close(l.release)
+				l.wg.Wait()
+			}()
+			ns.numGoroutine = l.count
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			const limit = 20
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				ns.runGoroutineLimitCheck(ctx, cancel, 5*time.Millisecond, limit, kill)
+			}()
+
+			l.leak(limit)
+			time.Sleep(50 * time.Millisecond)
+			if n := logs.Len(); n != 0 || ctx.Err() != nil {
+				t.Fatalf("check fired with %d goroutines, at the limit: %d logs, context error %v", l.count(), n, ctx.Err())
+			}
+
+			l.leak(10)
+			if err := tstest.WaitFor(5*time.Second, func() error {
+				if got := testutil.ToFloat64(ns.metrics.goroutineLimit); got == 0 {
+					return fmt.Errorf("goroutine_limit_exceeded_total is %v", got)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			first := logs.All()[0].Message
+			if !strings.Contains(first, "30 goroutines running, more than --max-goroutines=20") || !strings.Contains(first, "(*goroutineLeak).leak") {
+				t.Errorf("got log %.200q, want the goroutine count and the stacks of the leaked goroutines", first)
+			}
+			if kill {
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("check didn't stop after the limit was exceeded")
+				}
+				if ctx.Err() == nil {
+					t.Error("check didn't cancel the context")
+				}
+				return
+			}
+			if ctx.Err() != nil {
+				t.Error("check cancelled the context without --kill-on-goroutine-limit")
+			}
+			// Later checks are counted, but don't repeat the stacks.
+			if err := tstest.WaitFor(5*time.Second, func() error {
+				if logs.Len() < 2 {
+					return fmt.Errorf("got %d logs, want at least 2", logs.Len())
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if second := logs.All()[1].Message; strings.Contains(second, "stacks") {
+				t.Errorf("second log %q has the stacks again", second)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/cmd/k8s-nameserver/nsconfig"
+)
+
+func TestNameserverYAMLConfig(t *testing.T) {
+	ns := newTestNameserver(t, staticConfig([]byte(`
+hosts:
+  foo.bar.ts.net.: [10.20.30.40]
+`)))
+	ns.configFormat = nsconfig.FormatYAML
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ns.query(ctx, testQuery(t, "foo.bar.ts.net.", dnsmessage.TypeA), testSrc)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if _, ips := answerIPs(t, resp); len(ips) != 1 || ips[0] != netip.MustParseAddr("10.20.30.40") {
+		t.Errorf("got IPs %v, want [10.20.30.40]", ips)
+	}
+}
@@ -0,0 +1,504 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package kube
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FormatTSHosts returns h in a line based format that is meant for reading
+// and diffing, with one record or rule per line:
+//
+//	schemaVersion 1
+//	searchDomain svc.foo.ts.net.
+//	ndots 2
+//	clusterDomain cluster.local.
+//	A foo.bar.ts.net. 10.20.30.40
+//	AAAA foo.bar.ts.net. fd7a:115c:a1e0::1
+//	healthCheckPort foo.bar.ts.net. 8080
+//	expiresAt foo.bar.ts.net. 2024-05-01T12:00:00Z
+//	external A db.internal. 10.20.30.50
+//	sourcePriority foo.bar.ts.net. 1
+//	rpz old.bar.ts.net. REDIRECT foo.bar.ts.net.
+//	rewrite 10.1.0.0/16 10.20.30.40 10.20.30.41 foo.bar.ts.net.
+//	view 10.2.0.0/16
+//	  A foo.bar.ts.net. 10.20.30.42
+//
+// Records are sorted by name, keeping the order of the IP addresses of
+// each name, and rules keep their order. A name without IP addresses has an
+// A line without one. The indented records after a view line belong to that
+// view. Empty lines and lines starting with # are ignored by ParseTSHosts.
+//
+// ParseTSHosts of the text returns h, except that empty maps and slices are
+// nil. Names, IP addresses and other values that are empty or contain
+// whitespace can't be represented and are an error.
+func FormatTSHosts(h *TSHosts) ([]byte, error) {
+	w := &hostsTextWriter{}
+	if h.SchemaVersion != 0 {
+		w.line("schemaVersion", strconv.Itoa(h.SchemaVersion))
+	}
+	for _, d := range h.SearchDomains {
+		w.line("searchDomain", d)
+	}
+	if h.NDots != 0 {
+		w.line("ndots", strconv.Itoa(h.NDots))
+	}
+	if h.ClusterDomain != "" {
+		w.line("clusterDomain", h.ClusterDomain)
+	}
+	w.records("", h.Hosts)
+	for _, name := range sortedKeys(h.HealthCheckPorts) {
+		w.line("healthCheckPort", name, strconv.Itoa(int(h.HealthCheckPorts[name])))
+	}
+	for _, name := range sortedKeys(h.ExpiresAt) {
+		w.line("expiresAt", name, h.ExpiresAt[name].Format(time.RFC3339Nano))
+	}
+	w.records("external ", h.ExternalRecords)
+	for _, name := range sortedKeys(h.SourcePriority) {
+		w.line("sourcePriority", name, strconv.Itoa(h.SourcePriority[name]))
+	}
+	for _, r := range h.RPZ {
+		w.line("rpz", r.Name, r.Action)
+	}
+	for _, r := range h.RewriteRules {
+		if r.MatchName == "" {
+			w.line("rewrite", r.SourceCIDR, r.OriginalIP, r.ReplacementIP)
+		} else {
+			w.line("rewrite", r.SourceCIDR, r.OriginalIP, r.ReplacementIP, r.MatchName)
+		}
+	}
+	for _, v := range h.Views {
+		w.line("view", v.SourceCIDR)
+		w.records("  ", v.Hosts)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// hostsTextWriter writes the lines of FormatTSHosts, stopping at the
+// first value that can't be represented.
+type hostsTextWriter struct {
+	buf bytes.Buffer
+	err error
+}
+
+// line writes a line with the given keyword and values. The last value of
+// rpz lines is an action, which may contain single spaces.
+func (w *hostsTextWriter) line(keyword string, values ...string) {
+	if w.err != nil {
+		return
+	}
+	for i, v := range values {
+		ok := v != "" && !strings.ContainsFunc(v, unicode.IsSpace)
+		if keyword == "rpz" && i == len(values)-1 {
+			ok = v != "" && strings.Join(strings.Fields(v), " ") == v
+		}
+		if !ok {
+			w.err = fmt.Errorf("%s value %q can't be represented as text", strings.TrimSpace(keyword), v)
+			return
+		}
+	}
+	w.buf.WriteString(keyword)
+	for _, v := range values {
+		w.buf.WriteByte(' ')
+		w.buf.WriteString(v)
+	}
+	w.buf.WriteByte('\n')
+}
+
+// records writes the A and AAAA lines of recs, each with prefix.
+func (w *hostsTextWriter) records(prefix string, recs map[string][]string) {
+	for _, name := range sortedKeys(recs) {
+		if len(recs[name]) == 0 {
+			w.line(prefix+"A", name)
+		}
+		for _, ip := range recs[name] {
+			typ := "A"
+			if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() {
+				typ = "AAAA"
+			}
+			w.line(prefix+typ, name, ip)
+		}
+	}
+}
+
+// ParseTSHosts parses the format returned by FormatTSHosts.
+func ParseTSHosts(b []byte) (*TSHosts, error) {
+	h := &TSHosts{}
+	var view *View
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, len(b)+1)
+	for num := 1; s.Scan(); num++ {
+		line := s.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if err := h.parseLine(fields, indented, &view); err != nil {
+			return nil, fmt.Errorf("line %d: %w", num, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseLine parses the fields of a single line of the text format into h.
+// view is the view that indented lines belong to.
+func (h *TSHosts) parseLine(fields []string, indented bool, view **View) error {
+	keyword, args := fields[0], fields[1:]
+	if indented {
+		if *view == nil {
+			return fmt.Errorf("indented %s line outside of a view", keyword)
+		}
+		return parseRecordLine(&(*view).Hosts, keyword, args)
+	}
+	*view = nil
+	switch keyword {
+	case "A", "AAAA":
+		return parseRecordLine(&h.Hosts, keyword, args)
+	case "external":
+		if len(args) == 0 {
+			return fmt.Errorf("external line without a record type")
+		}
+		return parseRecordLine(&h.ExternalRecords, args[0], args[1:])
+	case "schemaVersion", "ndots":
+		if len(args) != 1 {
+			return fmt.Errorf("%s line must have 1 value, got %d", keyword, len(args))
+		}
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", keyword, err)
+		}
+		if keyword == "ndots" {
+			h.NDots = v
+		} else {
+			h.SchemaVersion = v
+		}
+	case "searchDomain":
+		if len(args) != 1 {
+			return fmt.Errorf("searchDomain line must have 1 value, got %d", len(args))
+		}
+		h.SearchDomains = append(h.SearchDomains, args[0])
+	case "clusterDomain":
+		if len(args) != 1 {
+			return fmt.Errorf("clusterDomain line must have 1 value, got %d", len(args))
+		}
+		h.ClusterDomain = args[0]
+	case "healthCheckPort":
+		if len(args) != 2 {
+			return fmt.Errorf("healthCheckPort line must have 2 values, got %d", len(args))
+		}
+		port, err := strconv.ParseUint(args[1], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid health check port: %w", err)
+		}
+		setKey(&h.HealthCheckPorts, args[0], uint16(port))
+	case "expiresAt":
+		if len(args) != 2 {
+			return fmt.Errorf("expiresAt line must have 2 values, got %d", len(args))
+		}
+		t, err := time.Parse(time.RFC3339Nano, args[1])
+		if err != nil {
+			return fmt.Errorf("invalid expiry time: %w", err)
+		}
+		setKey(&h.ExpiresAt, args[0], t)
+	case "sourcePriority":
+		if len(args) != 2 {
+			return fmt.Errorf("sourcePriority line must have 2 values, got %d", len(args))
+		}
+		priority, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid source priority: %w", err)
+		}
+		setKey(&h.SourcePriority, args[0], priority)
+	case "rpz":
+		if len(args) < 2 {
+			return fmt.Errorf("rpz line must have a name and an action")
+		}
+		h.RPZ = append(h.RPZ, RPZRule{Name: args[0], Action: strings.Join(args[1:], " ")})
+	case "rewrite":
+		if len(args) != 3 && len(args) != 4 {
+			return fmt.Errorf("rewrite line must have 3 or 4 values, got %d", len(args))
+		}
+		r := RewriteRule{SourceCIDR: args[0], OriginalIP: args[1], ReplacementIP: args[2]}
+		if len(args) == 4 {
+			r.MatchName = args[3]
+		}
+		h.RewriteRules = append(h.RewriteRules, r)
+	case "view":
+		if len(args) != 1 {
+			return fmt.Errorf("view line must have 1 value, got %d", len(args))
+		}
+		h.Views = append(h.Views, View{SourceCIDR: args[0]})
+		*view = &h.Views[len(h.Views)-1]
+	default:
+		return fmt.Errorf("unknown keyword %q", keyword)
+	}
+	return nil
+}
+
+// parseRecordLine adds the A or AAAA record with the given values, a name
+// and optionally an IP address, to *recs.
+func parseRecordLine(recs *map[string][]string, typ string, args []string) error {
+	if typ != "A" && typ != "AAAA" {
+		return fmt.Errorf("unknown record type %q", typ)
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("%s line must have a name and at most 1 IP address, got %d values", typ, len(args))
+	}
+	if *recs == nil {
+		*recs = make(map[string][]string)
+	}
+	name := args[0]
+	ips := (*recs)[name]
+	if len(args) == 2 {
+		ips = append(ips, args[1])
+	} else if ips == nil {
+		ips = []string{}
+	}
+	(*recs)[name] = ips
+	return nil
+}
+
+func setKey[V any](m *map[string]V, k string, v V) {
+	if *m == nil {
+		*m = make(map[string]V)
+	}
+	(*m)[k] = v
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// DiffTSHosts returns a unified diff from the text form of a, as returned by
+// FormatTSHosts, to that of b, with 3 lines of context, or "" if there are no
+// differences. Values that can't be represented as text are shown as they
+// are in Go syntax instead.
+func DiffTSHosts(a, b *TSHosts) string {
+	x, y := hostsTextLines(a), hostsTextLines(b)
+	return unifiedDiff("a", "b", x, y, 3)
+}
+
+// hostsTextLines returns the lines of the text form of h.
+func hostsTextLines(h *TSHosts) []string {
+	if h == nil {
+		h = &TSHosts{}
+	}
+	text, err := FormatTSHosts(h)
+	if err != nil {
+		return []string{fmt.Sprintf("# %v\n", err), fmt.Sprintf("# %#v\n", *h)}
+	}
+	lines := strings.SplitAfter(string(text), "\n")
+	return lines[:len(lines)-1]
+}
+
+// diffOp is a line of a diff.
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// unifiedDiff returns the unified diff with context lines of context from x,
+// named xName, to y, named yName. The lines are expected to end with a
+// newline, except possibly for the last one.
+func unifiedDiff(xName, yName string, x, y []string, context int) string {
+	ops := diffLines(x, y)
+	if !slices.ContainsFunc(ops, func(op diffOp) bool { return op.kind != ' ' }) {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", xName, yName)
+	// xLine and yLine are the 1-based line numbers of ops[i] in x and y.
+	xLine, yLine := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			xLine, yLine, i = xLine+1, yLine+1, i+1
+			continue
+		}
+		// Start a hunk with up to context lines before the change and
+		// extend it for as long as changes are at most 2*context lines
+		// apart.
+		start := max(i-context, 0)
+		for j := start; j < i; j++ {
+			xLine, yLine = xLine-1, yLine-1
+		}
+		end := i
+		for k := i; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*context {
+				break
+			}
+		}
+		end = min(end+context, len(ops))
+		var xCount, yCount int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				xCount++
+			}
+			if op.kind != '-' {
+				yCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(xLine, xCount), hunkRange(yLine, yCount))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		xLine, yLine, i = xLine+xCount, yLine+yCount, end
+	}
+	return sb.String()
+}
+
+// hunkRange formats the range of count lines starting at line start for a
+// unified diff hunk header.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// Empty ranges refer to the line before them.
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// diffLines returns a shortest edit script from x to y, computed with the
+// linear space variant of the Myers diff algorithm, so that diffing large
+// configs only needs memory proportional to their size.
+// http://www.xmailserver.org/diff2.pdf
+func diffLines(x, y []string) []diffOp {
+	// The furthest reaching paths are indexed by diagonal k = i-j, which
+	// lies in [-len(y), len(x)].
+	size := len(x) + len(y) + 2
+	d := &lineDiffer{
+		forward:  make([]int, 2*size),
+		backward: make([]int, 2*size),
+		offset:   size,
+	}
+	d.diff(x, y)
+	return d.ops
+}
+
+// lineDiffer computes the edit script of diffLines.
+type lineDiffer struct {
+	ops []diffOp
+	// forward[k+offset] and backward[k+offset] are the furthest x reached
+	// on diagonal k from the start and from the end, by middleSnake.
+	forward, backward []int
+	offset            int
+}
+
+// diff appends a shortest edit script from x to y to d.ops. It splits the
+// problem at the middle snake of an optimal path and recurses on both halves,
+// after trimming the common prefix and suffix, which is fast for the mostly
+// similar configs that are diffed in practice.
+func (d *lineDiffer) diff(x, y []string) {
+	var prefix, suffix int
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+	d.appendOps(' ', x[:prefix])
+	commonSuffix := x[len(x)-suffix:]
+	x, y = x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+	switch {
+	case len(x) == 0:
+		d.appendOps('+', y)
+	case len(y) == 0:
+		d.appendOps('-', x)
+	default:
+		// As the first and last lines of x and y differ, the edit
+		// script has at least two edits, and both halves are smaller.
+		xStart, yStart, xEnd, yEnd := d.middleSnake(x, y)
+		d.diff(x[:xStart], y[:yStart])
+		d.appendOps(' ', x[xStart:xEnd])
+		d.diff(x[xEnd:], y[yEnd:])
+	}
+	d.appendOps(' ', commonSuffix)
+}
+
+// appendOps appends an op of the given kind for each of lines to d.ops.
+func (d *lineDiffer) appendOps(kind byte, lines []string) {
+	for _, l := range lines {
+		d.ops = append(d.ops, diffOp{kind, l})
+	}
+}
+
+// middleSnake returns the start and end of the middle snake of a shortest
+// edit script from x to y, the run of equal lines at which the furthest
+// reaching paths from the start and from the end first overlap. x and y must
+// not be empty.
+func (d *lineDiffer) middleSnake(x, y []string) (xStart, yStart, xEnd, yEnd int) {
+	n, m := len(x), len(y)
+	// The paths from the end are on diagonals k from (n, m), in which the
+	// diagonal of the paths from the start is delta-k.
+	delta := n - m
+	odd := delta%2 != 0
+	fwd, bwd, off := d.forward, d.backward, d.offset
+	fwd[off+1], bwd[off+1] = 0, 0
+	for step := 0; step <= (n+m+1)/2; step++ {
+		for k := -step; k <= step; k += 2 {
+			var i int
+			if k == -step || (k != step && fwd[off+k-1] < fwd[off+k+1]) {
+				i = fwd[off+k+1] // down: insertion
+			} else {
+				i = fwd[off+k-1] + 1 // right: deletion
+			}
+			j := i - k
+			i0, j0 := i, j
+			for i < n && j < m && x[i] == y[j] {
+				i, j = i+1, j+1
+			}
+			fwd[off+k] = i
+			if odd && -(step-1) <= delta-k && delta-k <= step-1 && i+bwd[off+delta-k] >= n {
+				return i0, j0, i, j
+			}
+		}
+		for k := -step; k <= step; k += 2 {
+			var i int
+			if k == -step || (k != step && bwd[off+k-1] < bwd[off+k+1]) {
+				i = bwd[off+k+1]
+			} else {
+				i = bwd[off+k-1] + 1
+			}
+			j := i - k
+			i0, j0 := i, j
+			for i < n && j < m && x[n-1-i] == y[m-1-j] {
+				i, j = i+1, j+1
+			}
+			bwd[off+k] = i
+			if !odd && -step <= delta-k && delta-k <= step && i+fwd[off+delta-k] >= n {
+				return n - i, m - j, n - i0, m - j0
+			}
+		}
+	}
+	panic("unreachable")
+}
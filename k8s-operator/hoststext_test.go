@@ -0,0 +1,271 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package kube
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTSHosts() *TSHosts {
+	return &TSHosts{
+		SchemaVersion: 1,
+		Hosts: map[string][]string{
+			"foo.bar.ts.net.":   {"10.20.30.40"},
+			"baz.bar.ts.net.":   {"10.20.30.41", "fd7a:115c:a1e0::1"},
+			"empty.bar.ts.net.": {},
+		},
+		HealthCheckPorts: map[string]uint16{"foo.bar.ts.net.": 8080},
+		RPZ: []RPZRule{
+			{Name: "old.bar.ts.net.", Action: "REDIRECT foo.bar.ts.net."},
+			{Name: "*.ads.example.", Action: "NXDOMAIN"},
+		},
+		RewriteRules: []RewriteRule{
+			{SourceCIDR: "10.1.0.0/16", OriginalIP: "10.20.30.40", ReplacementIP: "10.20.30.42"},
+			{SourceCIDR: "10.2.0.0/16", MatchName: "baz.bar.ts.net.", OriginalIP: "10.20.30.41", ReplacementIP: "10.20.30.43"},
+		},
+		ExternalRecords: map[string][]string{"db.internal.": {"10.20.30.50"}},
+		SourcePriority:  map[string]int{"foo.bar.ts.net.": 1},
+		Views: []View{
+			{SourceCIDR: "10.3.0.0/16", Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.44"}}},
+			{SourceCIDR: "10.4.0.0/16"},
+		},
+		SearchDomains: []string{"svc.bar.ts.net.", "bar.ts.net."},
+		NDots:         2,
+		ClusterDomain: "k8s.local.",
+	}
+}
+
+func TestTSHostsText(t *testing.T) {
+	h := testTSHosts()
+	text, err := FormatTSHosts(h)
+	assert.Nil(t, err)
+	assert.Equal(t, `schemaVersion 1
+searchDomain svc.bar.ts.net.
+searchDomain bar.ts.net.
+ndots 2
+clusterDomain k8s.local.
+A baz.bar.ts.net. 10.20.30.41
+AAAA baz.bar.ts.net. fd7a:115c:a1e0::1
+A empty.bar.ts.net.
+A foo.bar.ts.net. 10.20.30.40
+healthCheckPort foo.bar.ts.net. 8080
+external A db.internal. 10.20.30.50
+sourcePriority foo.bar.ts.net. 1
+rpz old.bar.ts.net. REDIRECT foo.bar.ts.net.
+rpz *.ads.example. NXDOMAIN
+rewrite 10.1.0.0/16 10.20.30.40 10.20.30.42
+rewrite 10.2.0.0/16 10.20.30.41 10.20.30.43 baz.bar.ts.net.
+view 10.3.0.0/16
+  A foo.bar.ts.net. 10.20.30.44
+view 10.4.0.0/16
+`, string(text))
+
+	got, err := ParseTSHosts(text)
+	assert.Nil(t, err)
+	assert.Equal(t, h, got)
+
+	// Comments and empty lines are ignored.
+	got, err = ParseTSHosts([]byte("# comment\n\nA foo.bar.ts.net. 10.20.30.40\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &TSHosts{Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}}}, got)
+
+	empty := &TSHosts{}
+	text, err = FormatTSHosts(empty)
+	assert.Nil(t, err)
+	assert.Equal(t, "", string(text))
+	got, err = ParseTSHosts(text)
+	assert.Nil(t, err)
+	assert.Equal(t, empty, got)
+}
+
+func TestTSHostsTextErrors(t *testing.T) {
+	for _, h := range []TSHosts{
+		{Hosts: map[string][]string{"": {"10.20.30.40"}}},
+		{Hosts: map[string][]string{"foo bar.ts.net.": {"10.20.30.40"}}},
+		{SearchDomains: []string{"svc.bar.ts.net.\n"}},
+		{RPZ: []RPZRule{{Name: "foo.bar.ts.net."}}},
+		{RPZ: []RPZRule{{Name: "foo.bar.ts.net.", Action: "REDIRECT  10.20.30.40"}}},
+	} {
+		_, err := FormatTSHosts(&h)
+		assert.NotNil(t, err, "%#v", h)
+	}
+
+	for text, wantErr := range map[string]string{
+		"A":                                     "line 1: A line must have a name",
+		"\n\nMX foo.bar.ts.net. mail":           "line 3: unknown keyword",
+		"ndots two":                             "line 1: invalid ndots",
+		"healthCheckPort foo.bar.ts.net. 1e6":   "line 1: invalid health check port",
+		"  A foo.bar.ts.net. 10.20.30.40":       "line 1: indented A line outside of a view",
+		"external MX foo.bar.ts.net. mail":      "line 1: unknown record type",
+		"rpz foo.bar.ts.net.":                   "line 1: rpz line must have a name and an action",
+		"rewrite 10.1.0.0/16 10.20.30.40":       "line 1: rewrite line must have 3 or 4 values",
+		"view 10.3.0.0/16\nrewrite 10.1.0.0/16": "line 2: rewrite line",
+	} {
+		_, err := ParseTSHosts([]byte(text))
+		if assert.NotNil(t, err, text) {
+			assert.True(t, strings.HasPrefix(err.Error(), wantErr), "got error %q, want %q", err, wantErr)
+		}
+	}
+}
+
+func TestTSHostsJSON(t *testing.T) {
+	// TSHosts is a wire type, so it must be encoded as an object by every
+	// encoder, rather than as text.
+	var v any = TSHosts{}
+	if _, ok := v.(encoding.TextMarshaler); ok {
+		t.Error("TSHosts implements encoding.TextMarshaler")
+	}
+	if _, ok := any(&TSHosts{}).(encoding.TextUnmarshaler); ok {
+		t.Error("*TSHosts implements encoding.TextUnmarshaler")
+	}
+	h := testTSHosts()
+	b, err := json.Marshal(h)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(b), `{"schemaVersion":1,"hosts":{`), string(b))
+	var got TSHosts
+	assert.Nil(t, json.Unmarshal(b, &got))
+	assert.Equal(t, *h, got)
+
+	// Including as a map value.
+	b, err = json.Marshal(map[string]TSHosts{"a": *h})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(b), `{"a":{"schemaVersion":1,`), string(b))
+}
+
+func TestTSHostsTextExpiresAt(t *testing.T) {
+	h := TSHosts{
+		Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}},
+		ExpiresAt: map[string]time.Time{
+			"foo.bar.ts.net.": time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			"db.internal.":    time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC),
+		},
+	}
+	text, err := FormatTSHosts(&h)
+	assert.Nil(t, err)
+	assert.Equal(t, `A foo.bar.ts.net. 10.20.30.40
+expiresAt db.internal. 2024-05-01T12:00:00.0000005Z
+expiresAt foo.bar.ts.net. 2024-05-01T12:00:00Z
+`, string(text))
+	got, err := ParseTSHosts(text)
+	assert.Nil(t, err)
+	assert.Equal(t, &h, got)
+
+	_, err = ParseTSHosts([]byte("expiresAt foo.bar.ts.net. tomorrow\n"))
+	assert.NotNil(t, err)
+}
+
+func TestDiffTSHosts(t *testing.T) {
+	a := testTSHosts()
+	assert.Equal(t, "", DiffTSHosts(a, testTSHosts()))
+
+	b := testTSHosts()
+	b.Hosts["qux.bar.ts.net."] = []string{"10.20.30.45"}
+	delete(b.Hosts, "empty.bar.ts.net.")
+	b.Views = b.Views[:1]
+	assert.Equal(t, `--- a
++++ b
+@@ -5,8 +5,8 @@
+ clusterDomain k8s.local.
+ A baz.bar.ts.net. 10.20.30.41
+ AAAA baz.bar.ts.net. fd7a:115c:a1e0::1
+-A empty.bar.ts.net.
+ A foo.bar.ts.net. 10.20.30.40
++A qux.bar.ts.net. 10.20.30.45
+ healthCheckPort foo.bar.ts.net. 8080
+ external A db.internal. 10.20.30.50
+ sourcePriority foo.bar.ts.net. 1
+@@ -16,4 +16,3 @@
+ rewrite 10.2.0.0/16 10.20.30.41 10.20.30.43 baz.bar.ts.net.
+ view 10.3.0.0/16
+   A foo.bar.ts.net. 10.20.30.44
+-view 10.4.0.0/16
+`, DiffTSHosts(a, b))
+
+	// All records are added to an empty config.
+	assert.Equal(t, `--- a
++++ b
+@@ -0,0 +1 @@
++A foo.bar.ts.net. 10.20.30.40
+`, DiffTSHosts(nil, &TSHosts{Hosts: map[string][]string{"foo.bar.ts.net.": {"10.20.30.40"}}}))
+	assert.Equal(t, `--- a
++++ b
+@@ -1,2 +1 @@
+ A baz.bar.ts.net. 10.20.30.41
+-AAAA baz.bar.ts.net. fd7a:115c:a1e0::1
+`, DiffTSHosts(&TSHosts{Hosts: map[string][]string{"baz.bar.ts.net.": {"10.20.30.41", "fd7a:115c:a1e0::1"}}}, &TSHosts{Hosts: map[string][]string{"baz.bar.ts.net.": {"10.20.30.41"}}}))
+}
+
+func TestDiffLines(t *testing.T) {
+	// lcs returns the length of the longest common subsequence of x and y,
+	// which a shortest edit script keeps.
+	lcs := func(x, y []string) int {
+		prev, cur := make([]int, len(y)+1), make([]int, len(y)+1)
+		for i := range x {
+			for j := range y {
+				if x[i] == y[j] {
+					cur[j+1] = prev[j] + 1
+				} else {
+					cur[j+1] = max(prev[j+1], cur[j])
+				}
+			}
+			prev, cur = cur, prev
+		}
+		return prev[len(y)]
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	lines := func(n, alphabet int) []string {
+		l := make([]string, n)
+		for i := range l {
+			l[i] = fmt.Sprintf("%d\n", rng.IntN(alphabet))
+		}
+		return l
+	}
+	for i := range 500 {
+		x, y := lines(rng.IntN(30), 1+rng.IntN(6)), lines(rng.IntN(30), 1+rng.IntN(6))
+		var gotX, gotY []string
+		kept := 0
+		for _, op := range diffLines(x, y) {
+			switch op.kind {
+			case ' ':
+				gotX, gotY = append(gotX, op.line), append(gotY, op.line)
+				kept++
+			case '-':
+				gotX = append(gotX, op.line)
+			case '+':
+				gotY = append(gotY, op.line)
+			}
+		}
+		if strings.Join(gotX, "") != strings.Join(x, "") || strings.Join(gotY, "") != strings.Join(y, "") {
+			t.Fatalf("%d: diff of %q and %q is not an edit script between them", i, x, y)
+		}
+		if want := lcs(x, y); kept != want {
+			t.Fatalf("%d: diff of %q and %q keeps %d lines, want %d", i, x, y, kept, want)
+		}
+	}
+
+	// Large configs that have nothing in common are diffed in memory
+	// proportional to their size.
+	x, y := make([]string, 2000), make([]string, 2000)
+	for i := range x {
+		x[i], y[i] = fmt.Sprintf("x%d\n", i), fmt.Sprintf("y%d\n", i)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	diffLines(x, y)
+	runtime.ReadMemStats(&after)
+	if got := after.TotalAlloc - before.TotalAlloc; got > 1<<20 {
+		t.Errorf("diffing %d lines allocated %d bytes, want at most 1MiB", len(x)+len(y), got)
+	}
+}
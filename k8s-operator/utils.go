@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package kube
+
+import "time"
+
+// TSHosts is the configuration for the k8s-nameserver. The operator writes it
+// as JSON to a ConfigMap that gets mounted to the nameserver Pod.
+type TSHosts struct {
+	// SchemaVersion is the version of the config schema that this config
+	// was written for. Nameservers that support an older schema version
+	// ignore any fields that they don't know about. Zero means version 1.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+	// Hosts is a map of DNS names to the IP addresses that they should
+	// resolve to. DNS names are expected to be fully qualified and within
+	// the ts.net domain, i.e "foo.tailnetxyz.ts.net.".
+	Hosts map[string][]string `json:"hosts"`
+	// HealthCheckPorts optionally maps DNS names in Hosts to a TCP port
+	// that the nameserver can connect to in order to check whether the
+	// name's IP addresses are healthy. IP addresses that fail the check
+	// are not served until they recover. Names without a port are never
+	// health checked.
+	HealthCheckPorts map[string]uint16 `json:"healthCheckPorts,omitempty"`
+	// RPZ are response policy rules that override the nameserver's
+	// responses for matching DNS names, for example to block them.
+	RPZ []RPZRule `json:"rpz,omitempty"`
+	// RewriteRules replace IP addresses in the nameserver's responses
+	// depending on the source address of the query, for example to serve
+	// a different IP address to clients in another cluster.
+	RewriteRules []RewriteRule `json:"rewriteRules,omitempty"`
+	// ExternalRecords is a map of DNS names outside of the ts.net domain,
+	// i.e "db.internal.", to the IP addresses that they should resolve to.
+	// Queries for other names outside of ts.net are still forwarded. The
+	// nameserver only serves these if it was started with
+	// --allow-external-records.
+	ExternalRecords map[string][]string `json:"externalRecords,omitempty"`
+	// SourcePriority is set in configs that the nameserver merged from
+	// multiple sources. It maps DNS names in Hosts and ExternalRecords to
+	// the priority of the source that their IP addresses were taken from.
+	// Besides telling the nameserver which records were federated from
+	// peer nameservers, it is informational only.
+	SourcePriority map[string]int `json:"sourcePriority,omitempty"`
+	// Views optionally serve different IP addresses for names in Hosts to
+	// queries from different source addresses, for example to pods in
+	// different namespaces. A query is answered from the first view whose
+	// SourceCIDR contains its source address; names that the view has no
+	// records for are answered from Hosts.
+	Views []View `json:"views,omitempty"`
+	// SearchDomains are the domains, i.e "svc.bar.ts.net.", to look up
+	// names with fewer than NDots dots in before the name itself, the way
+	// that resolv.conf search domains are, for clients that query
+	// unqualified names such as "db". Names found in a search domain are
+	// answered under the queried name.
+	SearchDomains []string `json:"searchDomains,omitempty"`
+	// NDots is the number of dots that a name must have to be looked up
+	// as is first, before SearchDomains. Zero means 1, as in
+	// resolv.conf.
+	NDots int `json:"ndots,omitempty"`
+	// ClusterDomain is the domain of the Kubernetes cluster, i.e.
+	// "cluster.local.", that autodiscovered Pods with a single label DNS
+	// name are served in. If empty, the nameserver's --cluster-domain is
+	// used.
+	ClusterDomain string `json:"clusterDomain,omitempty"`
+	// ExpiresAt optionally maps DNS names in Hosts and ExternalRecords to
+	// the time at which their records stop being served, for records of
+	// dynamic sources that may not be removed when their workload goes
+	// away.
+	ExpiresAt map[string]time.Time `json:"expiresAt,omitempty"`
+}
+
+// View is a set of host records for the k8s-nameserver that is only served
+// to queries from some source addresses.
+type View struct {
+	// SourceCIDR is the prefix that the source address of a query must be
+	// in for the view to apply, i.e "10.1.0.0/16".
+	SourceCIDR string `json:"sourceCIDR"`
+	// Hosts is a map of DNS names to the IP addresses that they resolve
+	// to for queries from SourceCIDR, in the same format as
+	// TSHosts.Hosts.
+	Hosts map[string][]string `json:"hosts"`
+}
+
+// RPZRule is a response policy zone rule for the k8s-nameserver.
+type RPZRule struct {
+	// Name is the DNS name that the rule applies to. A name starting
+	// with "*." applies to all subdomains of the rest of the name, but
+	// not to the name itself.
+	Name string `json:"name"`
+	// Action is what the nameserver responds with to queries for Name.
+	// One of "NXDOMAIN", "NODATA", "DROP" (do not respond at all) or
+	// "REDIRECT <target>", where target is either an IP address to
+	// respond with or a DNS name whose records should be served instead.
+	Action string `json:"action"`
+}
+
+// RewriteRule is a response rewriting rule for the k8s-nameserver.
+type RewriteRule struct {
+	// SourceCIDR is the prefix that the source address of a query must be
+	// in for the rule to apply, i.e "10.1.0.0/16".
+	SourceCIDR string `json:"sourceCIDR"`
+	// MatchName optionally restricts the rule to answer records for a
+	// single DNS name. If empty, the rule applies to all names.
+	MatchName string `json:"matchName,omitempty"`
+	// OriginalIP is the IP address in answer records to replace.
+	OriginalIP string `json:"originalIP"`
+	// ReplacementIP is the IP address to replace OriginalIP with. It must
+	// be of the same address family as OriginalIP.
+	ReplacementIP string `json:"replacementIP"`
+}
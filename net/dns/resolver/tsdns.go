@@ -229,7 +229,11 @@ func (r *Resolver) SetConfig(cfg Config) error {
 		r.saveConfigForTests(cfg)
 	}
 
-	reverse := make(map[netip.Addr]dnsname.FQDN, len(cfg.Hosts))
+	var numIPs int
+	for _, ips := range cfg.Hosts {
+		numIPs += len(ips)
+	}
+	reverse := make(map[netip.Addr]dnsname.FQDN, numIPs)
 
 	for host, ips := range cfg.Hosts {
 		for _, ip := range ips {